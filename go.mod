@@ -14,3 +14,7 @@ require (
 )
 
 go 1.13
+
+// The server carries our JetStream changes, see third_party/nats-server.
+// Vendoring picks them up from there, do not edit vendor/ directly.
+replace github.com/nats-io/nats-server/v2 => ./third_party/nats-server
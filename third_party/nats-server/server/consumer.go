@@ -0,0 +1,3375 @@
+// Copyright 2019-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"golang.org/x/time/rate"
+)
+
+type ConsumerInfo struct {
+	Stream         string         `json:"stream_name"`
+	Name           string         `json:"name"`
+	Created        time.Time      `json:"created"`
+	Config         ConsumerConfig `json:"config"`
+	Delivered      SequencePair   `json:"delivered"`
+	AckFloor       SequencePair   `json:"ack_floor"`
+	NumAckPending  int            `json:"num_ack_pending"`
+	NumRedelivered int            `json:"num_redelivered"`
+	NumWaiting     int            `json:"num_waiting"`
+	NumPending     uint64         `json:"num_pending"`
+	Cluster        *ClusterInfo   `json:"cluster,omitempty"`
+}
+
+type ConsumerConfig struct {
+	Durable               string          `json:"durable_name,omitempty"`
+	DeliverSubject        string          `json:"deliver_subject,omitempty"`
+	DeliverPolicy         DeliverPolicy   `json:"deliver_policy"`
+	OptStartSeq           uint64          `json:"opt_start_seq,omitempty"`
+	OptStartTime          *time.Time      `json:"opt_start_time,omitempty"`
+	AckPolicy             AckPolicy       `json:"ack_policy"`
+	AckWait               time.Duration   `json:"ack_wait,omitempty"`
+	MaxDeliver            int             `json:"max_deliver,omitempty"`
+	FilterSubject         string          `json:"filter_subject,omitempty"`
+	ReplayPolicy          ReplayPolicy    `json:"replay_policy"`
+	RateLimit             uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
+	SampleFrequency       string          `json:"sample_freq,omitempty"`
+	MaxWaiting            int             `json:"max_waiting,omitempty"`
+	MaxAckPending         int             `json:"max_ack_pending,omitempty"`
+	Paused                bool            `json:"paused,omitempty"`
+	BackOff               []time.Duration `json:"backoff,omitempty"`
+	MaxDeliverConcurrency int             `json:"max_deliver_concurrency,omitempty"`
+	PoisonThreshold       int             `json:"poison_threshold,omitempty"`
+	DeadLetterSubject     string          `json:"dead_letter_subject,omitempty"`
+	NoRedelivery          bool            `json:"no_redelivery,omitempty"`
+	PriorityHeader        string          `json:"priority_header,omitempty"`
+	PriorityWindow        int             `json:"priority_window,omitempty"`
+	PriorityMaxSkip       int             `json:"priority_max_skip,omitempty"`
+	FilterHeader          *HeaderFilter   `json:"filter_header,omitempty"`
+
+	// These are non public configuration options.
+	// If you add new options, check fileConsumerInfoJSON in order for them to
+	// be properly persisted/recovered, if needed.
+	allowNoInterest bool
+}
+
+// HeaderFilter will only deliver messages where the named header has the given value.
+type HeaderFilter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type CreateConsumerRequest struct {
+	Stream string         `json:"stream_name"`
+	Config ConsumerConfig `json:"config"`
+}
+
+// DeliverPolicy determines how the consumer should select the first message to deliver.
+type DeliverPolicy int
+
+const (
+	// DeliverAll will be the default so can be omitted from the request.
+	DeliverAll DeliverPolicy = iota
+	// DeliverLast will start the consumer with the last sequence received.
+	DeliverLast
+	// DeliverNew will only deliver new messages that are sent after the consumer is created.
+	DeliverNew
+	// DeliverByStartSequence will look for a defined starting sequence to start.
+	DeliverByStartSequence
+	// DeliverByStartTime will select the first messsage with a timestamp >= to StartTime
+	DeliverByStartTime
+)
+
+func (dp DeliverPolicy) String() string {
+	switch dp {
+	case DeliverAll:
+		return "all"
+	case DeliverLast:
+		return "last"
+	case DeliverNew:
+		return "new"
+	case DeliverByStartSequence:
+		return "by_start_sequence"
+	case DeliverByStartTime:
+		return "by_start_time"
+	default:
+		return "undefined"
+	}
+}
+
+// AckPolicy determines how the consumer should acknowledge delivered messages.
+type AckPolicy int
+
+const (
+	// AckNone requires no acks for delivered messages.
+	AckNone AckPolicy = iota
+	// AckAll when acking a sequence number, this implicitly acks all sequences below this one as well.
+	AckAll
+	// AckExplicit requires ack or nack for all messages.
+	AckExplicit
+)
+
+func (a AckPolicy) String() string {
+	switch a {
+	case AckNone:
+		return "none"
+	case AckAll:
+		return "all"
+	default:
+		return "explicit"
+	}
+}
+
+// ReplayPolicy determines how the consumer should replay messages it already has queued in the stream.
+type ReplayPolicy int
+
+const (
+	// ReplayInstant will replay messages as fast as possible.
+	ReplayInstant ReplayPolicy = iota
+	// ReplayOriginal will maintain the same timing as the messages were received.
+	ReplayOriginal
+)
+
+func (r ReplayPolicy) String() string {
+	switch r {
+	case ReplayInstant:
+		return "instant"
+	default:
+		return "original"
+	}
+}
+
+// OK
+const OK = "+OK"
+
+// Ack responses. Note that a nil or no payload is same as AckAck
+var (
+	// Ack
+	AckAck = []byte("+ACK") // nil or no payload to ack subject also means ACK
+	AckOK  = []byte(OK)     // deprecated but +OK meant ack as well.
+
+	// Nack
+	AckNak = []byte("-NAK")
+	// Progress indicator
+	AckProgress = []byte("+WPI")
+	// Ack + Deliver the next message(s).
+	AckNext = []byte("+NXT")
+	// Terminate delivery of the message.
+	AckTerm = []byte("+TERM")
+)
+
+// Consumer is a jetstream consumer.
+type Consumer struct {
+	mu                sync.RWMutex
+	mset              *Stream
+	acc               *Account
+	srv               *Server
+	client            *client
+	sysc              *client
+	sid               int
+	name              string
+	stream            string
+	sseq              uint64
+	dseq              uint64
+	adflr             uint64
+	asflr             uint64
+	sgap              uint64
+	sskip             uint64
+	dsubj             string
+	rlimit            *rate.Limiter
+	reqSub            *subscription
+	ackSub            *subscription
+	dlqSub            *subscription
+	dlqReply          string
+	ackReplyT         string
+	ackSubj           string
+	nextMsgSubj       string
+	maxp              int
+	sendq             chan *jsPubMsg
+	pending           map[uint64]*Pending
+	ptmr              *time.Timer
+	rdq               []uint64
+	pq                []*jsPubMsg
+	rdc               map[uint64]uint64
+	maxdc             uint64
+	waiting           *waitQueue
+	config            ConsumerConfig
+	store             ConsumerStore
+	active            bool
+	replay            bool
+	filterWC          bool
+	dtmr              *time.Timer
+	dthresh           time.Duration
+	mch               chan struct{}
+	qch               chan struct{}
+	inch              chan bool
+	sfreq             int32
+	ackEventT         string
+	deliveryExcEventT string
+	poisonEventT      string
+	lpoison           time.Time
+	created           time.Time
+	closed            bool
+	startResolved     bool
+	startSeq          uint64
+
+	// Clustered.
+	ca      *consumerAssignment
+	node    RaftNode
+	infoSub *subscription
+	lqsent  time.Time
+}
+
+const (
+	// JsAckWaitDefault is the default AckWait, only applicable on explicit ack policy observables.
+	JsAckWaitDefault = 30 * time.Second
+	// JsDeleteWaitTimeDefault is the default amount of time we will wait for non-durable
+	// observables to be in an inactive state before deleting them.
+	JsDeleteWaitTimeDefault = 5 * time.Second
+)
+
+func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
+	return mset.addConsumer(config, _EMPTY_, nil)
+}
+
+// checkConsumerCfg will check the parts of a consumer config that do not depend on the stream.
+// This allows the clustered meta leader to reject bad configs before proposing them.
+func checkConsumerCfg(config *ConsumerConfig) error {
+	if config == nil {
+		return fmt.Errorf("consumer config required")
+	}
+
+	// For now expect a literal subject if its not empty. Empty means work queue mode (pull mode).
+	if config.DeliverSubject != _EMPTY_ {
+		if !subjectIsLiteral(config.DeliverSubject) {
+			return fmt.Errorf("consumer deliver subject has wildcards")
+		}
+		if config.MaxWaiting != 0 {
+			return fmt.Errorf("consumer in push mode can not set max waiting")
+		}
+		if config.MaxAckPending > 0 && config.AckPolicy == AckNone {
+			return fmt.Errorf("consumer requires ack policy for max ack pending")
+		}
+		if config.MaxDeliverConcurrency > 0 && config.AckPolicy == AckNone {
+			return fmt.Errorf("consumer requires ack policy for max deliver concurrency")
+		}
+	} else {
+		// Pull mode / work queue mode require explicit ack.
+		if config.AckPolicy != AckExplicit {
+			return fmt.Errorf("consumer in pull mode requires explicit ack policy")
+		}
+		// They are also required to be durable since otherwise we will not know when to
+		// clean them up.
+		if config.Durable == _EMPTY_ {
+			return fmt.Errorf("consumer in pull mode requires a durable name")
+		}
+		if config.RateLimit > 0 {
+			return fmt.Errorf("consumer in pull mode can not have rate limit set")
+		}
+		if config.MaxWaiting < 0 {
+			return fmt.Errorf("consumer max waiting needs to be positive")
+		}
+	}
+
+	if config.MaxDeliverConcurrency < 0 {
+		return fmt.Errorf("consumer max deliver concurrency needs to be positive")
+	}
+
+	if config.PoisonThreshold < 0 {
+		return fmt.Errorf("consumer poison threshold needs to be positive")
+	}
+	if config.PoisonThreshold > 0 && config.MaxDeliver > 0 && config.PoisonThreshold >= config.MaxDeliver {
+		return fmt.Errorf("consumer poison threshold needs to be less than max deliver")
+	}
+
+	if config.DeadLetterSubject != _EMPTY_ {
+		if config.AckPolicy == AckNone || config.MaxDeliver <= 0 {
+			return fmt.Errorf("consumer dead letter subject requires an ack policy and max deliver")
+		}
+		if !subjectIsLiteral(config.DeadLetterSubject) {
+			return fmt.Errorf("consumer dead letter subject has wildcards")
+		}
+	}
+
+	if config.NoRedelivery {
+		if config.AckPolicy == AckNone {
+			return fmt.Errorf("consumer requires ack policy for no redelivery")
+		}
+		if len(config.BackOff) > 0 || config.DeadLetterSubject != _EMPTY_ {
+			return fmt.Errorf("consumer with no redelivery can not have backoff or a dead letter subject")
+		}
+	}
+
+	if config.FilterHeader != nil && !validHeaderFilter(config.FilterHeader) {
+		return fmt.Errorf("consumer filter header name is not valid")
+	}
+
+	if config.PriorityHeader != _EMPTY_ {
+		if config.AckPolicy != AckExplicit {
+			return fmt.Errorf("consumer priority delivery requires explicit ack policy")
+		}
+		if config.DeliverSubject == _EMPTY_ {
+			return fmt.Errorf("consumer priority delivery requires push mode")
+		}
+		if config.ReplayPolicy != ReplayInstant || config.RateLimit > 0 {
+			return fmt.Errorf("consumer priority delivery can not have original replay or a rate limit")
+		}
+		if config.PriorityWindow < 0 || config.PriorityWindow > maxPriorityWindow {
+			return fmt.Errorf("consumer priority window needs to be between 0 and %d", maxPriorityWindow)
+		}
+		if config.PriorityMaxSkip < 0 {
+			return fmt.Errorf("consumer priority max skip can not be negative")
+		}
+	} else if config.PriorityWindow != 0 || config.PriorityMaxSkip != 0 {
+		return fmt.Errorf("consumer priority window and max skip require a priority header")
+	}
+
+	if len(config.BackOff) > 0 {
+		if config.AckPolicy == AckNone {
+			return fmt.Errorf("consumer requires ack policy for backoff")
+		}
+		for _, bo := range config.BackOff {
+			if bo <= 0 {
+				return fmt.Errorf("consumer backoff values need to be positive")
+			}
+		}
+	}
+
+	// Check on start position conflicts.
+	switch config.DeliverPolicy {
+	case DeliverAll:
+		if config.OptStartSeq > 0 {
+			return fmt.Errorf("consumer delivery policy is deliver all, but optional start sequence is also set")
+		}
+		if config.OptStartTime != nil {
+			return fmt.Errorf("consumer delivery policy is deliver all, but optional start time is also set")
+		}
+	case DeliverLast:
+		if config.OptStartSeq > 0 {
+			return fmt.Errorf("consumer delivery policy is deliver last, but optional start sequence is also set")
+		}
+		if config.OptStartTime != nil {
+			return fmt.Errorf("consumer delivery policy is deliver last, but optional start time is also set")
+		}
+	case DeliverNew:
+		if config.OptStartSeq > 0 {
+			return fmt.Errorf("consumer delivery policy is deliver new, but optional start sequence is also set")
+		}
+		if config.OptStartTime != nil {
+			return fmt.Errorf("consumer delivery policy is deliver new, but optional start time is also set")
+		}
+	case DeliverByStartSequence:
+		if config.OptStartSeq == 0 {
+			return fmt.Errorf("consumer delivery policy is deliver by start sequence, but optional start sequence is not set")
+		}
+		if config.OptStartTime != nil {
+			return fmt.Errorf("consumer delivery policy is deliver by start sequence, but optional start time is also set")
+		}
+	case DeliverByStartTime:
+		if config.OptStartTime == nil {
+			return fmt.Errorf("consumer delivery policy is deliver by start time, but optional start time is not set")
+		}
+		if config.OptStartSeq != 0 {
+			return fmt.Errorf("consumer delivery policy is deliver by start time, but optional start sequence is also set")
+		}
+	}
+
+	if config.SampleFrequency != "" {
+		s := strings.TrimSuffix(config.SampleFrequency, "%")
+		if _, err := strconv.Atoi(s); err != nil {
+			return fmt.Errorf("failed to parse consumer sampling configuration: %v", err)
+		}
+	}
+	return nil
+}
+
+func (mset *Stream) addConsumer(config *ConsumerConfig, oname string, ca *consumerAssignment) (*Consumer, error) {
+	mset.mu.RLock()
+	s, jsa := mset.srv, mset.jsa
+	mset.mu.RUnlock()
+
+	// If we do not have the consumer currently assigned to us in cluster mode we will proceed but warn.
+	// This can happen on startup with restored state where on meta replay we still do not have
+	// the assignment. Running in single server mode this always returns true.
+	if oname != _EMPTY_ && !jsa.consumerAssigned(mset.Name(), oname) {
+		s.Debugf("Consumer %q > %q does not seem to be assigned to this server", mset.Name(), oname)
+	}
+
+	if err := checkConsumerCfg(config); err != nil {
+		return nil, err
+	}
+
+	var err error
+	// Push mode can not deliver back into this stream.
+	if config.DeliverSubject != _EMPTY_ {
+		if mset.deliveryFormsCycle(config.DeliverSubject) {
+			return nil, fmt.Errorf("consumer deliver subject forms a cycle")
+		}
+	} else if config.MaxWaiting == 0 {
+		// Set to default if not specified.
+		config.MaxWaiting = JSWaitQueueDefaultMax
+	}
+	// Dead lettered messages can not land back in this stream.
+	if config.DeadLetterSubject != _EMPTY_ && mset.deliveryFormsCycle(config.DeadLetterSubject) {
+		return nil, fmt.Errorf("consumer dead letter subject forms a cycle")
+	}
+
+	// Setup proper default for ack wait if we are in explicit ack mode.
+	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
+		config.AckWait = JsAckWaitDefault
+	}
+	// Setup default of -1, meaning no limit for MaxDeliver.
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = -1
+	}
+
+	// Make sure any partition subject is also a literal.
+	if config.FilterSubject != "" {
+		var checkSubject bool
+
+		mset.mu.RLock()
+		// If the stream was created with no subject, then skip the checks
+		if !mset.config.allowNoSubject {
+			// If this is a direct match for the streams only subject clear the filter.
+			if len(mset.config.Subjects) == 1 && mset.config.Subjects[0] == config.FilterSubject {
+				config.FilterSubject = _EMPTY_
+			} else {
+				checkSubject = true
+			}
+		}
+		mset.mu.RUnlock()
+
+		// Make sure this is a valid partition of the interest subjects.
+		if checkSubject && !mset.validSubject(config.FilterSubject) {
+			return nil, fmt.Errorf("consumer filter subject is not a valid subset of the interest subjects")
+		}
+	}
+
+	sampleFreq := 0
+	if config.SampleFrequency != "" {
+		sampleFreq, _ = strconv.Atoi(strings.TrimSuffix(config.SampleFrequency, "%"))
+	}
+
+	// Grab the client, account and server reference.
+	c := mset.client
+	if c == nil {
+		return nil, fmt.Errorf("stream not valid")
+	}
+	c.mu.Lock()
+	s, a := c.srv, c.acc
+	c.mu.Unlock()
+
+	// Hold mset lock here.
+	mset.mu.Lock()
+
+	// If this one is durable and already exists, we let that be ok as long as the configs match.
+	if isDurableConsumer(config) {
+		if eo, ok := mset.consumers[config.Durable]; ok {
+			mset.mu.Unlock()
+			ocfg := eo.Config()
+			if reflect.DeepEqual(&ocfg, config) {
+				return eo, nil
+			} else {
+				// If we are a push mode and not active and the only difference
+				// is deliver subject then update and return.
+				if configsEqualSansDelivery(ocfg, *config) && (config.allowNoInterest || eo.hasNoLocalInterest()) {
+					eo.updateDeliverSubject(config.DeliverSubject)
+					return eo, nil
+				} else {
+					return nil, fmt.Errorf("consumer already exists")
+				}
+			}
+		}
+	}
+
+	// Check for any limits, if the config for the consumer sets a limit we check against that
+	// but if not we use the value from account limits, if account limits is more restrictive
+	// than stream config we prefer the account limits to handle cases where account limits are
+	// updated during the lifecycle of the stream
+	maxc := mset.config.MaxConsumers
+	if mset.config.MaxConsumers <= 0 || mset.jsa.limits.MaxConsumers < mset.config.MaxConsumers {
+		maxc = mset.jsa.limits.MaxConsumers
+	}
+
+	if maxc > 0 && len(mset.consumers) >= maxc {
+		mset.mu.Unlock()
+		return nil, ErrJetStreamMaximumConsumers
+	}
+
+	// Check on stream type conflicts.
+	switch mset.config.Retention {
+	case WorkQueuePolicy:
+		// Force explicit acks here.
+		if config.AckPolicy != AckExplicit {
+			mset.mu.Unlock()
+			return nil, fmt.Errorf("workqueue stream requires explicit ack")
+		}
+
+		if len(mset.consumers) > 0 {
+			if config.FilterSubject == _EMPTY_ {
+				mset.mu.Unlock()
+				return nil, fmt.Errorf("multiple non-filtered observables not allowed on workqueue stream")
+			} else if !mset.partitionUnique(config.FilterSubject) {
+				// We have a partition but it is not unique amongst the others.
+				mset.mu.Unlock()
+				return nil, fmt.Errorf("filtered consumer not unique on workqueue stream")
+			}
+		}
+		if config.DeliverPolicy != DeliverAll {
+			mset.mu.Unlock()
+			return nil, fmt.Errorf("consumer must be deliver all on workqueue stream")
+		}
+		// Skipped messages would never be consumed.
+		if config.FilterHeader != nil {
+			mset.mu.Unlock()
+			return nil, fmt.Errorf("consumer filter header not allowed on workqueue stream")
+		}
+	}
+
+	// Set name, which will be durable name if set, otherwise we create one at random.
+	o := &Consumer{
+		mset:    mset,
+		acc:     a,
+		srv:     s,
+		client:  s.createInternalJetStreamClient(),
+		sysc:    s.createInternalJetStreamClient(),
+		config:  *config,
+		dsubj:   config.DeliverSubject,
+		active:  true,
+		qch:     make(chan struct{}),
+		mch:     make(chan struct{}, 1),
+		sfreq:   int32(sampleFreq),
+		maxdc:   uint64(config.MaxDeliver),
+		maxp:    maxPending(config),
+		created: time.Now().UTC(),
+	}
+
+	// Bind internal client to the user account.
+	o.client.registerWithAccount(a)
+	// Bind to the system account.
+	o.sysc.registerWithAccount(s.SystemAccount())
+
+	if isDurableConsumer(config) {
+		if len(config.Durable) > JSMaxNameLen {
+			mset.mu.Unlock()
+			return nil, fmt.Errorf("consumer name is too long, maximum allowed is %d", JSMaxNameLen)
+		}
+		o.name = config.Durable
+		if o.isPullMode() {
+			o.waiting = newWaitQueue(config.MaxWaiting)
+		}
+	} else if oname != _EMPTY_ {
+		o.name = oname
+	} else {
+		for {
+			o.name = createConsumerName()
+			if _, ok := mset.consumers[o.name]; !ok {
+				break
+			}
+		}
+	}
+
+	// Check if we have a rate limit set.
+	if config.RateLimit != 0 {
+		// TODO(dlc) - Make sane values or error if not sane?
+		// We are configured in bits per sec so adjust to bytes.
+		rl := rate.Limit(config.RateLimit / 8)
+		// Burst should be set to maximum msg size for this account, etc.
+		var burst int
+		if mset.config.MaxMsgSize > 0 {
+			burst = int(mset.config.MaxMsgSize)
+		} else if mset.jsa.account.limits.mpay > 0 {
+			burst = int(mset.jsa.account.limits.mpay)
+		} else {
+			s := mset.jsa.account.srv
+			burst = int(s.getOpts().MaxPayload)
+		}
+		o.rlimit = rate.NewLimiter(rl, burst)
+	}
+
+	// Check if we have  filtered subject that is a wildcard.
+	if config.FilterSubject != _EMPTY_ && !subjectIsLiteral(config.FilterSubject) {
+		o.filterWC = true
+	}
+
+	// already under lock, mset.Name() would deadlock
+	o.stream = mset.config.Name
+	o.ackEventT = JSMetricConsumerAckPre + "." + o.stream + "." + o.name
+	o.deliveryExcEventT = JSAdvisoryConsumerMaxDeliveryExceedPre + "." + o.stream + "." + o.name
+	o.poisonEventT = JSAdvisoryConsumerPoisonMessagePre + "." + o.stream + "." + o.name
+
+	store, err := mset.store.ConsumerStore(o.name, config)
+	if err != nil {
+		mset.mu.Unlock()
+		o.deleteWithoutAdvisory()
+		return nil, fmt.Errorf("error creating store for observable: %v", err)
+	}
+	o.store = store
+
+	if !isValidName(o.name) {
+		mset.mu.Unlock()
+		o.deleteWithoutAdvisory()
+		return nil, fmt.Errorf("durable name can not contain '.', '*', '>'")
+	}
+
+	// Select starting sequence number
+	o.selectStartingSeqNo()
+
+	// Now register with mset and create the ack subscription.
+	// Check if we already have this one registered.
+	if eo, ok := mset.consumers[o.name]; ok {
+		mset.mu.Unlock()
+		if !o.isDurable() || !o.isPushMode() {
+			o.name = _EMPTY_ // Prevent removal since same name.
+			o.deleteWithoutAdvisory()
+			return nil, fmt.Errorf("consumer already exists")
+		}
+		// If we are here we have already registered this durable. If it is still active that is an error.
+		if eo.Active() {
+			o.name = _EMPTY_ // Prevent removal since same name.
+			o.deleteWithoutAdvisory()
+			return nil, fmt.Errorf("consumer already exists and is still active")
+		}
+		// Since we are here this means we have a potentially new durable so we should update here.
+		// Check that configs are the same.
+		if !configsEqualSansDelivery(o.config, eo.config) {
+			o.name = _EMPTY_ // Prevent removal since same name.
+			o.deleteWithoutAdvisory()
+			return nil, fmt.Errorf("consumer replacement durable config not the same")
+		}
+		// Once we are here we have a replacement push-based durable.
+		eo.updateDeliverSubject(o.config.DeliverSubject)
+		return eo, nil
+	}
+
+	// Set up the ack subscription for this observable. Will use wildcard for all acks.
+	// We will remember the template to generate replies with sequence numbers and use
+	// that to scanf them back in.
+	mn := mset.config.Name
+	pre := fmt.Sprintf(jsAckT, mn, o.name)
+	o.ackReplyT = fmt.Sprintf("%s.%%d.%%d.%%d.%%d.%%d", pre)
+	o.ackSubj = fmt.Sprintf("%s.*.*.*.*.*", pre)
+
+	if o.isPullMode() {
+		o.nextMsgSubj = fmt.Sprintf(JSApiRequestNextT, mn, o.name)
+	} else {
+		o.dthresh = JsDeleteWaitTimeDefault
+		if !o.isDurable() {
+			// Check if we are not durable that the delivery subject has interest.
+			// Check in place here for interest. Will setup properly in setLeader.
+			r := o.acc.sl.Match(o.config.DeliverSubject)
+			if !o.hasDeliveryInterest(len(r.psubs)+len(r.qsubs) > 0) {
+				mset.mu.Unlock()
+				o.deleteWithoutAdvisory()
+				return nil, fmt.Errorf("consumer requires interest for delivery subject when ephemeral")
+			}
+		}
+	}
+
+	// Set our ca.
+	if ca != nil {
+		o.setConsumerAssignment(ca)
+	}
+
+	mset.setConsumer(o)
+	mset.mu.Unlock()
+
+	if !s.JetStreamIsClustered() && s.standAloneMode() {
+		o.setLeader(true)
+	}
+
+	// This is always true in single server mode.
+	if o.isLeader() {
+		// Send advisory.
+		var suppress bool
+		if !s.standAloneMode() && ca == nil {
+			suppress = true
+		} else if ca != nil {
+			suppress = ca.responded
+		}
+		if !suppress {
+			o.sendCreateAdvisory()
+		}
+	}
+
+	return o, nil
+}
+
+func (o *Consumer) setConsumerAssignment(ca *consumerAssignment) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ca = ca
+	// Set our node.
+	if ca != nil {
+		o.node = ca.Group.node
+	}
+}
+
+// Lock should be held.
+func (o *Consumer) isLeader() bool {
+	if o.node != nil {
+		return o.node.Leader()
+	}
+	return true
+}
+
+func (o *Consumer) setLeader(isLeader bool) {
+	o.mu.RLock()
+	mset := o.mset
+	isRunning := o.ackSub != nil
+	o.mu.RUnlock()
+
+	if mset == nil {
+		return
+	}
+
+	// If we are here we have a change in leader status.
+	if isLeader {
+		if isRunning {
+			return
+		}
+
+		mset.mu.RLock()
+		s, jsa, stream := mset.srv, mset.jsa, mset.config.Name
+		mset.mu.RUnlock()
+
+		o.mu.Lock()
+		// Restore our saved state. During non-leader status we just update our underlying store.
+		o.readStoredState()
+
+		// A start time can resolve differently per replica, so have everyone agree on ours.
+		if o.node != nil && o.config.OptStartTime != nil && !o.startResolved && o.dseq == 1 {
+			o.node.Propose(encodeConsumerStartSeq(o.sseq))
+		}
+
+		// Do info sub.
+		if o.infoSub == nil && jsa != nil {
+			isubj := fmt.Sprintf(clusterConsumerInfoT, jsa.acc(), stream, o.name)
+			// Note below the way we subscribe here is so that we can send requests to ourselves.
+			o.infoSub, _ = s.systemSubscribe(isubj, _EMPTY_, false, o.sysc, o.handleClusterConsumerInfoRequest)
+		}
+
+		var err error
+		if o.ackSub, err = o.subscribeInternal(o.ackSubj, o.processAck); err != nil {
+			o.mu.Unlock()
+			o.deleteWithoutAdvisory()
+			return
+		}
+		// Setup the internal sub for the pub acks of messages we move to our dead letter subject.
+		if o.config.DeadLetterSubject != _EMPTY_ {
+			o.dlqReply = fmt.Sprintf(jsDeadLetterReplyT, stream, o.name, nuid.Next())
+			if o.dlqSub, err = o.subscribeInternal(o.dlqReply+".*", o.processDeadLetterAck); err != nil {
+				o.mu.Unlock()
+				o.deleteWithoutAdvisory()
+				return
+			}
+		}
+		// Setup the internal sub for next message requests.
+		if !o.isPushMode() {
+			if o.reqSub, err = o.subscribeInternal(o.nextMsgSubj, o.processNextMsgReq); err != nil {
+				o.mu.Unlock()
+				o.deleteWithoutAdvisory()
+				return
+			}
+		}
+		// Setup initial pending.
+		o.setInitialPending()
+
+		// If push mode, register for notifications on interest.
+		if o.isPushMode() {
+			o.inch = make(chan bool, 8)
+			o.acc.sl.RegisterNotification(o.config.DeliverSubject, o.inch)
+			o.active = <-o.inch
+		}
+
+		// If we are not in ReplayInstant mode mark us as in replay state until resolved.
+		if o.config.ReplayPolicy != ReplayInstant {
+			o.replay = true
+		}
+
+		// Recreate internal sendq
+		o.sendq = make(chan *jsPubMsg, msetSendQSize)
+		// Recreate quit channel.
+		o.qch = make(chan struct{})
+		qch := o.qch
+		o.mu.Unlock()
+
+		// Now start up Go routine to deliver msgs.
+		go o.loopAndGatherMsgs(qch)
+		// Startup our deliver loop.
+		go o.loopAndDeliverMsgs(qch)
+
+	} else {
+		// Shutdown the go routines and the subscriptions.
+		if !isRunning {
+			return
+		}
+		o.mu.Lock()
+		o.unsubscribe(o.ackSub)
+		o.unsubscribe(o.reqSub)
+		o.unsubscribe(o.infoSub)
+		o.unsubscribe(o.dlqSub)
+		o.ackSub = nil
+		o.reqSub = nil
+		o.infoSub = nil
+		o.dlqSub = nil
+		o.sendq = nil
+		o.pq = nil
+		close(o.qch)
+		o.qch = nil
+		o.mu.Unlock()
+	}
+}
+
+func (o *Consumer) handleClusterConsumerInfoRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var s *Server
+	o.mu.RLock()
+	if o.client != nil {
+		s = o.client.srv
+	}
+	o.mu.RUnlock()
+	if s == nil {
+		return
+	}
+	ci := o.Info()
+	b, _ := json.Marshal(ci)
+	s.sendInternalMsgLocked(reply, _EMPTY_, nil, b)
+}
+
+// Lock should be held.
+func (o *Consumer) subscribeInternal(subject string, cb msgHandler) (*subscription, error) {
+	c := o.client
+	if c == nil {
+		return nil, fmt.Errorf("invalid consumer")
+	}
+	if !c.srv.eventsEnabled() {
+		return nil, ErrNoSysAccount
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("undefined message handler")
+	}
+
+	o.sid++
+
+	// Now create the subscription
+	return c.processSub([]byte(subject), nil, []byte(strconv.Itoa(o.sid)), cb, false)
+}
+
+// Unsubscribe from our subscription.
+// Lock should be held.
+func (o *Consumer) unsubscribe(sub *subscription) {
+	if sub == nil || o.client == nil {
+		return
+	}
+	o.client.unsubscribe(o.client.acc, sub, true, true)
+}
+
+// We need to make sure we protect access to the sendq.
+// Do all advisory sends here.
+// Lock should be held on entry but will be released.
+func (o *Consumer) sendAdvisory(subj string, msg []byte) {
+	sendq := o.sendq
+	o.mu.Unlock()
+	if sendq != nil {
+		sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, msg, nil, 0}
+	}
+	o.mu.Lock()
+}
+
+func (o *Consumer) sendDeleteAdvisoryLocked() {
+	e := JSConsumerActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Action:   DeleteEvent,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerDeletedPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
+func (o *Consumer) sendCreateAdvisory() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e := JSConsumerActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Action:   CreateEvent,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerCreatedPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
+// Created returns created time.
+func (o *Consumer) Created() time.Time {
+	o.mu.Lock()
+	created := o.created
+	o.mu.Unlock()
+	return created
+}
+
+// Internal to allow creation time to be restored.
+func (o *Consumer) setCreated(created time.Time) {
+	o.mu.Lock()
+	o.created = created
+	o.mu.Unlock()
+}
+
+// This will check for extended interest in a subject. If we have local interest we just return
+// that, but in the absence of local interest and presence of gateways or service imports we need
+// to check those as well.
+func (o *Consumer) hasDeliveryInterest(localInterest bool) bool {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil {
+		o.mu.Unlock()
+		return false
+	}
+	acc := o.acc
+	deliver := o.config.DeliverSubject
+	o.mu.Unlock()
+
+	if localInterest {
+		return true
+	}
+
+	// If we are here check gateways.
+	if acc.srv != nil && acc.srv.gateway.enabled {
+		gw := acc.srv.gateway
+		gw.RLock()
+		for _, gwc := range gw.outo {
+			psi, qr := gwc.gatewayInterest(acc.Name, deliver)
+			if psi || qr != nil {
+				gw.RUnlock()
+				return true
+			}
+		}
+		gw.RUnlock()
+	}
+	return false
+}
+
+// This processes an update to the local interest for a deliver subject.
+func (o *Consumer) updateDeliveryInterest(localInterest bool) {
+	interest := o.hasDeliveryInterest(localInterest)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	mset := o.mset
+	if mset == nil || o.isPullMode() {
+		return
+	}
+
+	if interest && !o.active {
+		o.signalNewMessages()
+	}
+	o.active = interest
+
+	// Stop and clear the delete timer always.
+	stopAndClearTimer(&o.dtmr)
+
+	// If we do not have interest anymore and we are not durable start
+	// a timer to delete us. We wait for a bit in case of server reconnect.
+	if !o.isDurable() && !interest {
+		o.dtmr = time.AfterFunc(o.dthresh, func() { o.deleteNotActive() })
+	}
+}
+
+func (o *Consumer) deleteNotActive() {
+	o.mu.RLock()
+	if o.mset == nil {
+		o.mu.RUnlock()
+		return
+	}
+	s, js, jsa := o.mset.srv, o.mset.srv.js, o.mset.jsa
+	acc, stream, name := o.acc.Name, o.stream, o.name
+	o.mu.RUnlock()
+
+	// If we are clustered, check if we still have this consumer assigned.
+	// If we do forward a proposal to delete ourselves to the metacontroller leader.
+	if s.JetStreamIsClustered() {
+		if ca := js.consumerAssignment(acc, stream, name); ca != nil {
+			// We copy and clear the reply since this removal is internal.
+			jsa.mu.Lock()
+			js := jsa.js
+			jsa.mu.Unlock()
+
+			if js != nil {
+				js.mu.RLock()
+				if cc := js.cluster; cc != nil {
+					cca := *ca
+					cca.Reply = _EMPTY_
+					meta, removeEntry := cc.meta, encodeDeleteConsumerAssignment(&cca)
+					meta.ForwardProposal(removeEntry)
+
+					// Check to make sure we went away.
+					// Don't think this needs to be a monitored go routine.
+					go func() {
+						ticker := time.NewTicker(time.Second)
+						defer ticker.Stop()
+						for range ticker.C {
+							js.mu.RLock()
+							ca := js.consumerAssignment(acc, stream, name)
+							js.mu.RUnlock()
+							if ca != nil {
+								s.Warnf("Consumer assignment not cleaned up, retrying")
+								meta.ForwardProposal(removeEntry)
+							} else {
+								return
+							}
+						}
+					}()
+
+				}
+				js.mu.RUnlock()
+			}
+		}
+	}
+	// We will delete here regardless.
+	o.Delete()
+}
+
+// Config returns the consumer's configuration.
+func (o *Consumer) Config() ConsumerConfig {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.config
+}
+
+// Force expiration of all pending.
+// Lock should be held.
+func (o *Consumer) forceExpirePending() {
+	now := time.Now().UnixNano()
+	var expired []uint64
+	for seq := range o.pending {
+		if !o.onRedeliverQueue(seq) {
+			expired = append(expired, seq)
+		}
+	}
+	if len(expired) > 0 {
+		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+		o.rdq = append(o.rdq, expired...)
+		// Now we should update the timestamp here since we are redelivering.
+		// We will use an incrementing time to preserve order for any other redelivery.
+		off := now - o.pending[expired[0]].Timestamp
+		for _, seq := range expired {
+			if p, ok := o.pending[seq]; ok && p != nil {
+				p.Timestamp += off
+			}
+		}
+		o.ptmr.Reset(o.ackWait(0))
+	}
+	o.signalNewMessages()
+}
+
+// This is a config change for the delivery subject for a
+// push based consumer.
+func (o *Consumer) updateDeliverSubject(newDeliver string) {
+	// Update the config and the dsubj
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || o.isPullMode() || o.config.DeliverSubject == newDeliver {
+		return
+	}
+
+	// Force redeliver of all pending on change of delivery subject.
+	if len(o.pending) > 0 {
+		o.forceExpirePending()
+	}
+
+	o.acc.sl.ClearNotification(o.dsubj, o.inch)
+	o.dsubj, o.config.DeliverSubject = newDeliver, newDeliver
+	// When we register new one it will deliver to update state loop.
+	o.acc.sl.RegisterNotification(newDeliver, o.inch)
+}
+
+// maxPending returns how many messages can be in flight without an ack, 0 is no limit.
+// Both MaxAckPending and MaxDeliverConcurrency bound this, the lower wins. Since pending
+// is tracked in our replicated delivered and ack state a new leader honors the same limit.
+func maxPending(config *ConsumerConfig) int {
+	maxp, mdc := config.MaxAckPending, config.MaxDeliverConcurrency
+	if mdc > 0 && (maxp <= 0 || mdc < maxp) {
+		maxp = mdc
+	}
+	return maxp
+}
+
+// Check that configs are equal but allow delivery subjects to be different.
+func configsEqualSansDelivery(a, b ConsumerConfig) bool {
+	// These were copied in so can set Delivery here.
+	a.DeliverSubject, b.DeliverSubject = _EMPTY_, _EMPTY_
+	return reflect.DeepEqual(a, b)
+}
+
+// Helper to send a reply to an ack.
+func (o *Consumer) sendAckReply(subj string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sendAdvisory(subj, nil)
+}
+
+// Process a message for the ack reply subject delivered with a message.
+func (o *Consumer) processAck(_ *subscription, c *client, subject, reply string, rmsg []byte) {
+	_, msg := c.msgParts(rmsg)
+	sseq, dseq, dc := ackReplyInfo(subject)
+
+	skipAckReply := sseq == 0
+
+	switch {
+	case len(msg) == 0, bytes.Equal(msg, AckAck), bytes.Equal(msg, AckOK):
+		o.ackMsg(sseq, dseq, dc)
+	case bytes.HasPrefix(msg, AckNext):
+		o.ackMsg(sseq, dseq, dc)
+		o.processNextMsgReq(nil, nil, subject, reply, msg[len(AckNext):])
+		skipAckReply = true
+	case bytes.Equal(msg, AckNak):
+		o.processNak(sseq, dseq)
+	case bytes.Equal(msg, AckProgress):
+		o.progressUpdate(sseq)
+	case bytes.Equal(msg, AckTerm):
+		o.processTerm(sseq, dseq, dc)
+	}
+
+	// Ack the ack if requested.
+	if len(reply) > 0 && !skipAckReply {
+		o.sendAckReply(reply)
+	}
+}
+
+// Used to process a working update to delay redelivery.
+func (o *Consumer) progressUpdate(seq uint64) {
+	o.mu.Lock()
+	if len(o.pending) > 0 {
+		if p, ok := o.pending[seq]; ok {
+			p.Timestamp = time.Now().UnixNano()
+			// Update store system.
+			o.updateDelivered(p.Sequence, seq, 1, p.Timestamp)
+		}
+	}
+	o.mu.Unlock()
+}
+
+// Lock should be held.
+func (o *Consumer) updateDelivered(dseq, sseq, dc uint64, ts int64) {
+	// Clustered mode and R>1.
+	if o.node != nil {
+		// Inline for now, use variable compression.
+		var b [4*binary.MaxVarintLen64 + 1]byte
+		b[0] = byte(updateDeliveredOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], dseq)
+		n += binary.PutUvarint(b[n:], sseq)
+		n += binary.PutUvarint(b[n:], dc)
+		n += binary.PutVarint(b[n:], ts)
+		o.node.Propose(b[:n])
+	}
+	// Update local state always.
+	o.store.UpdateDelivered(dseq, sseq, dc, ts)
+	// A new delivery moves our state past anything skipped before it.
+	if sseq > o.sskip {
+		o.sskip = 0
+	}
+}
+
+// Records the last message our header filter skipped, so our stored delivered
+// state and ack floor move past skipped messages on every replica.
+// Lock should be held.
+func (o *Consumer) updateSkipped() {
+	sseq := o.sskip
+	if sseq == 0 {
+		return
+	}
+	o.sskip = 0
+	if o.node != nil {
+		var b [binary.MaxVarintLen64 + 1]byte
+		b[0] = byte(updateSkippedOp)
+		n := 1 + binary.PutUvarint(b[1:], sseq)
+		o.node.Propose(b[:n])
+	} else {
+		o.store.UpdateSkipped(sseq)
+	}
+}
+
+// Lock should be held.
+func (o *Consumer) updateAcks(dseq, sseq uint64) {
+	if o.node != nil {
+		// Inline for now, use variable compression.
+		var b [2*binary.MaxVarintLen64 + 1]byte
+		b[0] = byte(updateAcksOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], dseq)
+		n += binary.PutUvarint(b[n:], sseq)
+		o.node.Propose(b[:n])
+	} else {
+		o.store.UpdateAcks(dseq, sseq)
+	}
+}
+
+// Records a message as moved to our dead letter subject.
+// Lock should be held.
+func (o *Consumer) updateDeadLettered(dseq, sseq uint64) {
+	if o.node != nil {
+		var b [2*binary.MaxVarintLen64 + 1]byte
+		b[0] = byte(deadLetterOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], dseq)
+		n += binary.PutUvarint(b[n:], sseq)
+		o.node.Propose(b[:n])
+	} else {
+		o.store.UpdateAcks(dseq, sseq)
+	}
+}
+
+// Process a NAK.
+func (o *Consumer) processNak(sseq, dseq uint64) {
+	o.mu.Lock()
+	// Without redelivery a NAK terminates the message instead.
+	if o.config.NoRedelivery {
+		dc := o.rdc[sseq] + 1
+		o.mu.Unlock()
+		o.processTerm(sseq, dseq, dc)
+		return
+	}
+	defer o.mu.Unlock()
+
+	// Check for out of range.
+	if dseq <= o.adflr || dseq > o.dseq {
+		return
+	}
+	// If we are explicit ack make sure this is still on our pending list.
+	if len(o.pending) > 0 {
+		if _, ok := o.pending[sseq]; !ok {
+			return
+		}
+	}
+	// If already queued up also ignore.
+	if !o.onRedeliverQueue(sseq) {
+		o.rdq = append(o.rdq, sseq)
+	}
+
+	o.signalNewMessages()
+}
+
+// Process a TERM
+func (o *Consumer) processTerm(sseq, dseq, dc uint64) {
+	// Treat like an ack to suppress redelivery.
+	o.processAckMsg(sseq, dseq, dc, false)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Deliver an advisory
+	e := JSConsumerDeliveryTerminatedAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerDeliveryTerminatedAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:      o.stream,
+		Consumer:    o.name,
+		ConsumerSeq: dseq,
+		StreamSeq:   sseq,
+		Deliveries:  dc,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerMsgTerminatedPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
+// Introduce a small delay in when timer fires to check pending.
+// Allows bursts to be treated in same time frame.
+const ackWaitDelay = time.Millisecond
+
+// ackWait returns how long to wait to fire the pending timer.
+// Lock should be held.
+func (o *Consumer) ackWait(next time.Duration) time.Duration {
+	if next > 0 {
+		return next + ackWaitDelay
+	}
+	wait := o.config.AckWait
+	for _, bo := range o.config.BackOff {
+		if bo < wait {
+			wait = bo
+		}
+	}
+	return wait + ackWaitDelay
+}
+
+// ackWaitFor returns how long we wait for an ack of the given sequence before redelivery.
+// With a BackOff schedule this depends on the delivery count, which is from our replicated
+// state so all replicas agree. Past the end of the schedule we use the last value.
+// Lock should be held.
+func (o *Consumer) ackWaitFor(sseq uint64) time.Duration {
+	bo := o.config.BackOff
+	if len(bo) == 0 {
+		return o.config.AckWait
+	}
+	if dc := o.rdc[sseq]; dc < uint64(len(bo)) {
+		return bo[dc]
+	}
+	return bo[len(bo)-1]
+}
+
+// This will restore the state from disk.
+func (o *Consumer) readStoredState() error {
+	if o.store == nil {
+		return nil
+	}
+	state, err := o.store.State()
+	if err == nil && state != nil {
+		o.applyState(state)
+	}
+	return err
+}
+
+// Apply the consumer stored state.
+func (o *Consumer) applyState(state *ConsumerState) {
+	if state == nil {
+		return
+	}
+
+	o.dseq = state.Delivered.Consumer + 1
+	o.sseq = state.Delivered.Stream + 1
+	o.adflr = state.AckFloor.Consumer
+	o.asflr = state.AckFloor.Stream
+	o.pending = state.Pending
+	o.rdc = state.Redelivered
+
+	// Setup tracking timer if we have restored pending.
+	if len(o.pending) > 0 && o.ptmr == nil {
+		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+	}
+}
+
+func (o *Consumer) readStoreState() *ConsumerState {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.store == nil {
+		return nil
+	}
+	state, _ := o.store.State()
+	return state
+}
+
+var errConsumerStateRestore = errors.New("consumer state restore failed")
+
+// Sets our store state from another source. Used in clustered mode on snapshot restore.
+// We only apply the state once the store has accepted it.
+func (o *Consumer) setStoreState(state *ConsumerState) error {
+	if state == nil {
+		return nil
+	}
+	if err := o.store.Update(state); err != nil {
+		return fmt.Errorf("%w: %v", errConsumerStateRestore, err)
+	}
+	o.applyState(state)
+	return nil
+}
+
+var errConsumerStateMismatch = errors.New("consumer state does not match restored state")
+
+// How many times we try to apply a restored state before giving up.
+const stateRestoreAttempts = 3
+
+// restoreStoreState will set our store state and make sure the store holds it afterwards,
+// retrying if it does not. This catches a store that only partially applied the state.
+func (o *Consumer) restoreStoreState(state *ConsumerState) (err error) {
+	for i := 0; i < stateRestoreAttempts; i++ {
+		if err = o.setStoreState(state); err == nil {
+			if err = o.verifyStoreState(state); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// verifyStoreState checks our stored delivered and ack floors are not behind the given state.
+// Being ahead is fine, we may have delivered or received acks since it was applied.
+func (o *Consumer) verifyStoreState(state *ConsumerState) error {
+	actual := o.readStoreState()
+	if actual == nil {
+		return errConsumerStateMismatch
+	}
+	if actual.Delivered.Consumer < state.Delivered.Consumer || actual.Delivered.Stream < state.Delivered.Stream ||
+		actual.AckFloor.Consumer < state.AckFloor.Consumer || actual.AckFloor.Stream < state.AckFloor.Stream {
+		return fmt.Errorf("%w: delivered %d:%d ack floor %d:%d, expected %d:%d and %d:%d", errConsumerStateMismatch,
+			actual.Delivered.Consumer, actual.Delivered.Stream, actual.AckFloor.Consumer, actual.AckFloor.Stream,
+			state.Delivered.Consumer, state.Delivered.Stream, state.AckFloor.Consumer, state.AckFloor.Stream)
+	}
+	return nil
+}
+
+// Update our state to the store.
+func (o *Consumer) writeStoreState() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.store == nil {
+		return nil
+	}
+
+	state := ConsumerState{
+		Delivered: SequencePair{
+			Consumer: o.dseq - 1,
+			Stream:   o.sseq - 1,
+		},
+		AckFloor: SequencePair{
+			Consumer: o.adflr,
+			Stream:   o.asflr,
+		},
+		Pending:     o.pending,
+		Redelivered: o.rdc,
+	}
+	return o.store.Update(&state)
+}
+
+// loopAndDeliverMsgs() will loop and deliver messages and watch for interest changes.
+func (o *Consumer) loopAndDeliverMsgs(qch chan struct{}) {
+	o.mu.Lock()
+	inch, sendq := o.inch, o.sendq
+	s, acc := o.acc.srv, o.acc
+	o.mu.Unlock()
+
+	// Create our client used to send messages.
+	c := s.createInternalJetStreamClient()
+	// Bind to the account.
+	c.registerWithAccount(acc)
+	// Clean up on exit.
+	defer c.closeConnection(ClientClosed)
+
+	// Warn when internal send queue is backed up past 75%
+	warnThresh := cap(sendq) * 3 / 4
+	warnFreq := time.Second
+	last := time.Now().Add(-warnFreq)
+
+	for {
+		if len(sendq) > warnThresh && time.Since(last) >= warnFreq {
+			s.Warnf("Jetstream internal consumer send queue > 75%% for account: %q consumer: %q", acc.Name, o.Name())
+			last = time.Now()
+		}
+
+		select {
+		case <-qch:
+			return
+		case interest := <-inch:
+			// inch can be nil on pull-based, but then this will
+			// just block and not fire.
+			o.updateDeliveryInterest(interest)
+		case pm := <-sendq:
+			if pm == nil {
+				return
+			}
+			c.pa.subject = []byte(pm.subj)
+			c.pa.deliver = []byte(pm.dsubj)
+			c.pa.size = len(pm.msg) + len(pm.hdr)
+			c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+			c.pa.reply = []byte(pm.reply)
+
+			var msg []byte
+			if len(pm.hdr) > 0 {
+				c.pa.hdr = len(pm.hdr)
+				c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+				msg = append(pm.hdr, pm.msg...)
+				msg = append(msg, _CRLF_...)
+			} else {
+				c.pa.hdr = -1
+				c.pa.hdb = nil
+				msg = append(pm.msg, _CRLF_...)
+			}
+
+			didDeliver := c.processInboundClientMsg(msg)
+			c.pa.szb = nil
+			c.flushClients(0)
+
+			// Check to see if this is a delivery for an observable and
+			// we failed to deliver the message. If so alert the observable.
+			if !didDeliver && pm.o != nil && pm.seq > 0 {
+				pm.o.didNotDeliver(pm.seq)
+			}
+		}
+	}
+}
+
+// Info returns our current consumer state.
+func (o *Consumer) Info() *ConsumerInfo {
+	ci := o.srv.clusterInfo(o.node)
+
+	o.mu.Lock()
+	info := &ConsumerInfo{
+		Stream:  o.stream,
+		Name:    o.name,
+		Created: o.created,
+		Config:  o.config,
+		Delivered: SequencePair{
+			Consumer: o.dseq - 1,
+			Stream:   o.sseq - 1,
+		},
+		AckFloor: SequencePair{
+			Consumer: o.adflr,
+			Stream:   o.asflr,
+		},
+		NumAckPending:  len(o.pending),
+		NumRedelivered: len(o.rdc),
+		NumPending:     o.sgap,
+		Cluster:        ci,
+	}
+	// If we are a pull mode consumer, report on number of waiting requests.
+	if o.isPullMode() {
+		info.NumWaiting = o.waiting.len()
+	}
+	o.mu.Unlock()
+	return info
+}
+
+// setPaused will pause or resume delivery for this consumer.
+func (o *Consumer) setPaused(paused bool) {
+	o.mu.Lock()
+	if o.config.Paused == paused {
+		o.mu.Unlock()
+		return
+	}
+	o.config.Paused = paused
+	o.mu.Unlock()
+
+	// Kick our delivery loop on resume.
+	if !paused {
+		o.signalNewMessages()
+	}
+}
+
+// setStartSeq will set the starting sequence the consumer leader resolved from OptStartTime.
+// The first one committed wins, and is ignored if we have already started delivering.
+func (o *Consumer) setStartSeq(seq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.startResolved {
+		return
+	}
+	o.startResolved, o.startSeq = true, seq
+	if o.dseq == 1 && seq > 0 {
+		o.sseq = seq
+		o.asflr = seq - 1
+	}
+}
+
+// consumerSettings are the replicated settings that are not part of our store state.
+// These are carried in checkpoints so they survive the log being compacted.
+type consumerSettings struct {
+	Paused        bool          `json:"paused,omitempty"`
+	FilterSubject string        `json:"filter_subject,omitempty"`
+	FilterHeader  *HeaderFilter `json:"filter_header,omitempty"`
+	StartSeq      uint64        `json:"start_seq,omitempty"`
+}
+
+func (o *Consumer) settings() *consumerSettings {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return &consumerSettings{
+		Paused:        o.config.Paused,
+		FilterSubject: o.config.FilterSubject,
+		FilterHeader:  o.config.FilterHeader,
+		StartSeq:      o.startSeq,
+	}
+}
+
+// applySettings will apply settings from a checkpoint.
+func (o *Consumer) applySettings(cs *consumerSettings) {
+	if cs == nil {
+		return
+	}
+	o.setPaused(cs.Paused)
+	o.setFilterSubject(cs.FilterSubject)
+	o.setHeaderFilter(cs.FilterHeader)
+	if cs.StartSeq > 0 {
+		o.setStartSeq(cs.StartSeq)
+	}
+}
+
+// checkFilterUpdate will check if filter can replace our current filter subject.
+func (o *Consumer) checkFilterUpdate(filter string) error {
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	if mset == nil {
+		return errBadConsumer
+	}
+	mset.mu.RLock()
+	isWorkQueue, allowNoSubject := mset.config.Retention == WorkQueuePolicy, mset.config.allowNoSubject
+	mset.mu.RUnlock()
+
+	// Partitions need to stay unique on workqueue streams, so do not allow changes there.
+	if isWorkQueue {
+		return fmt.Errorf("consumer filter subject can not be updated on a workqueue stream")
+	}
+	if filter != _EMPTY_ && !allowNoSubject && !mset.validSubject(filter) {
+		return fmt.Errorf("consumer filter subject is not a valid subset of the interest subjects")
+	}
+	return nil
+}
+
+// setFilterSubject will switch our filter subject. Messages already delivered under the
+// old filter stay pending and will be redelivered until acked, new deliveries use the new filter.
+func (o *Consumer) setFilterSubject(filter string) {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil || o.config.FilterSubject == filter {
+		o.mu.Unlock()
+		return
+	}
+	hadFilter := o.config.FilterSubject != _EMPTY_
+	o.config.FilterSubject = filter
+	o.filterWC = filter != _EMPTY_ && !subjectIsLiteral(filter)
+	o.mu.Unlock()
+
+	// Keep the stream's count of filtered consumers current.
+	mset.mu.Lock()
+	if hadFilter && filter == _EMPTY_ {
+		mset.numFilter--
+	} else if !hadFilter && filter != _EMPTY_ {
+		mset.numFilter++
+	}
+	mset.mu.Unlock()
+
+	o.signalNewMessages()
+}
+
+// validHeaderFilter checks the header name can be matched against and encoded.
+func validHeaderFilter(hf *HeaderFilter) bool {
+	return hf.Name != _EMPTY_ && !strings.ContainsAny(hf.Name, ": \t\r\n")
+}
+
+// checkHeaderFilterUpdate will check if we can switch to the new header filter.
+func (o *Consumer) checkHeaderFilterUpdate(hf *HeaderFilter) error {
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	if mset == nil {
+		return errBadConsumer
+	}
+	if hf != nil && !validHeaderFilter(hf) {
+		return fmt.Errorf("consumer filter header name is not valid")
+	}
+	mset.mu.RLock()
+	isWorkQueue := mset.config.Retention == WorkQueuePolicy
+	mset.mu.RUnlock()
+	if isWorkQueue && hf != nil {
+		return fmt.Errorf("consumer filter header not allowed on workqueue stream")
+	}
+	return nil
+}
+
+// setHeaderFilter will switch our header filter. Like setFilterSubject, messages already
+// delivered stay pending and new deliveries are matched against the new filter.
+func (o *Consumer) setHeaderFilter(hf *HeaderFilter) {
+	o.mu.Lock()
+	if o.mset == nil || reflect.DeepEqual(o.config.FilterHeader, hf) {
+		o.mu.Unlock()
+		return
+	}
+	o.config.FilterHeader = hf
+	o.mu.Unlock()
+
+	o.signalNewMessages()
+}
+
+// Check to see if the message headers match our header filter if its present.
+// Only the headers are looked at so every replica selects the same messages.
+// Lock should be held.
+func (o *Consumer) isHeaderMatch(hdr []byte) bool {
+	hf := o.config.FilterHeader
+	if hf == nil {
+		return true
+	}
+	if len(hdr) == 0 {
+		return false
+	}
+	return string(getHdrVal(hf.Name, hdr)) == hf.Value
+}
+
+// Will signal us that new messages are available. Will break out of waiting.
+func (o *Consumer) signalNewMessages() {
+	// Kick our new message channel
+	select {
+	case o.mch <- struct{}{}:
+	default:
+	}
+}
+
+// shouldSample lets us know if we are sampling metrics on acks.
+// This is decided by the consumer sequence so any leader samples the same messages.
+func (o *Consumer) shouldSample(dseq uint64) bool {
+	switch {
+	case o.sfreq <= 0:
+		return false
+	case o.sfreq >= 100:
+		return true
+	}
+	// Spread sequential sequences evenly, same mixing as splitmix64.
+	h := dseq * 0x9E3779B97F4A7C15
+	h = (h ^ (h >> 30)) * 0xBF58476D1CE4E5B9
+	h = (h ^ (h >> 27)) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return h%100 < uint64(o.sfreq)
+}
+
+func (o *Consumer) sampleAck(sseq, dseq, dc uint64) {
+	if !o.shouldSample(dseq) {
+		return
+	}
+
+	now := time.Now().UTC()
+	unow := now.UnixNano()
+
+	e := JSConsumerAckMetric{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerAckMetricType,
+			ID:   nuid.Next(),
+			Time: now,
+		},
+		Stream:      o.stream,
+		Consumer:    o.name,
+		ConsumerSeq: dseq,
+		StreamSeq:   sseq,
+		Delay:       unow - o.pending[sseq].Timestamp,
+		Deliveries:  dc,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.ackEventT, j)
+}
+
+// Process an ack for a message.
+func (o *Consumer) ackMsg(sseq, dseq, dc uint64) {
+	o.processAckMsg(sseq, dseq, dc, true)
+}
+
+func (o *Consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
+	o.mu.Lock()
+	var sagap uint64
+	var needSignal bool
+
+	switch o.config.AckPolicy {
+	case AckExplicit:
+		if p, ok := o.pending[sseq]; ok {
+			if doSample {
+				o.sampleAck(sseq, dseq, dc)
+			}
+			if o.maxp > 0 && len(o.pending) >= o.maxp {
+				needSignal = true
+			}
+			delete(o.pending, sseq)
+			// Use the original deliver sequence from our pending record.
+			dseq = p.Sequence
+			// Consumers sequence numbers can skip during re-delivery since
+			// they always increment. So if we do not have any pending treat
+			// as all scenario below. Otherwise check that we filled in a gap.
+			if len(o.pending) == 0 {
+				o.adflr, o.asflr = o.dseq-1, o.sseq-1
+				o.pending = nil
+			} else if dseq == o.adflr+1 {
+				o.adflr, o.asflr = dseq, sseq
+				for ss := sseq + 1; ss < o.sseq; ss++ {
+					if p, ok := o.pending[ss]; ok {
+						if p.Sequence > 0 {
+							o.adflr, o.asflr = p.Sequence-1, ss-1
+						}
+						break
+					}
+				}
+			}
+		}
+		// We do these regardless.
+		delete(o.rdc, sseq)
+		o.removeFromRedeliverQueue(sseq)
+	case AckAll:
+		// no-op
+		if dseq <= o.adflr || sseq <= o.asflr {
+			o.mu.Unlock()
+			return
+		}
+		if o.maxp > 0 && len(o.pending) >= o.maxp {
+			needSignal = true
+		}
+		sagap = sseq - o.asflr
+		o.adflr, o.asflr = dseq, sseq
+		for seq := sseq; seq > sseq-sagap; seq-- {
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+			o.removeFromRedeliverQueue(seq)
+		}
+	case AckNone:
+		// FIXME(dlc) - This is error but do we care?
+		o.mu.Unlock()
+		return
+	}
+
+	// Update underlying store.
+	o.updateAcks(dseq, sseq)
+
+	mset := o.mset
+	o.mu.Unlock()
+
+	// Let the owning stream know if we are interest or workqueue retention based.
+	if mset != nil && mset.config.Retention != LimitsPolicy {
+		if sagap > 1 {
+			// FIXME(dlc) - This is very inefficient, will need to fix.
+			for seq := sseq; seq > sseq-sagap; seq-- {
+				mset.ackMsg(o, seq)
+			}
+		} else {
+			mset.ackMsg(o, sseq)
+		}
+	}
+
+	// If we had max ack pending set and were at limit we need to unblock folks.
+	if needSignal {
+		o.signalNewMessages()
+	}
+}
+
+// Check if we need an ack for this store seq.
+// This is called for interest based retention streams to remove messages.
+func (o *Consumer) needAck(sseq uint64) bool {
+	var needAck bool
+	o.mu.Lock()
+	switch o.config.AckPolicy {
+	case AckNone, AckAll:
+		needAck = sseq > o.asflr
+	case AckExplicit:
+		if sseq > o.asflr {
+			// Generally this means we need an ack, but just double check pending acks.
+			needAck = true
+			if len(o.pending) > 0 && sseq < o.sseq {
+				_, needAck = o.pending[sseq]
+			}
+		}
+	}
+	o.mu.Unlock()
+	return needAck
+}
+
+// Helper for the next message requests.
+func nextReqFromMsg(msg []byte) (time.Time, int, bool, error) {
+	req := bytes.TrimSpace(msg)
+
+	switch {
+	case len(req) == 0:
+		return time.Time{}, 1, false, nil
+
+	case req[0] == '{':
+		var cr JSApiConsumerGetNextRequest
+		if err := json.Unmarshal(req, &cr); err != nil {
+			return time.Time{}, -1, false, err
+		}
+		return cr.Expires, cr.Batch, cr.NoWait, nil
+
+	default:
+		if n, err := strconv.Atoi(string(req)); err == nil {
+			return time.Time{}, n, false, nil
+		}
+	}
+
+	return time.Time{}, 1, false, nil
+}
+
+// Represents a request that is on the internal waiting queue
+type waitingRequest struct {
+	client  *client
+	reply   string
+	n       int // For batching
+	expires time.Time
+	noWait  bool
+}
+
+// waiting queue for requests that are waiting for new messages to arrive.
+type waitQueue struct {
+	rp, wp int
+	reqs   []*waitingRequest
+}
+
+// Create a new ring buffer with at most max items.
+func newWaitQueue(max int) *waitQueue {
+	return &waitQueue{rp: -1, reqs: make([]*waitingRequest, max)}
+}
+
+var (
+	errWaitQueueFull = errors.New("wait queue is full")
+	errWaitQueueNil  = errors.New("wait queue is nil")
+)
+
+// Adds in a new request.
+func (wq *waitQueue) add(req *waitingRequest) error {
+	if wq == nil {
+		return errWaitQueueNil
+	}
+	if wq.isFull() {
+		return errWaitQueueFull
+	}
+	wq.reqs[wq.wp] = req
+	// TODO(dlc) - Could make pow2 and get rid of mod.
+	wq.wp = (wq.wp + 1) % cap(wq.reqs)
+
+	// Adjust read pointer if we were empty.
+	if wq.rp < 0 {
+		wq.rp = 0
+	}
+
+	return nil
+}
+
+func (wq *waitQueue) isFull() bool {
+	return wq.rp == wq.wp
+}
+
+func (wq *waitQueue) len() int {
+	if wq == nil || wq.rp < 0 {
+		return 0
+	}
+	if wq.rp < wq.wp {
+		return wq.wp - wq.rp
+	}
+	return cap(wq.reqs) - wq.rp + wq.wp
+}
+
+// Peek will return the next request waiting or nil if empty.
+func (wq *waitQueue) peek() *waitingRequest {
+	if wq == nil {
+		return nil
+	}
+	var wr *waitingRequest
+	if wq.rp >= 0 {
+		wr = wq.reqs[wq.rp]
+	}
+	return wr
+}
+
+// pop will return the next request and move the read cursor.
+func (wq *waitQueue) pop() *waitingRequest {
+	wr := wq.peek()
+	if wr != nil {
+		wr.n--
+		if wr.n <= 0 {
+			wq.reqs[wq.rp] = nil
+			wq.rp = (wq.rp + 1) % cap(wq.reqs)
+			// Check if we are empty.
+			if wq.rp == wq.wp {
+				wq.rp, wq.wp = -1, 0
+			}
+		}
+	}
+	return wr
+}
+
+// processNextMsgReq will process a request for the next message available. A nil message payload means deliver
+// a single message. If the payload is a formal request or a number parseable with Atoi(), then we will send a
+// batch of messages without requiring another request to this endpoint, or an ACK.
+func (o *Consumer) processNextMsgReq(_ *subscription, c *client, _, reply string, msg []byte) {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil || o.isPushMode() || o.sendq == nil {
+		o.mu.Unlock()
+		return
+	}
+
+	sendErr := func(status int, description string) {
+		sendq := o.sendq
+		o.mu.Unlock()
+		hdr := []byte(fmt.Sprintf("NATS/1.0 %d %s\r\n\r\n", status, description))
+		pmsg := &jsPubMsg{reply, reply, _EMPTY_, hdr, nil, nil, 0}
+		sendq <- pmsg // Send message.
+	}
+
+	if o.waiting.isFull() {
+		// Try to expire some of the requests.
+		if expired := o.expireWaiting(); expired == 0 {
+			// Force expiration if needed.
+			o.forceExpireFirstWaiting()
+		}
+	}
+
+	// Check payload here to see if they sent in batch size or a formal request.
+	expires, batchSize, noWait, err := nextReqFromMsg(msg)
+	if err != nil {
+		sendErr(400, fmt.Sprintf("Bad Request - %v", err))
+		return
+	}
+
+	// In case we have to queue up this request. This is all on stack pre-allocated.
+	wr := waitingRequest{client: c, reply: reply, n: batchSize, noWait: noWait, expires: expires}
+
+	// If we are in replay mode, defer to processReplay for delivery.
+	if o.replay {
+		o.waiting.add(&wr)
+		o.mu.Unlock()
+		o.signalNewMessages()
+		return
+	}
+
+	for i := 0; i < batchSize; i++ {
+		// See if we have more messages available.
+		if subj, hdr, msg, seq, dc, ts, err := o.getNextMsg(); err == nil {
+			o.deliverMsg(reply, subj, hdr, msg, seq, dc, ts)
+			// Need to discount this from the total n for the request.
+			wr.n--
+		} else {
+			if wr.noWait {
+				switch err {
+				case errMaxAckPending:
+					sendErr(409, "Exceeded MaxAckPending")
+				default:
+					sendErr(404, "No Messages")
+				}
+				return
+			}
+			o.waiting.add(&wr)
+			break
+		}
+	}
+	o.mu.Unlock()
+}
+
+// Increase the delivery count for this message.
+// ONLY used on redelivery semantics.
+// Lock should be held.
+func (o *Consumer) incDeliveryCount(sseq uint64) uint64 {
+	if o.rdc == nil {
+		o.rdc = make(map[uint64]uint64)
+	}
+	o.rdc[sseq] += 1
+	return o.rdc[sseq] + 1
+}
+
+// send a delivery exceeded advisory.
+func (o *Consumer) notifyDeliveryExceeded(sseq, dc uint64) {
+	e := JSConsumerDeliveryExceededAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerDeliveryExceededAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:     o.stream,
+		Consumer:   o.name,
+		StreamSeq:  sseq,
+		Deliveries: dc,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.deliveryExcEventT, j)
+}
+
+// How often we will send a poison message advisory per consumer.
+const poisonAdvisoryInterval = 10 * time.Second
+
+// send a poison message advisory if we have not sent one recently.
+// Lock should be held.
+func (o *Consumer) notifyPoisonMessage(sseq, dc uint64) {
+	now := time.Now()
+	if now.Sub(o.lpoison) < poisonAdvisoryInterval {
+		return
+	}
+	o.lpoison = now
+
+	e := JSConsumerPoisonMessageAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerPoisonMessageAdvisoryType,
+			ID:   nuid.Next(),
+			Time: now.UTC(),
+		},
+		Stream:     o.stream,
+		Consumer:   o.name,
+		StreamSeq:  sseq,
+		Deliveries: dc,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.poisonEventT, j)
+}
+
+// deadLetter will return the message that exceeded MaxDeliver to republish to our dead letter subject.
+// The message carries a msg id based on its stream sequence so a target stream will drop the copy a new
+// leader may send after failover. It stays pending until the target stream acks it, see processDeadLetterAck(),
+// so if the target is unavailable or out of resources it is retried on the next redelivery.
+// Returns true if the message is gone and there is nothing to move.
+// Lock should be held.
+func (o *Consumer) deadLetter(sseq uint64) (*jsPubMsg, bool) {
+	if o.sendq == nil || o.dlqSub == nil {
+		return nil, false
+	}
+	p := o.pending[sseq]
+	subj, hdr, msg, _, err := o.mset.store.LoadMsg(sseq)
+	if err != nil {
+		var dseq uint64
+		if p != nil {
+			dseq = p.Sequence
+		}
+		delete(o.rdc, sseq)
+		o.updateDeadLettered(dseq, sseq)
+		return nil, true
+	}
+	// Wait a full ack wait for the pub ack before we retry.
+	if p != nil {
+		p.Timestamp = time.Now().UnixNano()
+	}
+	hdr = prependHeader(hdr, JSMsgId, fmt.Sprintf("%s.%s.%d", o.stream, o.name, sseq))
+	hdr = prependHeader(hdr, JSSequence, strconv.FormatUint(sseq, 10))
+	hdr = prependHeader(hdr, JSSubject, subj)
+	hdr = prependHeader(hdr, JSStream, o.stream)
+	if len(msg) > 0 {
+		msg = append(msg[:0:0], msg...)
+	}
+	reply := o.dlqReply + "." + strconv.FormatUint(sseq, 10)
+	return &jsPubMsg{o.config.DeadLetterSubject, _EMPTY_, reply, hdr, msg, nil, 0}, false
+}
+
+// processDeadLetterAck will record a message as moved once the dead letter target has stored it.
+func (o *Consumer) processDeadLetterAck(_ *subscription, c *client, subject, _ string, rmsg []byte) {
+	_, msg := c.msgParts(rmsg)
+	sseq, err := strconv.ParseUint(subject[strings.LastIndexByte(subject, '.')+1:], 10, 64)
+	if err != nil {
+		return
+	}
+	var resp JSPubAckResponse
+	if err := json.Unmarshal(msg, &resp); err != nil || resp.Error != nil {
+		// Stays pending, we will retry on the next redelivery.
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := o.pending[sseq]
+	if p == nil {
+		return
+	}
+	delete(o.pending, sseq)
+	delete(o.rdc, sseq)
+	o.updateDeadLettered(p.Sequence, sseq)
+}
+
+// sendDeadLetters will send the messages we are moving to our dead letter subject.
+// Lock should be held on entry but will be released while sending.
+func (o *Consumer) sendDeadLetters(pmsgs []*jsPubMsg) {
+	sendq := o.sendq
+	if sendq == nil {
+		return
+	}
+	// This needs to be unlocked since the other side may need this lock.
+	o.mu.Unlock()
+	for _, pmsg := range pmsgs {
+		sendq <- pmsg
+	}
+	o.mu.Lock()
+}
+
+// Check to see if the candidate subject matches a filter if its present.
+// Lock should be held.
+func (o *Consumer) isFilteredMatch(subj string) bool {
+	// No filter is automatic match.
+	if o.config.FilterSubject == _EMPTY_ {
+		return true
+	}
+	if !o.filterWC {
+		return subj == o.config.FilterSubject
+	}
+	// If we are here we have a wildcard filter subject.
+	// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
+	return subjectIsSubsetMatch(subj, o.config.FilterSubject)
+}
+
+var errMaxAckPending = errors.New("max ack pending reached")
+var errBadConsumer = errors.New("consumer not valid")
+
+// Get next available message from underlying store.
+// Is partition aware and redeliver aware.
+// Lock should be held.
+func (o *Consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dc uint64, ts int64, err error) {
+	if o.mset == nil || o.mset.store == nil {
+		return _EMPTY_, nil, nil, 0, 0, 0, errBadConsumer
+	}
+	// Messages to move to our dead letter subject are sent once we are done.
+	var dlq []*jsPubMsg
+	defer func() {
+		if len(dlq) > 0 {
+			o.sendDeadLetters(dlq)
+		}
+	}()
+	for {
+		seq, dc := o.sseq, uint64(1)
+		if len(o.rdq) > 0 {
+			seq = o.rdq[0]
+			o.rdq = append(o.rdq[:0], o.rdq[1:]...)
+			dc = o.incDeliveryCount(seq)
+			if o.maxdc > 0 && dc > o.maxdc {
+				// Only send once
+				if dc == o.maxdc+1 {
+					o.notifyDeliveryExceeded(seq, dc-1)
+				}
+				// Until the move is acked we keep it pending and retry on the next redelivery.
+				if o.config.DeadLetterSubject != _EMPTY_ {
+					pmsg, gone := o.deadLetter(seq)
+					if pmsg != nil {
+						dlq = append(dlq, pmsg)
+					}
+					if !gone {
+						continue
+					}
+				}
+				// Make sure to remove from pending.
+				delete(o.pending, seq)
+				continue
+			}
+			// Soft ceiling, we still deliver the message.
+			if pt := uint64(o.config.PoisonThreshold); pt > 0 && dc > pt {
+				o.notifyPoisonMessage(seq, dc)
+			}
+		} else if o.maxp > 0 && len(o.pending) >= o.maxp {
+			// maxp only set when ack policy != AckNone and user set MaxAckPending or MaxDeliverConcurrency
+			// Stall if we have hit max pending.
+			return _EMPTY_, nil, nil, 0, 0, 0, errMaxAckPending
+		}
+
+		subj, hdr, msg, ts, err := o.mset.store.LoadMsg(seq)
+		if err == nil {
+			if dc == 1 { // First delivery.
+				o.sseq++
+				if o.config.FilterSubject != _EMPTY_ && !o.isFilteredMatch(subj) {
+					continue
+				}
+				// Skipped messages were counted as pending for our subject.
+				if !o.isHeaderMatch(hdr) {
+					if o.sgap > 0 {
+						o.sgap--
+					}
+					o.sskip = seq
+					continue
+				}
+			}
+			// We have the msg here.
+			return subj, hdr, msg, seq, dc, ts, nil
+		}
+		// We got an error here. If this is an EOF we will return, otherwise
+		// we can continue looking.
+		if err == ErrStoreEOF || err == ErrStoreClosed {
+			return _EMPTY_, nil, nil, 0, 0, 0, err
+		}
+		// Skip since its probably deleted or expired.
+		o.sseq++
+	}
+}
+
+// forceExpireFirstWaiting will force expire the first waiting.
+// Lock should be held.
+func (o *Consumer) forceExpireFirstWaiting() *waitingRequest {
+	// FIXME(dlc) - Should we do advisory here as well?
+	wr := o.waiting.pop()
+	if wr == nil {
+		return wr
+	}
+	// If we are expiring this and we think there is still interest, alert.
+	if rr := o.acc.sl.Match(wr.reply); len(rr.psubs)+len(rr.qsubs) > 0 && o.mset != nil && o.sendq != nil {
+		// We still appear to have interest, so send alert as courtesy.
+		hdr := []byte("NATS/1.0 408 Request Timeout\r\n\r\n")
+		pmsg := &jsPubMsg{wr.reply, wr.reply, _EMPTY_, hdr, nil, nil, 0}
+		o.sendq <- pmsg // Send message.
+	}
+	return wr
+}
+
+// Will check for expiration and lack of interest on waiting requests.
+func (o *Consumer) expireWaiting() int {
+	var expired int
+	now := time.Now()
+	for wr := o.waiting.peek(); wr != nil; wr = o.waiting.peek() {
+		if !wr.expires.IsZero() && now.After(wr.expires) {
+			o.forceExpireFirstWaiting()
+			expired++
+			continue
+		}
+		rr := o.acc.sl.Match(wr.reply)
+		if len(rr.psubs)+len(rr.qsubs) > 0 {
+			break
+		}
+		// No more interest so go ahead and remove this one from our list.
+		o.forceExpireFirstWaiting()
+		expired++
+	}
+	return expired
+}
+
+// Will check to make sure those waiting still have registered interest.
+func (o *Consumer) checkWaitingForInterest() bool {
+	o.expireWaiting()
+	return o.waiting.len() > 0
+}
+
+func (o *Consumer) loopAndGatherMsgs(qch chan struct{}) {
+	// On startup check to see if we are in a a reply situtation where replay policy is not instant.
+	var (
+		lts  int64 // last time stamp seen, used for replay.
+		lseq uint64
+	)
+
+	o.mu.Lock()
+	if o.replay {
+		// consumer is closed when mset is set to nil.
+		if o.mset == nil {
+			o.mu.Unlock()
+			return
+		}
+		lseq = o.mset.State().LastSeq
+	}
+	o.mu.Unlock()
+
+	// Deliver all the msgs we have now, once done or on a condition, we wait for new ones.
+	for {
+		var (
+			seq, dc     uint64
+			subj, dsubj string
+			hdr         []byte
+			msg         []byte
+			err         error
+			ts          int64
+			delay       time.Duration
+		)
+
+		o.mu.Lock()
+		// consumer is closed when mset is set to nil.
+		if o.mset == nil {
+			o.mu.Unlock()
+			return
+		}
+
+		// If we are paused we stop sending, pending messages will be redelivered on resume.
+		if o.config.Paused {
+			goto waitForMsgs
+		}
+
+		// If we are in push mode and not active let's stop sending.
+		if o.isPushMode() && !o.active {
+			goto waitForMsgs
+		}
+
+		// If we are in pull mode and no one is waiting already break and wait.
+		if o.isPullMode() && !o.checkWaitingForInterest() {
+			goto waitForMsgs
+		}
+
+		// In priority mode we send from the current window before looking at the stream again.
+		if o.config.PriorityHeader != _EMPTY_ {
+			if len(o.pq) == 0 && len(o.rdq) == 0 {
+				err = o.fillPriorityWindow()
+			}
+			if len(o.pq) > 0 && o.sendq != nil {
+				pmsg, sendq := o.pq[0], o.sendq
+				o.pq = append(o.pq[:0], o.pq[1:]...)
+				o.mu.Unlock()
+				sendq <- pmsg
+				continue
+			}
+		}
+
+		if err == nil {
+			subj, hdr, msg, seq, dc, ts, err = o.getNextMsg()
+		}
+
+		// On error either wait or return.
+		if err != nil {
+			if err == ErrStoreMsgNotFound || err == ErrStoreEOF || err == errMaxAckPending {
+				goto waitForMsgs
+			} else {
+				o.mu.Unlock()
+				return
+			}
+		}
+
+		if wr := o.waiting.pop(); wr != nil {
+			dsubj = wr.reply
+		} else {
+			dsubj = o.dsubj
+		}
+
+		// If we are in a replay scenario and have not caught up check if we need to delay here.
+		if o.replay && lts > 0 {
+			if delay = time.Duration(ts - lts); delay > time.Millisecond {
+				o.mu.Unlock()
+				select {
+				case <-qch:
+					return
+				case <-time.After(delay):
+				}
+				o.mu.Lock()
+			}
+		}
+
+		// Track this regardless.
+		lts = ts
+
+		// If we have a rate limit set make sure we check that here.
+		if o.rlimit != nil {
+			now := time.Now()
+			r := o.rlimit.ReserveN(now, len(msg)+len(hdr)+len(subj)+len(dsubj)+len(o.ackReplyT))
+			delay := r.DelayFrom(now)
+			if delay > 0 {
+				o.mu.Unlock()
+				select {
+				case <-qch:
+					return
+				case <-time.After(delay):
+				}
+				o.mu.Lock()
+			}
+		}
+
+		o.deliverMsg(dsubj, subj, hdr, msg, seq, dc, ts)
+
+		o.mu.Unlock()
+		continue
+
+	waitForMsgs:
+		// Anything left in the priority window is already pending and will be redelivered.
+		if o.config.Paused || (o.isPushMode() && !o.active) {
+			o.pq = nil
+		}
+
+		// If we were in a replay state check to see if we are caught up. If so clear.
+		if o.replay && o.sseq > lseq {
+			o.replay = false
+		}
+
+		// Record anything our header filter skipped past since our last delivery.
+		o.updateSkipped()
+
+		// We will wait here for new messages to arrive.
+		mch := o.mch
+		o.mu.Unlock()
+
+		select {
+		case <-qch:
+			return
+		case <-mch:
+		}
+	}
+}
+
+func (o *Consumer) ackReply(sseq, dseq, dc uint64, ts int64, pending uint64) string {
+	return fmt.Sprintf(o.ackReplyT, dc, sseq, dseq, ts, pending)
+}
+
+// deliverCurrentMsg is the hot path to deliver a message that was just received.
+// Will return if the message was delivered or not.
+func (o *Consumer) deliverCurrentMsg(subj string, hdr, msg []byte, seq uint64, ts int64) bool {
+	o.mu.Lock()
+	if seq != o.sseq {
+		o.mu.Unlock()
+		return false
+	}
+
+	// If we are paused we stop sending.
+	if o.config.Paused {
+		o.mu.Unlock()
+		return false
+	}
+
+	// If we are in push mode and not active let's stop sending.
+	if o.isPushMode() && !o.active {
+		o.mu.Unlock()
+		return false
+	}
+
+	// Priority delivery has to go through the window.
+	if o.config.PriorityHeader != _EMPTY_ {
+		o.mu.Unlock()
+		return false
+	}
+
+	// If we are in pull mode and no one is waiting already break and wait.
+	if o.isPullMode() && !o.checkWaitingForInterest() {
+		o.mu.Unlock()
+		return false
+	}
+
+	// Since we short circuit the getNextMsg() call where we check for max pending
+	// we need to do that here as well.
+	if o.maxp > 0 && len(o.pending) >= o.maxp {
+		o.mu.Unlock()
+		return false
+	}
+
+	// Bump store sequence here.
+	o.sseq++
+
+	// If we are partitioned and we do not match, do not consider this a failure.
+	// Go ahead and return true.
+	if o.config.FilterSubject != _EMPTY_ && !o.isFilteredMatch(subj) {
+		o.mu.Unlock()
+		return true
+	}
+	if !o.isHeaderMatch(hdr) {
+		if o.sgap > 0 {
+			o.sgap--
+		}
+		o.sskip = seq
+		o.updateSkipped()
+		o.mu.Unlock()
+		return true
+	}
+
+	var dsubj string
+	if wr := o.waiting.pop(); wr != nil {
+		dsubj = wr.reply
+	} else {
+		dsubj = o.dsubj
+	}
+
+	o.deliverMsg(dsubj, subj, hdr, msg, seq, 1, ts)
+	o.mu.Unlock()
+
+	return true
+}
+
+// Deliver a msg to the consumer.
+// Lock should be held and o.mset validated to be non-nil.
+func (o *Consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dc uint64, ts int64) {
+	if o.mset == nil || o.sendq == nil {
+		return
+	}
+	// Update pending on first attempt
+	if dc == 1 && o.sgap > 0 {
+		o.sgap--
+	}
+
+	if len(hdr) > 0 {
+		hdr = append(hdr[:0:0], hdr...)
+	}
+	if len(msg) > 0 {
+		msg = append(msg[:0:0], msg...)
+	}
+
+	dseq := o.dseq
+	pmsg := &jsPubMsg{dsubj, subj, o.ackReply(seq, dseq, dc, ts, o.sgap), hdr, msg, o, seq}
+	mset := o.mset
+	ap := o.config.AckPolicy
+	sendq := o.sendq
+	// This needs to be unlocked since the other side may need this lock on a failed delivery.
+	o.mu.Unlock()
+	// Send message.
+	sendq <- pmsg
+	// If we are ack none and mset is interest only we should make sure stream removes interest.
+	if ap == AckNone && mset.config.Retention == InterestPolicy && !mset.retentionHeld() && !mset.checkInterest(seq, o) {
+		mset.store.RemoveMsg(seq)
+	}
+	// Re-acquire lock.
+	o.mu.Lock()
+
+	if ap == AckExplicit || ap == AckAll {
+		o.trackPending(seq, dseq)
+	} else if ap == AckNone {
+		o.adflr = o.dseq
+		o.asflr = seq
+	}
+
+	o.dseq++
+
+	// FIXME(dlc) - Capture errors?
+	o.updateDelivered(dseq, seq, dc, ts)
+}
+
+const (
+	// Lookahead used for priority delivery when not set.
+	defaultPriorityWindow = 64
+	// Upper bound on the priority lookahead.
+	maxPriorityWindow = 1024
+	// How many times a message can be passed over when not set.
+	defaultPriorityMaxSkip = 16
+)
+
+// A message in the priority window.
+type priorityMsg struct {
+	pmsg  *jsPubMsg
+	prio  int64
+	skips int
+}
+
+// fillPriorityWindow loads up to the priority window of first deliveries and
+// orders them for sending. Delivery tracking is done here in stream order so the
+// replicated consumer state is the same as for in order delivery, only the send
+// order is changed. The order only depends on the messages in the window, so any
+// leader will produce the same one.
+// Lock should be held.
+func (o *Consumer) fillPriorityWindow() error {
+	wsz := o.config.PriorityWindow
+	if wsz == 0 {
+		wsz = defaultPriorityWindow
+	}
+	var win []*priorityMsg
+	for len(win) < wsz && len(o.rdq) == 0 {
+		subj, hdr, msg, seq, dc, ts, err := o.getNextMsg()
+		if err != nil {
+			if len(win) == 0 {
+				return err
+			}
+			break
+		}
+		if pmsg := o.trackPriorityMsg(subj, hdr, msg, seq, dc, ts); pmsg != nil {
+			win = append(win, &priorityMsg{pmsg, o.msgPriority(hdr), 0})
+		}
+	}
+	o.pq = orderByPriority(win, o.priorityMaxSkip())
+	return nil
+}
+
+// trackPriorityMsg does the delivery bookkeeping of deliverMsg without sending.
+// Lock should be held.
+func (o *Consumer) trackPriorityMsg(subj string, hdr, msg []byte, seq, dc uint64, ts int64) *jsPubMsg {
+	if o.mset == nil {
+		return nil
+	}
+	if dc == 1 && o.sgap > 0 {
+		o.sgap--
+	}
+	if len(hdr) > 0 {
+		hdr = append(hdr[:0:0], hdr...)
+	}
+	if len(msg) > 0 {
+		msg = append(msg[:0:0], msg...)
+	}
+	dseq := o.dseq
+	pmsg := &jsPubMsg{o.dsubj, subj, o.ackReply(seq, dseq, dc, ts, o.sgap), hdr, msg, o, seq}
+	o.trackPending(seq, dseq)
+	o.dseq++
+	o.updateDelivered(dseq, seq, dc, ts)
+	return pmsg
+}
+
+// msgPriority returns the priority of a message from the configured header.
+// Missing or invalid values are the lowest priority.
+func (o *Consumer) msgPriority(hdr []byte) int64 {
+	if len(hdr) == 0 {
+		return 0
+	}
+	if p := parseInt64(getHdrVal(o.config.PriorityHeader, hdr)); p > 0 {
+		return p
+	}
+	return 0
+}
+
+// Lock should be held.
+func (o *Consumer) priorityMaxSkip() int {
+	if o.config.PriorityMaxSkip == 0 {
+		return defaultPriorityMaxSkip
+	}
+	return o.config.PriorityMaxSkip
+}
+
+// orderByPriority orders the window by highest priority first, oldest first for ties.
+// A message that has been passed over maxSkip times goes next. The oldest message in
+// the window has always been skipped the most, so only that one needs checking.
+func orderByPriority(win []*priorityMsg, maxSkip int) []*jsPubMsg {
+	if len(win) == 0 {
+		return nil
+	}
+	out := make([]*jsPubMsg, 0, len(win))
+	for len(win) > 0 {
+		pick := 0
+		if win[0].skips < maxSkip {
+			for i, pm := range win {
+				if pm.prio > win[pick].prio {
+					pick = i
+				}
+			}
+		}
+		for i := 0; i < pick; i++ {
+			win[i].skips++
+		}
+		out = append(out, win[pick].pmsg)
+		win = append(win[:pick], win[pick+1:]...)
+	}
+	return out
+}
+
+// Tracks our outstanding pending acks. Only applicable to AckExplicit mode.
+// Lock should be held.
+func (o *Consumer) trackPending(sseq, dseq uint64) {
+	if o.pending == nil {
+		o.pending = make(map[uint64]*Pending)
+	}
+	if o.ptmr == nil {
+		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+	}
+	if p, ok := o.pending[sseq]; ok {
+		p.Timestamp = time.Now().UnixNano()
+	} else {
+		o.pending[sseq] = &Pending{dseq, time.Now().UnixNano()}
+	}
+}
+
+// didNotDeliver is called when a delivery for a consumer message failed.
+// Depending on our state, we will process the failure.
+func (o *Consumer) didNotDeliver(seq uint64) {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil {
+		o.mu.Unlock()
+		return
+	}
+
+	if o.isPushMode() {
+		o.active = false
+	} else if o.pending != nil {
+		// pull mode and we have pending.
+		if _, ok := o.pending[seq]; ok {
+			// We found this messsage on pending, we need
+			// to queue it up for immediate redelivery since
+			// we know it was not delivered.
+			if !o.onRedeliverQueue(seq) {
+				o.rdq = append(o.rdq, seq)
+				o.signalNewMessages()
+			}
+		}
+	}
+	o.mu.Unlock()
+}
+
+// This checks if we already have this sequence queued for redelivery.
+// FIXME(dlc) - This is O(n) but should be fast with small redeliver size.
+// Lock should be held.
+func (o *Consumer) onRedeliverQueue(seq uint64) bool {
+	for _, rseq := range o.rdq {
+		if rseq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove a sequence from the redelivery queue.
+// Lock should be held.
+func (o *Consumer) removeFromRedeliverQueue(seq uint64) bool {
+	for i, rseq := range o.rdq {
+		if rseq == seq {
+			o.rdq = append(o.rdq[:i], o.rdq[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the pending messages.
+func (o *Consumer) checkPending() {
+	// Without redelivery expired messages are terminated once we release the lock.
+	// Terminating acks the message through our raft group, so a new leader will not redeliver it.
+	var terms [][3]uint64
+	defer func() {
+		for _, t := range terms {
+			o.processTerm(t[0], t[1], t[2])
+		}
+	}()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	mset := o.mset
+	if mset == nil {
+		return
+	}
+	next := int64(o.ackWait(0))
+	now := time.Now().UnixNano()
+
+	// Since we can update timestamps, we have to review all pending.
+	// We may want to unlock here or warn if list is big.
+	var expired []uint64
+	for seq, p := range o.pending {
+		ttl := int64(o.ackWaitFor(seq))
+		elapsed := now - p.Timestamp
+		if elapsed >= ttl {
+			if !o.onRedeliverQueue(seq) {
+				expired = append(expired, seq)
+				o.signalNewMessages()
+			}
+		} else if ttl-elapsed < next {
+			// Update when we should fire next.
+			next = ttl - elapsed
+		}
+	}
+
+	if len(expired) > 0 && o.config.NoRedelivery {
+		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+		for _, seq := range expired {
+			terms = append(terms, [3]uint64{seq, o.pending[seq].Sequence, o.rdc[seq] + 1})
+		}
+	} else if len(expired) > 0 {
+		// We need to sort.
+		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+		o.rdq = append(o.rdq, expired...)
+		// Now we should update the timestamp here since we are redelivering.
+		// We will use an incrementing time to preserve order for any other redelivery.
+		off := now - o.pending[expired[0]].Timestamp
+		for _, seq := range expired {
+			if p, ok := o.pending[seq]; ok {
+				p.Timestamp += off
+			}
+		}
+	}
+
+	if len(o.pending) > 0 {
+		o.ptmr.Reset(o.ackWait(time.Duration(next)))
+	} else {
+		o.ptmr.Stop()
+		o.ptmr = nil
+	}
+}
+
+// SeqFromReply will extract a sequence number from a reply subject.
+func (o *Consumer) SeqFromReply(reply string) uint64 {
+	_, dseq, _ := ackReplyInfo(reply)
+	return dseq
+}
+
+// StreamSeqFromReply will extract the stream sequence from the reply subject.
+func (o *Consumer) StreamSeqFromReply(reply string) uint64 {
+	sseq, _, _ := ackReplyInfo(reply)
+	return sseq
+}
+
+// Quick parser for positive numbers in ack reply encoding.
+func parseAckReplyNum(d string) (n int64) {
+	if len(d) == 0 {
+		return -1
+	}
+	for _, dec := range d {
+		if dec < asciiZero || dec > asciiNine {
+			return -1
+		}
+		n = n*10 + (int64(dec) - asciiZero)
+	}
+	return n
+}
+
+const expectedNumReplyTokens = 9
+
+// Grab encoded information in the reply subject for a delivered message.
+func (o *Consumer) ReplyInfo(subject string) (sseq, dseq, dc uint64, ts int64, pending uint64) {
+	tsa := [expectedNumReplyTokens]string{}
+	start, tokens := 0, tsa[:0]
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	tokens = append(tokens, subject[start:])
+	if len(tokens) != expectedNumReplyTokens || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return 0, 0, 0, 0, 0
+	}
+	// TODO(dlc) - Should we error if we do not match consumer name?
+	// stream is tokens[2], consumer is 3.
+	dc = uint64(parseAckReplyNum(tokens[4]))
+	sseq, dseq = uint64(parseAckReplyNum(tokens[5])), uint64(parseAckReplyNum(tokens[6]))
+	ts = parseAckReplyNum(tokens[7])
+	pending = uint64(parseAckReplyNum(tokens[8]))
+
+	return sseq, dseq, dc, ts, pending
+}
+
+func ackReplyInfo(subject string) (sseq, dseq, dc uint64) {
+	tsa := [expectedNumReplyTokens]string{}
+	start, tokens := 0, tsa[:0]
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	tokens = append(tokens, subject[start:])
+	if len(tokens) != expectedNumReplyTokens || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return 0, 0, 0
+	}
+	dc = uint64(parseAckReplyNum(tokens[4]))
+	sseq, dseq = uint64(parseAckReplyNum(tokens[5])), uint64(parseAckReplyNum(tokens[6]))
+
+	return sseq, dseq, dc
+}
+
+// NextSeq returns the next delivered sequence number for this observable.
+func (o *Consumer) NextSeq() uint64 {
+	o.mu.Lock()
+	dseq := o.dseq
+	o.mu.Unlock()
+	return dseq
+}
+
+// This will select the store seq to start with based on the
+// partition subject.
+func (o *Consumer) selectSubjectLast() {
+	stats := o.mset.store.State()
+	if stats.LastSeq == 0 {
+		o.sseq = stats.LastSeq
+		return
+	}
+	// FIXME(dlc) - this is linear and can be optimized by store layer.
+	for seq := stats.LastSeq; seq >= stats.FirstSeq; seq-- {
+		subj, _, _, _, err := o.mset.store.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound {
+			continue
+		}
+		if o.isFilteredMatch(subj) {
+			o.sseq = seq
+			return
+		}
+	}
+}
+
+// Will select the starting sequence.
+func (o *Consumer) selectStartingSeqNo() {
+	stats := o.mset.store.State()
+	if o.config.OptStartSeq == 0 {
+		if o.config.DeliverPolicy == DeliverAll {
+			o.sseq = stats.FirstSeq
+		} else if o.config.DeliverPolicy == DeliverLast {
+			o.sseq = stats.LastSeq
+			// If we are partitioned here we may need to walk backwards.
+			if o.config.FilterSubject != _EMPTY_ {
+				o.selectSubjectLast()
+			}
+		} else if o.config.OptStartTime != nil {
+			// If we are here we are time based. A time before our first message starts at the first.
+			// When clustered the leader replicates what it resolved here, see setStartSeq.
+			o.sseq = o.mset.store.GetSeqFromTime(*o.config.OptStartTime)
+		} else {
+			// Default is deliver new only.
+			o.sseq = stats.LastSeq + 1
+		}
+	} else {
+		o.sseq = o.config.OptStartSeq
+	}
+
+	if stats.FirstSeq == 0 {
+		o.sseq = 1
+	} else if o.sseq < stats.FirstSeq {
+		o.sseq = stats.FirstSeq
+	} else if o.sseq > stats.LastSeq {
+		o.sseq = stats.LastSeq + 1
+	}
+	// Always set delivery sequence to 1.
+	o.dseq = 1
+	// Set ack delivery floor to delivery-1
+	o.adflr = o.dseq - 1
+	// Set ack store floor to store-1
+	o.asflr = o.sseq - 1
+}
+
+// Test whether a config represents a durable subscriber.
+func isDurableConsumer(config *ConsumerConfig) bool {
+	return config != nil && config.Durable != _EMPTY_
+}
+
+func (o *Consumer) isDurable() bool {
+	return o.config.Durable != _EMPTY_
+}
+
+// Are we in push mode, delivery subject, etc.
+func (o *Consumer) isPushMode() bool {
+	return o.config.DeliverSubject != _EMPTY_
+}
+
+func (o *Consumer) isPullMode() bool {
+	return o.config.DeliverSubject == _EMPTY_
+}
+
+// Name returns the name of this observable.
+func (o *Consumer) Name() string {
+	o.mu.Lock()
+	n := o.name
+	o.mu.Unlock()
+	return n
+}
+
+func createConsumerName() string {
+	return string(getHash(nuid.Next()))
+}
+
+// DeleteConsumer will delete the consumer from this stream.
+func (mset *Stream) DeleteConsumer(o *Consumer) error {
+	return o.Delete()
+}
+
+func (o *Consumer) Stream() string {
+	o.mu.RLock()
+	mset := o.mset
+	o.mu.RUnlock()
+	if mset != nil {
+		return mset.Name()
+	}
+	return _EMPTY_
+}
+
+// Active indicates if this consumer is still active.
+func (o *Consumer) Active() bool {
+	o.mu.Lock()
+	active := o.active && o.mset != nil
+	o.mu.Unlock()
+	return active
+}
+
+// hasActivity returns true if we have interest, waiting pull requests or messages pending an ack.
+func (o *Consumer) hasActivity() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mset == nil {
+		return false
+	}
+	if o.active || len(o.pending) > 0 {
+		return true
+	}
+	return o.isPullMode() && o.waiting.len() > 0
+}
+
+// hasNoLocalInterest return true if we have no local interest.
+func (o *Consumer) hasNoLocalInterest() bool {
+	o.mu.Lock()
+	rr := o.acc.sl.Match(o.config.DeliverSubject)
+	o.mu.Unlock()
+	return len(rr.psubs)+len(rr.qsubs) == 0
+}
+
+// This is when the underlying stream has been purged.
+func (o *Consumer) purge(sseq uint64) {
+	o.mu.Lock()
+	o.sseq = sseq
+	o.asflr = sseq - 1
+	o.adflr = o.dseq - 1
+	o.sgap = 0
+	if len(o.pending) > 0 {
+		o.pending = nil
+		if o.ptmr != nil {
+			o.ptmr.Stop()
+			// Do not nil this out here. This allows checkPending to fire
+			// and still be ok and not panic.
+		}
+	}
+	// We need to remove all those being queued for redelivery under o.rdq
+	if len(o.rdq) > 0 {
+		var newRDQ []uint64
+		for _, sseq := range o.rdq {
+			if sseq >= o.sseq {
+				newRDQ = append(newRDQ, sseq)
+			}
+		}
+		// Replace with new list. Most of the time this will be nil.
+		o.rdq = newRDQ
+	}
+	// Anything still in the priority window was purged.
+	o.pq = nil
+	o.mu.Unlock()
+
+	o.writeStoreState()
+}
+
+func stopAndClearTimer(tp **time.Timer) {
+	if *tp == nil {
+		return
+	}
+	// Will get drained in normal course, do not try to
+	// drain here.
+	(*tp).Stop()
+	*tp = nil
+}
+
+// Stop will shutdown  the consumer for the associated stream.
+func (o *Consumer) Stop() error {
+	return o.stop(false, true, false)
+}
+
+func (o *Consumer) deleteWithoutAdvisory() error {
+	return o.stop(true, true, false)
+}
+
+// Delete will delete the consumer for the associated stream and send advisories.
+func (o *Consumer) Delete() error {
+	return o.stop(true, true, true)
+}
+
+func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+
+	if dflag && advisory && o.isLeader() {
+		o.sendDeleteAdvisoryLocked()
+	}
+
+	if o.qch != nil {
+		close(o.qch)
+		o.qch = nil
+	}
+
+	a := o.acc
+	store := o.store
+	mset := o.mset
+	o.mset = nil
+	o.active = false
+	o.unsubscribe(o.ackSub)
+	o.unsubscribe(o.reqSub)
+	o.unsubscribe(o.infoSub)
+	o.unsubscribe(o.dlqSub)
+	o.ackSub = nil
+	o.reqSub = nil
+	o.infoSub = nil
+	o.dlqSub = nil
+	c := o.client
+	o.client = nil
+	sysc := o.sysc
+	o.sysc = nil
+	stopAndClearTimer(&o.ptmr)
+	stopAndClearTimer(&o.dtmr)
+	delivery := o.config.DeliverSubject
+	o.waiting = nil
+	// Break us out of the readLoop.
+	if doSignal {
+		o.signalNewMessages()
+	}
+	n := o.node
+	o.mu.Unlock()
+
+	if c != nil {
+		c.closeConnection(ClientClosed)
+	}
+	if sysc != nil {
+		sysc.closeConnection(ClientClosed)
+	}
+
+	if delivery != _EMPTY_ {
+		a.sl.ClearNotification(delivery, o.inch)
+	}
+
+	mset.mu.Lock()
+	mset.deleteConsumer(o)
+	rp := mset.config.Retention
+	mset.mu.Unlock()
+
+	// We need to optionally remove all messages since we are interest based retention.
+	// We will do this consistently on all replicas. Note that if in clustered mode the
+	// non-leader consumers will need to restore state first.
+	if dflag && rp == InterestPolicy {
+		var seqs []uint64
+		o.mu.Lock()
+		if !o.isLeader() {
+			o.readStoredState()
+		}
+		for seq := range o.pending {
+			seqs = append(seqs, seq)
+		}
+		o.mu.Unlock()
+		// Sort just to keep pending sparse array state small.
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			mset.mu.Lock()
+			hasNoInterest := !mset.config.RetentionHold && !mset.checkInterest(seq, o)
+			mset.mu.Unlock()
+			if hasNoInterest {
+				mset.store.RemoveMsg(seq)
+			}
+		}
+	}
+
+	// Cluster cleanup.
+	if n != nil {
+		if dflag {
+			n.Delete()
+		} else {
+			n.Stop()
+		}
+	}
+
+	var err error
+	if store != nil {
+		if dflag {
+			err = store.Delete()
+		} else {
+			err = store.Stop()
+		}
+	}
+	return err
+}
+
+// Check that we do not form a cycle by delivering to a delivery subject
+// that is part of the interest group.
+func (mset *Stream) deliveryFormsCycle(deliverySubject string) bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+
+	for _, subject := range mset.config.Subjects {
+		if subjectIsSubsetMatch(deliverySubject, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// This is same as check for delivery cycle.
+func (mset *Stream) validSubject(partitionSubject string) bool {
+	return mset.deliveryFormsCycle(partitionSubject)
+}
+
+// SetInActiveDeleteThreshold sets the delete threshold for how long to wait
+// before deleting an inactive ephemeral observable.
+func (o *Consumer) SetInActiveDeleteThreshold(dthresh time.Duration) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.isPullMode() {
+		return fmt.Errorf("consumer is not push-based")
+	}
+	if o.isDurable() {
+		return fmt.Errorf("consumer is not durable")
+	}
+	deleteWasRunning := o.dtmr != nil
+	stopAndClearTimer(&o.dtmr)
+	o.dthresh = dthresh
+	if deleteWasRunning {
+		o.dtmr = time.AfterFunc(o.dthresh, func() { o.deleteNotActive() })
+	}
+	return nil
+}
+
+// switchToEphemeral is called on startup when recovering ephemerals.
+func (o *Consumer) switchToEphemeral() {
+	o.mu.Lock()
+	o.config.Durable = _EMPTY_
+	store, ok := o.store.(*consumerFileStore)
+	rr := o.acc.sl.Match(o.config.DeliverSubject)
+	o.mu.Unlock()
+
+	// Update interest
+	o.updateDeliveryInterest(len(rr.psubs)+len(rr.qsubs) > 0)
+	// Write out new config
+	if ok {
+		store.updateConfig(o.config)
+	}
+}
+
+// RequestNextMsgSubject returns the subject to request the next message when in pull or worker mode.
+// Returns empty otherwise.
+func (o *Consumer) RequestNextMsgSubject() string {
+	return o.nextMsgSubj
+}
+
+// Will set the initial pending.
+// mset lock should be held.
+func (o *Consumer) setInitialPending() {
+	mset := o.mset
+	if mset == nil {
+		return
+	}
+	// Non-filtering, means we want all messages.
+	if o.config.FilterSubject == _EMPTY_ {
+		state := mset.store.State()
+		if state.Msgs > 0 {
+			o.sgap = state.Msgs - (o.sseq - state.FirstSeq)
+		}
+	} else {
+		// Here we are filtered.
+		// FIXME(dlc) - This could be slow with O(n)
+		for seq := o.sseq; ; seq++ {
+			subj, _, _, _, err := o.mset.store.LoadMsg(seq)
+			if err == ErrStoreMsgNotFound {
+				continue
+			} else if err == ErrStoreEOF {
+				break
+			} else if err == nil && o.isFilteredMatch(subj) {
+				o.sgap++
+			}
+		}
+	}
+}
+
+// addStreamPending will add to the stream pending.
+func (o *Consumer) incStreamPending(sseq uint64, subj string) {
+	o.mu.Lock()
+	if o.isFilteredMatch(subj) {
+		o.sgap++
+	}
+	o.mu.Unlock()
+}
+
+func (o *Consumer) decStreamPending(sseq uint64, subj string) {
+	o.mu.Lock()
+	// Ignore if we have already seen this one.
+	if sseq >= o.sseq && o.sgap > 0 && o.isFilteredMatch(subj) {
+		o.sgap--
+	}
+	o.mu.Unlock()
+}
+
+func (o *Consumer) account() *Account {
+	o.mu.RLock()
+	a := o.acc
+	o.mu.RUnlock()
+	return a
+}
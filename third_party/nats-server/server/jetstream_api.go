@@ -0,0 +1,2786 @@
+// Copyright 2020-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// Request API subjects for JetStream.
+const (
+	// JSApiInfo is for obtaining general information about JetStream for this account.
+	// Will return JSON response.
+	JSApiAccountInfo = "$JS.API.INFO"
+
+	// JSApiTemplateCreate is the endpoint to create new stream templates.
+	// Will return JSON response.
+	JSApiTemplateCreate  = "$JS.API.STREAM.TEMPLATE.CREATE.*"
+	JSApiTemplateCreateT = "$JS.API.STREAM.TEMPLATE.CREATE.%s"
+
+	// JSApiTemplates is the endpoint to list all stream template names for this account.
+	// Will return JSON response.
+	JSApiTemplates = "$JS.API.STREAM.TEMPLATE.NAMES"
+
+	// JSApiTemplateInfo is for obtaining general information about a named stream template.
+	// Will return JSON response.
+	JSApiTemplateInfo  = "$JS.API.STREAM.TEMPLATE.INFO.*"
+	JSApiTemplateInfoT = "$JS.API.STREAM.TEMPLATE.INFO.%s"
+
+	// JSApiTemplateDelete is the endpoint to delete stream templates.
+	// Will return JSON response.
+	JSApiTemplateDelete  = "$JS.API.STREAM.TEMPLATE.DELETE.*"
+	JSApiTemplateDeleteT = "$JS.API.STREAM.TEMPLATE.DELETE.%s"
+
+	// JSApiStreamCreate is the endpoint to create new streams.
+	// Will return JSON response.
+	JSApiStreamCreate  = "$JS.API.STREAM.CREATE.*"
+	JSApiStreamCreateT = "$JS.API.STREAM.CREATE.%s"
+
+	// JSApiStreamUpdate is the endpoint to update existing streams.
+	// Will return JSON response.
+	JSApiStreamUpdate  = "$JS.API.STREAM.UPDATE.*"
+	JSApiStreamUpdateT = "$JS.API.STREAM.UPDATE.%s"
+
+	// JSApiStreams is the endpoint to list all stream names for this account.
+	// Will return JSON response.
+	JSApiStreams = "$JS.API.STREAM.NAMES"
+	// JSApiStreamList is the endpoint that will return all detailed stream information
+	JSApiStreamList = "$JS.API.STREAM.LIST"
+
+	// JSApiStreamInfo is for obtaining general information about a named stream.
+	// Will return JSON response.
+	JSApiStreamInfo  = "$JS.API.STREAM.INFO.*"
+	JSApiStreamInfoT = "$JS.API.STREAM.INFO.%s"
+
+	// JSApiStreamDelete is the endpoint to delete streams.
+	// Will return JSON response.
+	JSApiStreamDelete  = "$JS.API.STREAM.DELETE.*"
+	JSApiStreamDeleteT = "$JS.API.STREAM.DELETE.%s"
+
+	// JSApiPurgeStream is the endpoint to purge streams.
+	// Will return JSON response.
+	JSApiStreamPurge  = "$JS.API.STREAM.PURGE.*"
+	JSApiStreamPurgeT = "$JS.API.STREAM.PURGE.%s"
+
+	// JSApiStreamSnapshot is the endpoint to snapshot streams.
+	// Will return a stream of chunks with a nil chunk as EOF to
+	// the deliver subject. Caller should respond to each chunk
+	// with a nil body response for ack flow.
+	JSApiStreamSnapshot  = "$JS.API.STREAM.SNAPSHOT.*"
+	JSApiStreamSnapshotT = "$JS.API.STREAM.SNAPSHOT.%s"
+
+	// JSApiStreamRestore is the endpoint to restore a stream from a snapshot.
+	// Caller should resond to each chunk with a nil body response.
+	JSApiStreamRestore  = "$JS.API.STREAM.RESTORE.*"
+	JSApiStreamRestoreT = "$JS.API.STREAM.RESTORE.%s"
+
+	// JSApiDeleteMsg is the endpoint to delete messages from a stream.
+	// Will return JSON response.
+	JSApiMsgDelete  = "$JS.API.STREAM.MSG.DELETE.*"
+	JSApiMsgDeleteT = "$JS.API.STREAM.MSG.DELETE.%s"
+
+	// JSApiMsgGet is the template for direct requests for a message by its stream sequence number.
+	// Will return JSON response.
+	JSApiMsgGet  = "$JS.API.STREAM.MSG.GET.*"
+	JSApiMsgGetT = "$JS.API.STREAM.MSG.GET.%s"
+
+	// JSApiStreamLastSeq is the endpoint to get the last stream sequence stored for a subject.
+	// Will return JSON response.
+	JSApiStreamLastSeq  = "$JS.API.STREAM.LAST_SEQ.*"
+	JSApiStreamLastSeqT = "$JS.API.STREAM.LAST_SEQ.%s"
+
+	// JSApiConsumerCreate is the endpoint to create ephemeral consumers for streams.
+	// Will return JSON response.
+	JSApiConsumerCreate  = "$JS.API.CONSUMER.CREATE.*"
+	JSApiConsumerCreateT = "$JS.API.CONSUMER.CREATE.%s"
+
+	// JSApiDurableCreate is the endpoint to create durable consumers for streams.
+	// You need to include the stream and consumer name in the subject.
+	JSApiDurableCreate  = "$JS.API.CONSUMER.DURABLE.CREATE.*.*"
+	JSApiDurableCreateT = "$JS.API.CONSUMER.DURABLE.CREATE.%s.%s"
+
+	// JSApiConsumers is the endpoint to list all consumer names for the stream.
+	// Will return JSON response.
+	JSApiConsumers  = "$JS.API.CONSUMER.NAMES.*"
+	JSApiConsumersT = "$JS.API.CONSUMER.NAMES.%s"
+
+	// JSApiConsumerList is the endpoint that will return all detailed consumer information
+	JSApiConsumerList  = "$JS.API.CONSUMER.LIST.*"
+	JSApiConsumerListT = "$JS.API.CONSUMER.LIST.%s"
+
+	// JSApiConsumerInfo is for obtaining general information about a consumer.
+	// Will return JSON response.
+	JSApiConsumerInfo  = "$JS.API.CONSUMER.INFO.*.*"
+	JSApiConsumerInfoT = "$JS.API.CONSUMER.INFO.%s.%s"
+
+	// JSApiDeleteConsumer is the endpoint to delete consumers.
+	// Will return JSON response.
+	JSApiConsumerDelete  = "$JS.API.CONSUMER.DELETE.*.*"
+	JSApiConsumerDeleteT = "$JS.API.CONSUMER.DELETE.%s.%s"
+
+	// JSApiRequestNextT is the prefix for the request next message(s) for a consumer in worker/pull mode.
+	JSApiRequestNextT = "$JS.API.CONSUMER.MSG.NEXT.%s.%s"
+
+	// For snapshots and restores. The ack will have additional tokens.
+	jsSnapshotAckT    = "$JS.SNAPSHOT.ACK.%s.%s"
+	jsRestoreDeliverT = "$JS.SNAPSHOT.RESTORE.%s.%s"
+
+	// jsMirrorReplyT is the template for replies to a mirror's requests to its source.
+	// Each request appends its own id as the last token.
+	jsMirrorReplyT = "$JS.MIRROR.%s.%s"
+
+	// jsDeadLetterReplyT is the template for pub acks to a consumer's dead letter moves.
+	// The stream sequence moved is appended as the last token.
+	jsDeadLetterReplyT = "$JS.DLQ.%s.%s.%s"
+
+	// jsAckT is the template for the ack message stream coming back from a consumer
+	// when they ACK/NAK, etc a message.
+	jsAckT   = "$JS.ACK.%s.%s"
+	jsAckPre = "$JS.ACK."
+
+	// JSAdvisoryPrefix is a prefix for all JetStream advisories.
+	JSAdvisoryPrefix = "$JS.EVENT.ADVISORY"
+
+	// JSMetricPrefix is a prefix for all JetStream metrics.
+	JSMetricPrefix = "$JS.EVENT.METRIC"
+
+	// JSMetricConsumerAckPre is a metric containing ack latency.
+	JSMetricConsumerAckPre = "$JS.EVENT.METRIC.CONSUMER.ACK"
+
+	// JSAdvisoryConsumerMaxDeliveryExceedPre is a notification published when a message exceeds its delivery threshold.
+	JSAdvisoryConsumerMaxDeliveryExceedPre = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES"
+
+	// JSAdvisoryConsumerPoisonMessagePre is a notification published when a message exceeds its poison threshold.
+	JSAdvisoryConsumerPoisonMessagePre = "$JS.EVENT.ADVISORY.CONSUMER.POISON_MESSAGE"
+
+	// JSAdvisoryConsumerMsgTerminatedPre is a notification published when a message has been terminated.
+	JSAdvisoryConsumerMsgTerminatedPre = "$JS.EVENT.ADVISORY.CONSUMER.MSG_TERMINATED"
+
+	// JSAdvisoryStreamCreatedPre notification that a stream was created.
+	JSAdvisoryStreamCreatedPre = "$JS.EVENT.ADVISORY.STREAM.CREATED"
+
+	// JSAdvisoryStreamDeletedPre notification that a stream was deleted.
+	JSAdvisoryStreamDeletedPre = "$JS.EVENT.ADVISORY.STREAM.DELETED"
+
+	// JSAdvisoryStreamUpdatedPre notification that a stream was updated.
+	JSAdvisoryStreamUpdatedPre = "$JS.EVENT.ADVISORY.STREAM.UPDATED"
+
+	// JSAdvisoryConsumerCreatedPre notification that a template created.
+	JSAdvisoryConsumerCreatedPre = "$JS.EVENT.ADVISORY.CONSUMER.CREATED"
+
+	// JSAdvisoryConsumerDeletedPre notification that a template deleted.
+	JSAdvisoryConsumerDeletedPre = "$JS.EVENT.ADVISORY.CONSUMER.DELETED"
+
+	// JSAdvisoryStreamSnapshotCreatePre notification that a snapshot was created.
+	JSAdvisoryStreamSnapshotCreatePre = "$JS.EVENT.ADVISORY.STREAM.SNAPSHOT_CREATE"
+
+	// JSAdvisoryStreamSnapshotCompletePre notification that a snapshot was completed.
+	JSAdvisoryStreamSnapshotCompletePre = "$JS.EVENT.ADVISORY.STREAM.SNAPSHOT_COMPLETE"
+
+	// JSAdvisoryStreamRestoreCreatePre notification that a restore was start.
+	JSAdvisoryStreamRestoreCreatePre = "$JS.EVENT.ADVISORY.STREAM.RESTORE_CREATE"
+
+	// JSAdvisoryStreamRestoreCompletePre notification that a restore was completed.
+	JSAdvisoryStreamRestoreCompletePre = "$JS.EVENT.ADVISORY.STREAM.RESTORE_COMPLETE"
+
+	// JSAdvisoryStreamLeaderElectPre notification that a replicated stream has elected a leader.
+	JSAdvisoryStreamLeaderElectedPre = "$JS.EVENT.ADVISORY.STREAM.LEADER_ELECTED"
+
+	// JSAdvisoryStreamQuorumLostPre notification that a stream and its consumers are stalled.
+	JSAdvisoryStreamQuorumLostPre = "$JS.EVENT.ADVISORY.STREAM.QUORUM_LOST"
+
+	// JSAdvisoryStreamAsymmetricPartitionPre notification that a stream leader is not hearing back from some followers.
+	JSAdvisoryStreamAsymmetricPartitionPre = "$JS.EVENT.ADVISORY.STREAM.ASYMMETRIC_PARTITION"
+
+	// JSAdvisoryStreamMaxAgeExpiryPre notification that a replicated stream has expired messages past MaxAge.
+	JSAdvisoryStreamMaxAgeExpiryPre = "$JS.EVENT.ADVISORY.STREAM.MAX_AGE_EXPIRY"
+
+	// JSAdvisoryServerStorageExhaustedPre notification that a server's storage is past its high water mark.
+	JSAdvisoryServerStorageExhaustedPre = "$JS.EVENT.ADVISORY.SERVER.STORAGE_EXHAUSTED"
+
+	// JSAdvisoryServerStorageRecoveredPre notification that a server's storage is back below its low water mark.
+	JSAdvisoryServerStorageRecoveredPre = "$JS.EVENT.ADVISORY.SERVER.STORAGE_RECOVERED"
+
+	// JSAdvisoryConsumerLeaderElectPre notification that a replicated consumer has elected a leader.
+	JSAdvisoryConsumerLeaderElectedPre = "$JS.EVENT.ADVISORY.CONSUMER.LEADER_ELECTED"
+
+	// JSAdvisoryConsumerQuorumLostPre notification that a consumer is stalled.
+	JSAdvisoryConsumerQuorumLostPre = "$JS.EVENT.ADVISORY.CONSUMER.QUORUM_LOST"
+
+	// JSAdvisoryConsumerStateRestoreFailedPre notification that a consumer could not restore its assigned state.
+	JSAdvisoryConsumerStateRestoreFailedPre = "$JS.EVENT.ADVISORY.CONSUMER.STATE_RESTORE_FAILED"
+
+	// JSAuditAdvisory is a notification about JetStream API access.
+	// FIXME - Add in details about who..
+	JSAuditAdvisory = "$JS.EVENT.ADVISORY.API"
+)
+
+// Maximum name lengths for streams, consumers and templates.
+const JSMaxNameLen = 256
+
+// Maximum size of all keys and values of a stream's metadata.
+// The metadata is carried in every meta snapshot so we keep it small.
+const JSMaxMetadataLen = 8 * 1024
+
+// Responses for API calls.
+
+// ApiError is included in all responses if there was an error.
+// TODO(dlc) - Move to more generic location.
+type ApiError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description,omitempty"`
+}
+
+// ApiResponse is a standard response from the JetStream JSON API
+type ApiResponse struct {
+	Type  string    `json:"type"`
+	Error *ApiError `json:"error,omitempty"`
+}
+
+// ApiPaged includes variables used to create paged responses from the JSON API
+type ApiPaged struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// ApiPagedRequest includes parameters allowing specific pages to be requests from APIs responding with ApiPaged
+type ApiPagedRequest struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// listLimit returns the requested page size, capped at JSApiListLimit.
+func (req *ApiPagedRequest) listLimit() int {
+	if req.Limit <= 0 || req.Limit > JSApiListLimit {
+		return JSApiListLimit
+	}
+	return req.Limit
+}
+
+// JSApiAccountInfoResponse reports back information on jetstream for this account.
+type JSApiAccountInfoResponse struct {
+	ApiResponse
+	*JetStreamAccountStats
+}
+
+const JSApiAccountInfoResponseType = "io.nats.jetstream.api.v1.account_info_response"
+
+// JSApiStreamCreateResponse stream creation.
+type JSApiStreamCreateResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamCreateResponseType = "io.nats.jetstream.api.v1.stream_create_response"
+
+// JSApiStreamDeleteResponse stream removal.
+type JSApiStreamDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiStreamDeleteResponseType = "io.nats.jetstream.api.v1.stream_delete_response"
+
+// JSApiStreamInfoResponse.
+type JSApiStreamInfoResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamInfoResponseType = "io.nats.jetstream.api.v1.stream_info_response"
+
+// Maximum entries we will return for streams or consumers lists.
+// TODO(dlc) - with header or request support could request chunked response.
+const JSApiNamesLimit = 1024
+const JSApiListLimit = 256
+
+type JSApiStreamNamesRequest struct {
+	ApiPagedRequest
+	// These are filters that can be applied to the list.
+	Subject string `json:"subject,omitempty"`
+}
+
+// JSApiStreamNamesResponse list of streams.
+// A nil request is valid and means all streams.
+type JSApiStreamNamesResponse struct {
+	ApiResponse
+	ApiPaged
+	Streams []string `json:"streams"`
+}
+
+const JSApiStreamNamesResponseType = "io.nats.jetstream.api.v1.stream_names_response"
+
+// JSApiStreamListResponse list of detailed stream information.
+// A nil request is valid and means all streams.
+type JSApiStreamListResponse struct {
+	ApiResponse
+	ApiPaged
+	Streams []*StreamInfo `json:"streams"`
+}
+
+const JSApiStreamListResponseType = "io.nats.jetstream.api.v1.stream_list_response"
+
+// JSApiStreamPurgeResponse.
+type JSApiStreamPurgeResponse struct {
+	ApiResponse
+	Success bool   `json:"success,omitempty"`
+	Purged  uint64 `json:"purged"`
+}
+
+const JSApiStreamPurgeResponseType = "io.nats.jetstream.api.v1.stream_purge_response"
+
+// JSApiStreamUpdateResponse for updating a stream.
+type JSApiStreamUpdateResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamUpdateResponseType = "io.nats.jetstream.api.v1.stream_update_response"
+
+// JSApiMsgDeleteRequest delete message request.
+type JSApiMsgDeleteRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// JSApiMsgDeleteResponse.
+type JSApiMsgDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiMsgDeleteResponseType = "io.nats.jetstream.api.v1.stream_msg_delete_response"
+
+type JSApiStreamSnapshotRequest struct {
+	// Subject to deliver the chunks to for the snapshot.
+	DeliverSubject string `json:"deliver_subject"`
+	// Do not include consumers in the snapshot.
+	NoConsumers bool `json:"no_consumers,omitempty"`
+	// Optional chunk size preference.
+	// Best to just let server select.
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// Check all message's checksums prior to snapshot.
+	CheckMsgs bool `json:"jsck,omitempty"`
+}
+
+// JSApiStreamSnapshotResponse is the direct response to the snapshot request.
+type JSApiStreamSnapshotResponse struct {
+	ApiResponse
+	// Configuration of the given stream.
+	Config *StreamConfig `json:"config,omitempty"`
+	// Current State for the given stream.
+	State *StreamState `json:"state,omitempty"`
+}
+
+const JSApiStreamSnapshotResponseType = "io.nats.jetstream.api.v1.stream_snapshot_response"
+
+// JSApiStreamRestoreRequest is the required restore request.
+type JSApiStreamRestoreRequest struct {
+	// Configuration of the given stream.
+	Config StreamConfig `json:"config"`
+	// Current State for the given stream.
+	State StreamState `json:"state"`
+}
+
+const JSApiStreamRestoreRequestType = "io.nats.jetstream.api.v1.stream_restore_request"
+
+// JSApiStreamRestoreResponse is the direct response to the restore request.
+type JSApiStreamRestoreResponse struct {
+	ApiResponse
+	// Subject to deliver the chunks to for the snapshot restore.
+	DeliverSubject string `json:"deliver_subject"`
+}
+
+const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_response"
+
+// JSApiMsgGetRequest get a message request.
+type JSApiMsgGetRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// JSApiMsgGetResponse.
+type JSApiMsgGetResponse struct {
+	ApiResponse
+	Message *StoredMsg `json:"message,omitempty"`
+}
+
+const JSApiMsgGetResponseType = "io.nats.jetstream.api.v1.stream_msg_get_response"
+
+// JSApiStreamLastSeqRequest asks for the last sequence stored for a subject.
+type JSApiStreamLastSeqRequest struct {
+	Subject string `json:"subject"`
+}
+
+// JSApiStreamLastSeqResponse reports the last sequence for a subject, zero if there are no messages.
+type JSApiStreamLastSeqResponse struct {
+	ApiResponse
+	Subject string `json:"subject,omitempty"`
+	Seq     uint64 `json:"seq"`
+}
+
+const JSApiStreamLastSeqResponseType = "io.nats.jetstream.api.v1.stream_last_seq_response"
+
+// JSWaitQueueDefaultMax is the default max number of outstanding requests for pull consumers.
+const JSWaitQueueDefaultMax = 512
+
+// JSApiConsumerCreateResponse.
+type JSApiConsumerCreateResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerCreateResponseType = "io.nats.jetstream.api.v1.consumer_create_response"
+
+// JSApiConsumerDeleteResponse.
+type JSApiConsumerDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiConsumerDeleteResponseType = "io.nats.jetstream.api.v1.consumer_delete_response"
+
+// JSApiConsumerInfoResponse.
+type JSApiConsumerInfoResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerInfoResponseType = "io.nats.jetstream.api.v1.consumer_info_response"
+
+// JSApiConsumersRequest
+type JSApiConsumersRequest struct {
+	ApiPagedRequest
+}
+
+// JSApiConsumerNamesResponse.
+type JSApiConsumerNamesResponse struct {
+	ApiResponse
+	ApiPaged
+	Consumers []string `json:"consumers"`
+}
+
+const JSApiConsumerNamesResponseType = "io.nats.jetstream.api.v1.consumer_names_response"
+
+// JSApiConsumerListResponse.
+type JSApiConsumerListResponse struct {
+	ApiResponse
+	ApiPaged
+	Consumers []*ConsumerInfo `json:"consumers"`
+}
+
+const JSApiConsumerListResponseType = "io.nats.jetstream.api.v1.consumer_list_response"
+
+// JSApiConsumerGetNextRequest is for getting next messages for pull based consumers.
+type JSApiConsumerGetNextRequest struct {
+	Expires time.Time `json:"expires,omitempty"`
+	Batch   int       `json:"batch,omitempty"`
+	NoWait  bool      `json:"no_wait,omitempty"`
+}
+
+// JSApiStreamTemplateCreateResponse for creating templates.
+type JSApiStreamTemplateCreateResponse struct {
+	ApiResponse
+	*StreamTemplateInfo
+}
+
+const JSApiStreamTemplateCreateResponseType = "io.nats.jetstream.api.v1.stream_template_create_response"
+
+// JSApiStreamTemplateDeleteResponse
+type JSApiStreamTemplateDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiStreamTemplateDeleteResponseType = "io.nats.jetstream.api.v1.stream_template_delete_response"
+
+// JSApiStreamTemplateInfoResponse for information about stream templates.
+type JSApiStreamTemplateInfoResponse struct {
+	ApiResponse
+	*StreamTemplateInfo
+}
+
+const JSApiStreamTemplateInfoResponseType = "io.nats.jetstream.api.v1.stream_template_info_response"
+
+// JSApiStreamTemplatesRequest
+type JSApiStreamTemplatesRequest struct {
+	ApiPagedRequest
+}
+
+// JSApiStreamTemplateNamesResponse list of templates
+type JSApiStreamTemplateNamesResponse struct {
+	ApiResponse
+	ApiPaged
+	Templates []string `json:"streams"`
+}
+
+const JSApiStreamTemplateNamesResponseType = "io.nats.jetstream.api.v1.stream_template_names_response"
+
+var (
+	jsNotEnabledErr       = &ApiError{Code: 503, Description: "JetStream not enabled for account"}
+	jsBadRequestErr       = &ApiError{Code: 400, Description: "bad request"}
+	jsNotEmptyRequestErr  = &ApiError{Code: 400, Description: "expected an empty request payload"}
+	jsInvalidJSONErr      = &ApiError{Code: 400, Description: "invalid JSON request"}
+	jsInsufficientErr     = &ApiError{Code: 503, Description: "insufficient Resources"}
+	jsNoAccountErr        = &ApiError{Code: 404, Description: "account not found"}
+	jsNoConsumerErr       = &ApiError{Code: 404, Description: "consumer not found"}
+	jsStreamMismatchErr   = &ApiError{Code: 400, Description: "stream name in subject does not match request"}
+	jsNoClusterSupportErr = &ApiError{Code: 503, Description: "not currently supported in clustered mode"}
+	jsClusterNotAvailErr  = &ApiError{Code: 503, Description: "JetStream system temporarily unavailable"}
+	jsStreamNotCurrentErr = &ApiError{Code: 503, Description: "stream replica not current"}
+)
+
+// For easier handling of exports and imports.
+var allJsExports = []string{
+	JSApiAccountInfo,
+	JSApiTemplateCreate,
+	JSApiTemplates,
+	JSApiTemplateInfo,
+	JSApiTemplateDelete,
+	JSApiStreamCreate,
+	JSApiStreamUpdate,
+	JSApiStreams,
+	JSApiStreamList,
+	JSApiStreamInfo,
+	JSApiStreamDelete,
+	JSApiStreamPurge,
+	JSApiStreamSnapshot,
+	JSApiStreamRestore,
+	JSApiMsgDelete,
+	JSApiMsgGet,
+	JSApiStreamLastSeq,
+	JSApiConsumerCreate,
+	JSApiDurableCreate,
+	JSApiConsumers,
+	JSApiConsumerList,
+	JSApiConsumerInfo,
+	JSApiConsumerDelete,
+}
+
+func (s *Server) setJetStreamExportSubs() error {
+	pairs := []struct {
+		subject string
+		handler msgHandler
+	}{
+		{JSApiAccountInfo, s.jsAccountInfoRequest},
+		{JSApiTemplateCreate, s.jsTemplateCreateRequest},
+		{JSApiTemplates, s.jsTemplateNamesRequest},
+		{JSApiTemplateInfo, s.jsTemplateInfoRequest},
+		{JSApiTemplateDelete, s.jsTemplateDeleteRequest},
+		{JSApiStreamCreate, s.jsStreamCreateRequest},
+		{JSApiStreamUpdate, s.jsStreamUpdateRequest},
+		{JSApiStreams, s.jsStreamNamesRequest},
+		{JSApiStreamList, s.jsStreamListRequest},
+		{JSApiStreamInfo, s.jsStreamInfoRequest},
+		{JSApiStreamDelete, s.jsStreamDeleteRequest},
+		{JSApiStreamPurge, s.jsStreamPurgeRequest},
+		{JSApiStreamSnapshot, s.jsStreamSnapshotRequest},
+		{JSApiStreamRestore, s.jsStreamRestoreRequest},
+		{JSApiMsgDelete, s.jsMsgDeleteRequest},
+		{JSApiMsgGet, s.jsMsgGetRequest},
+		{JSApiStreamLastSeq, s.jsStreamLastSeqRequest},
+		{JSApiConsumerCreate, s.jsConsumerCreateRequest},
+		{JSApiDurableCreate, s.jsDurableCreateRequest},
+		{JSApiConsumers, s.jsConsumerNamesRequest},
+		{JSApiConsumerList, s.jsConsumerListRequest},
+		{JSApiConsumerInfo, s.jsConsumerInfoRequest},
+		{JSApiConsumerDelete, s.jsConsumerDeleteRequest},
+	}
+
+	for _, p := range pairs {
+		if _, err := s.sysSubscribe(p.subject, p.handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) sendAPIResponse(ci *ClientInfo, acc *Account, subject, reply, request, response string) {
+	acc.trackAPI()
+	s.sendInternalAccountMsg(nil, reply, response)
+	s.sendJetStreamAPIAuditAdvisory(ci, acc, subject, request, response, _EMPTY_)
+}
+
+func (s *Server) sendAPIErrResponse(ci *ClientInfo, acc *Account, subject, reply, request, response string) {
+	acc.trackAPIErr()
+	s.sendInternalAccountMsg(nil, reply, response)
+	s.sendJetStreamAPIAuditAdvisory(ci, acc, subject, request, response, _EMPTY_)
+}
+
+// auditClusteredRequest will send an audit advisory for an administrative request when clustered, before it
+// is proposed, so we have a record of who asked for what. This is done by the server the client is connected
+// to when known, the request is seen by all of them, otherwise by the meta leader.
+func (s *Server) auditClusteredRequest(ci *ClientInfo, acc *Account, subject, request, action string) {
+	if ci == nil || !s.JetStreamIsClustered() {
+		return
+	}
+	if ci.Server != _EMPTY_ {
+		if ci.Server != s.Name() {
+			return
+		}
+	} else if !s.JetStreamIsLeader() {
+		return
+	}
+	s.sendJetStreamAPIAuditAdvisory(ci, acc, subject, request, _EMPTY_, action)
+}
+
+func (s *Server) getRequestInfo(c *client, raw []byte) (pci *ClientInfo, acc *Account, hdr, msg []byte, err error) {
+	hdr, msg = c.msgParts(raw)
+	var ci ClientInfo
+	if len(hdr) > 0 {
+		if err := json.Unmarshal(getHdrVal(ClientInfoHdr, hdr), &ci); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	if c.pa.proxy != nil {
+		acc = c.pa.proxy
+	} else if ci.Account != _EMPTY_ {
+		acc, _ = s.LookupAccount(ci.Account)
+	} else {
+		// Direct $SYS access.
+		acc = c.acc
+	}
+	if acc == nil {
+		return nil, nil, nil, nil, ErrMissingAccount
+	}
+	return &ci, acc, hdr, msg, nil
+}
+
+func (a *Account) trackAPI() {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa != nil {
+		jsa.mu.Lock()
+		jsa.usage.api++
+		jsa.apiTotal++
+		jsa.sendClusterUsageUpdate()
+		jsa.mu.Unlock()
+	}
+}
+
+func (a *Account) trackAPIErr() {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa != nil {
+		jsa.mu.Lock()
+		jsa.usage.api++
+		jsa.apiTotal++
+		jsa.usage.err++
+		jsa.apiErrors++
+		jsa.sendClusterUsageUpdate()
+		jsa.mu.Unlock()
+	}
+}
+
+const badAPIRequestT = "Malformed JetStream API Request: %q"
+
+// Request for current usage and limits for this account.
+func (s *Server) jsAccountInfoRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiAccountInfoResponse{ApiResponse: ApiResponse{Type: JSApiAccountInfoResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+	} else {
+		stats := acc.JetStreamUsage()
+		resp.JetStreamAccountStats = &stats
+	}
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), string(b))
+}
+
+// Helpers for token extraction.
+func templateNameFromSubject(subject string) string {
+	return tokenAt(subject, 6)
+}
+
+func streamNameFromSubject(subject string) string {
+	return tokenAt(subject, 5)
+}
+
+func consumerNameFromSubject(subject string) string {
+	return tokenAt(subject, 6)
+}
+
+// Request to create a new template.
+func (s *Server) jsTemplateCreateRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamTemplateCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamTemplateCreateResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Not supported for now.
+	if s.JetStreamIsClustered() {
+		resp.Error = jsNoClusterSupportErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var cfg StreamTemplateConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	templateName := templateNameFromSubject(subject)
+	if templateName != cfg.Name {
+		resp.Error = &ApiError{Code: 400, Description: "template name in subject does not match request"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	t, err := acc.AddStreamTemplate(&cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	t.mu.Lock()
+	tcfg := t.StreamTemplateConfig.deepCopy()
+	streams := t.streams
+	if streams == nil {
+		streams = []string{}
+	}
+	t.mu.Unlock()
+	resp.StreamTemplateInfo = &StreamTemplateInfo{Config: tcfg, Streams: streams}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for the list of all template names.
+func (s *Server) jsTemplateNamesRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamTemplateNamesResponse{ApiResponse: ApiResponse{Type: JSApiStreamTemplateNamesResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Not supported for now.
+	if s.JetStreamIsClustered() {
+		resp.Error = jsNoClusterSupportErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var offset int
+	if !isEmptyRequest(msg) {
+		var req JSApiStreamTemplatesRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		offset = req.Offset
+	}
+
+	ts := acc.Templates()
+	sort.Slice(ts, func(i, j int) bool {
+		return strings.Compare(ts[i].StreamTemplateConfig.Name, ts[j].StreamTemplateConfig.Name) < 0
+	})
+
+	tcnt := len(ts)
+	if offset > tcnt {
+		offset = tcnt
+	}
+
+	for _, t := range ts[offset:] {
+		t.mu.Lock()
+		name := t.Name
+		t.mu.Unlock()
+		resp.Templates = append(resp.Templates, name)
+		if len(resp.Templates) >= JSApiNamesLimit {
+			break
+		}
+	}
+	resp.Total = tcnt
+	resp.Limit = JSApiNamesLimit
+	resp.Offset = offset
+	if resp.Templates == nil {
+		resp.Templates = []string{}
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for information about a stream template.
+func (s *Server) jsTemplateInfoRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamTemplateInfoResponse{ApiResponse: ApiResponse{Type: JSApiStreamTemplateInfoResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	name := templateNameFromSubject(subject)
+	t, err := acc.LookupStreamTemplate(name)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	t.mu.Lock()
+	cfg := t.StreamTemplateConfig.deepCopy()
+	streams := t.streams
+	if streams == nil {
+		streams = []string{}
+	}
+	t.mu.Unlock()
+
+	resp.StreamTemplateInfo = &StreamTemplateInfo{Config: cfg, Streams: streams}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to delete a stream template.
+func (s *Server) jsTemplateDeleteRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamTemplateDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamTemplateDeleteResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	name := templateNameFromSubject(subject)
+	err = acc.DeleteStreamTemplate(name)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+func (s *Server) jsonResponse(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.Warnf("Problem marshaling JSON for JetStream API:", err)
+		return ""
+	}
+	return string(b)
+}
+
+func jsError(err error) *ApiError {
+	return &ApiError{
+		Code:        500,
+		Description: err.Error(),
+	}
+}
+
+func jsNotFoundError(err error) *ApiError {
+	return &ApiError{
+		Code:        404,
+		Description: err.Error(),
+	}
+}
+
+// Request to create a stream.
+func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("create stream %q", streamNameFromSubject(subject)))
+
+	var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var cfg StreamConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	streamName := streamNameFromSubject(subject)
+	if streamName != cfg.Name {
+		resp.Error = jsStreamMismatchErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamRequest(ci, subject, reply, rmsg, &cfg)
+		return
+	}
+
+	mset, err := acc.AddStream(&cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to update a stream.
+func (s *Server) jsStreamUpdateRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("update stream %q", streamNameFromSubject(subject)))
+
+	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var cfg StreamConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	streamName := streamNameFromSubject(subject)
+	if streamName != cfg.Name {
+		resp.Error = jsStreamMismatchErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamUpdateRequest(ci, subject, reply, rmsg, &cfg)
+		return
+	}
+
+	mset, err := acc.LookupStream(streamName)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if err := mset.Update(&cfg); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Cluster: s.clusterInfo(mset.raftNode())}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for the list of all stream names.
+func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamNamesResponse{ApiResponse: ApiResponse{Type: JSApiStreamNamesResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var offset int
+	var filter string
+
+	if !isEmptyRequest(msg) {
+		var req JSApiStreamNamesRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		offset = req.Offset
+		if req.Subject != _EMPTY_ {
+			filter = req.Subject
+		}
+	}
+
+	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
+	// TODO(dlc) - If this list is long maybe do this in a Go routine?
+	var numStreams int
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			// TODO(dlc) - Debug or Warn?
+			return
+		}
+		js.mu.RLock()
+		for stream, sa := range cc.streams[acc.Name] {
+			if sa.err == ErrJetStreamNotAssigned {
+				continue
+			}
+			if filter != _EMPTY_ {
+				// These could not have subjects auto-filled in since they are raw and unprocessed.
+				if len(sa.Config.Subjects) == 0 {
+					if SubjectsCollide(filter, sa.Config.Name) {
+						resp.Streams = append(resp.Streams, stream)
+					}
+				} else {
+					for _, subj := range sa.Config.Subjects {
+						if SubjectsCollide(filter, subj) {
+							resp.Streams = append(resp.Streams, stream)
+							break
+						}
+					}
+				}
+			} else {
+				resp.Streams = append(resp.Streams, stream)
+			}
+		}
+		js.mu.RUnlock()
+		if len(resp.Streams) > 1 {
+			sort.Slice(resp.Streams, func(i, j int) bool { return strings.Compare(resp.Streams[i], resp.Streams[j]) < 0 })
+		}
+		numStreams = len(resp.Streams)
+		if offset > numStreams {
+			offset = numStreams
+			resp.Streams = resp.Streams[:offset]
+		}
+	} else {
+		msets := acc.filteredStreams(filter)
+		// Since we page results order matters.
+		if len(msets) > 1 {
+			sort.Slice(msets, func(i, j int) bool {
+				return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
+			})
+		}
+
+		numStreams = len(msets)
+		if offset > numStreams {
+			offset = numStreams
+		}
+
+		for _, mset := range msets[offset:] {
+			resp.Streams = append(resp.Streams, mset.config.Name)
+			if len(resp.Streams) >= JSApiNamesLimit {
+				break
+			}
+		}
+	}
+	resp.Total = numStreams
+	resp.Limit = JSApiNamesLimit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for the list of all detailed stream info.
+// TODO(dlc) - combine with above long term
+func (s *Server) jsStreamListRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamListResponse{
+		ApiResponse: ApiResponse{Type: JSApiStreamListResponseType},
+		Streams:     []*StreamInfo{},
+	}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	offset, limit := 0, JSApiListLimit
+	if !isEmptyRequest(msg) {
+		var req JSApiStreamNamesRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		offset, limit = req.Offset, req.listLimit()
+	}
+
+	// Clustered mode will invoke a scatter and gather.
+	if s.JetStreamIsClustered() {
+		// Need to copy these off before sending..
+		msg = append(msg[:0:0], msg...)
+		s.startGoRoutine(func() { s.jsClusteredStreamListRequest(acc, ci, offset, limit, subject, reply, msg) })
+		return
+	}
+
+	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
+	// TODO(dlc) - If this list is long maybe do this in a Go routine?
+	msets := acc.Streams()
+	sort.Slice(msets, func(i, j int) bool {
+		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
+	})
+
+	scnt := len(msets)
+	if offset > scnt {
+		offset = scnt
+	}
+
+	for _, mset := range msets[offset:] {
+		resp.Streams = append(resp.Streams, &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()})
+		if len(resp.Streams) >= limit {
+			break
+		}
+	}
+	resp.Total = scnt
+	resp.Limit = limit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for information about a stream.
+func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	name := streamNameFromSubject(subject)
+
+	var resp = JSApiStreamInfoResponse{ApiResponse: ApiResponse{Type: JSApiStreamInfoResponseType}}
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() {
+		// Check to make sure the stream is assigned.
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, name)
+		js.mu.RUnlock()
+
+		if isLeader && sa == nil {
+			// We can't find the stream, so mimic what would be the errors below.
+			if !acc.JetStreamEnabled() {
+				resp.Error = jsNotEnabledErr
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			// No stream present.
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the stream assigned and a leader, so only the stream leader should answer.
+		if !acc.JetStreamIsStreamLeader(name) {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.LookupStream(name)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	config := mset.Config()
+	// Some streams are created without subject (for instance MQTT streams),
+	// but "nats" tooling would then fail to display them since it uses
+	// validation and expect the config's Subjects to not be empty.
+	if config.allowNoSubject && len(config.Subjects) == 0 {
+		config.Subjects = []string{">"}
+	}
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: config, Cluster: s.clusterInfo(mset.raftNode())}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+func isEmptyRequest(req []byte) bool {
+	if len(req) == 0 {
+		return true
+	}
+	if bytes.Equal(req, []byte("{}")) {
+		return true
+	}
+	// If we are here we didn't get our simple match, but still could be valid.
+	var v interface{}
+	if err := json.Unmarshal(req, &v); err != nil {
+		return false
+	}
+	vm, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	return len(vm) == 0
+}
+
+// Request to delete a stream.
+func (s *Server) jsStreamDeleteRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("delete stream %q", streamNameFromSubject(subject)))
+
+	var resp = JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	stream := streamNameFromSubject(subject)
+
+	// Clustered.
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamDeleteRequest(ci, stream, reply, msg)
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if mset.Config().internal {
+		resp.Error = &ApiError{Code: 403, Description: "not allowed to delete internal stream"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if mset.Config().DenyDelete {
+		resp.Error = &ApiError{Code: 403, Description: ErrJetStreamStreamDeleteDenied.Error()}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if err := mset.Delete(); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to delete a message.
+// This expects a stream sequence number as the msg body.
+func (s *Server) jsMsgDeleteRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	stream := tokenAt(subject, 6)
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("delete message from stream %q", stream))
+
+	var resp = JSApiMsgDeleteResponse{ApiResponse: ApiResponse{Type: JSApiMsgDeleteResponseType}}
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() {
+		// Check to make sure the stream is assigned.
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+		js.mu.RUnlock()
+
+		if isLeader && sa == nil {
+			// We can't find the stream, so mimic what would be the errors below.
+			if !acc.JetStreamEnabled() {
+				resp.Error = jsNotEnabledErr
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			// No stream present.
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the stream assigned and a leader, so only the stream leader should answer.
+		if !acc.JetStreamIsStreamLeader(stream) {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiMsgDeleteRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredMsgDeleteRequest(ci, stream, subject, reply, req.Seq, rmsg)
+		return
+	}
+
+	removed, err := mset.EraseMsg(req.Seq)
+	if err != nil {
+		resp.Error = jsError(err)
+	} else if !removed {
+		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("sequence [%d] not found", req.Seq)}
+	} else {
+		resp.Success = true
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to get a raw stream message.
+func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiMsgGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	stream := tokenAt(subject, 6)
+
+	// If we are in clustered mode the stream leader will serve the read.
+	if s.JetStreamIsClustered() {
+		s.jsClusteredMsgGetRequest(ci, acc, stream, subject, reply, req.Seq, msg)
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	subj, hdr, msg, ts, err := mset.store.LoadMsg(req.Seq)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Message = &StoredMsg{
+		Subject:  subj,
+		Sequence: req.Seq,
+		Header:   hdr,
+		Data:     msg,
+		Time:     time.Unix(0, ts),
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to get the last sequence stored for a subject.
+func (s *Server) jsStreamLastSeqRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamLastSeqResponse{ApiResponse: ApiResponse{Type: JSApiStreamLastSeqResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiStreamLastSeqRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !subjectIsLiteral(req.Subject) {
+		resp.Error = &ApiError{Code: 400, Description: "subject must be a literal"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+
+	// If we are in clustered mode the stream leader will serve the read.
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamLastSeqRequest(ci, acc, stream, subject, reply, req.Subject, msg)
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Subject, resp.Seq = req.Subject, mset.LastSeqForSubject(req.Subject)
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to purge a stream.
+func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("purge stream %q", stream))
+
+	var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() {
+		// Check to make sure the stream is assigned.
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+		js.mu.RUnlock()
+
+		if isLeader && sa == nil {
+			// We can't find the stream, so mimic what would be the errors below.
+			if !acc.JetStreamEnabled() {
+				resp.Error = jsNotEnabledErr
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			// No stream present.
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the stream assigned and a leader, so only the stream leader should answer.
+		if !acc.JetStreamIsStreamLeader(stream) {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamPurgeRequest(ci, stream, subject, reply, rmsg)
+		return
+	}
+	if mset.Config().DenyPurge {
+		resp.Error = &ApiError{Code: 403, Description: ErrJetStreamStreamPurgeDenied.Error()}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	purged, err := mset.Purge()
+	if err != nil {
+		resp.Error = jsError(err)
+	} else {
+		resp.Purged = purged
+		resp.Success = true
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to restore a stream.
+func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("restore stream %q", streamNameFromSubject(subject)))
+	if !s.JetStreamIsLeader() {
+		return
+	}
+
+	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamRestoreRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamRestoreRequest(ci, acc, &req, stream, subject, reply, rmsg)
+		return
+	}
+
+	if _, err := acc.LookupStream(stream); err == nil {
+		resp.Error = jsError(ErrJetStreamStreamAlreadyUsed)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	s.processStreamRestore(ci, acc, stream, subject, reply, string(msg))
+}
+
+func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, stream, subject, reply, msg string) <-chan error {
+	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
+
+	// FIXME(dlc) - Need to close these up if we fail for some reason.
+	// TODO(dlc) - Might need to make configurable or stream direct to storage dir.
+	tfile, err := ioutil.TempFile("", "jetstream-restore-")
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: "JetStream unable to open temp storage for restore"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return nil
+	}
+
+	s.Noticef("Starting restore for stream '%s > %s'", acc.Name, stream)
+
+	start := time.Now()
+
+	s.publishAdvisory(acc, JSAdvisoryStreamRestoreCreatePre+"."+stream, &JSRestoreCreateAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSRestoreCreateAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream: stream,
+		Client: ci,
+	})
+
+	// Create our internal subscription to accept the snapshot.
+	restoreSubj := fmt.Sprintf(jsRestoreDeliverT, stream, nuid.Next())
+
+	type result struct {
+		err   error
+		reply string
+	}
+
+	// For signaling to upper layers.
+	resultCh := make(chan result, 8)
+	activeCh := make(chan int, 32)
+	// Signals our restore Go routine with the reply for the last chunk.
+	restoreCh := make(chan string, 1)
+	qch := make(chan struct{})
+
+	processChunk := func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		// We require reply subjects to communicate back failures, flow etc. If they do not have one log and cancel.
+		if reply == _EMPTY_ {
+			sub.client.processUnsub(sub.sid)
+			resultCh <- result{
+				fmt.Errorf("restore for stream '%s > %s' requires reply subject for each chunk", acc.Name, stream),
+				reply,
+			}
+			return
+		}
+		// Account client messages have \r\n on end. This is an error.
+		if len(msg) < LEN_CR_LF {
+			resultCh <- result{
+				fmt.Errorf("restore for stream '%s > %s' received short chunk", acc.Name, stream),
+				reply,
+			}
+			return
+		}
+		// Adjust.
+		msg = msg[:len(msg)-LEN_CR_LF]
+
+		// This means we are complete with our transfer from the client.
+		if len(msg) == 0 {
+			select {
+			case restoreCh <- reply:
+			default:
+			}
+			return
+		}
+
+		// Append chunk to temp file. Mark as issue if we encounter an error.
+		if n, err := tfile.Write(msg); n != len(msg) || err != nil {
+			resultCh <- result{err, reply}
+			if reply != _EMPTY_ {
+				s.sendInternalAccountMsg(acc, reply, "-ERR 'storage failure during restore'")
+			}
+			return
+		}
+
+		activeCh <- len(msg)
+		s.sendInternalAccountMsg(acc, reply, nil)
+	}
+
+	sub, err := acc.subscribeInternal(restoreSubj, processChunk)
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: "JetStream unable to subscribe to restore snapshot"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return nil
+	}
+
+	// Mark the subject so the end user knows where to send the snapshot chunks.
+	resp.DeliverSubject = restoreSubj
+	s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+
+	doneCh := make(chan error, 1)
+
+	// The restore itself runs in its own Go routine so pacing it does not hold up our subscription.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		var reply string
+		select {
+		case reply = <-restoreCh:
+		case <-qch:
+			return
+		case <-s.quitCh:
+			return
+		}
+		tfile.Seek(0, 0)
+		var r io.Reader = tfile
+		// Pace the restore if we have been configured to do so.
+		if rl := newCatchupLimiter(s.getOpts().MaxRestoreRate); rl != nil {
+			r = &restoreReader{r: tfile, rl: rl, activeCh: activeCh, qch: qch}
+		}
+		_, err := acc.RestoreStream(stream, r)
+		resultCh <- result{err, reply}
+	})
+
+	// Monitor the progress from another Go routine.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer func() {
+			close(qch)
+			tfile.Close()
+			os.Remove(tfile.Name())
+			sub.client.processUnsub(sub.sid)
+		}()
+
+		const activityInterval = 2 * time.Second
+		notActive := time.NewTimer(activityInterval)
+		defer notActive.Stop()
+
+		total := 0
+		for {
+			select {
+			case result := <-resultCh:
+				end := time.Now()
+
+				// TODO(rip) - Should this have the error code in it??
+				s.publishAdvisory(acc, JSAdvisoryStreamRestoreCompletePre+"."+stream, &JSRestoreCompleteAdvisory{
+					TypedEvent: TypedEvent{
+						Type: JSRestoreCompleteAdvisoryType,
+						ID:   nuid.Next(),
+						Time: time.Now().UTC(),
+					},
+					Stream: stream,
+					Start:  start.UTC(),
+					End:    end.UTC(),
+					Bytes:  int64(total),
+					Client: ci,
+				})
+
+				var mset *Stream
+				var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+
+				err := result.err
+				if err == nil {
+					mset, err = acc.LookupStream(stream)
+				}
+				if err != nil {
+					resp.Error = jsError(err)
+					s.Warnf("Restore failed for %s for stream '%s > %s' in %v",
+						FriendlyBytes(int64(total)), stream, acc.Name, end.Sub(start))
+				} else {
+					resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+					s.Noticef("Completed restore of %s for stream '%s > %s' in %v",
+						FriendlyBytes(int64(total)), stream, acc.Name, end.Sub(start))
+				}
+
+				// On the last EOF, send back the stream info or error status.
+				s.sendInternalAccountMsg(acc, result.reply, s.jsonResponse(&resp))
+				// Signal to the upper layers.
+				doneCh <- err
+				return
+			case n := <-activeCh:
+				total += n
+				notActive.Reset(activityInterval)
+			case <-notActive.C:
+				err := fmt.Errorf("restore for stream '%s > %s' is stalled", acc, stream)
+				s.Warnf(err.Error())
+				doneCh <- err
+				return
+			}
+		}
+	})
+
+	return doneCh
+}
+
+// restoreReader will rate limit reads of a restore snapshot.
+// It also signals activity while waiting so the restore is not considered stalled.
+// This is only used from the restore's own Go routine.
+type restoreReader struct {
+	r        io.Reader
+	rl       *catchupLimiter
+	activeCh chan int
+	qch      chan struct{}
+}
+
+func (rr *restoreReader) Read(p []byte) (int, error) {
+	for d := rr.rl.wait(); d > 0; d = rr.rl.wait() {
+		select {
+		case rr.activeCh <- 0:
+		default:
+		}
+		select {
+		case <-time.After(d):
+		case <-rr.qch:
+			return 0, fmt.Errorf("restore cancelled")
+		}
+	}
+	// Do not read more than one second worth at a time.
+	if int64(len(p)) > rr.rl.rate {
+		p = p[:rr.rl.rate]
+	}
+	n, err := rr.r.Read(p)
+	rr.rl.take(int64(n))
+	return n, err
+}
+
+// Process a snapshot request.
+func (s *Server) jsStreamSnapshotRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	smsg := string(msg)
+	stream := streamNameFromSubject(subject)
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() && !acc.JetStreamIsStreamLeader(stream) {
+		return
+	}
+
+	var resp = JSApiStreamSnapshotResponse{ApiResponse: ApiResponse{Type: JSApiStreamSnapshotResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	var req JSApiStreamSnapshotRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+	if !IsValidSubject(req.DeliverSubject) {
+		resp.Error = &ApiError{Code: 400, Description: "deliver subject not valid"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+		return
+	}
+
+	// We will do the snapshot in a go routine as well since check msgs may
+	// stall this go routine.
+	go func() {
+		if req.CheckMsgs {
+			s.Noticef("Starting health check and snapshot for stream '%s > %s'", mset.jsa.account.Name, mset.Name())
+		} else {
+			s.Noticef("Starting snapshot for stream '%s > %s'", mset.jsa.account.Name, mset.Name())
+		}
+
+		start := time.Now()
+
+		sr, err := mset.Snapshot(0, req.CheckMsgs, !req.NoConsumers)
+		if err != nil {
+			s.Warnf("Snapshot of stream '%s > %s' failed: %v", mset.jsa.account.Name, mset.Name(), err)
+			resp.Error = jsError(err)
+			s.sendAPIErrResponse(ci, acc, subject, reply, smsg, s.jsonResponse(&resp))
+			return
+		}
+
+		config := mset.Config()
+		resp.State = &sr.State
+		resp.Config = &config
+
+		s.sendAPIResponse(ci, acc, subject, reply, smsg, s.jsonResponse(resp))
+
+		s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCreatePre+"."+mset.Name(), &JSSnapshotCreateAdvisory{
+			TypedEvent: TypedEvent{
+				Type: JSSnapshotCreatedAdvisoryType,
+				ID:   nuid.Next(),
+				Time: time.Now().UTC(),
+			},
+			Stream: mset.Name(),
+			State:  sr.State,
+			Client: ci,
+		})
+
+		// Now do the real streaming.
+		s.streamSnapshot(ci, acc, mset, sr, &req)
+
+		end := time.Now()
+
+		s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCompletePre+"."+mset.Name(), &JSSnapshotCompleteAdvisory{
+			TypedEvent: TypedEvent{
+				Type: JSSnapshotCompleteAdvisoryType,
+				ID:   nuid.Next(),
+				Time: time.Now().UTC(),
+			},
+			Stream: mset.Name(),
+			Start:  start.UTC(),
+			End:    end.UTC(),
+			Client: ci,
+		})
+
+		s.Noticef("Completed snapshot of %s for stream '%s > %s' in %v",
+			FriendlyBytes(int64(sr.State.Bytes)),
+			mset.jsa.account.Name,
+			mset.Name(),
+			end.Sub(start))
+	}()
+}
+
+// Default chunk size for now.
+const defaultSnapshotChunkSize = 128 * 1024
+const defaultSnapshotWindowSize = 16 * 1024 * 1024 // 16MB
+
+// streamSnapshot will stream out our snapshot to the reply subject.
+func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *Stream, sr *SnapshotResult, req *JSApiStreamSnapshotRequest) {
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+	// Setup for the chunk stream.
+	reply := req.DeliverSubject
+	r := sr.Reader
+	defer r.Close()
+
+	// Check interest for the snapshot deliver subject.
+	inch := make(chan bool, 1)
+	acc.sl.RegisterNotification(req.DeliverSubject, inch)
+	defer acc.sl.ClearNotification(req.DeliverSubject, inch)
+	hasInterest := <-inch
+	if !hasInterest {
+		// Allow 2 seconds or so for interest to show up.
+		select {
+		case <-inch:
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	// Create our ack flow handler.
+	// This is very simple for now.
+	acks := make(chan struct{}, 1)
+	acks <- struct{}{}
+
+	// Track bytes outstanding.
+	var out int32
+
+	// We will place sequence number and size of chunk sent in the reply.
+	ackSubj := fmt.Sprintf(jsSnapshotAckT, mset.Name(), nuid.Next())
+	ackSub, _ := mset.subscribeInternalUnlocked(ackSubj+".>", func(_ *subscription, _ *client, subject, _ string, _ []byte) {
+		// This is very crude and simple, but ok for now.
+		// This only matters when sending multiple chunks.
+		if atomic.LoadInt32(&out) > defaultSnapshotWindowSize {
+			acks <- struct{}{}
+		}
+		cs, _ := strconv.Atoi(tokenAt(subject, 6))
+		atomic.AddInt32(&out, int32(-cs))
+	})
+	defer mset.unsubscribeUnlocked(ackSub)
+
+	// TODO(dlc) - Add in NATS-Chunked-Sequence header
+
+	for index := 1; ; index++ {
+		chunk := make([]byte, chunkSize)
+		n, err := r.Read(chunk)
+		chunk = chunk[:n]
+		if err != nil {
+			if n > 0 {
+				mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, chunk, nil, 0}
+			}
+			break
+		}
+
+		// Wait on acks for flow control if past our window size.
+		// Wait up to 1ms for now if no acks received.
+		if atomic.LoadInt32(&out) > defaultSnapshotWindowSize {
+			select {
+			case <-acks:
+			case <-inch: // Lost interest
+				goto done
+			case <-time.After(time.Millisecond):
+			}
+		}
+		// TODO(dlc) - Might want these moved off sendq if we have contention.
+		ackReply := fmt.Sprintf("%s.%d.%d", ackSubj, len(chunk), index)
+		mset.sendq <- &jsPubMsg{reply, _EMPTY_, ackReply, nil, chunk, nil, 0}
+		atomic.AddInt32(&out, int32(len(chunk)))
+	}
+done:
+	// Send last EOF
+	// TODO(dlc) - place hash in header
+	mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, nil, nil, 0}
+}
+
+// Request to create a durable consumer.
+func (s *Server) jsDurableCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	s.jsConsumerCreate(sub, c, subject, reply, msg, true)
+}
+
+// Request to create a consumer.
+func (s *Server) jsConsumerCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	s.jsConsumerCreate(sub, c, subject, reply, msg, false)
+}
+
+func (s *Server) jsConsumerCreate(sub *subscription, c *client, subject, reply string, rmsg []byte, expectDurable bool) {
+	if c == nil {
+		return
+	}
+
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("create consumer on stream %q", streamNameFromSubject(subject)))
+
+	var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	var streamName string
+	if expectDurable {
+		streamName = tokenAt(subject, 6)
+	} else {
+		streamName = tokenAt(subject, 5)
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req CreateConsumerRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if streamName != req.Stream {
+		resp.Error = jsStreamMismatchErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if expectDurable {
+		if numTokens(subject) != 7 {
+			resp.Error = &ApiError{Code: 400, Description: "consumer expected to be durable but no durable name set in subject"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Now check on requirements for durable request.
+		if req.Config.Durable == _EMPTY_ {
+			resp.Error = &ApiError{Code: 400, Description: "consumer expected to be durable but a durable name was not set"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		consumerName := tokenAt(subject, 7)
+		if consumerName != req.Config.Durable {
+			resp.Error = &ApiError{Code: 400, Description: "consumer name in subject does not match durable name in request"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	} else {
+		if numTokens(subject) != 5 {
+			resp.Error = &ApiError{Code: 400, Description: "consumer expected to be ephemeral but detected a durable name set in subject"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if req.Config.Durable != _EMPTY_ {
+			resp.Error = &ApiError{Code: 400, Description: "consumer expected to be ephemeral but a durable name was set in request"}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerRequest(ci, subject, reply, rmsg, req.Stream, &req.Config)
+		return
+	}
+
+	stream, err := acc.LookupStream(req.Stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	o, err := stream.AddConsumer(&req.Config)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ConsumerInfo = o.Info()
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for the list of all consumer names.
+func (s *Server) jsConsumerNamesRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerNamesResponse{
+		ApiResponse: ApiResponse{Type: JSApiConsumerNamesResponseType},
+		Consumers:   []string{},
+	}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var offset int
+	if !isEmptyRequest(msg) {
+		var req JSApiConsumersRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		offset = req.Offset
+	}
+
+	streamName := streamNameFromSubject(subject)
+	var numConsumers int
+
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			// TODO(dlc) - Debug or Warn?
+			return
+		}
+		js.mu.RLock()
+		sas := cc.streams[acc.Name]
+		if sas == nil {
+			js.mu.RUnlock()
+			resp.Error = jsNotFoundError(ErrJetStreamNotEnabled)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		sa := sas[streamName]
+		if sa == nil || sa.err != nil {
+			js.mu.RUnlock()
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		for consumer := range sa.consumers {
+			resp.Consumers = append(resp.Consumers, consumer)
+		}
+		if len(resp.Consumers) > 1 {
+			sort.Slice(resp.Consumers, func(i, j int) bool { return strings.Compare(resp.Consumers[i], resp.Consumers[j]) < 0 })
+		}
+		numConsumers = len(resp.Consumers)
+		if offset > numConsumers {
+			offset = numConsumers
+			resp.Consumers = resp.Consumers[:offset]
+		}
+		js.mu.RUnlock()
+
+	} else {
+		mset, err := acc.LookupStream(streamName)
+		if err != nil {
+			resp.Error = jsNotFoundError(err)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		obs := mset.Consumers()
+		sort.Slice(obs, func(i, j int) bool {
+			return strings.Compare(obs[i].name, obs[j].name) < 0
+		})
+
+		numConsumers = len(obs)
+		if offset > numConsumers {
+			offset = numConsumers
+		}
+
+		for _, o := range obs[offset:] {
+			resp.Consumers = append(resp.Consumers, o.Name())
+			if len(resp.Consumers) >= JSApiNamesLimit {
+				break
+			}
+		}
+	}
+	resp.Total = numConsumers
+	resp.Limit = JSApiNamesLimit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for the list of all detailed consumer information.
+func (s *Server) jsConsumerListRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerListResponse{
+		ApiResponse: ApiResponse{Type: JSApiConsumerListResponseType},
+		Consumers:   []*ConsumerInfo{},
+	}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	offset, limit := 0, JSApiListLimit
+	if !isEmptyRequest(msg) {
+		var req JSApiConsumersRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		offset, limit = req.Offset, req.listLimit()
+	}
+
+	streamName := streamNameFromSubject(subject)
+
+	// Clustered mode will invoke a scatter and gather.
+	if s.JetStreamIsClustered() {
+		msg = append(msg[:0:0], msg...)
+		s.startGoRoutine(func() {
+			s.jsClusteredConsumerListRequest(acc, ci, offset, limit, streamName, subject, reply, msg)
+		})
+		return
+	}
+
+	mset, err := acc.LookupStream(streamName)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	obs := mset.Consumers()
+	sort.Slice(obs, func(i, j int) bool {
+		return strings.Compare(obs[i].name, obs[j].name) < 0
+	})
+
+	ocnt := len(obs)
+	if offset > ocnt {
+		offset = ocnt
+	}
+
+	for _, o := range obs[offset:] {
+		resp.Consumers = append(resp.Consumers, o.Info())
+		if len(resp.Consumers) >= limit {
+			break
+		}
+	}
+	resp.Total = ocnt
+	resp.Limit = limit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for information about an consumer.
+func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	var resp = JSApiConsumerInfoResponse{ApiResponse: ApiResponse{Type: JSApiConsumerInfoResponseType}}
+
+	// If we are in clustered mode we need to be the stream leader to proceed.
+	if s.JetStreamIsClustered() {
+		// Check to make sure the consumer is assigned.
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader, sa, ca := cc.isLeader(), js.streamAssignment(acc.Name, stream), js.consumerAssignment(acc.Name, stream, consumer)
+		js.mu.RUnlock()
+
+		if isLeader && ca == nil {
+			// We can't find the consumer, so mimic what would be the errors below.
+			if !acc.JetStreamEnabled() {
+				resp.Error = jsNotEnabledErr
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			if sa == nil {
+				resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				return
+			}
+			// If we are here the consumer is not present.
+			resp.Error = jsNoConsumerErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if ca == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(ca.Group) {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the consumer assigned and a leader, so only the consumer leader should answer.
+		if !acc.JetStreamIsConsumerLeader(stream, consumer) {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	obs := mset.LookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = jsNoConsumerErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ConsumerInfo = obs.Info()
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to delete an Consumer.
+func (s *Server) jsConsumerDeleteRequest(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+	if c == nil {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	s.auditClusteredRequest(ci, acc, subject, string(msg), fmt.Sprintf("delete consumer %q on stream %q", consumerNameFromSubject(subject), streamNameFromSubject(subject)))
+
+	var resp = JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if cc.meta != nil && cc.meta.GroupLeader() == _EMPTY_ {
+			resp.Error = jsClusterNotAvailErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerDeleteRequest(ci, stream, consumer, subject, reply, rmsg)
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if mset.Config().internal {
+		resp.Error = &ApiError{Code: 403, Description: "not allowed to delete consumer of internal stream"}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	obs := mset.LookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = jsNoConsumerErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := obs.Delete(); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// sendJetStreamAPIAuditAdvisor will send the audit event for a given event.
+func (s *Server) sendJetStreamAPIAuditAdvisory(ci *ClientInfo, acc *Account, subject, request, response, action string) {
+	s.publishAdvisory(acc, JSAuditAdvisory, JSAPIAudit{
+		TypedEvent: TypedEvent{
+			Type: JSAPIAuditType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Server:   s.Name(),
+		Client:   ci,
+		Subject:  subject,
+		Request:  request,
+		Response: response,
+		Action:   action,
+	})
+}
@@ -0,0 +1,6398 @@
+// Copyright 2020-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nuid"
+)
+
+// jetStreamCluster holds information about the meta group and stream assignments.
+type jetStreamCluster struct {
+	// The metacontroller raftNode.
+	meta RaftNode
+	// For stream and consumer assignments. All servers will have this be the same.
+	// ACC -> STREAM -> Stream Assignment -> Consumers
+	streams map[string]map[string]*streamAssignment
+	// Server.
+	s *Server
+	// Internal client.
+	c *client
+	// Processing assignment results.
+	streamResults   *subscription
+	consumerResults *subscription
+	// Peers that recently reported hitting their raft group limit.
+	full map[string]time.Time
+}
+
+// Define types of the entry.
+type entryOp uint8
+
+const (
+	// Meta ops.
+	assignStreamOp entryOp = iota
+	assignConsumerOp
+	removeStreamOp
+	removeConsumerOp
+	// Stream ops.
+	streamMsgOp
+	purgeStreamOp
+	deleteMsgOp
+	// Consumer ops
+	updateDeliveredOp
+	updateAcksOp
+	// Compressed consumer assignments.
+	assignCompressedConsumerOp
+	// Consumer state checkpoint.
+	updateCheckpointOp
+	// Stream updates.
+	updateStreamOp
+	streamConfigOp
+	// Consumer pause and resume.
+	pauseConsumerOp
+	// Stream republish checkpoint.
+	rePublishedOp
+	// Consumer filter subject updates.
+	updateFilterOp
+	// Consumer messages moved to the dead letter subject.
+	deadLetterOp
+	// Consumer starting sequence resolved from a start time.
+	startSeqOp
+	// Stream messages expired by age, proposed by the leader.
+	expireMsgsOp
+	// Stream write pause and resume.
+	pauseWritesOp
+	// Consumer leader barrier, a new leader waits for it to be applied before delivering.
+	leaderSyncOp
+	// Stream messages below every consumer's ack floor, proposed by the leader.
+	ackFloorOp
+	// Consumer header filter updates.
+	updateHeaderFilterOp
+	// Request from a replica with corrupt state for the leader to snapshot.
+	snapshotRequestOp
+	// Consumer messages skipped by a header filter.
+	updateSkippedOp
+	// Stream floor below which sequences are never stored, proposed by the leader after a purge.
+	minRetainedSeqOp
+)
+
+// raftGroups are controlled by the metagroup controller.
+// The raftGroups will house streams and consumers.
+type raftGroup struct {
+	Name      string      `json:"name"`
+	Peers     []string    `json:"peers"`
+	Storage   StorageType `json:"store"`
+	Preferred string      `json:"preferred,omitempty"`
+	// WriteQuorum if set is how many peers need to store an entry to commit it.
+	WriteQuorum int `json:"write_quorum,omitempty"`
+	// Internal
+	node RaftNode
+}
+
+// streamAssignment is what the meta controller uses to assign streams to peers.
+type streamAssignment struct {
+	Client  *ClientInfo   `json:"client,omitempty"`
+	Created time.Time     `json:"created"`
+	Config  *StreamConfig `json:"stream"`
+	Group   *raftGroup    `json:"group"`
+	Sync    string        `json:"sync"`
+	Reply   string        `json:"reply"`
+	Restore *StreamState  `json:"restore_state,omitempty"`
+	// Internal
+	consumers  map[string]*consumerAssignment
+	responded  bool
+	recovering bool
+	err        error
+}
+
+// consumerAssignment is what the meta controller uses to assign consumers to streams.
+type consumerAssignment struct {
+	Client  *ClientInfo     `json:"client,omitempty"`
+	Created time.Time       `json:"created"`
+	Name    string          `json:"name"`
+	Stream  string          `json:"stream"`
+	Config  *ConsumerConfig `json:"consumer"`
+	Group   *raftGroup      `json:"group"`
+	Reply   string          `json:"reply"`
+	State   *ConsumerState  `json:"state,omitempty"`
+	// Internal
+	responded bool
+	err       error
+}
+
+// streamPurge is what the stream leader will replicate when purging a stream.
+type streamPurge struct {
+	Client *ClientInfo `json:"client,omitempty"`
+	Stream string      `json:"stream"`
+	Reply  string      `json:"reply"`
+}
+
+// streamConfigUpdate is what the stream leader will replicate when updating a stream's config.
+type streamConfigUpdate struct {
+	Client *ClientInfo   `json:"client,omitempty"`
+	Config *StreamConfig `json:"stream"`
+	Reply  string        `json:"reply"`
+}
+
+// streamMsgDelete is what the stream leader will replicate when deleting a message.
+// For compaction Newer is the sequence of a newer message on the same subject,
+// which must still exist when applied for the delete to happen.
+type streamMsgDelete struct {
+	Client  *ClientInfo `json:"client,omitempty"`
+	Stream  string      `json:"stream"`
+	Seq     uint64      `json:"seq"`
+	Newer   uint64      `json:"newer,omitempty"`
+	NoErase bool        `json:"no_erase,omitempty"`
+	Reply   string      `json:"reply"`
+}
+
+const (
+	defaultStoreDirName  = "_js_"
+	defaultMetaGroupName = "_meta_"
+	defaultMetaFSBlkSize = 64 * 1024
+)
+
+// For validating clusters.
+func validateJetStreamOptions(o *Options) error {
+	// If not clustered no checks.
+	if !o.JetStream || o.Cluster.Port == 0 {
+		return nil
+	}
+	if o.ServerName == _EMPTY_ {
+		return fmt.Errorf("jetstream cluster requires `server_name` to be set")
+	}
+	if o.Cluster.Name == _EMPTY_ {
+		return fmt.Errorf("jetstream cluster requires `cluster.name` to be set")
+	}
+	return nil
+}
+
+func (s *Server) getJetStreamCluster() (*jetStream, *jetStreamCluster) {
+	s.mu.Lock()
+	shutdown := s.shutdown
+	js := s.js
+	s.mu.Unlock()
+
+	if shutdown || js == nil {
+		return nil, nil
+	}
+
+	js.mu.RLock()
+	cc := js.cluster
+	js.mu.RUnlock()
+	if cc == nil {
+		return nil, nil
+	}
+	return js, cc
+}
+
+func (s *Server) JetStreamIsClustered() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	isClustered := js.cluster != nil
+	js.mu.RUnlock()
+	return isClustered
+}
+
+func (s *Server) JetStreamIsLeader() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.cluster.isLeader()
+}
+
+func (s *Server) JetStreamIsCurrent() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.cluster.isCurrent()
+}
+
+// How often we check our groups while waiting for them to be current.
+const waitCurrentInterval = 100 * time.Millisecond
+
+// JetStreamWaitCurrent will block until the meta group and every stream and consumer group assigned to this
+// server are current and not catching up. On timeout the error lists the groups that are still lagging.
+// Useful as a readiness check.
+func (s *Server) JetStreamWaitCurrent(timeout time.Duration) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		lagging := js.laggingGroups()
+		if len(lagging) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("jetstream not current after %v, lagging groups: %s", timeout, strings.Join(lagging, ", "))
+		}
+		select {
+		case <-time.After(waitCurrentInterval):
+		case <-s.quitCh:
+			return ErrServerNotRunning
+		}
+	}
+}
+
+// laggingGroups returns the names of our raft groups that are not current.
+func (js *jetStream) laggingGroups() []string {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	cc := js.cluster
+	if cc == nil {
+		return nil
+	}
+	var lagging []string
+	if !cc.isCurrent() {
+		lagging = append(lagging, defaultMetaGroupName)
+	}
+	ourID := cc.meta.ID()
+	for accName, asa := range cc.streams {
+		for streamName, sa := range asa {
+			if sa.Group.isMember(ourID) && !cc.isStreamCurrent(accName, streamName) {
+				lagging = append(lagging, sa.Group.Name)
+			}
+			for _, ca := range sa.consumers {
+				if rg := ca.Group; rg.isMember(ourID) && (rg.node == nil || !rg.node.Current()) {
+					lagging = append(lagging, rg.Name)
+				}
+			}
+		}
+	}
+	sort.Strings(lagging)
+	return lagging
+}
+
+func (s *Server) JetStreamSnapshotMeta() error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	cc := js.cluster
+	if !cc.isLeader() {
+		return errNotLeader
+	}
+	return cc.meta.Snapshot(js.metaSnapshot())
+}
+
+// ExportMetaState will write all stream and consumer assignments of the meta group to path.
+// This is a backup of the cluster topology only, no stream data is included.
+func (s *Server) ExportMetaState(path string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	// Write to a temp file first so a failed export does not leave a partial backup.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, js.metaSnapshot(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ImportMetaState will restore the stream and consumer assignments written by ExportMetaState.
+// This needs to be called on the meta leader of a cluster with no assignments. The assignments are
+// proposed, streams first, and every server including us applies them from the meta log.
+// If a proposal fails the error says how many were proposed before it.
+func (s *Server) ImportMetaState(path string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	wsas, err := decodeMetaSnapshot(buf)
+	if err != nil {
+		return err
+	}
+
+	js.mu.RLock()
+	isLeader, fresh, meta := cc.isLeader(), len(cc.streams) == 0, cc.meta
+	js.mu.RUnlock()
+	if !isLeader {
+		return errNotLeader
+	}
+	if !fresh {
+		return errMetaStateNotEmpty
+	}
+
+	// Our own state is only changed when these are applied, like any other assignment.
+	// All streams are proposed before any consumers so every server can place them.
+	var entries [][]byte
+	for _, wsa := range wsas {
+		sa := &streamAssignment{Client: wsa.Client, Created: wsa.Created, Config: wsa.Config, Group: wsa.Group, Sync: wsa.Sync}
+		entries = append(entries, encodeAddStreamAssignment(sa))
+	}
+	for _, wsa := range wsas {
+		for _, ca := range wsa.Consumers {
+			entries = append(entries, encodeAddConsumerAssignment(ca))
+		}
+	}
+	for i, entry := range entries {
+		if err := meta.Propose(entry); err != nil {
+			return fmt.Errorf("meta state import proposed %d of %d assignments: %v", i, len(entries), err)
+		}
+	}
+	return nil
+}
+
+var errMetaStateNotEmpty = errors.New("meta state import requires no existing assignments")
+
+// JetStreamForceMetaElection will have this server campaign for leadership of the meta group.
+// This is a safety valve for a wedged cluster and is refused if the meta group has a leader.
+func (s *Server) JetStreamForceMetaElection() error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	js.mu.RLock()
+	meta := cc.meta
+	js.mu.RUnlock()
+
+	if meta == nil {
+		return ErrJetStreamNotClustered
+	}
+	if meta.GroupLeader() != noLeader {
+		return ErrJetStreamMetaLeaderExists
+	}
+	s.Warnf("JetStream cluster forcing meta group election")
+	return meta.Campaign()
+}
+
+// RecoverRaftPeers will rewrite the peer state for the named raft group from the supplied peers.
+// This allows a server that has lost its peer state to rejoin the group. The group can not be running.
+func (s *Server) RecoverRaftPeers(group string, peers []string) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	sysAcc := s.SystemAccount()
+	if sysAcc == nil {
+		return ErrNoSysAccount
+	}
+	js.mu.RLock()
+	stateDir := path.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, group)
+	js.mu.RUnlock()
+
+	if _, err := os.Stat(stateDir); err != nil {
+		return err
+	}
+	return s.recoverPeerState(stateDir, group, peers)
+}
+
+// RaftGroupOwner will return the account, stream and consumer, if any, that own the named raft group.
+// Useful for mapping group names seen in the logs back to assets.
+func (s *Server) RaftGroupOwner(group string) (account, stream, consumer string, ok bool) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return _EMPTY_, _EMPTY_, _EMPTY_, false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	for accName, asa := range cc.streams {
+		for streamName, sa := range asa {
+			if sa.Group != nil && sa.Group.Name == group {
+				return accName, streamName, _EMPTY_, true
+			}
+			for consumerName, ca := range sa.consumers {
+				if ca.Group != nil && ca.Group.Name == group {
+					return accName, streamName, consumerName, true
+				}
+			}
+		}
+	}
+	return _EMPTY_, _EMPTY_, _EMPTY_, false
+}
+
+// DeleteRaftGroup will stop and delete the named raft group and its state on this server.
+// This is for manually cleaning up orphans, so we refuse if any stream or consumer assignment still owns the group.
+func (s *Server) DeleteRaftGroup(group string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	if group == defaultMetaGroupName {
+		return ErrJetStreamRaftGroupInUse
+	}
+	if _, _, _, ok := s.RaftGroupOwner(group); ok {
+		return ErrJetStreamRaftGroupInUse
+	}
+	node := s.lookupRaftNode(group)
+	if node == nil {
+		return errUnknownGroup
+	}
+	s.Warnf("JetStream cluster deleting raft group %q", group)
+	node.Delete()
+	return nil
+}
+
+// JetStreamTransferStreamLeader will have the stream leader hand leadership to the target peer,
+// which can be given as a peer ID or server name. The target needs to be a current member.
+func (s *Server) JetStreamTransferStreamLeader(account, stream, targetPeer string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	node := mset.raftNode()
+	if node == nil {
+		return ErrJetStreamNotClustered
+	}
+	if !node.Leader() {
+		return errNotLeader
+	}
+	for _, p := range node.Peers() {
+		if p.ID == targetPeer || s.serverNameForNode(p.ID) == targetPeer {
+			return node.TransferLeader(p.ID)
+		}
+	}
+	return errUnknownPeer
+}
+
+func (s *Server) JetStreamStepdownStream(account, stream string) error {
+	return s.jetStreamStepdownStream(account, stream, false)
+}
+
+// How long a stepdown will wait for its snapshot to be applied before stepping down anyway.
+const stepdownSnapshotWait = 5 * time.Second
+
+// JetStreamStepdownStreamWithSnapshot is like JetStreamStepdownStream but will first snapshot
+// the stream and compact its log so the new leader does not need to replay a long log.
+// The snapshot is skipped if we are not current, and we step down regardless of its outcome.
+func (s *Server) JetStreamStepdownStreamWithSnapshot(account, stream string) error {
+	return s.jetStreamStepdownStream(account, stream, true)
+}
+
+func (s *Server) jetStreamStepdownStream(account, stream string, snapshot bool) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	// Grab account
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	// Grab stream
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+
+	if node := mset.raftNode(); node != nil && node.Leader() {
+		if snapshot && node.Current() && !mset.isCatchingUp() {
+			// Hold proposals until compacted, we are handing off leadership anyway.
+			node.PausePropose()
+			if err := node.SnapshotAndWait(mset.snapshot(), stepdownSnapshotWait); err != nil {
+				s.Debugf("JetStream cluster stream '%s > %s' stepdown snapshot failed: %v", account, stream, err)
+			}
+			node.ResumePropose()
+		}
+		node.StepDown()
+	}
+
+	return nil
+}
+
+var errResetStreamLeader = errors.New("jetstream cluster can not reset the stream leader")
+
+// ResetStreamReplica will discard our local copy of a replicated stream and its consumers, including
+// their raft logs, and rejoin their groups as a fresh follower that catches up from the leader.
+// This is a repair tool for a diverged replica, it does not touch the other replicas and will
+// refuse to run on the stream leader.
+func (s *Server) ResetStreamReplica(account, stream string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	node := mset.raftNode()
+	if node == nil {
+		return ErrJetStreamNotClustered
+	}
+	if node.Leader() {
+		return errResetStreamLeader
+	}
+
+	js.mu.RLock()
+	sa := js.streamAssignment(account, stream)
+	js.mu.RUnlock()
+	if sa == nil {
+		return ErrJetStreamNotAssigned
+	}
+
+	s.Warnf("JetStream cluster resetting replica for '%s > %s'", account, stream)
+
+	// This removes our store and raft logs for the stream and its consumers but leaves the assignments.
+	if err := mset.stop(true, false); err != nil {
+		return err
+	}
+
+	js.mu.Lock()
+	sa.Group.node = nil
+	var cas []*consumerAssignment
+	for _, ca := range sa.consumers {
+		if ca.Group != nil {
+			ca.Group.node = nil
+		}
+		cas = append(cas, ca)
+	}
+	js.mu.Unlock()
+
+	// Rejoin with empty state, the leader will catch us up.
+	js.processClusterCreateStream(acc, sa)
+	for _, ca := range cas {
+		js.processClusterCreateConsumer(ca)
+	}
+	return nil
+}
+
+// JetStreamPauseConsumer will pause or resume delivery for a consumer. In clustered mode this
+// needs to be called on the consumer leader and is replicated so all replicas agree.
+func (s *Server) JetStreamPauseConsumer(account, stream, consumer string, pause bool) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	// Grab account
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	// Grab stream
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	o := mset.LookupConsumer(consumer)
+	if o == nil {
+		return ErrJetStreamConsumerNotFound
+	}
+
+	if node := o.raftNode(); node != nil {
+		if !node.Leader() {
+			return ErrJetStreamNotLeader
+		}
+		if err := node.Propose(encodeConsumerPause(pause)); err != nil {
+			return err
+		}
+
+		// Update the assignment as well so the pause survives restarts and compaction.
+		_, cc := s.getJetStreamCluster()
+		if cc == nil {
+			return nil
+		}
+		o.mu.RLock()
+		ca := o.ca
+		o.mu.RUnlock()
+		if ca == nil {
+			return nil
+		}
+		js.mu.RLock()
+		nca := *ca
+		cfg := *ca.Config
+		js.mu.RUnlock()
+		cfg.Paused = pause
+		nca.Config, nca.State = &cfg, nil
+		return cc.meta.ForwardProposal(encodeAddConsumerAssignment(&nca))
+	}
+	o.setPaused(pause)
+	return nil
+}
+
+// Longest we will pause writes to a stream, pauses are resumed automatically after this.
+const maxWritePause = 5 * time.Minute
+
+// JetStreamPauseStreamWrites will have the stream reject new messages for up to d, e.g. for a consistent backup.
+// The pause is resumed automatically after d, which is capped at maxWritePause. In clustered mode this needs
+// to be called on the stream leader and is replicated so all replicas reject the same messages.
+func (s *Server) JetStreamPauseStreamWrites(account, stream string, d time.Duration) error {
+	if d <= 0 || d > maxWritePause {
+		d = maxWritePause
+	}
+	return s.setStreamWritePause(account, stream, time.Now().Add(d).UnixNano())
+}
+
+// JetStreamResumeStreamWrites will resume writes to a stream paused with JetStreamPauseStreamWrites.
+func (s *Server) JetStreamResumeStreamWrites(account, stream string) error {
+	return s.setStreamWritePause(account, stream, 0)
+}
+
+func (s *Server) setStreamWritePause(account, stream string, until int64) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	if node := mset.raftNode(); node != nil {
+		if !node.Leader() {
+			return ErrJetStreamNotLeader
+		}
+		return node.Propose(encodeStreamWritePause(until))
+	}
+	mset.setWritePause(until)
+	return nil
+}
+
+// JetStreamUpdateConsumerFilter will change the filter subject for a consumer. In clustered mode this
+// needs to be called on the consumer leader. The change is ordered through the consumer's log so all
+// replicas switch filters at the same point, and the consumer assignment is updated to survive restarts.
+func (s *Server) JetStreamUpdateConsumerFilter(account, stream, consumer, filter string) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if filter != _EMPTY_ && !IsValidSubject(filter) {
+		return ErrBadSubject
+	}
+	// Grab account
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	// Grab stream
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	o := mset.LookupConsumer(consumer)
+	if o == nil {
+		return ErrJetStreamConsumerNotFound
+	}
+	if err := o.checkFilterUpdate(filter); err != nil {
+		return err
+	}
+
+	node := o.raftNode()
+	if node == nil {
+		o.setFilterSubject(filter)
+		return nil
+	}
+	if !node.Leader() {
+		return ErrJetStreamNotLeader
+	}
+	if err := node.Propose(encodeConsumerFilterUpdate(filter)); err != nil {
+		return err
+	}
+
+	// Update the assignment as well.
+	_, cc := s.getJetStreamCluster()
+	if cc == nil {
+		return nil
+	}
+	o.mu.RLock()
+	ca := o.ca
+	o.mu.RUnlock()
+	if ca == nil {
+		return nil
+	}
+	js.mu.RLock()
+	nca := *ca
+	cfg := *ca.Config
+	js.mu.RUnlock()
+	cfg.FilterSubject = filter
+	nca.Config, nca.State = &cfg, nil
+	return cc.meta.ForwardProposal(encodeAddConsumerAssignment(&nca))
+}
+
+// JetStreamUpdateConsumerHeaderFilter will change the header filter for a consumer, a nil filter removes it.
+// In clustered mode this needs to be called on the consumer leader. As with filter subjects the change is
+// ordered through the consumer's log so all replicas switch at the same point.
+func (s *Server) JetStreamUpdateConsumerHeaderFilter(account, stream, consumer string, hf *HeaderFilter) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	o := mset.LookupConsumer(consumer)
+	if o == nil {
+		return ErrJetStreamConsumerNotFound
+	}
+	if err := o.checkHeaderFilterUpdate(hf); err != nil {
+		return err
+	}
+
+	node := o.raftNode()
+	if node == nil {
+		o.setHeaderFilter(hf)
+		return nil
+	}
+	if !node.Leader() {
+		return ErrJetStreamNotLeader
+	}
+	if err := node.Propose(encodeConsumerHeaderFilter(hf)); err != nil {
+		return err
+	}
+
+	// Update the assignment as well.
+	_, cc := s.getJetStreamCluster()
+	if cc == nil {
+		return nil
+	}
+	o.mu.RLock()
+	ca := o.ca
+	o.mu.RUnlock()
+	if ca == nil {
+		return nil
+	}
+	js.mu.RLock()
+	nca := *ca
+	cfg := *ca.Config
+	js.mu.RUnlock()
+	cfg.FilterHeader = hf
+	nca.Config, nca.State = &cfg, nil
+	return cc.meta.ForwardProposal(encodeAddConsumerAssignment(&nca))
+}
+
+// RaftCompactResult is the result of compacting the WAL for a raft group.
+type RaftCompactResult struct {
+	Group    string `json:"group"`
+	Bytes    uint64 `json:"bytes"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CompactAllRaftWALs will compact the WAL for every raft group on this server to reclaim space.
+// Leaders of the meta and stream groups will snapshot, which compacts the WAL once applied.
+// Everyone else only compacts up to their last applied snapshot, since entries past it are
+// needed to rebuild state on restart. Groups that are not current are skipped.
+func (s *Server) CompactAllRaftWALs() []*RaftCompactResult {
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n)
+	}
+	s.rnMu.RUnlock()
+
+	js := s.getJetStream()
+	results := make([]*RaftCompactResult, 0, len(nodes))
+	for _, n := range nodes {
+		_, sz := n.Size()
+		res := &RaftCompactResult{Group: n.Group(), Bytes: sz}
+		results = append(results, res)
+		if err := s.compactRaftWAL(js, n, res); err != nil {
+			res.Error = err.Error()
+		}
+	}
+	return results
+}
+
+func (s *Server) compactRaftWAL(js *jetStream, n RaftNode, res *RaftCompactResult) error {
+	rn, ok := n.(*raft)
+	if !ok {
+		return errNodeClosed
+	}
+	if !n.Current() {
+		return errNotCurrent
+	}
+
+	// Check if this is a stream that is catching up, or a leader that can snapshot.
+	var mset *Stream
+	isMeta := n.Group() == defaultMetaGroupName
+	if account, stream, consumer, ok := s.RaftGroupOwner(n.Group()); ok && consumer == _EMPTY_ {
+		if acc, err := s.LookupAccount(account); err == nil {
+			mset, _ = acc.LookupStream(stream)
+		}
+		if mset != nil && mset.isCatchingUp() {
+			return errNotCurrent
+		}
+	}
+
+	if n.Leader() && js != nil && (isMeta || mset != nil) {
+		var snap []byte
+		n.PausePropose()
+		if isMeta {
+			js.mu.RLock()
+			snap = js.metaSnapshot()
+			js.mu.RUnlock()
+		} else {
+			snap = mset.snapshot()
+		}
+		err := n.Snapshot(snap)
+		n.ResumePropose()
+		res.Snapshot = err == nil
+		return err
+	}
+	// Never compact past our last snapshot, we would lose state on replay.
+	if sindex := rn.snapshotIndex(); sindex > 0 {
+		return n.Compact(sindex)
+	}
+	return nil
+}
+
+func (s *Server) JetStreamSnapshotStream(account, stream string) error {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if cc == nil {
+		return ErrJetStreamNotClustered
+	}
+	// Grab account
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	// Grab stream
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+
+	mset.mu.RLock()
+	if !mset.node.Leader() {
+		mset.mu.RUnlock()
+		return ErrJetStreamNotLeader
+	}
+	n := mset.node
+	mset.mu.RUnlock()
+
+	n.PausePropose()
+	err = n.Snapshot(mset.snapshot())
+	n.ResumePropose()
+
+	return err
+}
+
+// SnapshotSink receives a full stream snapshot, messages included, for an external backup.
+// The chunks form the same archive as the snapshot API and can be used with RestoreStream.
+type SnapshotSink interface {
+	// Begin is called once with the stream config and the state captured by the snapshot.
+	Begin(cfg StreamConfig, state StreamState) error
+	// WriteChunk is called for each chunk in order, offset is where it starts in the archive.
+	WriteChunk(offset uint64, chunk []byte) error
+	// Complete is called once at the end, err is nil when the snapshot was fully written.
+	Complete(err error) error
+}
+
+// How long we will allow a snapshot to a sink to run.
+const snapshotSinkDeadline = 30 * time.Minute
+
+// JetStreamSnapshotStreamToSink will write a point in time snapshot of the stream's messages
+// to sink in chunks of chunkSize. When clustered this must be called on the stream leader,
+// and proposals are paused only while the snapshot state is captured.
+func (s *Server) JetStreamSnapshotStreamToSink(account, stream string, sink SnapshotSink, chunkSize int) error {
+	if sink == nil {
+		return errors.New("snapshot sink required")
+	}
+	// Grab account
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return err
+	}
+	// Grab stream
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		return err
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+
+	mset.mu.RLock()
+	n, cfg := mset.node, mset.config
+	mset.mu.RUnlock()
+
+	if n != nil && !n.Leader() {
+		return ErrJetStreamNotLeader
+	}
+
+	// Pause so the captured state is consistent with what we have applied. Once the store
+	// snapshot is started we only need to hold off removals, which the store does for us.
+	if n != nil {
+		n.PausePropose()
+	}
+	sr, err := mset.Snapshot(snapshotSinkDeadline, false, true)
+	if n != nil {
+		n.ResumePropose()
+	}
+	if err != nil {
+		return err
+	}
+	defer sr.Reader.Close()
+
+	if err := sink.Begin(cfg, sr.State); err != nil {
+		return sink.Complete(err)
+	}
+	var offset uint64
+	chunk := make([]byte, chunkSize)
+	for {
+		nr, rerr := io.ReadFull(sr.Reader, chunk)
+		if nr > 0 {
+			if err := sink.WriteChunk(offset, chunk[:nr]); err != nil {
+				return sink.Complete(err)
+			}
+			offset += uint64(nr)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return sink.Complete(rerr)
+		}
+	}
+	return sink.Complete(nil)
+}
+
+func (s *Server) JetStreamClusterPeers() []string {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	cc := js.cluster
+	if !cc.isLeader() {
+		return nil
+	}
+	peers := cc.meta.Peers()
+	var nodes []string
+	for _, p := range peers {
+		nodes = append(nodes, p.ID)
+	}
+	return nodes
+}
+
+// Read lock should be held.
+func (cc *jetStreamCluster) isLeader() bool {
+	if cc == nil {
+		// Non-clustered mode
+		return true
+	}
+	return cc.meta.Leader()
+}
+
+// isCurrent will determine if this node is a leader or an up to date follower.
+// Read lock should be held.
+func (cc *jetStreamCluster) isCurrent() bool {
+	if cc == nil {
+		// Non-clustered mode
+		return true
+	}
+	return cc.meta.Current()
+}
+
+// isStreamCurrent will determine if this node is a participant for the stream and if its up to date.
+// Read lock should be held.
+func (cc *jetStreamCluster) isStreamCurrent(account, stream string) bool {
+	if cc == nil {
+		// Non-clustered mode
+		return true
+	}
+	as := cc.streams[account]
+	if as == nil {
+		return false
+	}
+	sa := as[stream]
+	if sa == nil {
+		return false
+	}
+	rg := sa.Group
+	if rg == nil || rg.node == nil {
+		return false
+	}
+
+	isCurrent := rg.node.Current()
+	if isCurrent {
+		// Check if we are processing a snapshot and are catching up.
+		acc, err := cc.s.LookupAccount(account)
+		if err != nil {
+			return false
+		}
+		mset, err := acc.LookupStream(stream)
+		if err != nil {
+			return false
+		}
+		if mset.isCatchingUp() {
+			return false
+		}
+	}
+
+	return isCurrent
+}
+
+func (a *Account) getJetStreamFromAccount() (*Server, *jetStream, *jsAccount) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return nil, nil, nil
+	}
+	jsa.mu.RLock()
+	js := jsa.js
+	jsa.mu.RUnlock()
+	if js == nil {
+		return nil, nil, nil
+	}
+	js.mu.RLock()
+	s := js.srv
+	js.mu.RUnlock()
+	return s, js, jsa
+}
+
+func (s *Server) JetStreamIsStreamLeader(account, stream string) bool {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return cc.isStreamLeader(account, stream)
+}
+
+func (a *Account) JetStreamIsStreamLeader(stream string) bool {
+	s, js, jsa := a.getJetStreamFromAccount()
+	if s == nil || js == nil || jsa == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.cluster.isStreamLeader(a.Name, stream)
+}
+
+func (s *Server) JetStreamIsStreamCurrent(account, stream string) bool {
+	js, cc := s.getJetStreamCluster()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return cc.isStreamCurrent(account, stream)
+}
+
+func (a *Account) JetStreamIsConsumerLeader(stream, consumer string) bool {
+	s, js, jsa := a.getJetStreamFromAccount()
+	if s == nil || js == nil || jsa == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.cluster.isConsumerLeader(a.Name, stream, consumer)
+}
+
+func (s *Server) JetStreamIsConsumerLeader(account, stream, consumer string) bool {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return cc.isConsumerLeader(account, stream, consumer)
+}
+
+func (s *Server) enableJetStreamClustering() error {
+	if !s.isRunning() {
+		return nil
+	}
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	// Already set.
+	if js.cluster != nil {
+		return nil
+	}
+
+	s.Noticef("Starting JetStream cluster")
+	// We need to determine if we have a stable cluster name and expected number of servers.
+	s.Debugf("JetStream cluster checking for stable cluster name and peers")
+	if s.isClusterNameDynamic() || s.configuredRoutes() == 0 {
+		return errors.New("JetStream cluster requires cluster name and explicit routes")
+	}
+
+	return js.setupMetaGroup()
+}
+
+func (js *jetStream) setupMetaGroup() error {
+	s := js.srv
+	s.Noticef("Creating JetStream metadata controller")
+
+	// Setup our WAL for the metagroup.
+	sysAcc := s.SystemAccount()
+	stateDir := metaStoreDir(js.config.StoreDir, sysAcc.Name)
+	fs, bootstrap, err := newFileStore(
+		FileStoreConfig{StoreDir: stateDir, BlockSize: defaultMetaFSBlkSize},
+		StreamConfig{Name: defaultMetaGroupName, Storage: FileStorage},
+	)
+	if err != nil {
+		s.Errorf("Error creating filestore: %v", err)
+		return err
+	}
+
+	cfg := &RaftConfig{Name: defaultMetaGroupName, Store: stateDir, Log: fs}
+
+	if bootstrap {
+		s.Noticef("JetStream cluster bootstrapping")
+		// FIXME(dlc) - Make this real.
+		peers := s.activePeers()
+		s.Debugf("JetStream cluster initial peers: %+v", peers)
+		if err := s.checkMetaBootstrapPeers(peers); err != nil {
+			// Remove the new store so we bootstrap again on the next attempt.
+			fs.Delete()
+			return err
+		}
+		s.bootstrapRaftNode(cfg, peers, false)
+	} else {
+		s.Noticef("JetStream cluster recovering state")
+	}
+	// Start up our meta node.
+	n, err := s.startRaftNode(cfg)
+	if err != nil {
+		s.Warnf("Could not start metadata controller: %v", err)
+		return err
+	}
+
+	c := s.createInternalJetStreamClient()
+	sacc := s.SystemAccount()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.cluster = &jetStreamCluster{
+		meta:    n,
+		streams: make(map[string]map[string]*streamAssignment),
+		s:       s,
+		c:       c,
+	}
+	c.registerWithAccount(sacc)
+
+	js.srv.startGoRoutine(js.monitorCluster)
+	return nil
+}
+
+// checkMetaBootstrapPeers makes sure we do not bootstrap a meta group with fewer peers than expected.
+// Our active peers do not include ourselves. A meta group accidentally bootstrapped by itself can not
+// be expanded cleanly later, so this requires an explicit force_single to be set.
+func (s *Server) checkMetaBootstrapPeers(peers []string) error {
+	opts := s.getOpts()
+	if opts.MetaExpectedPeers <= 0 || opts.MetaForceSingle {
+		return nil
+	}
+	if have := len(peers) + 1; have < opts.MetaExpectedPeers {
+		s.Warnf("JetStream cluster has %d of %d expected peers, set force_single to override", have, opts.MetaExpectedPeers)
+		return ErrJetStreamMetaInsufficientPeers
+	}
+	return nil
+}
+
+// metaStoreDir returns the directory holding the meta group WAL for the given store directory.
+func metaStoreDir(storeDir, sysAccName string) string {
+	return path.Join(storeDir, sysAccName, defaultStoreDirName, defaultMetaGroupName)
+}
+
+// MigrateMetaStore will move the meta group store from one JetStream store directory to another.
+// This is an offline operation and the server using srcStoreDir must not be running.
+// The moved peer state and term and vote files are validated before returning.
+func MigrateMetaStore(srcStoreDir, dstStoreDir, sysAccName string) error {
+	src, dst := metaStoreDir(srcStoreDir, sysAccName), metaStoreDir(dstStoreDir, sysAccName)
+	if err := validateMetaStore(src); err != nil {
+		return fmt.Errorf("invalid meta store at %q: %v", src, err)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("meta store already exists at %q", dst)
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// Try a rename first, this will fail across devices so fallback to a copy.
+	if err := os.Rename(src, dst); err != nil {
+		if err := copyDir(src, dst); err != nil {
+			os.RemoveAll(dst)
+			return err
+		}
+		if err := validateMetaStore(dst); err != nil {
+			os.RemoveAll(dst)
+			return fmt.Errorf("invalid meta store after copy to %q: %v", dst, err)
+		}
+		return os.RemoveAll(src)
+	}
+	return validateMetaStore(dst)
+}
+
+// validateMetaStore checks that the peer state and term and vote files in dir are readable.
+func validateMetaStore(dir string) error {
+	ps, err := readPeerState(dir)
+	if err != nil {
+		return err
+	}
+	if len(ps.knownPeers) == 0 {
+		return errors.New("no known peers")
+	}
+	buf, err := ioutil.ReadFile(path.Join(dir, termVoteFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && len(buf) < 8 {
+		return errors.New("corrupt term and vote state")
+	}
+	return nil
+}
+
+// copyDir will recursively copy the directory src to dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, buf, fi.Mode().Perm())
+	})
+}
+
+func (js *jetStream) getMetaGroup() RaftNode {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if js.cluster == nil {
+		return nil
+	}
+	return js.cluster.meta
+}
+
+func (js *jetStream) server() *Server {
+	js.mu.RLock()
+	s := js.srv
+	js.mu.RUnlock()
+	return s
+}
+
+// Will respond iff we are a member and we know we have no leader.
+func (js *jetStream) isGroupLeaderless(rg *raftGroup) bool {
+	if rg == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	cc := js.cluster
+
+	// If we are not a member we can not say..
+	if !rg.isMember(cc.meta.ID()) {
+		return false
+	}
+	// Single peer groups always have a leader if we are here.
+	if rg.node == nil {
+		return false
+	}
+	return rg.node.GroupLeader() == _EMPTY_
+}
+
+func (s *Server) JetStreamIsStreamAssigned(account, stream string) bool {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return false
+	}
+	acc, _ := s.LookupAccount(account)
+	if acc == nil {
+		return false
+	}
+	return cc.isStreamAssigned(acc, stream)
+}
+
+// streamAssigned informs us if this server has this stream assigned.
+func (jsa *jsAccount) streamAssigned(stream string) bool {
+	jsa.mu.RLock()
+	js, acc := jsa.js, jsa.account
+	jsa.mu.RUnlock()
+
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	assigned := js.cluster.isStreamAssigned(acc, stream)
+	js.mu.RUnlock()
+	return assigned
+}
+
+// Read lock should be held.
+func (cc *jetStreamCluster) isStreamAssigned(a *Account, stream string) bool {
+	// Non-clustered mode always return true.
+	if cc == nil {
+		return true
+	}
+	as := cc.streams[a.Name]
+	if as == nil {
+		return false
+	}
+	sa := as[stream]
+	if sa == nil {
+		return false
+	}
+	rg := sa.Group
+	if rg == nil {
+		return false
+	}
+	// Check if we are the leader of this raftGroup assigned to the stream.
+	ourID := cc.meta.ID()
+	for _, peer := range rg.Peers {
+		if peer == ourID {
+			return true
+		}
+	}
+	return false
+}
+
+// Read lock should be held.
+func (cc *jetStreamCluster) isStreamLeader(account, stream string) bool {
+	// Non-clustered mode always return true.
+	if cc == nil {
+		return true
+	}
+	var sa *streamAssignment
+	if as := cc.streams[account]; as != nil {
+		sa = as[stream]
+	}
+	if sa == nil {
+		return false
+	}
+	rg := sa.Group
+	if rg == nil {
+		return false
+	}
+	// Check if we are the leader of this raftGroup assigned to the stream.
+	ourID := cc.meta.ID()
+	for _, peer := range rg.Peers {
+		if peer == ourID {
+			if len(rg.Peers) == 1 || rg.node != nil && rg.node.Leader() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read lock should be held.
+func (cc *jetStreamCluster) isConsumerLeader(account, stream, consumer string) bool {
+	// Non-clustered mode always return true.
+	if cc == nil {
+		return true
+	}
+	var sa *streamAssignment
+	if as := cc.streams[account]; as != nil {
+		sa = as[stream]
+	}
+	if sa == nil {
+		return false
+	}
+	// Check if we are the leader of this raftGroup assigned to this consumer.
+	ourID := cc.meta.ID()
+	for _, ca := range sa.consumers {
+		rg := ca.Group
+		for _, peer := range rg.Peers {
+			if peer == ourID {
+				if len(rg.Peers) == 1 || (rg.node != nil && rg.node.Leader()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (js *jetStream) monitorCluster() {
+	const (
+		compactInterval  = 5 * time.Minute
+		compactSizeLimit = 64 * 1024
+	)
+
+	s, cc, n := js.server(), js.cluster, js.getMetaGroup()
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	defer s.grWG.Done()
+
+	s.Debugf("Starting metadata monitor")
+	defer s.Debugf("Exiting metadata monitor")
+
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	ot := time.NewTicker(orphanCheckInterval)
+	defer ot.Stop()
+
+	isLeader := cc.isLeader()
+
+	var lastSnap []byte
+	var snapout bool
+	// Set when we could not apply a snapshot, we wait for a new one before applying anything else.
+	var stale bool
+
+	// Raft groups we have seen without an assignment, and when.
+	orphans := make(map[string]time.Time)
+
+	// Only to be called from leader.
+	attemptSnapshot := func() {
+		if snapout {
+			return
+		}
+		n.PausePropose()
+		defer n.ResumePropose()
+		if snap := js.metaSnapshot(); !bytes.Equal(lastSnap, snap) {
+			if err := n.Snapshot(snap); err != nil {
+			} else {
+				lastSnap = snap
+				snapout = true
+			}
+		}
+	}
+
+	isRecovering := true
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			if ce == nil {
+				// Signals we have replayed all of our metadata.
+				isRecovering = false
+				s.Debugf("Recovered JetStream cluster metadata")
+				continue
+			}
+			// Do not apply on top of stale state, only a new snapshot can resync us.
+			if stale && !hasSnapshotEntry(ce) {
+				continue
+			}
+			// FIXME(dlc) - Deal with errors.
+			if hadSnapshot, err := js.applyMetaEntries(ce.Entries, isRecovering); err == nil {
+				n.Applied(ce.Index)
+				if hadSnapshot {
+					snapout = false
+					if stale {
+						stale = false
+						s.Noticef("JetStream cluster metadata resynced from snapshot")
+					}
+				}
+			} else {
+				n.ApplyFailed(ce.Index, err)
+				if err == errSnapshotCorrupt {
+					s.Errorf("JetStream cluster metadata snapshot is corrupt, requesting a new one from the leader")
+					stale = true
+					requestSnapshot(n)
+				}
+			}
+			if isLeader && hasSnapshotRequest(ce) {
+				lastSnap, snapout = nil, false
+				attemptSnapshot()
+			}
+			if isLeader && !snapout {
+				_, b := n.Size()
+				if b > compactSizeLimit {
+					attemptSnapshot()
+				}
+			}
+		case isLeader = <-lch:
+			js.processLeaderChange(isLeader)
+		case <-t.C:
+			if isLeader && !snapout {
+				attemptSnapshot()
+			}
+			// Ask again in case our request or the snapshot was lost.
+			if stale {
+				requestSnapshot(n)
+			}
+		case <-ot.C:
+			if !isRecovering {
+				js.reapOrphanedRaftGroups(orphans)
+			}
+			if isLeader && !isRecovering {
+				js.reconcileConsumerPeers()
+			}
+		}
+	}
+}
+
+const (
+	// How often we check for raft groups that no assignment references.
+	orphanCheckInterval = 30 * time.Second
+	// How long a raft group needs to be orphaned before we remove it, so we do not race in-flight creates.
+	orphanGracePeriod = 2 * time.Minute
+)
+
+// reconcileConsumerPeers will make sure every consumer's peers are a subset of its stream's peers.
+// Consumers that have drifted get a corrected assignment proposed. Should only be called on the meta leader.
+func (js *jetStream) reconcileConsumerPeers() {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	cc := js.cluster
+	if cc == nil || !cc.isLeader() {
+		return
+	}
+	for _, asa := range cc.streams {
+		for _, sa := range asa {
+			for _, ca := range sa.consumers {
+				if nca := cc.correctConsumerPeers(sa, ca); nca != nil {
+					cc.meta.Propose(encodeAddConsumerAssignment(nca))
+				}
+			}
+		}
+	}
+}
+
+// correctConsumerPeers returns a corrected consumer assignment if the consumer has peers that are not
+// members of its stream, otherwise nil. We keep the group and drop the extra peers when possible
+// so the consumer state is kept, otherwise we place it on a new group from the stream's peers.
+// Lock should be held.
+func (cc *jetStreamCluster) correctConsumerPeers(sa *streamAssignment, ca *consumerAssignment) *consumerAssignment {
+	if sa == nil || sa.Group == nil || ca == nil || ca.Group == nil {
+		return nil
+	}
+	var peers []string
+	for _, peer := range ca.Group.Peers {
+		if sa.Group.isMember(peer) {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == len(ca.Group.Peers) {
+		return nil
+	}
+	cc.s.Warnf("JetStream cluster consumer '%s > %s > %s' has peers outside of its stream, correcting",
+		ca.Client.Account, ca.Stream, ca.Name)
+
+	nca := *ca
+	nca.Reply, nca.responded, nca.err = _EMPTY_, true, nil
+	if len(peers) > 0 {
+		nca.Group = &raftGroup{Name: ca.Group.Name, Peers: peers, Storage: ca.Group.Storage}
+	} else if nca.Group = cc.createGroupForConsumer(sa, ca.Name); nca.Group == nil {
+		return nil
+	}
+	return &nca
+}
+
+// reapOrphanedRaftGroups will stop and delete any of our raft groups that no stream or consumer
+// assignment references once they have been orphaned past our grace period. The seen map tracks
+// when we first noticed each orphan.
+func (js *jetStream) reapOrphanedRaftGroups(seen map[string]time.Time) {
+	s := js.srv
+
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n)
+	}
+	s.rnMu.RUnlock()
+
+	js.mu.RLock()
+	known := make(map[string]struct{})
+	for _, asa := range js.cluster.streams {
+		for _, sa := range asa {
+			if sa.Group != nil {
+				known[sa.Group.Name] = struct{}{}
+			}
+			for _, ca := range sa.consumers {
+				if ca.Group != nil {
+					known[ca.Group.Name] = struct{}{}
+				}
+			}
+		}
+	}
+	js.mu.RUnlock()
+
+	now := time.Now()
+	orphans := make(map[string]time.Time)
+	for _, n := range nodes {
+		group := n.Group()
+		if group == defaultMetaGroupName {
+			continue
+		}
+		if _, ok := known[group]; ok {
+			continue
+		}
+		first, ok := seen[group]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) < orphanGracePeriod {
+			orphans[group] = first
+			continue
+		}
+		s.Warnf("JetStream cluster removing orphaned raft group %q", group)
+		n.Delete()
+	}
+	// Only keep what is still orphaned.
+	for group := range seen {
+		delete(seen, group)
+	}
+	for group, first := range orphans {
+		seen[group] = first
+	}
+}
+
+// Represents our stable meta state that we can write out.
+type writeableStreamAssignment struct {
+	Client    *ClientInfo   `json:"client,omitempty"`
+	Created   time.Time     `json:"created"`
+	Config    *StreamConfig `json:"stream"`
+	Group     *raftGroup    `json:"group"`
+	Sync      string        `json:"sync"`
+	Consumers []*consumerAssignment
+}
+
+func (js *jetStream) metaSnapshot() []byte {
+	var streams []writeableStreamAssignment
+	js.mu.RLock()
+	cc := js.cluster
+	for _, asa := range cc.streams {
+		for _, sa := range asa {
+			wsa := writeableStreamAssignment{
+				Client:  sa.Client,
+				Created: sa.Created,
+				Config:  sa.Config,
+				Group:   sa.Group,
+				Sync:    sa.Sync,
+			}
+			for _, ca := range sa.consumers {
+				wsa.Consumers = append(wsa.Consumers, ca)
+			}
+			streams = append(streams, wsa)
+		}
+	}
+	js.mu.RUnlock()
+
+	// An empty meta state is still framed so we can tell it from a corrupt one.
+	if len(streams) == 0 {
+		return encodeSnapshot(nil)
+	}
+
+	b, _ := json.Marshal(streams)
+	return encodeSnapshot(s2.EncodeBetter(nil, b))
+}
+
+// Snapshots are framed with a magic, length and checksum so we can verify them on load.
+const (
+	snapshotMagic   = "JSNP"
+	snapshotHdrSize = len(snapshotMagic) + 8
+)
+
+var errSnapshotCorrupt = errors.New("snapshot corrupt")
+
+func encodeSnapshot(buf []byte) []byte {
+	snap := make([]byte, snapshotHdrSize, snapshotHdrSize+len(buf))
+	copy(snap, snapshotMagic)
+	le := binary.LittleEndian
+	le.PutUint32(snap[len(snapshotMagic):], uint32(len(buf)))
+	le.PutUint32(snap[len(snapshotMagic)+4:], crc32.ChecksumIEEE(buf))
+	return append(snap, buf...)
+}
+
+// decodeSnapshot will verify a framed snapshot and return its payload.
+// Snapshots from before framing are passed through as is.
+func decodeSnapshot(snap []byte) ([]byte, error) {
+	if !bytes.HasPrefix(snap, []byte(snapshotMagic)) {
+		return snap, nil
+	}
+	if len(snap) < snapshotHdrSize {
+		return nil, errSnapshotCorrupt
+	}
+	le := binary.LittleEndian
+	sz, sum := le.Uint32(snap[len(snapshotMagic):]), le.Uint32(snap[len(snapshotMagic)+4:])
+	buf := snap[snapshotHdrSize:]
+	if int(sz) != len(buf) || crc32.ChecksumIEEE(buf) != sum {
+		return nil, errSnapshotCorrupt
+	}
+	return buf, nil
+}
+
+// decodeMetaSnapshot will decode the stream assignments from a meta snapshot.
+func decodeMetaSnapshot(buf []byte) ([]writeableStreamAssignment, error) {
+	buf, err := decodeSnapshot(buf)
+	if err != nil {
+		return nil, err
+	}
+	var wsas []writeableStreamAssignment
+	// A legitimately empty snapshot means we have no streams.
+	if len(buf) > 0 {
+		jse, err := s2.Decode(nil, buf)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(jse, &wsas); err != nil {
+			return nil, err
+		}
+	}
+	return wsas, nil
+}
+
+func (js *jetStream) applyMetaSnapshot(buf []byte, isRecovering bool) error {
+	wsas, err := decodeMetaSnapshot(buf)
+	if err != nil {
+		return err
+	}
+	// Build our new version here outside of js.
+	streams := make(map[string]map[string]*streamAssignment)
+	for _, wsa := range wsas {
+		as := streams[wsa.Client.Account]
+		if as == nil {
+			as = make(map[string]*streamAssignment)
+			streams[wsa.Client.Account] = as
+		}
+		sa := &streamAssignment{Client: wsa.Client, Created: wsa.Created, Config: wsa.Config, Group: wsa.Group, Sync: wsa.Sync}
+		if len(wsa.Consumers) > 0 {
+			sa.consumers = make(map[string]*consumerAssignment)
+			for _, ca := range wsa.Consumers {
+				sa.consumers[ca.Name] = ca
+			}
+		}
+		as[wsa.Config.Name] = sa
+	}
+
+	js.mu.Lock()
+	cc := js.cluster
+
+	var saAdd, saDel, saChk []*streamAssignment
+	// Walk through the old list to generate the delete list.
+	for account, asa := range cc.streams {
+		nasa := streams[account]
+		for sn, sa := range asa {
+			if nsa := nasa[sn]; nsa == nil {
+				saDel = append(saDel, sa)
+			} else {
+				saChk = append(saChk, nsa)
+			}
+		}
+	}
+	// Walk through the new list to generate the add list.
+	for account, nasa := range streams {
+		asa := cc.streams[account]
+		for sn, sa := range nasa {
+			if asa[sn] == nil {
+				saAdd = append(saAdd, sa)
+			}
+		}
+	}
+	// Now walk the ones to check and process consumers.
+	var caAdd, caDel []*consumerAssignment
+	for _, sa := range saChk {
+		if osa := js.streamAssignment(sa.Client.Account, sa.Config.Name); osa != nil {
+			for _, ca := range osa.consumers {
+				if sa.consumers[ca.Name] == nil {
+					caDel = append(caDel, ca)
+				} else {
+					caAdd = append(caAdd, ca)
+				}
+			}
+		}
+	}
+	js.mu.Unlock()
+
+	// Do removals first.
+	for _, sa := range saDel {
+		if isRecovering {
+			js.setStreamAssignmentResponded(sa)
+		}
+		js.processStreamRemoval(sa)
+	}
+	// Now do add for the streams. Also add in all consumers.
+	for _, sa := range saAdd {
+		if isRecovering {
+			js.setStreamAssignmentResponded(sa)
+		}
+		js.processStreamAssignment(sa)
+		// We can simply add the consumers.
+		for _, ca := range sa.consumers {
+			if isRecovering {
+				js.setConsumerAssignmentResponded(ca)
+			}
+			js.processConsumerAssignment(ca)
+		}
+	}
+	// Now do the deltas for existing stream's consumers.
+	for _, ca := range caDel {
+		if isRecovering {
+			js.setConsumerAssignmentResponded(ca)
+		}
+		js.processConsumerRemoval(ca)
+	}
+	for _, ca := range caAdd {
+		if isRecovering {
+			js.setConsumerAssignmentResponded(ca)
+		}
+		js.processConsumerAssignment(ca)
+	}
+
+	return nil
+}
+
+// Called on recovery to make sure we do not process like original
+func (js *jetStream) setStreamAssignmentResponded(sa *streamAssignment) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	sa.responded = true
+	sa.Restore = nil
+}
+
+// Called on recovery for stream updates, these have already been committed to the stream's own log.
+func (js *jetStream) setStreamAssignmentRecovering(sa *streamAssignment) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	sa.responded = true
+	sa.recovering = true
+}
+
+// Called on recovery to make sure we do not process like original
+func (js *jetStream) setConsumerAssignmentResponded(ca *consumerAssignment) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	ca.responded = true
+}
+
+func (js *jetStream) applyMetaEntries(entries []*Entry, isRecovering bool) (bool, error) {
+	var didSnap bool
+	for _, e := range entries {
+		if e.Type == EntrySnapshot {
+			if err := js.applyMetaSnapshot(e.Data, isRecovering); err != nil {
+				js.srv.Errorf("JetStream cluster failed to apply metadata snapshot: %v", err)
+				return didSnap, err
+			}
+			didSnap = true
+		} else {
+			buf := e.Data
+			switch entryOp(buf[0]) {
+			case assignStreamOp:
+				sa, err := decodeStreamAssignment(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode stream assignment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setStreamAssignmentResponded(sa)
+				}
+				js.processStreamAssignment(sa)
+			case updateStreamOp:
+				sa, err := decodeStreamAssignment(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode stream assignment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setStreamAssignmentRecovering(sa)
+				}
+				js.processUpdateStreamAssignment(sa)
+			case removeStreamOp:
+				sa, err := decodeStreamAssignment(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode stream assignment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setStreamAssignmentResponded(sa)
+				}
+				js.processStreamRemoval(sa)
+			case assignConsumerOp:
+				ca, err := decodeConsumerAssignment(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode consumer assigment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setConsumerAssignmentResponded(ca)
+				}
+				js.processConsumerAssignment(ca)
+			case assignCompressedConsumerOp:
+				ca, err := decodeConsumerAssignmentCompressed(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode compressed consumer assigment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setConsumerAssignmentResponded(ca)
+				}
+				js.processConsumerAssignment(ca)
+			case removeConsumerOp:
+				ca, err := decodeConsumerAssignment(buf[1:])
+				if err != nil {
+					js.srv.Errorf("JetStream cluster failed to decode consumer assigment: %q", buf[1:])
+					return didSnap, err
+				}
+				if isRecovering {
+					js.setConsumerAssignmentResponded(ca)
+				}
+				js.processConsumerRemoval(ca)
+			case snapshotRequestOp:
+				// The leader will snapshot, see monitorCluster.
+			default:
+				panic("JetStream Cluster Unknown meta entry op type")
+			}
+		}
+	}
+	return didSnap, nil
+}
+
+func (rg *raftGroup) isMember(id string) bool {
+	if rg == nil {
+		return false
+	}
+	for _, peer := range rg.Peers {
+		if peer == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (rg *raftGroup) setPreferred() {
+	if rg == nil || len(rg.Peers) == 0 {
+		return
+	}
+	if len(rg.Peers) == 1 {
+		rg.Preferred = rg.Peers[0]
+	} else {
+		// For now just randomly select a peer for the preferred.
+		pi := rand.Int31n(int32(len(rg.Peers)))
+		rg.Preferred = rg.Peers[pi]
+	}
+}
+
+// createRaftGroup is called to spin up this raft group if needed.
+func (js *jetStream) createRaftGroup(rg *raftGroup) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	s, cc := js.srv, js.cluster
+
+	// If this is a single peer raft group or we are not a member return.
+	if len(rg.Peers) <= 1 || !rg.isMember(cc.meta.ID()) {
+		// Nothing to do here.
+		return nil
+	}
+
+	// We already have this assigned.
+	if node := s.lookupRaftNode(rg.Name); node != nil {
+		s.Debugf("JetStream cluster already has raft group %q assigned", rg.Name)
+		// This could be an updated assignment for the same group, so make sure it has our node.
+		rg.node = node
+		return nil
+	}
+
+	// Make sure we do not take on more groups than we are allowed.
+	if max := s.getOpts().MaxRaftGroups; max > 0 && s.numRaftNodes() >= max {
+		s.Warnf("JetStream cluster can not create raft group %q, limit of %d reached", rg.Name, max)
+		return ErrJetStreamMaximumRaftGroups
+	}
+
+	s.Debugf("JetStream cluster creating raft group:%+v", rg)
+
+	sysAcc := s.SystemAccount()
+	if sysAcc == nil {
+		s.Debugf("JetStream cluster detected shutdown processing raft group: %+v", rg)
+		return errors.New("shutting down")
+	}
+
+	stateDir := path.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, rg.Name)
+	fs, bootstrap, err := newFileStore(
+		FileStoreConfig{StoreDir: stateDir, BlockSize: 32 * 1024 * 1024},
+		StreamConfig{Name: rg.Name, Storage: FileStorage},
+	)
+	if err != nil {
+		s.Errorf("Error creating filestore: %v", err)
+		return err
+	}
+
+	cfg := &RaftConfig{Name: rg.Name, Store: stateDir, Log: fs, WriteQuorum: rg.WriteQuorum}
+
+	if bootstrap {
+		s.bootstrapRaftNode(cfg, rg.Peers, true)
+	}
+	n, err := s.startRaftNode(cfg)
+	if err != nil {
+		s.Debugf("Error creating raft group: %v", err)
+		return err
+	}
+	rg.node = n
+
+	// See if we are preferred and should start campaign immediately.
+	if n.ID() == rg.Preferred {
+		n.Campaign()
+	}
+
+	return nil
+}
+
+func (mset *Stream) raftNode() RaftNode {
+	if mset == nil {
+		return nil
+	}
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.node
+}
+
+// Monitor our stream node for this stream.
+func (js *jetStream) monitorStream(mset *Stream, sa *streamAssignment) {
+	s, cc, n := js.server(), js.cluster, sa.Group.node
+	defer s.grWG.Done()
+
+	if n == nil {
+		s.Warnf("No RAFT group for '%s > %s", sa.Client.Account, sa.Config.Name)
+		return
+	}
+
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	const (
+		compactInterval  = 10 * time.Minute
+		compactSizeLimit = 64 * 1024 * 1024
+		compactMinWait   = 5 * time.Second
+	)
+
+	s.Debugf("Starting stream monitor for '%s > %s'", sa.Client.Account, sa.Config.Name)
+	defer s.Debugf("Exiting stream monitor for '%s > %s'", sa.Client.Account, sa.Config.Name)
+
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	it := time.NewTicker(idleCheckInterval)
+	defer it.Stop()
+
+	ct := time.NewTicker(compactionInterval)
+	defer ct.Stop()
+
+	js.mu.RLock()
+	isLeader := cc.isStreamLeader(sa.Client.Account, sa.Config.Name)
+	isRestore := sa.Restore != nil
+	created := sa.Created
+	js.mu.RUnlock()
+
+	acc, err := s.LookupAccount(sa.Client.Account)
+	if err != nil {
+		s.Warnf("Could not retrieve account for stream '%s > %s", sa.Client.Account, sa.Config.Name)
+		return
+	}
+
+	var (
+		lastSnap   []byte
+		snapout    bool
+		stale      bool
+		lastFailed time.Time
+		lastActive time.Time
+		idleDelete bool
+		lastBytes  uint64
+		lastRePub  uint64
+	)
+
+	// Only to be called from leader. Will propose deletes for all but the last message per subject.
+	attemptCompaction := func() {
+		if mset == nil || isRestore || mset.Config().Compaction != CompactToLast || mset.retentionHeld() {
+			return
+		}
+		lastBytes = mset.State().Bytes
+		for _, md := range mset.compactionDeletes(maxCompactionBatch) {
+			md.Client = sa.Client
+			if err := n.Propose(encodeMsgDelete(md)); err != nil {
+				s.Debugf("Stream compaction for '%s > %s' stopped: %v", sa.Client.Account, sa.Config.Name, err)
+				return
+			}
+		}
+	}
+
+	// Only to be called from leader.
+	attemptSnapshot := func() {
+		if mset == nil || isRestore || snapout {
+			return
+		}
+		n.PausePropose()
+		defer n.ResumePropose()
+		if snap := mset.snapshot(); !bytes.Equal(lastSnap, snap) {
+			if !lastFailed.IsZero() && time.Since(lastFailed) <= compactMinWait {
+				s.Debugf("Stream compaction delayed")
+				return
+			}
+			if err := n.Snapshot(snap); err != nil {
+				lastFailed = time.Now()
+			} else {
+				lastSnap = snap
+				snapout = true
+				lastFailed = time.Time{}
+			}
+		}
+	}
+
+	// We will establish a restoreDoneCh no matter what. Will never be triggered unless
+	// we replace with the restore chan.
+	restoreDoneCh := make(<-chan error)
+
+	for {
+		select {
+		case err := <-restoreDoneCh:
+			// We have completed a restore from snapshot on this server. The stream assignment has
+			// already been assigned but the replicas will need to catch up out of band. Consumers
+			// will need to be assigned by forwarding the proposal and stamping the initial state.
+			s.Debugf("Stream restore for '%s > %s' completed", sa.Client.Account, sa.Config.Name)
+			if err != nil {
+				s.Debugf("Stream restore failed: %v", err)
+			}
+			isRestore = false
+			sa.Restore = nil
+			// If we were successful lookup up our stream now.
+			if err == nil {
+				mset, err = acc.LookupStream(sa.Config.Name)
+				if mset != nil {
+					mset.setStreamAssignment(sa)
+				}
+			}
+			if err != nil {
+				if mset != nil {
+					mset.Delete()
+				}
+				js.mu.Lock()
+				sa.err = err
+				sa.responded = true
+				if n != nil {
+					n.Delete()
+				}
+				result := &streamAssignmentResult{
+					Account: sa.Client.Account,
+					Stream:  sa.Config.Name,
+					Restore: &JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}},
+				}
+				result.Restore.Error = jsError(sa.err)
+				js.mu.Unlock()
+				// Send response to the metadata leader. They will forward to the user as needed.
+				b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+				s.sendInternalMsgLocked(streamAssignmentSubj, _EMPTY_, nil, b)
+				return
+			}
+
+			if !isLeader {
+				panic("Finished restore but not leader")
+			}
+			js.processStreamLeaderChange(mset, sa, isLeader)
+			attemptSnapshot()
+
+			// Check to see if we have restored consumers here.
+			// These are not currently assigned so we will need to do so here.
+			if consumers := mset.Consumers(); len(consumers) > 0 {
+				for _, o := range mset.Consumers() {
+					name, cfg := o.Name(), o.Config()
+					rg := cc.createGroupForConsumer(sa, name)
+					// Pick a preferred leader.
+					rg.setPreferred()
+					// Place our initial state here as well for assignment distribution.
+					ca := &consumerAssignment{
+						Group:   rg,
+						Stream:  sa.Config.Name,
+						Name:    name,
+						Config:  &cfg,
+						Client:  sa.Client,
+						Created: o.Created(),
+						State:   o.readStoreState(),
+					}
+
+					// We make these compressed in case state is complex.
+					addEntry := encodeAddConsumerAssignmentCompressed(ca)
+					cc.meta.ForwardProposal(addEntry)
+
+					// Check to make sure we see the assignment.
+					go func() {
+						ticker := time.NewTicker(time.Second)
+						defer ticker.Stop()
+						for range ticker.C {
+							js.mu.RLock()
+							ca, meta := js.consumerAssignment(ca.Client.Account, sa.Config.Name, name), cc.meta
+							js.mu.RUnlock()
+							if ca == nil {
+								s.Warnf("Consumer assignment has not been assigned, retrying")
+								meta.ForwardProposal(addEntry)
+							} else {
+								return
+							}
+						}
+					}()
+				}
+			}
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			// No special processing needed for when we are caught up on restart.
+			if ce == nil {
+				continue
+			}
+			if mset == nil && isRestore {
+				isRestore = false
+				sa.Restore = nil
+				if mset, err = acc.addStream(sa.Config, nil, sa); err != nil {
+					s.Warnf("Could not add stream after restore '%s > %s': %v", sa.Client.Account, sa.Config.Name, err)
+					return
+				}
+			}
+			// Do not apply on top of stale state, only a new snapshot can resync us.
+			if stale && !hasSnapshotEntry(ce) {
+				continue
+			}
+			// Apply our entries.
+			if hadSnapshot, err := js.applyStreamEntries(mset, ce); err == nil {
+				n.Applied(ce.Index)
+				if hadSnapshot {
+					snapout = false
+					if stale {
+						stale = false
+						s.Noticef("JetStream cluster stream '%s > %s' resynced from snapshot", sa.Client.Account, sa.Config.Name)
+					}
+				}
+			} else {
+				s.Warnf("Error applying entries to '%s > %s'", sa.Client.Account, sa.Config.Name)
+				n.ApplyFailed(ce.Index, err)
+				if err == errSnapshotCorrupt {
+					s.Errorf("JetStream cluster snapshot for '%s > %s' is corrupt, requesting a new one from the leader", sa.Client.Account, sa.Config.Name)
+					stale = true
+					requestSnapshot(n)
+				}
+			}
+			if isLeader && hasSnapshotRequest(ce) {
+				lastSnap, snapout = nil, false
+				attemptSnapshot()
+			}
+			// Republish what we applied, our followers learn where we are on our idle check.
+			if isLeader && mset != nil {
+				mset.republishPending()
+			}
+			if isLeader && !snapout {
+				if _, b := n.Size(); b > compactSizeLimit {
+					attemptSnapshot()
+				}
+			}
+			if isLeader && mset != nil && mset.State().Bytes > lastBytes+compactionSizeTrigger {
+				attemptCompaction()
+			}
+		case isLeader = <-lch:
+			if isLeader && isRestore {
+				acc, _ := s.LookupAccount(sa.Client.Account)
+				restoreDoneCh = s.processStreamRestore(sa.Client, acc, sa.Config.Name, _EMPTY_, sa.Reply, _EMPTY_)
+			} else {
+				if !isLeader && n.GroupLeader() != noLeader {
+					js.setStreamAssignmentResponded(sa)
+				}
+				js.processStreamLeaderChange(mset, sa, isLeader)
+				// Pick up where the previous leader left off.
+				lastRePub = 0
+				if isLeader && mset != nil {
+					mset.republishPending()
+				}
+			}
+		case <-t.C:
+			if isLeader {
+				attemptSnapshot()
+			}
+			// Ask again in case our request or the snapshot was lost.
+			if stale {
+				requestSnapshot(n)
+			}
+		case <-ct.C:
+			if isLeader {
+				attemptCompaction()
+			}
+		case <-it.C:
+			if !isLeader || isRestore || mset == nil || idleDelete {
+				continue
+			}
+			if mute := n.MutePeers(); len(mute) > 0 {
+				s.sendStreamAsymmetricPartitionAdvisory(mset, mute)
+			}
+			if seq := mset.checkAgeExpiry(); seq > 0 {
+				n.Propose(encodeStreamExpire(seq))
+			}
+			if mset.writePauseExpired() {
+				n.Propose(encodeStreamWritePause(0))
+			}
+			js.mu.RLock()
+			nc := len(sa.consumers)
+			js.mu.RUnlock()
+			if seq := mset.ackFloorCompactSeq(nc); seq > 0 {
+				n.Propose(encodeStreamAckFloor(seq))
+			}
+			if seq := mset.rePublished(); seq > lastRePub {
+				if err := n.Propose(encodeRePublished(seq)); err == nil {
+					lastRePub = seq
+				}
+			}
+			if mset.hasActiveConsumers() {
+				lastActive = time.Now()
+			} else if mset.isIdle(created, lastActive) {
+				s.Noticef("JetStream cluster deleting idle stream '%s > %s'", sa.Client.Account, sa.Config.Name)
+				js.mu.RLock()
+				dsa := &streamAssignment{Group: sa.Group, Config: sa.Config, Client: sa.Client}
+				js.mu.RUnlock()
+				cc.meta.ForwardProposal(encodeDeleteStreamAssignment(dsa))
+				idleDelete = true
+			}
+		}
+	}
+}
+
+// How often a replicated stream's leader checks if the stream has been idle past its MaxStreamIdle.
+// This is also when the leader checks for messages past MaxAge and replicates how far it has republished.
+const idleCheckInterval = time.Second
+
+// Most messages we will look at for a single age expiry proposal.
+const maxAgeExpiryBatch = 64 * 1024
+
+// checkAgeExpiry will return the sequence below which all messages are past MaxAge, or 0 if
+// there is nothing new to expire. This should only be called on the leader, which will propose
+// it so every replica removes the same messages.
+func (mset *Stream) checkAgeExpiry() uint64 {
+	mset.mu.RLock()
+	maxAge, store, ldage, expseq := mset.config.MaxAge, mset.store, mset.ldage, mset.expseq
+	hold := mset.config.RetentionHold
+	mset.mu.RUnlock()
+
+	if !ldage || hold || maxAge <= 0 || store == nil {
+		return 0
+	}
+	state := store.State()
+	if state.Msgs == 0 {
+		return 0
+	}
+	minTs := time.Now().Add(-maxAge).UnixNano()
+	seq := state.FirstSeq
+	for n := 0; seq <= state.LastSeq && n < maxAgeExpiryBatch; seq, n = seq+1, n+1 {
+		_, _, _, ts, err := store.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound {
+			continue
+		}
+		if err != nil || ts > minTs {
+			break
+		}
+	}
+	// Make sure we stop at a message that is still present, stores compact up to an existing one.
+	for ; seq <= state.LastSeq; seq++ {
+		if _, _, _, _, err := store.LoadMsg(seq); err != ErrStoreMsgNotFound {
+			break
+		}
+	}
+	// Nothing expired, or we already proposed this and it has not been applied yet.
+	if seq <= state.FirstSeq || (seq <= expseq && state.FirstSeq < expseq) {
+		return 0
+	}
+	mset.mu.Lock()
+	mset.expseq = seq
+	mset.mu.Unlock()
+	return seq
+}
+
+func encodeStreamExpire(seq uint64) []byte {
+	var bb [9]byte
+	bb[0] = byte(expireMsgsOp)
+	binary.LittleEndian.PutUint64(bb[1:], seq)
+	return bb[:]
+}
+
+func encodeStreamAckFloor(seq uint64) []byte {
+	var bb [9]byte
+	bb[0] = byte(ackFloorOp)
+	binary.LittleEndian.PutUint64(bb[1:], seq)
+	return bb[:]
+}
+
+func encodeStreamWritePause(until int64) []byte {
+	var bb [9]byte
+	bb[0] = byte(pauseWritesOp)
+	binary.LittleEndian.PutUint64(bb[1:], uint64(until))
+	return bb[:]
+}
+
+// hasActiveConsumers returns true if any of our consumers have recent activity.
+func (mset *Stream) hasActiveConsumers() bool {
+	for _, o := range mset.Consumers() {
+		if o.hasActivity() {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdle returns true if we have had no new messages since created and no consumer
+// activity since lastActive for our MaxStreamIdle. The last message time is replicated
+// with the message, so the idle clock survives a leader change.
+func (mset *Stream) isIdle(created, lastActive time.Time) bool {
+	mset.mu.RLock()
+	maxIdle, hold := mset.config.MaxStreamIdle, mset.config.RetentionHold
+	mset.mu.RUnlock()
+
+	if maxIdle <= 0 || hold {
+		return false
+	}
+	last := created
+	if state := mset.State(); state.LastSeq > 0 && state.LastTime.After(last) {
+		last = state.LastTime
+	}
+	if lastActive.After(last) {
+		last = lastActive
+	}
+	// A newly added consumer counts as activity.
+	for _, o := range mset.Consumers() {
+		if oc := o.Created(); oc.After(last) {
+			last = oc
+		}
+	}
+	return time.Since(last) >= maxIdle
+}
+
+const (
+	// How often a replicated stream's leader will compact, if the stream's policy asks for it.
+	compactionInterval = time.Minute
+	// We will also compact when the stream has grown this much since we last did.
+	compactionSizeTrigger = 8 * 1024 * 1024
+	// Upper bound on the deletes proposed at once, stays below the raft proposal queue.
+	maxCompactionBatch = 128
+)
+
+// compactionDeletes will return deletes for messages that have a newer message on
+// the same subject, up to max. We walk backwards so we see the last message for a
+// subject first. Messages stored while we walk are newer than anything we delete.
+func (mset *Stream) compactionDeletes(max int) []*streamMsgDelete {
+	state := mset.State()
+	if state.Msgs == 0 {
+		return nil
+	}
+	var mds []*streamMsgDelete
+	last := make(map[string]uint64)
+	for seq := state.LastSeq; seq >= state.FirstSeq && seq > 0 && len(mds) < max; seq-- {
+		subj, _, _, _, err := mset.store.LoadMsg(seq)
+		if err != nil {
+			continue
+		}
+		if newer, ok := last[subj]; ok {
+			mds = append(mds, &streamMsgDelete{Stream: mset.Name(), Seq: seq, Newer: newer})
+		} else {
+			last[subj] = seq
+		}
+	}
+	return mds
+}
+
+func (js *jetStream) applyStreamEntries(mset *Stream, ce *CommittedEntry) (bool, error) {
+	var didSnap bool
+	for _, e := range ce.Entries {
+		if e.Type == EntrySnapshot {
+			if err := mset.processSnapshot(e.Data); err != nil {
+				js.srv.Errorf("JetStream cluster failed to apply snapshot for '%s > %s': %v", mset.account(), mset.Name(), err)
+				return didSnap, err
+			}
+			didSnap = true
+		} else {
+			buf := e.Data
+			switch entryOp(buf[0]) {
+			case streamMsgOp:
+				subject, reply, hdr, msg, lseq, ts, err := decodeStreamMsg(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				// Skip by hand here since first msg special case.
+				// Reason is sequence is unsigned and for lseq being 0
+				// the lseq under stream would have be -1.
+				if lseq == 0 && mset.lastSeq() != 0 {
+					continue
+				}
+				if err := mset.processJetStreamMsg(subject, reply, hdr, msg, lseq, ts, ce.Index); err != nil {
+					js.srv.Debugf("Got error processing JetStream msg: %v", err)
+				}
+			case deleteMsgOp:
+				md, err := decodeMsgDelete(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				s, cc := js.server(), js.cluster
+				// For compaction we only delete if the newer message is still present, e.g. it could have
+				// been deleted by a user or limits since proposed. This is decided the same on every replica.
+				if md.Newer > 0 {
+					if _, _, _, _, err := mset.store.LoadMsg(md.Newer); err == nil {
+						if _, err := mset.RemoveMsg(md.Seq); err != nil {
+							s.Warnf("JetStream cluster failed to compact msg %d from stream %q: %v", md.Seq, md.Stream, err)
+						}
+					} else {
+						mset.perSubjectDeleteSkipped(md.Seq)
+					}
+					continue
+				}
+				// Removals for retention, e.g. when a retention hold is released, have no one to respond to.
+				if md.NoErase {
+					if _, err := mset.RemoveMsg(md.Seq); err != nil {
+						s.Warnf("JetStream cluster failed to remove msg %d from stream %q: %v", md.Seq, md.Stream, err)
+					}
+					continue
+				}
+				removed, err := mset.EraseMsg(md.Seq)
+				if err != nil {
+					s.Warnf("JetStream cluster failed to delete msg %d from stream %q for account %q: %v", md.Seq, md.Stream, md.Client.Account, err)
+				}
+				js.mu.RLock()
+				isLeader := cc.isStreamLeader(md.Client.Account, md.Stream)
+				js.mu.RUnlock()
+				if isLeader {
+					var resp = JSApiMsgDeleteResponse{ApiResponse: ApiResponse{Type: JSApiMsgDeleteResponseType}}
+					if err != nil {
+						resp.Error = jsError(err)
+						s.sendAPIErrResponse(md.Client, mset.account(), _EMPTY_, md.Reply, _EMPTY_, s.jsonResponse(resp))
+					} else if !removed {
+						resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("sequence [%d] not found", md.Seq)}
+						s.sendAPIErrResponse(md.Client, mset.account(), _EMPTY_, md.Reply, _EMPTY_, s.jsonResponse(resp))
+					} else {
+						resp.Success = true
+						s.sendAPIResponse(md.Client, mset.account(), _EMPTY_, md.Reply, _EMPTY_, s.jsonResponse(resp))
+					}
+				}
+			case purgeStreamOp:
+				sp, err := decodeStreamPurge(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				s := js.server()
+				purged, err := mset.Purge()
+				if err != nil {
+					s.Warnf("JetStream cluster failed to purge stream %q for account %q: %v", sp.Stream, sp.Client.Account, err)
+				}
+				js.mu.RLock()
+				isLeader := js.cluster.isStreamLeader(sp.Client.Account, sp.Stream)
+				js.mu.RUnlock()
+				if isLeader {
+					// Replicate our new floor so replicas that missed the purge never store below it.
+					if err == nil {
+						if n := mset.raftNode(); n != nil {
+							n.Propose(encodeMinRetainedSeq(mset.lastSeq() + 1))
+						}
+					}
+					var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+					if err != nil {
+						resp.Error = jsError(err)
+						s.sendAPIErrResponse(sp.Client, mset.account(), _EMPTY_, sp.Reply, _EMPTY_, s.jsonResponse(resp))
+					} else {
+						resp.Purged = purged
+						resp.Success = true
+						s.sendAPIResponse(sp.Client, mset.account(), _EMPTY_, sp.Reply, _EMPTY_, s.jsonResponse(resp))
+					}
+				}
+			case rePublishedOp:
+				if len(buf) < 9 {
+					panic(errBadStreamMsg.Error())
+				}
+				mset.setRePublished(binary.LittleEndian.Uint64(buf[1:]))
+			case minRetainedSeqOp:
+				if len(buf) < 9 {
+					panic(errBadStreamMsg.Error())
+				}
+				mset.setMinRetainedSeq(binary.LittleEndian.Uint64(buf[1:]))
+			case expireMsgsOp:
+				if len(buf) < 9 {
+					panic(errBadStreamMsg.Error())
+				}
+				seq := binary.LittleEndian.Uint64(buf[1:])
+				s := js.server()
+				expired, first, err := mset.expireTo(seq)
+				if err != nil {
+					s.Warnf("JetStream cluster failed to expire msgs below %d from stream '%s > %s': %v", seq, mset.account().GetName(), mset.Name(), err)
+				}
+				if expired > 0 && mset.isLeader() {
+					s.sendStreamMaxAgeExpiryAdvisory(mset, expired, first, seq-1)
+				}
+			case ackFloorOp:
+				if len(buf) < 9 {
+					panic(errBadStreamMsg.Error())
+				}
+				seq := binary.LittleEndian.Uint64(buf[1:])
+				if _, _, err := mset.expireTo(seq); err != nil {
+					js.srv.Warnf("JetStream cluster failed to remove acked msgs below %d from stream '%s > %s': %v", seq, mset.account().GetName(), mset.Name(), err)
+				}
+			case pauseWritesOp:
+				if len(buf) < 9 {
+					panic(errBadStreamMsg.Error())
+				}
+				mset.setWritePause(int64(binary.LittleEndian.Uint64(buf[1:])))
+			case streamConfigOp:
+				su, err := decodeStreamConfigUpdate(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				// The client may not be set, e.g. for updates proposed by the server itself.
+				s, accName := js.server(), mset.account().GetName()
+				if err = mset.Update(su.Config); err != nil {
+					s.Warnf("JetStream cluster failed to update stream %q for account %q: %v", su.Config.Name, accName, err)
+				}
+				js.mu.RLock()
+				isLeader := js.cluster.isStreamLeader(accName, su.Config.Name)
+				js.mu.RUnlock()
+				if isLeader && su.Reply != _EMPTY_ {
+					var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+					if err != nil {
+						resp.Error = jsError(err)
+						s.sendAPIErrResponse(su.Client, mset.account(), _EMPTY_, su.Reply, _EMPTY_, s.jsonResponse(resp))
+					} else {
+						resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Cluster: s.clusterInfo(mset.raftNode())}
+						s.sendAPIResponse(su.Client, mset.account(), _EMPTY_, su.Reply, _EMPTY_, s.jsonResponse(resp))
+					}
+				}
+			case snapshotRequestOp:
+				// The leader will snapshot, see monitorStream.
+			default:
+				panic("JetStream Cluster Unknown group entry op type!")
+			}
+		}
+	}
+	return didSnap, nil
+}
+
+// Returns the PeerInfo for all replicas of a raft node. This is different than node.Peers()
+// and is used for external facing advisories.
+func (s *Server) replicas(node RaftNode) []*PeerInfo {
+	now := time.Now()
+	var replicas []*PeerInfo
+	for _, rp := range node.Peers() {
+		pi := &PeerInfo{Name: s.serverNameForNode(rp.ID), Current: rp.Current, Active: now.Sub(rp.Last)}
+		replicas = append(replicas, pi)
+	}
+	return replicas
+}
+
+func (js *jetStream) processStreamLeaderChange(mset *Stream, sa *streamAssignment, isLeader bool) {
+	js.mu.Lock()
+	s, account, err := js.srv, sa.Client.Account, sa.err
+	client, reply, cfg := sa.Client, sa.Reply, sa.Config
+	hasResponded := sa.responded
+	sa.responded = true
+	js.mu.Unlock()
+
+	stream := mset.Name()
+
+	if isLeader {
+		s.Noticef("JetStream cluster new stream leader for '%s > %s'", sa.Client.Account, stream)
+		s.sendStreamLeaderElectAdvisory(mset)
+	} else {
+		// We are stepping down.
+		// Make sure if we are doing so because we have lost quorum that we send the appropriate advisories.
+		if node := mset.raftNode(); node != nil && !node.Quorum() {
+			s.sendStreamLostQuorumAdvisory(mset)
+		}
+	}
+
+	// Tell stream to switch leader status.
+	mset.setLeader(isLeader)
+
+	// If the previous leader did not get a config update into our log, propose it now.
+	if node := mset.raftNode(); isLeader && node != nil && cfg != nil {
+		if ncfg, err := checkStreamCfg(cfg); err == nil && !reflect.DeepEqual(mset.Config(), ncfg) {
+			node.Propose(encodeStreamConfigUpdate(&streamConfigUpdate{Config: cfg, Client: client}))
+		}
+	}
+
+	if !isLeader || hasResponded {
+		return
+	}
+
+	acc, _ := s.LookupAccount(account)
+	if acc == nil {
+		return
+	}
+
+	// Send our response.
+	var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(client, acc, _EMPTY_, reply, _EMPTY_, s.jsonResponse(&resp))
+	} else {
+		resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Cluster: s.clusterInfo(mset.raftNode())}
+		s.sendAPIResponse(client, acc, _EMPTY_, reply, _EMPTY_, s.jsonResponse(&resp))
+		if node := mset.raftNode(); node != nil {
+			mset.sendCreateAdvisory()
+		}
+	}
+}
+
+// Fixed value ok for now.
+const lostQuorumAdvInterval = 10 * time.Second
+
+// Determines if we should send lost quorum advisory. We throttle these after first one.
+func (mset *Stream) shouldSendLostQuorum() bool {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if time.Since(mset.lqsent) >= lostQuorumAdvInterval {
+		mset.lqsent = time.Now()
+		return true
+	}
+	return false
+}
+
+func (s *Server) sendStreamLostQuorumAdvisory(mset *Stream) {
+	if mset == nil {
+		return
+	}
+	node, stream, acc := mset.raftNode(), mset.Name(), mset.account()
+	if node == nil {
+		return
+	}
+	if !mset.shouldSendLostQuorum() {
+		return
+	}
+
+	s.Warnf("JetStream cluster stream '%s > %s' has NO quorum, stalled.", acc.GetName(), stream)
+
+	subj := JSAdvisoryStreamQuorumLostPre + "." + stream
+	adv := &JSStreamQuorumLostAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamQuorumLostAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Replicas: s.replicas(node),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+// Determines if we should send an asymmetric partition advisory. Throttled like lost quorum.
+func (mset *Stream) shouldSendAsymmetricPartition() bool {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if time.Since(mset.apsent) >= lostQuorumAdvInterval {
+		mset.apsent = time.Now()
+		return true
+	}
+	return false
+}
+
+func (s *Server) sendStreamAsymmetricPartitionAdvisory(mset *Stream, mute []string) {
+	if mset == nil {
+		return
+	}
+	node, stream, acc := mset.raftNode(), mset.Name(), mset.account()
+	if node == nil {
+		return
+	}
+	if !mset.shouldSendAsymmetricPartition() {
+		return
+	}
+
+	var names []string
+	for _, peer := range mute {
+		names = append(names, s.serverNameForNode(peer))
+	}
+
+	s.Warnf("JetStream cluster stream '%s > %s' is not receiving responses from %v", acc.GetName(), stream, names)
+
+	subj := JSAdvisoryStreamAsymmetricPartitionPre + "." + stream
+	adv := &JSStreamAsymmetricPartitionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamAsymmetricPartitionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Leader:   s.serverNameForNode(node.GroupLeader()),
+		Mute:     names,
+		Replicas: s.replicas(node),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+func (s *Server) sendStreamMaxAgeExpiryAdvisory(mset *Stream, expired, first, last uint64) {
+	if mset == nil {
+		return
+	}
+	stream, acc := mset.Name(), mset.account()
+
+	subj := JSAdvisoryStreamMaxAgeExpiryPre + "." + stream
+	adv := &JSStreamMaxAgeExpiryAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamMaxAgeExpiryAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Expired:  expired,
+		FirstSeq: first,
+		LastSeq:  last,
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+func (s *Server) sendStreamLeaderElectAdvisory(mset *Stream) {
+	if mset == nil {
+		return
+	}
+	node, stream, acc := mset.raftNode(), mset.Name(), mset.account()
+	if node == nil {
+		return
+	}
+	subj := JSAdvisoryStreamLeaderElectedPre + "." + stream
+	adv := &JSStreamLeaderElectedAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamLeaderElectedAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Leader:   s.serverNameForNode(node.GroupLeader()),
+		Replicas: s.replicas(node),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+// Will lookup a stream assignment.
+// Lock should be held.
+func (js *jetStream) streamAssignment(account, stream string) (sa *streamAssignment) {
+	cc := js.cluster
+	if cc == nil {
+		return nil
+	}
+
+	if as := cc.streams[account]; as != nil {
+		sa = as[stream]
+	}
+	return sa
+}
+
+// processStreamAssignment is called when followers have replicated an assignment.
+func (js *jetStream) processStreamAssignment(sa *streamAssignment) {
+	js.mu.RLock()
+	s, cc := js.srv, js.cluster
+	js.mu.RUnlock()
+	if s == nil || cc == nil {
+		// TODO(dlc) - debug at least
+		return
+	}
+
+	acc, err := s.LookupAccount(sa.Client.Account)
+	if err != nil {
+		// TODO(dlc) - log error
+		return
+	}
+	stream := sa.Config.Name
+
+	js.mu.Lock()
+	// Check if we already have this assigned.
+	accStreams := cc.streams[acc.Name]
+	if accStreams != nil && accStreams[stream] != nil {
+		// TODO(dlc) - Debug?
+		// We already have this assignment, should we check they are the same?
+		js.mu.Unlock()
+		return
+	}
+	if accStreams == nil {
+		accStreams = make(map[string]*streamAssignment)
+	}
+	// Update our state.
+	accStreams[stream] = sa
+	cc.streams[acc.Name] = accStreams
+
+	var isMember bool
+	if sa.Group != nil && cc.meta != nil {
+		isMember = sa.Group.isMember(cc.meta.ID())
+	}
+	js.mu.Unlock()
+
+	// Check if this is for us..
+	if isMember {
+		js.processClusterCreateStream(acc, sa)
+	}
+}
+
+// processUpdateStreamAssignment is called when followers have replicated an updated stream configuration.
+func (js *jetStream) processUpdateStreamAssignment(sa *streamAssignment) {
+	js.mu.Lock()
+	s, cc := js.srv, js.cluster
+	if s == nil || cc == nil {
+		js.mu.Unlock()
+		return
+	}
+	osa := js.streamAssignment(sa.Client.Account, sa.Config.Name)
+	if osa == nil {
+		js.mu.Unlock()
+		return
+	}
+	// Update our config, the group and consumers remain.
+	osa.Config = sa.Config
+	isMember := osa.Group.isMember(cc.meta.ID())
+	js.mu.Unlock()
+
+	if isMember {
+		js.processClusterUpdateStream(sa)
+	}
+}
+
+// processClusterUpdateStream is called when we have an updated stream assignment and
+// this server is a member of the peer group.
+func (js *jetStream) processClusterUpdateStream(sa *streamAssignment) {
+	js.mu.RLock()
+	s, cc, recovering := js.srv, js.cluster, sa.recovering
+	js.mu.RUnlock()
+
+	acc, err := s.LookupAccount(sa.Client.Account)
+	if err != nil {
+		s.Debugf("JetStream cluster failed to lookup account %q: %v", sa.Client.Account, err)
+		return
+	}
+	mset, err := acc.LookupStream(sa.Config.Name)
+	if err != nil {
+		s.Debugf("JetStream cluster failed to lookup stream '%s > %s': %v", sa.Client.Account, sa.Config.Name, err)
+		return
+	}
+
+	// Config changes need to be ordered with the messages in our own log, so the leader will propose them.
+	// When recovering this has already been committed and our log may have been compacted, so apply directly.
+	node := mset.raftNode()
+	if node == nil || recovering {
+		err = mset.Update(sa.Config)
+	}
+
+	js.mu.RLock()
+	isLeader := cc.isStreamLeader(sa.Client.Account, sa.Config.Name)
+	js.mu.RUnlock()
+
+	if !isLeader {
+		return
+	}
+	if node != nil && !recovering {
+		su := &streamConfigUpdate{Config: sa.Config, Reply: sa.Reply, Client: sa.Client}
+		if err = node.Propose(encodeStreamConfigUpdate(su)); err == nil {
+			// We will respond when applied.
+			return
+		}
+	}
+	if sa.Reply == _EMPTY_ {
+		return
+	}
+	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(sa.Client, acc, _EMPTY_, sa.Reply, _EMPTY_, s.jsonResponse(&resp))
+	} else {
+		resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Cluster: s.clusterInfo(node)}
+		s.sendAPIResponse(sa.Client, acc, _EMPTY_, sa.Reply, _EMPTY_, s.jsonResponse(&resp))
+	}
+}
+
+// processClusterCreateStream is called when we have a stream assignment that
+// has been committed and this server is a member of the peer group.
+func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignment) {
+	if sa == nil {
+		return
+	}
+
+	js.mu.RLock()
+	s, rg := js.srv, sa.Group
+	js.mu.RUnlock()
+
+	// Process the raft group and make sure it's running if needed.
+	err := js.createRaftGroup(rg)
+
+	// If we are restoring, create the stream if we are R>1 and not the preferred who handles the
+	// receipt of the snapshot itself.
+	shouldCreate := true
+	if sa.Restore != nil {
+		if len(rg.Peers) == 1 || rg.node != nil && rg.node.ID() == rg.Preferred {
+			shouldCreate = false
+		}
+	}
+
+	var mset *Stream
+
+	// Process here if not restoring or not the leader.
+	if shouldCreate && err == nil {
+		// Go ahead and create or update the stream.
+		mset, err = acc.LookupStream(sa.Config.Name)
+		if err == nil && mset != nil {
+			mset.setStreamAssignment(sa)
+			if err := mset.Update(sa.Config); err != nil {
+				s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
+			}
+		} else if err == ErrJetStreamStreamNotFound {
+			// Add in the stream here.
+			mset, err = acc.addStream(sa.Config, nil, sa)
+		}
+		if mset != nil {
+			mset.setCreated(sa.Created)
+		}
+	}
+
+	// This is an error condition.
+	if err != nil {
+		s.Debugf("Stream create failed for '%s > %s': %v", sa.Client.Account, sa.Config.Name, err)
+		js.mu.Lock()
+		sa.err = err
+		sa.responded = true
+		if rg.node != nil {
+			rg.node.Delete()
+		}
+		result := &streamAssignmentResult{
+			Account:  sa.Client.Account,
+			Stream:   sa.Config.Name,
+			Response: &JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}},
+		}
+		result.Response.Error = jsError(err)
+		// Let the metadata leader know to place this group elsewhere.
+		if err == ErrJetStreamMaximumRaftGroups {
+			result.Full = js.cluster.meta.ID()
+		}
+		js.mu.Unlock()
+
+		// Send response to the metadata leader. They will forward to the user as needed.
+		b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+		s.sendInternalMsgLocked(streamAssignmentSubj, _EMPTY_, nil, b)
+		return
+	}
+
+	// Start our monitoring routine.
+	if rg.node != nil {
+		s.startGoRoutine(func() { js.monitorStream(mset, sa) })
+	} else {
+		// Single replica stream, process manually here.
+		// If we are restoring, process that first.
+		if sa.Restore != nil {
+			// We are restoring a stream here.
+			restoreDoneCh := s.processStreamRestore(sa.Client, acc, sa.Config.Name, _EMPTY_, sa.Reply, _EMPTY_)
+			s.startGoRoutine(func() {
+				defer s.grWG.Done()
+				select {
+				case err := <-restoreDoneCh:
+					if err == nil {
+						mset, err = acc.LookupStream(sa.Config.Name)
+						if mset != nil {
+							mset.setStreamAssignment(sa)
+							mset.setCreated(sa.Created)
+						}
+					}
+					if err != nil {
+						if mset != nil {
+							mset.Delete()
+						}
+						js.mu.Lock()
+						sa.err = err
+						sa.responded = true
+						result := &streamAssignmentResult{
+							Account: sa.Client.Account,
+							Stream:  sa.Config.Name,
+							Restore: &JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}},
+						}
+						result.Restore.Error = jsError(sa.err)
+						js.mu.Unlock()
+						// Send response to the metadata leader. They will forward to the user as needed.
+						b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+						s.sendInternalMsgLocked(streamAssignmentSubj, _EMPTY_, nil, b)
+						return
+					}
+					js.processStreamLeaderChange(mset, sa, true)
+
+					// Check to see if we have restored consumers here.
+					// These are not currently assigned so we will need to do so here.
+					if consumers := mset.Consumers(); len(consumers) > 0 {
+						js.mu.RLock()
+						cc := js.cluster
+						js.mu.RUnlock()
+
+						for _, o := range mset.Consumers() {
+							name, cfg := o.Name(), o.Config()
+							rg := cc.createGroupForConsumer(sa, name)
+							// Place our initial state here as well for assignment distribution.
+							ca := &consumerAssignment{
+								Group:   rg,
+								Stream:  sa.Config.Name,
+								Name:    name,
+								Config:  &cfg,
+								Client:  sa.Client,
+								Created: o.Created(),
+							}
+
+							addEntry := encodeAddConsumerAssignment(ca)
+							cc.meta.ForwardProposal(addEntry)
+
+							// Check to make sure we see the assignment.
+							go func() {
+								ticker := time.NewTicker(time.Second)
+								defer ticker.Stop()
+								for range ticker.C {
+									js.mu.RLock()
+									ca, meta := js.consumerAssignment(ca.Client.Account, sa.Config.Name, name), cc.meta
+									js.mu.RUnlock()
+									if ca == nil {
+										s.Warnf("Consumer assignment has not been assigned, retrying")
+										meta.ForwardProposal(addEntry)
+									} else {
+										return
+									}
+								}
+							}()
+						}
+					}
+
+				case <-s.quitCh:
+					return
+				}
+			})
+		} else {
+			js.processStreamLeaderChange(mset, sa, true)
+		}
+	}
+}
+
+// processStreamRemoval is called when followers have replicated an assignment.
+func (js *jetStream) processStreamRemoval(sa *streamAssignment) {
+	js.mu.Lock()
+	s, cc := js.srv, js.cluster
+	if s == nil || cc == nil {
+		// TODO(dlc) - debug at least
+		js.mu.Unlock()
+		return
+	}
+	stream := sa.Config.Name
+	isMember := sa.Group.isMember(cc.meta.ID())
+	wasLeader := cc.isStreamLeader(sa.Client.Account, stream)
+
+	// Check if we already have this assigned.
+	accStreams := cc.streams[sa.Client.Account]
+	needDelete := accStreams != nil && accStreams[stream] != nil
+	if needDelete {
+		delete(accStreams, stream)
+		if len(accStreams) == 0 {
+			delete(cc.streams, sa.Client.Account)
+		}
+	}
+	js.mu.Unlock()
+
+	if needDelete {
+		js.processClusterDeleteStream(sa, isMember, wasLeader)
+	}
+}
+
+func (js *jetStream) processClusterDeleteStream(sa *streamAssignment, isMember, wasLeader bool) {
+	if sa == nil {
+		return
+	}
+	js.mu.RLock()
+	s := js.srv
+	js.mu.RUnlock()
+
+	acc, err := s.LookupAccount(sa.Client.Account)
+	if err != nil {
+		s.Debugf("JetStream cluster failed to lookup account %q: %v", sa.Client.Account, err)
+		return
+	}
+
+	var resp = JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+
+	// Go ahead and delete the stream.
+	mset, err := acc.LookupStream(sa.Config.Name)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+	} else if mset != nil {
+		if mset.Config().internal {
+			err = errors.New("not allowed to delete internal stream")
+		} else {
+			err = mset.stop(true, wasLeader)
+		}
+	}
+
+	if sa.Group.node != nil {
+		sa.Group.node.Delete()
+	}
+
+	// No one to respond to if we deleted this stream ourselves, e.g. when idle.
+	if !isMember || sa.Reply == _EMPTY_ || !wasLeader && sa.Group.node != nil && sa.Group.node.GroupLeader() != noLeader {
+		return
+	}
+
+	if err != nil {
+		if resp.Error == nil {
+			resp.Error = jsError(err)
+		}
+		s.sendAPIErrResponse(sa.Client, acc, _EMPTY_, sa.Reply, _EMPTY_, s.jsonResponse(resp))
+	} else {
+		resp.Success = true
+		s.sendAPIResponse(sa.Client, acc, _EMPTY_, sa.Reply, _EMPTY_, s.jsonResponse(resp))
+	}
+}
+
+// processConsumerAssignment is called when followers have replicated an assignment for a consumer.
+func (js *jetStream) processConsumerAssignment(ca *consumerAssignment) {
+	js.mu.Lock()
+	s, cc := js.srv, js.cluster
+	if s == nil || cc == nil {
+		// TODO(dlc) - debug at least
+		js.mu.Unlock()
+		return
+	}
+
+	sa := js.streamAssignment(ca.Client.Account, ca.Stream)
+	if sa == nil {
+		s.Debugf("Consumer create failed, could not locate stream '%s > %s'", ca.Client.Account, ca.Stream)
+		ca.err = ErrJetStreamStreamNotFound
+		result := &consumerAssignmentResult{
+			Account:  ca.Client.Account,
+			Stream:   ca.Stream,
+			Consumer: ca.Name,
+			Response: &JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}},
+		}
+		result.Response.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+		// Send response to the metadata leader. They will forward to the user as needed.
+		b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+		s.sendInternalMsgLocked(consumerAssignmentSubj, _EMPTY_, nil, b)
+		js.mu.Unlock()
+		return
+	}
+
+	if sa.consumers == nil {
+		sa.consumers = make(map[string]*consumerAssignment)
+	}
+
+	// Place into our internal map under the stream assignment.
+	// Ok to replace an existing one, we check on process call below.
+	sa.consumers[ca.Name] = ca
+
+	// The consumer's peers need to be members of the stream. If they are not the meta leader
+	// will propose a correction, and we only process this if we have the stream.
+	if cc.isLeader() {
+		if nca := cc.correctConsumerPeers(sa, ca); nca != nil {
+			cc.meta.Propose(encodeAddConsumerAssignment(nca))
+		}
+	}
+	ourID := cc.meta.ID()
+	isMember := ca.Group.isMember(ourID) && sa.Group.isMember(ourID)
+	js.mu.Unlock()
+
+	// Check if this is for us..
+	if isMember {
+		js.processClusterCreateConsumer(ca)
+		js.removeStaleConsumerPeers(ca)
+	}
+}
+
+// removeStaleConsumerPeers will have the consumer leader remove raft peers that are no
+// longer part of the consumer's assignment, e.g. after a peer correction.
+func (js *jetStream) removeStaleConsumerPeers(ca *consumerAssignment) {
+	js.mu.RLock()
+	node := ca.Group.node
+	js.mu.RUnlock()
+
+	if node == nil || !node.Leader() {
+		return
+	}
+	for _, peer := range node.Peers() {
+		if !ca.Group.isMember(peer.ID) {
+			node.ProposeRemovePeer(peer.ID)
+		}
+	}
+}
+
+func (js *jetStream) processConsumerRemoval(ca *consumerAssignment) {
+	js.mu.Lock()
+	s, cc := js.srv, js.cluster
+	if s == nil || cc == nil {
+		// TODO(dlc) - debug at least
+		js.mu.Unlock()
+		return
+	}
+	isMember := ca.Group.isMember(cc.meta.ID())
+	wasLeader := cc.isConsumerLeader(ca.Client.Account, ca.Stream, ca.Name)
+
+	// Delete from our state.
+	var needDelete bool
+	if accStreams := cc.streams[ca.Client.Account]; accStreams != nil {
+		if sa := accStreams[ca.Stream]; sa != nil && sa.consumers != nil && sa.consumers[ca.Name] != nil {
+			needDelete = true
+			delete(sa.consumers, ca.Name)
+		}
+	}
+	js.mu.Unlock()
+
+	if needDelete {
+		js.processClusterDeleteConsumer(ca, isMember, wasLeader)
+	}
+}
+
+type consumerAssignmentResult struct {
+	Account  string                       `json:"account"`
+	Stream   string                       `json:"stream"`
+	Consumer string                       `json:"consumer"`
+	Response *JSApiConsumerCreateResponse `json:"response,omitempty"`
+}
+
+// processClusterCreateConsumer is when we are a member fo the group and need to create the consumer.
+func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
+	if ca == nil {
+		return
+	}
+	js.mu.RLock()
+	s := js.srv
+	acc, err := s.LookupAccount(ca.Client.Account)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to lookup account %q: %v", ca.Client.Account, err)
+		js.mu.RUnlock()
+		return
+	}
+	rg := ca.Group
+	js.mu.RUnlock()
+
+	// Go ahead and create or update the consumer.
+	mset, err := acc.LookupStream(ca.Stream)
+	if err != nil {
+		js.mu.Lock()
+		s.Debugf("Consumer create failed, could not locate stream '%s > %s'", ca.Client.Account, ca.Stream)
+		ca.err = ErrJetStreamStreamNotFound
+		result := &consumerAssignmentResult{
+			Account:  ca.Client.Account,
+			Stream:   ca.Stream,
+			Consumer: ca.Name,
+			Response: &JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}},
+		}
+		result.Response.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+		// Send response to the metadata leader. They will forward to the user as needed.
+		b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+		s.sendInternalMsgLocked(consumerAssignmentSubj, _EMPTY_, nil, b)
+		js.mu.Unlock()
+		return
+	}
+
+	// Process the raft group and make sure its running if needed.
+	js.createRaftGroup(rg)
+
+	// Check if we already have this consumer running.
+	o := mset.LookupConsumer(ca.Name)
+	if o != nil {
+		if o.isDurable() && o.isPushMode() {
+			ocfg := o.Config()
+			if configsEqualSansDelivery(ocfg, *ca.Config) && (ocfg.allowNoInterest || o.hasNoLocalInterest()) {
+				o.updateDeliverSubject(ca.Config.DeliverSubject)
+			}
+		}
+		// If we have already responded for this consumer do not do so again on a leader change.
+		o.mu.RLock()
+		oca := o.ca
+		o.mu.RUnlock()
+		js.mu.Lock()
+		if oca != nil && oca.responded {
+			ca.responded = true
+		}
+		js.mu.Unlock()
+		o.setConsumerAssignment(ca)
+		s.Debugf("JetStream cluster, consumer was already running")
+	}
+
+	// Add in the consumer if needed.
+	if o == nil {
+		o, err = mset.addConsumer(ca.Config, ca.Name, ca)
+	}
+
+	// If we have an initial state set apply that now.
+	// If this fails the consumer is still up but has lost its position, so we do not fail the create.
+	if ca.State != nil && o != nil && err == nil {
+		if serr := o.restoreStoreState(ca.State); serr != nil {
+			s.Warnf("JetStream cluster consumer '%s > %s > %s' failed to restore state: %v", ca.Client.Account, ca.Stream, ca.Name, serr)
+			s.sendConsumerStateRestoreFailedAdvisory(o, ca.State, serr)
+		}
+	}
+
+	if err != nil {
+		js.srv.Debugf("Consumer create failed for '%s > %s > %s': %v\n", ca.Client.Account, ca.Stream, ca.Name, err)
+		ca.err = err
+		if rg.node != nil {
+			rg.node.Delete()
+		}
+		result := &consumerAssignmentResult{
+			Account:  ca.Client.Account,
+			Stream:   ca.Stream,
+			Consumer: ca.Name,
+			Response: &JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}},
+		}
+		result.Response.Error = jsError(err)
+
+		// Send response to the metadata leader. They will forward to the user as needed.
+		b, _ := json.Marshal(result) // Avoids auto-processing and doing fancy json with newlines.
+		s.sendInternalMsgLocked(consumerAssignmentSubj, _EMPTY_, nil, b)
+	} else {
+		o.setCreated(ca.Created)
+		// Start our monitoring routine.
+		if rg.node != nil {
+			s.startGoRoutine(func() { js.monitorConsumer(o, ca) })
+		} else {
+			// Single replica consumer, process manually here.
+			js.processConsumerLeaderChange(o, ca, true)
+		}
+	}
+}
+
+func (js *jetStream) processClusterDeleteConsumer(ca *consumerAssignment, isMember, wasLeader bool) {
+	if ca == nil {
+		return
+	}
+	js.mu.RLock()
+	s := js.srv
+	js.mu.RUnlock()
+
+	acc, err := s.LookupAccount(ca.Client.Account)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to lookup account %q: %v", ca.Client.Account, err)
+		return
+	}
+
+	var resp = JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+
+	// Go ahead and delete the consumer.
+	mset, err := acc.LookupStream(ca.Stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+	} else if mset != nil {
+		if mset.Config().internal {
+			err = errors.New("not allowed to delete internal consumer")
+		} else if o := mset.LookupConsumer(ca.Name); o != nil {
+			err = o.stop(true, true, wasLeader)
+		} else {
+			resp.Error = jsNoConsumerErr
+		}
+	}
+
+	if ca.Group.node != nil {
+		ca.Group.node.Delete()
+	}
+
+	if !wasLeader || ca.Reply == _EMPTY_ {
+		return
+	}
+
+	if err != nil {
+		if resp.Error == nil {
+			resp.Error = jsError(err)
+		}
+		s.sendAPIErrResponse(ca.Client, acc, _EMPTY_, ca.Reply, _EMPTY_, s.jsonResponse(resp))
+	} else {
+		resp.Success = true
+		s.sendAPIResponse(ca.Client, acc, _EMPTY_, ca.Reply, _EMPTY_, s.jsonResponse(resp))
+	}
+}
+
+// Returns the consumer assignment, or nil if not present.
+// Lock should be held.
+func (js *jetStream) consumerAssignment(account, stream, consumer string) *consumerAssignment {
+	if sa := js.streamAssignment(account, stream); sa != nil {
+		return sa.consumers[consumer]
+	}
+	return nil
+}
+
+// consumerAssigned informs us if this server has this consumer assigned.
+func (jsa *jsAccount) consumerAssigned(stream, consumer string) bool {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+
+	js, acc := jsa.js, jsa.account
+	if js == nil {
+		return false
+	}
+	return js.cluster.isConsumerAssigned(acc, stream, consumer)
+}
+
+// Read lock should be held.
+func (cc *jetStreamCluster) isConsumerAssigned(a *Account, stream, consumer string) bool {
+	// Non-clustered mode always return true.
+	if cc == nil {
+		return true
+	}
+	var sa *streamAssignment
+	accStreams := cc.streams[a.Name]
+	if accStreams != nil {
+		sa = accStreams[stream]
+	}
+	if sa == nil {
+		// TODO(dlc) - This should not happen.
+		return false
+	}
+	ca := sa.consumers[consumer]
+	if ca == nil {
+		return false
+	}
+	rg := ca.Group
+	// Check if we are the leader of this raftGroup assigned to the stream.
+	ourID := cc.meta.ID()
+	for _, peer := range rg.Peers {
+		if peer == ourID {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Consumer) raftNode() RaftNode {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.node
+}
+
+func (js *jetStream) monitorConsumer(o *Consumer, ca *consumerAssignment) {
+	s, n := js.server(), o.raftNode()
+	defer s.grWG.Done()
+
+	if n == nil {
+		s.Warnf("No RAFT group for consumer")
+		return
+	}
+
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	const (
+		compactInterval    = 1 * time.Minute
+		compactSizeLimit   = 8 * 1024 * 1024
+		checkpointInterval = 10 * time.Second
+	)
+
+	s.Debugf("Starting consumer monitor for '%s > %s > %s", o.acc.Name, ca.Stream, ca.Name)
+	defer s.Debugf("Exiting consumer monitor for '%s > %s > %s'", o.acc.Name, ca.Stream, ca.Name)
+
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	ct := time.NewTicker(checkpointInterval)
+	defer ct.Stop()
+
+	// Our last applied and last checkpoint.
+	last, lcp := uint64(0), uint64(0)
+	isLeader := false
+
+	// When we become leader we propose a barrier and only start acting as leader once it is applied.
+	// Everything before it in our log, e.g. deliveries and acks from the prior leader, is then in our
+	// store, so the pending state we restore and enforce MaxAckPending with is accurate.
+	var syncID uint64
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			// No special processing needed for when we are caught up on restart.
+			if ce == nil {
+				continue
+			}
+			if hadCheckpoint, err := js.applyConsumerEntries(o, ce); err == nil {
+				n.Applied(ce.Index)
+				last = ce.Index
+				if syncID > 0 && hasLeaderSync(ce, syncID) {
+					syncID = 0
+					js.processConsumerLeaderChange(o, ca, true)
+				}
+				// Our state and settings are fully captured at a checkpoint, so we can compact below it.
+				// Never compact past our last checkpoint, entries after it are needed on restart.
+				if hadCheckpoint {
+					lcp = last
+					n.Compact(last)
+				} else if _, b := n.Size(); b > compactSizeLimit && lcp > 0 {
+					n.Compact(lcp)
+				}
+			} else {
+				n.ApplyFailed(ce.Index, err)
+			}
+		case isLeader = <-lch:
+			syncID = 0
+			if isLeader {
+				id := rand.Uint64() | 1
+				if err := n.Propose(encodeConsumerLeaderSync(id)); err == nil {
+					syncID = id
+					continue
+				}
+			}
+			if !isLeader && n.GroupLeader() != noLeader {
+				js.setConsumerAssignmentResponded(ca)
+			}
+			js.processConsumerLeaderChange(o, ca, isLeader)
+		case <-ct.C:
+			// Only the leader proposes checkpoints, and only if we have applied entries since the last one.
+			if isLeader && syncID == 0 && last > lcp {
+				if state := o.readStoreState(); state != nil && state.Delivered.Consumer > 0 {
+					n.Propose(encodeConsumerCheckpoint(state, o.settings()))
+				}
+			}
+		case <-t.C:
+			// TODO(dlc) - We should have this delayed a bit to not race the invariants.
+			if lcp != 0 {
+				n.Compact(lcp)
+			}
+		}
+	}
+}
+
+func (js *jetStream) applyConsumerEntries(o *Consumer, ce *CommittedEntry) (bool, error) {
+	var didSnap bool
+	for _, e := range ce.Entries {
+		if e.Type == EntrySnapshot {
+			// No-op needed?
+			state, err := decodeConsumerState(e.Data)
+			if err != nil {
+				panic(err.Error())
+			}
+			o.store.Update(state)
+			didSnap = true
+		} else {
+			buf := e.Data
+			switch entryOp(buf[0]) {
+			case updateDeliveredOp:
+				dseq, sseq, dc, ts, err := decodeDeliveredUpdate(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				if err := o.store.UpdateDelivered(dseq, sseq, dc, ts); err != nil {
+					panic(err.Error())
+				}
+			case updateAcksOp:
+				dseq, sseq, err := decodeAckUpdate(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				o.store.UpdateAcks(dseq, sseq)
+			case updateSkippedOp:
+				sseq, n := binary.Uvarint(buf[1:])
+				if n <= 0 {
+					panic(errBadConsumerSkip.Error())
+				}
+				o.store.UpdateSkipped(sseq)
+			case updateCheckpointOp:
+				state, cs, err := decodeConsumerCheckpoint(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				// The leader's state is authoritative and may have moved past the checkpoint.
+				if !o.isLeader() {
+					if err := o.store.Update(state); err != nil {
+						return didSnap, err
+					}
+					o.applySettings(cs)
+				}
+				didSnap = true
+			case pauseConsumerOp:
+				if len(buf) < 2 {
+					panic(errBadPauseUpdate.Error())
+				}
+				o.setPaused(buf[1] == 1)
+			case updateFilterOp:
+				o.setFilterSubject(string(buf[1:]))
+			case updateHeaderFilterOp:
+				o.setHeaderFilter(decodeConsumerHeaderFilter(buf[1:]))
+			case startSeqOp:
+				if len(buf) < 9 {
+					panic(errBadStartSeqUpdate.Error())
+				}
+				o.setStartSeq(binary.LittleEndian.Uint64(buf[1:]))
+			case leaderSyncOp:
+				// Nothing to apply, see monitorConsumer.
+			case deadLetterOp:
+				// Moved messages are no longer pending or redelivered.
+				dseq, sseq, err := decodeAckUpdate(buf[1:])
+				if err != nil {
+					panic(err.Error())
+				}
+				o.store.UpdateAcks(dseq, sseq)
+			default:
+				panic("JetStream Cluster Unknown group entry op type!")
+			}
+		}
+	}
+	return didSnap, nil
+}
+
+var errBadPauseUpdate = errors.New("jetstream cluster bad replicated pause update")
+var errBadStartSeqUpdate = errors.New("jetstream cluster bad replicated start sequence update")
+var errBadHeaderFilterUpdate = errors.New("jetstream cluster bad replicated header filter update")
+
+func encodeConsumerLeaderSync(id uint64) []byte {
+	var b [9]byte
+	b[0] = byte(leaderSyncOp)
+	binary.LittleEndian.PutUint64(b[1:], id)
+	return b[:]
+}
+
+// hasLeaderSync returns true if the committed entry has our leader barrier.
+func hasLeaderSync(ce *CommittedEntry, id uint64) bool {
+	for _, e := range ce.Entries {
+		if e.Type == EntryNormal && len(e.Data) >= 9 && entryOp(e.Data[0]) == leaderSyncOp {
+			if binary.LittleEndian.Uint64(e.Data[1:]) == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func encodeConsumerPause(paused bool) []byte {
+	var b [2]byte
+	b[0] = byte(pauseConsumerOp)
+	if paused {
+		b[1] = 1
+	}
+	return b[:]
+}
+
+func encodeConsumerFilterUpdate(filter string) []byte {
+	b := make([]byte, 1+len(filter))
+	b[0] = byte(updateFilterOp)
+	copy(b[1:], filter)
+	return b
+}
+
+// Header names can not contain a colon, so use it to separate the name and value.
+// An empty update clears the filter.
+func encodeConsumerHeaderFilter(hf *HeaderFilter) []byte {
+	if hf == nil {
+		return []byte{byte(updateHeaderFilterOp)}
+	}
+	b := make([]byte, 1, 2+len(hf.Name)+len(hf.Value))
+	b[0] = byte(updateHeaderFilterOp)
+	b = append(b, hf.Name...)
+	b = append(b, ':')
+	return append(b, hf.Value...)
+}
+
+func decodeConsumerHeaderFilter(buf []byte) *HeaderFilter {
+	if len(buf) == 0 {
+		return nil
+	}
+	i := bytes.IndexByte(buf, ':')
+	if i < 0 {
+		panic(errBadHeaderFilterUpdate.Error())
+	}
+	return &HeaderFilter{Name: string(buf[:i]), Value: string(buf[i+1:])}
+}
+
+// requestSnapshot will ask the leader of the group to snapshot. This is sent through the log
+// so the leader sees it in order. If we are the leader our own snapshot was bad, so step down.
+func requestSnapshot(n RaftNode) {
+	if n.Leader() {
+		n.StepDown()
+		return
+	}
+	n.ForwardProposal([]byte{byte(snapshotRequestOp)})
+}
+
+// hasSnapshotEntry returns true if the committed entries contain a snapshot.
+func hasSnapshotEntry(ce *CommittedEntry) bool {
+	for _, e := range ce.Entries {
+		if e.Type == EntrySnapshot {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSnapshotRequest returns true if the committed entries contain a snapshot request.
+func hasSnapshotRequest(ce *CommittedEntry) bool {
+	for _, e := range ce.Entries {
+		if e.Type == EntryNormal && len(e.Data) > 0 && entryOp(e.Data[0]) == snapshotRequestOp {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeConsumerStartSeq(seq uint64) []byte {
+	var b [9]byte
+	b[0] = byte(startSeqOp)
+	binary.LittleEndian.PutUint64(b[1:], seq)
+	return b[:]
+}
+
+func encodeRePublished(seq uint64) []byte {
+	var b [9]byte
+	b[0] = byte(rePublishedOp)
+	binary.LittleEndian.PutUint64(b[1:], seq)
+	return b[:]
+}
+
+func encodeMinRetainedSeq(seq uint64) []byte {
+	var b [9]byte
+	b[0] = byte(minRetainedSeqOp)
+	binary.LittleEndian.PutUint64(b[1:], seq)
+	return b[:]
+}
+
+// Checkpoints are the encoded store state, length prefixed, followed by our settings.
+func encodeConsumerCheckpoint(state *ConsumerState, cs *consumerSettings) []byte {
+	sb := encodeConsumerState(state)
+	var lb [binary.MaxVarintLen64]byte
+	var bb bytes.Buffer
+	bb.WriteByte(byte(updateCheckpointOp))
+	bb.Write(lb[:binary.PutUvarint(lb[:], uint64(len(sb)))])
+	bb.Write(sb)
+	b, _ := json.Marshal(cs)
+	bb.Write(b)
+	return bb.Bytes()
+}
+
+var errBadCheckpoint = errors.New("jetstream cluster bad replicated checkpoint")
+var errBadConsumerSkip = errors.New("jetstream cluster bad replicated consumer skip")
+
+func decodeConsumerCheckpoint(buf []byte) (*ConsumerState, *consumerSettings, error) {
+	sl, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < sl {
+		return nil, nil, errBadCheckpoint
+	}
+	state, err := decodeConsumerState(buf[n : n+int(sl)])
+	if err != nil {
+		return nil, nil, err
+	}
+	var cs consumerSettings
+	if err := json.Unmarshal(buf[n+int(sl):], &cs); err != nil {
+		return nil, nil, errBadCheckpoint
+	}
+	return state, &cs, nil
+}
+
+var errBadAckUpdate = errors.New("jetstream cluster bad replicated ack update")
+var errBadDeliveredUpdate = errors.New("jetstream cluster bad replicated delivered update")
+
+func decodeAckUpdate(buf []byte) (dseq, sseq uint64, err error) {
+	var bi, n int
+	if dseq, n = binary.Uvarint(buf); n < 0 {
+		return 0, 0, errBadAckUpdate
+	}
+	bi += n
+	if sseq, n = binary.Uvarint(buf[bi:]); n < 0 {
+		return 0, 0, errBadAckUpdate
+	}
+	return dseq, sseq, nil
+}
+
+func decodeDeliveredUpdate(buf []byte) (dseq, sseq, dc uint64, ts int64, err error) {
+	var bi, n int
+	if dseq, n = binary.Uvarint(buf); n < 0 {
+		return 0, 0, 0, 0, errBadDeliveredUpdate
+	}
+	bi += n
+	if sseq, n = binary.Uvarint(buf[bi:]); n < 0 {
+		return 0, 0, 0, 0, errBadDeliveredUpdate
+	}
+	bi += n
+	if dc, n = binary.Uvarint(buf[bi:]); n < 0 {
+		return 0, 0, 0, 0, errBadDeliveredUpdate
+	}
+	bi += n
+	if ts, n = binary.Varint(buf[bi:]); n < 0 {
+		return 0, 0, 0, 0, errBadDeliveredUpdate
+	}
+	return dseq, sseq, dc, ts, nil
+}
+
+func (js *jetStream) processConsumerLeaderChange(o *Consumer, ca *consumerAssignment, isLeader bool) {
+	js.mu.Lock()
+	s, account, err := js.srv, ca.Client.Account, ca.err
+	client, reply := ca.Client, ca.Reply
+	hasResponded := ca.responded
+	ca.responded = true
+	js.mu.Unlock()
+
+	stream := o.Stream()
+	consumer := o.Name()
+	acc, _ := s.LookupAccount(account)
+	if acc == nil {
+		return
+	}
+
+	if isLeader {
+		s.Noticef("JetStream cluster new consumer leader for '%s > %s > %s'", ca.Client.Account, stream, consumer)
+		s.sendConsumerLeaderElectAdvisory(o)
+	} else {
+		// We are stepping down.
+		// Make sure if we are doing so because we have lost quorum that we send the appropriate advisories.
+		if node := o.raftNode(); node != nil && !node.Quorum() {
+			s.sendConsumerLostQuorumAdvisory(o)
+		}
+	}
+
+	// Tell consumer to switch leader status.
+	o.setLeader(isLeader)
+
+	if !isLeader || hasResponded {
+		return
+	}
+
+	var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(client, acc, _EMPTY_, reply, _EMPTY_, s.jsonResponse(&resp))
+	} else {
+		resp.ConsumerInfo = o.Info()
+		s.sendAPIResponse(client, acc, _EMPTY_, reply, _EMPTY_, s.jsonResponse(&resp))
+		if node := o.raftNode(); node != nil {
+			o.sendCreateAdvisory()
+		}
+	}
+}
+
+// Determines if we should send lost quorum advisory. We throttle these after first one.
+func (o *Consumer) shouldSendLostQuorum() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.lqsent) >= lostQuorumAdvInterval {
+		o.lqsent = time.Now()
+		return true
+	}
+	return false
+}
+
+func (s *Server) sendConsumerStateRestoreFailedAdvisory(o *Consumer, intended *ConsumerState, err error) {
+	if o == nil || intended == nil {
+		return
+	}
+	stream, consumer, acc := o.Stream(), o.Name(), o.account()
+
+	var actual SequencePair
+	if state := o.readStoreState(); state != nil {
+		actual = state.AckFloor
+	}
+
+	subj := JSAdvisoryConsumerStateRestoreFailedPre + "." + stream + "." + consumer
+	adv := &JSConsumerStateRestoreFailedAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerStateRestoreFailedAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:           stream,
+		Consumer:         consumer,
+		IntendedAckFloor: intended.AckFloor,
+		ActualAckFloor:   actual,
+		Error:            err.Error(),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+func (s *Server) sendConsumerLostQuorumAdvisory(o *Consumer) {
+	if o == nil {
+		return
+	}
+	node, stream, consumer, acc := o.raftNode(), o.Stream(), o.Name(), o.account()
+	if node == nil {
+		return
+	}
+	if !o.shouldSendLostQuorum() {
+		return
+	}
+
+	s.Warnf("JetStream cluster consumer '%s > %s >%s' has NO quorum, stalled.", acc.GetName(), stream, consumer)
+
+	subj := JSAdvisoryConsumerQuorumLostPre + "." + stream + "." + consumer
+	adv := &JSConsumerQuorumLostAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerQuorumLostAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Consumer: consumer,
+		Replicas: s.replicas(node),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+func (s *Server) sendConsumerLeaderElectAdvisory(o *Consumer) {
+	if o == nil {
+		return
+	}
+	node, stream, consumer, acc := o.raftNode(), o.Stream(), o.Name(), o.account()
+	if node == nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerLeaderElectedPre + "." + stream + "." + consumer
+	adv := &JSConsumerLeaderElectedAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerLeaderElectedAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Consumer: consumer,
+		Leader:   s.serverNameForNode(node.GroupLeader()),
+		Replicas: s.replicas(node),
+	}
+
+	// Send to the user's account if not the system account.
+	if acc != s.SystemAccount() {
+		s.publishAdvisory(acc, subj, adv)
+	}
+	// Now do system level one. Place account info in adv, and nil account means system.
+	adv.Account = acc.GetName()
+	s.publishAdvisory(nil, subj, adv)
+}
+
+type streamAssignmentResult struct {
+	Account  string                      `json:"account"`
+	Stream   string                      `json:"stream"`
+	Response *JSApiStreamCreateResponse  `json:"create_response,omitempty"`
+	Restore  *JSApiStreamRestoreResponse `json:"restore_response,omitempty"`
+	Full     string                      `json:"full_peer,omitempty"`
+}
+
+// Process error results of stream and consumer assignments.
+// Success will be handled by stream leader.
+func (js *jetStream) processStreamAssignmentResults(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var result streamAssignmentResult
+	if err := json.Unmarshal(msg, &result); err != nil {
+		// TODO(dlc) - log
+		return
+	}
+	acc, _ := js.srv.LookupAccount(result.Account)
+	if acc == nil {
+		// TODO(dlc) - log
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	s, cc := js.srv, js.cluster
+
+	// FIXME(dlc) - suppress duplicates?
+	if sa := js.streamAssignment(result.Account, result.Stream); sa != nil {
+		if result.Full != _EMPTY_ {
+			// Ignore if this is for a group we have already moved.
+			if !sa.Group.isMember(result.Full) {
+				return
+			}
+			if js.replaceFullStreamAssignment(sa, result.Full) {
+				return
+			}
+		}
+		var resp string
+		if result.Response != nil {
+			resp = s.jsonResponse(result.Response)
+		} else if result.Restore != nil {
+			resp = s.jsonResponse(result.Restore)
+		}
+		js.srv.sendAPIErrResponse(sa.Client, acc, _EMPTY_, sa.Reply, _EMPTY_, resp)
+		sa.responded = true
+		// TODO(dlc) - Could have mixed results, should track per peer.
+		// Set sa.err while we are deleting so we will not respond to list/names requests.
+		sa.err = ErrJetStreamNotAssigned
+		cc.meta.Propose(encodeDeleteStreamAssignment(sa))
+	}
+}
+
+// How long we will avoid placing new groups on a peer that reported its raft group limit.
+const fullPeerBackoff = 30 * time.Second
+
+// replaceFullStreamAssignment will move a new stream assignment off of a peer that is at its
+// raft group limit by removing it and proposing it again on a fresh set of peers.
+// Returns false if we could not find another placement.
+// Lock should be held.
+func (js *jetStream) replaceFullStreamAssignment(sa *streamAssignment, peer string) bool {
+	cc := js.cluster
+	if cc.full == nil {
+		cc.full = make(map[string]time.Time)
+	}
+	cc.full[peer] = time.Now()
+
+	// Restores are tied to the peer receiving the snapshot so we do not move them.
+	if sa.Restore != nil {
+		return false
+	}
+	rg := cc.createGroupForStream(sa.Client.Account, sa.Config)
+	if rg == nil {
+		return false
+	}
+	rg.setPreferred()
+	js.srv.Noticef("JetStream cluster moving stream '%s > %s' off of full peer %q", sa.Client.Account, sa.Config.Name, js.srv.serverNameForNode(peer))
+
+	nsa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: sa.Config, Reply: sa.Reply, Client: sa.Client, Created: sa.Created}
+	sa.err = ErrJetStreamNotAssigned
+	// Only the new placement should answer the client, so the removal carries no reply or client info.
+	dsa := &streamAssignment{Group: sa.Group, Config: sa.Config, Client: &ClientInfo{Account: sa.Client.Account}}
+	cc.meta.Propose(encodeDeleteStreamAssignment(dsa))
+	cc.meta.Propose(encodeAddStreamAssignment(nsa))
+	return true
+}
+
+func (js *jetStream) processConsumerAssignmentResults(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var result consumerAssignmentResult
+	if err := json.Unmarshal(msg, &result); err != nil {
+		// TODO(dlc) - log
+		return
+	}
+	acc, _ := js.srv.LookupAccount(result.Account)
+	if acc == nil {
+		// TODO(dlc) - log
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	s, cc := js.srv, js.cluster
+
+	if sa := js.streamAssignment(result.Account, result.Stream); sa != nil && sa.consumers != nil {
+		if ca := sa.consumers[result.Consumer]; ca != nil && !ca.responded {
+			js.srv.sendAPIErrResponse(ca.Client, acc, _EMPTY_, ca.Reply, _EMPTY_, s.jsonResponse(result.Response))
+			ca.responded = true
+			// Check if this failed.
+			// TODO(dlc) - Could have mixed results, should track per peer.
+			if result.Response.Error != nil {
+				// So while we are delting we will not respond to list/names requests.
+				ca.err = ErrJetStreamNotAssigned
+				cc.meta.Propose(encodeDeleteConsumerAssignment(ca))
+			}
+		}
+	}
+}
+
+const (
+	streamAssignmentSubj   = "$SYS.JSC.STREAM.ASSIGNMENT.RESULT"
+	consumerAssignmentSubj = "$SYS.JSC.CONSUMER.ASSIGNMENT.RESULT"
+)
+
+// Lock should be held.
+func (js *jetStream) startUpdatesSub() {
+	cc, s, c := js.cluster, js.srv, js.cluster.c
+	if cc.streamResults == nil {
+		cc.streamResults, _ = s.systemSubscribe(streamAssignmentSubj, _EMPTY_, false, c, js.processStreamAssignmentResults)
+	}
+	if cc.consumerResults == nil {
+		cc.consumerResults, _ = s.systemSubscribe(consumerAssignmentSubj, _EMPTY_, false, c, js.processConsumerAssignmentResults)
+	}
+}
+
+// Lock should be held.
+func (js *jetStream) stopUpdatesSub() {
+	cc := js.cluster
+	if cc.streamResults != nil {
+		cc.s.sysUnsubscribe(cc.streamResults)
+		cc.streamResults = nil
+	}
+	if cc.consumerResults != nil {
+		cc.s.sysUnsubscribe(cc.consumerResults)
+		cc.consumerResults = nil
+	}
+}
+
+func (js *jetStream) processLeaderChange(isLeader bool) {
+	if isLeader {
+		js.srv.Noticef("JetStream cluster new metadata leader")
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if isLeader {
+		js.startUpdatesSub()
+	} else {
+		js.stopUpdatesSub()
+		// TODO(dlc) - stepdown.
+	}
+}
+
+// selectPeerGroup will select a group of peers to start a raft group.
+// TODO(dlc) - For now randomly select. Can be way smarter.
+func (cc *jetStreamCluster) selectPeerGroup(r int) []string {
+	var nodes []string
+	peers := cc.meta.Peers()
+	// Make sure they are active
+	s := cc.s
+	ourID := cc.meta.ID()
+	for _, p := range peers {
+		// Skip peers that recently told us they are at their raft group limit.
+		if ts, ok := cc.full[p.ID]; ok {
+			if time.Since(ts) < fullPeerBackoff {
+				continue
+			}
+			delete(cc.full, p.ID)
+		}
+		if p.ID == ourID || s.getRouteByHash([]byte(p.ID)) != nil {
+			nodes = append(nodes, p.ID)
+		}
+	}
+	if len(nodes) < r {
+		return nil
+	}
+	// Don't depend on range.
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	return nodes[:r]
+}
+
+func groupNameForStream(peers []string, storage StorageType, salt string) string {
+	return groupName("S", peers, storage, salt)
+}
+
+func groupNameForConsumer(peers []string, storage StorageType, salt string) string {
+	return groupName("C", peers, storage, salt)
+}
+
+// groupName will generate a name for a raft group. Without a salt multi-peer groups get a
+// random name. With a salt the name is derived from the salt and the sorted peer set, so the
+// same logical group on the same peers will always have the same name.
+func groupName(prefix string, peers []string, storage StorageType, salt string) string {
+	var gns string
+	if len(peers) == 1 {
+		gns = peers[0]
+	} else if salt != _EMPTY_ {
+		sorted := append([]string(nil), peers...)
+		sort.Strings(sorted)
+		gns = string(getHashSize(salt+"|"+strings.Join(sorted, ","), stableGroupHashLen))
+	} else {
+		gns = string(getHash(nuid.Next()))
+	}
+	return fmt.Sprintf("%s-R%d%s-%s", prefix, len(peers), storage.String()[:1], gns)
+}
+
+// Longer than our normal hash since stable names can not be retried on a collision.
+const stableGroupHashLen = 16
+
+// Returns the salt to use for stable group names, or empty if not configured.
+func (cc *jetStreamCluster) groupSalt(parts ...string) string {
+	if !cc.s.getOpts().JetStreamStableGroups {
+		return _EMPTY_
+	}
+	return strings.Join(parts, " ")
+}
+
+// createGroupForStream will create a group for assignment for the stream.
+// Lock should be held.
+func (cc *jetStreamCluster) createGroupForStream(account string, cfg *StreamConfig) *raftGroup {
+	replicas := cfg.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+
+	// Need to create a group here.
+	// TODO(dlc) - Can be way smarter here.
+	peers := cc.selectPeerGroup(replicas)
+	if len(peers) == 0 {
+		return nil
+	}
+	rg := &raftGroup{Name: groupNameForStream(peers, cfg.Storage, cc.groupSalt(account, cfg.Name)), Storage: cfg.Storage, Peers: peers}
+	rg.WriteQuorum = cfg.WriteQuorum
+	return rg
+}
+
+func (s *Server) jsClusteredStreamRequest(ci *ClientInfo, subject, reply string, rmsg []byte, cfg *StreamConfig) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+	acc, err := s.LookupAccount(ci.Account)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	js.mu.RLock()
+	numStreams := len(cc.streams[ci.Account])
+	js.mu.RUnlock()
+
+	// Grab our jetstream account info.
+	acc.mu.RLock()
+	jsa := acc.js
+	acc.mu.RUnlock()
+
+	// Check for stream limits here before proposing.
+	jsa.mu.RLock()
+	exceeded := jsa.limits.MaxStreams > 0 && numStreams >= jsa.limits.MaxStreams
+	jsa.mu.RUnlock()
+
+	if exceeded {
+		resp.Error = jsError(fmt.Errorf("maximum number of streams reached"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Now process the request and proposal.
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if sa := js.streamAssignment(ci.Account, cfg.Name); sa != nil {
+		resp.Error = jsError(ErrJetStreamStreamAlreadyUsed)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Check for overlapping subjects here, we see all assignments for the account unlike the members.
+	if other := cc.subjectsOverlap(ci.Account, cfg); other != _EMPTY_ {
+		resp.Error = jsError(fmt.Errorf("subjects overlap with an existing stream %q", other))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Raft group selection and placement.
+	rg := cc.createGroupForStream(ci.Account, cfg)
+	if rg == nil {
+		// Peers may be briefly away, so keep trying for a bit if configured to.
+		if wait := s.getOpts().PeerSelectWait; wait > 0 {
+			// Copy the request since we will be holding onto it.
+			deadline, rmsg := time.Now().Add(wait), append([]byte(nil), rmsg...)
+			s.startGoRoutine(func() { s.retryClusteredStreamRequest(ci, acc, subject, reply, rmsg, cfg, deadline) })
+			return
+		}
+		resp.Error = jsInsufficientErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Pick a preferred leader.
+	rg.setPreferred()
+	// Sync subject for post snapshot sync.
+	sa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: cfg, Reply: reply, Client: ci, Created: time.Now()}
+	cc.meta.Propose(encodeAddStreamAssignment(sa))
+}
+
+// streamSubjects returns the subjects a stream will capture, which defaults to its name.
+func streamSubjects(cfg *StreamConfig) []string {
+	if len(cfg.Subjects) == 0 && cfg.Mirror == nil {
+		return []string{cfg.Name}
+	}
+	return cfg.Subjects
+}
+
+// subjectsOverlap returns the name of an existing stream in the account whose subjects overlap
+// with the ones in cfg, including wildcard overlaps, or empty if there is none.
+// Lock should be held.
+func (cc *jetStreamCluster) subjectsOverlap(account string, cfg *StreamConfig) string {
+	subjects := streamSubjects(cfg)
+	for name, sa := range cc.streams[account] {
+		if name == cfg.Name || sa.Config == nil {
+			continue
+		}
+		for _, subj := range streamSubjects(sa.Config) {
+			for _, tsubj := range subjects {
+				if SubjectsCollide(tsubj, subj) {
+					return name
+				}
+			}
+		}
+	}
+	return _EMPTY_
+}
+
+// How often we retry peer selection for a stream create, see PeerSelectWait.
+const peerSelectRetryInterval = 250 * time.Millisecond
+
+// retryClusteredStreamRequest will retry placement of a new stream until deadline, for when not
+// enough peers were active on the first attempt. Responds with insufficient resources if we run out of time.
+func (s *Server) retryClusteredStreamRequest(ci *ClientInfo, acc *Account, subject, reply string, rmsg []byte, cfg *StreamConfig, deadline time.Time) {
+	defer s.grWG.Done()
+
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	var resp = JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType}}
+
+	ticker := time.NewTicker(peerSelectRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitCh:
+			return
+		}
+
+		js.mu.Lock()
+		// We may have lost leadership while waiting, the new leader is not aware of this request.
+		if !cc.isLeader() {
+			js.mu.Unlock()
+			return
+		}
+		if sa := js.streamAssignment(ci.Account, cfg.Name); sa != nil {
+			js.mu.Unlock()
+			resp.Error = jsError(ErrJetStreamStreamAlreadyUsed)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		if other := cc.subjectsOverlap(ci.Account, cfg); other != _EMPTY_ {
+			js.mu.Unlock()
+			resp.Error = jsError(fmt.Errorf("subjects overlap with an existing stream %q", other))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		if rg := cc.createGroupForStream(ci.Account, cfg); rg != nil {
+			rg.setPreferred()
+			sa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: cfg, Reply: reply, Client: ci, Created: time.Now()}
+			cc.meta.Propose(encodeAddStreamAssignment(sa))
+			js.mu.Unlock()
+			return
+		}
+		js.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			resp.Error = jsInsufficientErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+	}
+}
+
+func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, subject, reply string, rmsg []byte, cfg *StreamConfig) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	acc, err := s.LookupAccount(ci.Account)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	osa := js.streamAssignment(ci.Account, cfg.Name)
+	if osa == nil {
+		resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	ncfg, err := checkStreamCfg(cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Our peer group is fixed.
+	if ncfg.Replicas != osa.Config.Replicas {
+		resp.Error = jsError(errors.New("stream configuration update can not change replicas"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if ncfg.Compression != osa.Config.Compression {
+		resp.Error = jsError(errors.New("stream configuration update can not change compression"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if ncfg.WriteQuorum != osa.Config.WriteQuorum {
+		resp.Error = jsError(errors.New("stream configuration update can not change write quorum"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if osa.Config.Sealed && !ncfg.Sealed {
+		resp.Error = jsError(errors.New("stream configuration update can not unseal a sealed stream"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	sa := &streamAssignment{Group: osa.Group, Sync: osa.Sync, Config: &ncfg, Reply: reply, Client: ci, Created: osa.Created}
+	cc.meta.Propose(encodeUpdateStreamAssignment(sa))
+}
+
+func (s *Server) jsClusteredStreamDeleteRequest(ci *ClientInfo, stream, reply string, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	osa := js.streamAssignment(ci.Account, stream)
+	if osa == nil {
+		acc, err := s.LookupAccount(ci.Account)
+		if err == nil {
+			var resp = JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, _EMPTY_, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	// Protected streams need deny delete cleared with an update first.
+	if osa.Config.DenyDelete {
+		if acc, err := s.LookupAccount(ci.Account); err == nil {
+			var resp = JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType}}
+			resp.Error = &ApiError{Code: 403, Description: ErrJetStreamStreamDeleteDenied.Error()}
+			s.sendAPIErrResponse(ci, acc, _EMPTY_, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	// Remove any remaining consumers as well.
+	for _, ca := range osa.consumers {
+		ca.Reply, ca.State = _EMPTY_, nil
+		cc.meta.Propose(encodeDeleteConsumerAssignment(ca))
+	}
+
+	sa := &streamAssignment{Group: osa.Group, Config: osa.Config, Reply: reply, Client: ci}
+	cc.meta.Propose(encodeDeleteStreamAssignment(sa))
+}
+
+func (s *Server) jsClusteredStreamPurgeRequest(ci *ClientInfo, stream, subject, reply string, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	sa := js.streamAssignment(ci.Account, stream)
+	if sa == nil || sa.Group == nil || sa.Group.node == nil {
+		resp := JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+		acc, err := s.LookupAccount(ci.Account)
+		if err != nil {
+			resp.Error = jsError(err)
+		} else {
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+		}
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Protected streams need deny purge cleared with an update first.
+	if sa.Config.DenyPurge {
+		if acc, err := s.LookupAccount(ci.Account); err == nil {
+			resp := JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+			resp.Error = &ApiError{Code: 403, Description: ErrJetStreamStreamPurgeDenied.Error()}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	n := sa.Group.node
+	sp := &streamPurge{Stream: stream, Reply: reply, Client: ci}
+	n.Propose(encodeStreamPurge(sp))
+}
+
+func (s *Server) jsClusteredStreamRestoreRequest(ci *ClientInfo, acc *Account, req *JSApiStreamRestoreRequest, stream, subject, reply string, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	cfg := &req.Config
+	resp := JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
+
+	if sa := js.streamAssignment(ci.Account, cfg.Name); sa != nil {
+		resp.Error = jsError(ErrJetStreamStreamAlreadyUsed)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Raft group selection and placement.
+	rg := cc.createGroupForStream(ci.Account, cfg)
+	if rg == nil {
+		resp.Error = jsInsufficientErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Pick a preferred leader.
+	rg.setPreferred()
+	sa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: cfg, Reply: reply, Client: ci, Created: time.Now()}
+	// Now add in our restore state and pre-select a peer to handle the actual receipt of the snapshot.
+	sa.Restore = &req.State
+	cc.meta.Propose(encodeAddStreamAssignment(sa))
+}
+
+// This will do a scatter and gather operation for all streams for this account.
+// This will be running in a separate Go routine.
+func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, offset, limit int, subject, reply string, rmsg []byte) {
+	defer s.grWG.Done()
+
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var streams []*streamAssignment
+	for _, sa := range cc.streams[acc.Name] {
+		streams = append(streams, sa)
+	}
+	// Needs to be sorted.
+	if len(streams) > 1 {
+		sort.Slice(streams, func(i, j int) bool {
+			return strings.Compare(streams[i].Config.Name, streams[j].Config.Name) < 0
+		})
+	}
+
+	scnt := len(streams)
+	if offset > scnt {
+		offset = scnt
+	}
+	if offset > 0 {
+		streams = streams[offset:]
+	}
+	if len(streams) > limit {
+		streams = streams[:limit]
+	}
+
+	rc := make(chan *StreamInfo, len(streams))
+
+	// Create an inbox for our responses and send out requests.
+	inbox := infoReplySubject()
+	rsub, _ := s.systemSubscribe(inbox, _EMPTY_, false, cc.c, func(_ *subscription, _ *client, _, reply string, msg []byte) {
+		var si StreamInfo
+		if err := json.Unmarshal(msg, &si); err != nil {
+			s.Warnf("Error unmarshaling clustered stream info response:%v", err)
+			return
+		}
+		select {
+		case rc <- &si:
+		default:
+			s.Warnf("Failed placing stream info result on internal chan")
+		}
+	})
+	defer s.sysUnsubscribe(rsub)
+
+	// Send out our requests here.
+	for _, sa := range streams {
+		isubj := fmt.Sprintf(clusterStreamInfoT, sa.Client.Account, sa.Config.Name)
+		s.sendInternalMsgLocked(isubj, inbox, nil, nil)
+	}
+
+	const timeout = 2 * time.Second
+	notActive := time.NewTimer(timeout)
+	defer notActive.Stop()
+
+	var resp = JSApiStreamListResponse{
+		ApiResponse: ApiResponse{Type: JSApiStreamListResponseType},
+		Streams:     make([]*StreamInfo, 0, len(streams)),
+	}
+
+LOOP:
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-notActive.C:
+			s.Warnf("Did not receive all stream info results for %q", acc)
+			break LOOP
+		case si := <-rc:
+			resp.Streams = append(resp.Streams, si)
+			// Check to see if we are done.
+			if len(resp.Streams) == len(streams) {
+				break LOOP
+			}
+		}
+	}
+
+	// Needs to be sorted as well.
+	if len(resp.Streams) > 1 {
+		sort.Slice(resp.Streams, func(i, j int) bool {
+			return strings.Compare(resp.Streams[i].Config.Name, resp.Streams[j].Config.Name) < 0
+		})
+	}
+
+	resp.Total = len(resp.Streams)
+	resp.Limit = limit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(resp))
+}
+
+// This will do a scatter and gather operation for all consumers for this stream and account.
+// This will be running in a separate Go routine.
+func (s *Server) jsClusteredConsumerListRequest(acc *Account, ci *ClientInfo, offset, limit int, stream, subject, reply string, rmsg []byte) {
+	defer s.grWG.Done()
+
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var consumers []*consumerAssignment
+	if sas := cc.streams[acc.Name]; sas != nil {
+		if sa := sas[stream]; sa != nil {
+			// Copy over since we need to sort etc.
+			for _, ca := range sa.consumers {
+				consumers = append(consumers, ca)
+			}
+		}
+	}
+	// Needs to be sorted.
+	if len(consumers) > 1 {
+		sort.Slice(consumers, func(i, j int) bool {
+			return strings.Compare(consumers[i].Name, consumers[j].Name) < 0
+		})
+	}
+
+	ocnt := len(consumers)
+	if offset > ocnt {
+		offset = ocnt
+	}
+	if offset > 0 {
+		consumers = consumers[offset:]
+	}
+	if len(consumers) > limit {
+		consumers = consumers[:limit]
+	}
+
+	rc := make(chan *ConsumerInfo, len(consumers))
+
+	// Create an inbox for our responses and send out requests.
+	inbox := infoReplySubject()
+	rsub, _ := s.systemSubscribe(inbox, _EMPTY_, false, cc.c, func(_ *subscription, _ *client, _, reply string, msg []byte) {
+		var ci ConsumerInfo
+		if err := json.Unmarshal(msg, &ci); err != nil {
+			s.Warnf("Error unmarshaling clustered consumer info response:%v", err)
+			return
+		}
+		select {
+		case rc <- &ci:
+		default:
+			s.Warnf("Failed placing consumer info result on internal chan")
+		}
+	})
+	defer s.sysUnsubscribe(rsub)
+
+	// Send out our requests here.
+	var resp = JSApiConsumerListResponse{
+		ApiResponse: ApiResponse{Type: JSApiConsumerListResponseType},
+		Consumers:   []*ConsumerInfo{},
+	}
+
+	if len(consumers) == 0 {
+		resp.Limit = limit
+		resp.Offset = offset
+		s.sendAPIResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(resp))
+		return
+	}
+
+	for _, ca := range consumers {
+		isubj := fmt.Sprintf(clusterConsumerInfoT, ca.Client.Account, stream, ca.Name)
+		s.sendInternalMsgLocked(isubj, inbox, nil, nil)
+	}
+
+	const timeout = 2 * time.Second
+	notActive := time.NewTimer(timeout)
+	defer notActive.Stop()
+
+LOOP:
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-notActive.C:
+			s.Warnf("Did not receive all stream info results for %q", acc)
+			break LOOP
+		case ci := <-rc:
+			resp.Consumers = append(resp.Consumers, ci)
+			// Check to see if we are done.
+			if len(resp.Consumers) == len(consumers) {
+				break LOOP
+			}
+		}
+	}
+
+	// Needs to be sorted as well.
+	if len(resp.Consumers) > 1 {
+		sort.Slice(resp.Consumers, func(i, j int) bool {
+			return strings.Compare(resp.Consumers[i].Name, resp.Consumers[j].Name) < 0
+		})
+	}
+
+	resp.Total = len(resp.Consumers)
+	resp.Limit = limit
+	resp.Offset = offset
+	s.sendAPIResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(resp))
+}
+
+func encodeStreamPurge(sp *streamPurge) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(purgeStreamOp))
+	json.NewEncoder(&bb).Encode(sp)
+	return bb.Bytes()
+}
+
+func decodeStreamPurge(buf []byte) (*streamPurge, error) {
+	var sp streamPurge
+	err := json.Unmarshal(buf, &sp)
+	return &sp, err
+}
+
+func (s *Server) jsClusteredConsumerDeleteRequest(ci *ClientInfo, stream, consumer, subject, reply string, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	sa := js.streamAssignment(ci.Account, stream)
+	if sa == nil || sa.consumers == nil {
+		// TODO(dlc) - Should respond? Log?
+		return
+	}
+	oca := sa.consumers[consumer]
+	if oca == nil {
+		acc, err := s.LookupAccount(ci.Account)
+		if err == nil {
+			var resp = JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+			resp.Error = jsNoAccountErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	ca := &consumerAssignment{Group: oca.Group, Stream: stream, Name: consumer, Config: oca.Config, Reply: reply, Client: ci}
+	cc.meta.Propose(encodeDeleteConsumerAssignment(ca))
+}
+
+func encodeStreamConfigUpdate(su *streamConfigUpdate) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(streamConfigOp))
+	json.NewEncoder(&bb).Encode(su)
+	return bb.Bytes()
+}
+
+func decodeStreamConfigUpdate(buf []byte) (*streamConfigUpdate, error) {
+	var su streamConfigUpdate
+	err := json.Unmarshal(buf, &su)
+	return &su, err
+}
+
+func encodeMsgDelete(md *streamMsgDelete) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(deleteMsgOp))
+	json.NewEncoder(&bb).Encode(md)
+	return bb.Bytes()
+}
+
+func decodeMsgDelete(buf []byte) (*streamMsgDelete, error) {
+	var md streamMsgDelete
+	err := json.Unmarshal(buf, &md)
+	return &md, err
+}
+
+func (s *Server) jsClusteredMsgDeleteRequest(ci *ClientInfo, stream, subject, reply string, seq uint64, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	sa := js.streamAssignment(ci.Account, stream)
+	if sa == nil || sa.Group == nil || sa.Group.node == nil {
+		// TODO(dlc) - Should respond? Log?
+		return
+	}
+	n := sa.Group.node
+	md := &streamMsgDelete{Seq: seq, Stream: stream, Reply: reply, Client: ci}
+	n.Propose(encodeMsgDelete(md))
+}
+
+// jsClusteredMsgGetRequest will serve a message get for a clustered stream. Only the stream leader answers
+// so the read reflects all committed messages. If the leader is still applying committed entries it hands
+// the read to a current follower, and only returns a not current error if there is none.
+func (s *Server) jsClusteredMsgGetRequest(ci *ClientInfo, acc *Account, stream, subject, reply string, seq uint64, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	var resp = JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+
+	js.mu.RLock()
+	isMetaLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+	isLeader, isCurrent := cc.isStreamLeader(acc.Name, stream), cc.isStreamCurrent(acc.Name, stream)
+	js.mu.RUnlock()
+
+	if sa == nil {
+		// The metadata leader will answer for streams that do not exist.
+		if isMetaLeader {
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	// Check to see if we are a member of the group and if the group has no leader.
+	if js.isGroupLeaderless(sa.Group) {
+		resp.Error = jsClusterNotAvailErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Only the stream leader should answer.
+	if !isLeader {
+		return
+	}
+	n := sa.Group.node
+	peer, ok := msgGetResponder(isCurrent, n.ID(), n.Peers())
+	if !ok {
+		// A new leader may still be applying committed entries.
+		resp.Error = jsStreamNotCurrentErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if peer != _EMPTY_ {
+		fwd := &msgGetForward{Client: ci, Subject: subject, Reply: reply, Seq: seq, Request: string(rmsg)}
+		b, _ := json.Marshal(fwd)
+		s.sendInternalMsgLocked(fmt.Sprintf(clusterMsgGetT, acc.Name, stream, peer), _EMPTY_, nil, b)
+		return
+	}
+	s.sendClusteredMsgGet(ci, acc, stream, subject, reply, seq, rmsg)
+}
+
+// msgGetResponder will decide who serves a message get as the stream leader. We serve it ourselves if we are
+// current, otherwise we hand it to a current follower if we have one. Returns false if no replica is current.
+func msgGetResponder(isCurrent bool, ourID string, peers []*Peer) (string, bool) {
+	if isCurrent {
+		return _EMPTY_, true
+	}
+	var current []string
+	for _, p := range peers {
+		if p.ID != ourID && p.Current {
+			current = append(current, p.ID)
+		}
+	}
+	if len(current) == 0 {
+		return _EMPTY_, false
+	}
+	sort.Strings(current)
+	return current[0], true
+}
+
+// msgGetForward is a message get the stream leader handed to a current follower to serve.
+type msgGetForward struct {
+	Client  *ClientInfo `json:"client"`
+	Subject string      `json:"subject"`
+	Reply   string      `json:"reply"`
+	Seq     uint64      `json:"seq"`
+	Request string      `json:"request,omitempty"`
+}
+
+// handleClusterMsgGetRequest will serve a message get handed to us by the stream leader.
+// If we fell behind since the leader picked us we return a not current error.
+func (mset *Stream) handleClusterMsgGetRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var fwd msgGetForward
+	if err := json.Unmarshal(msg, &fwd); err != nil {
+		return
+	}
+	mset.mu.RLock()
+	s, jsa, stream := mset.srv, mset.jsa, mset.config.Name
+	mset.mu.RUnlock()
+	if jsa == nil {
+		return
+	}
+	acc := jsa.acc()
+
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+	js.mu.RLock()
+	isCurrent := cc.isStreamCurrent(acc.Name, stream)
+	js.mu.RUnlock()
+
+	if !isCurrent {
+		var resp = JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+		resp.Error = jsStreamNotCurrentErr
+		s.sendAPIErrResponse(fwd.Client, acc, fwd.Subject, fwd.Reply, fwd.Request, s.jsonResponse(&resp))
+		return
+	}
+	s.sendClusteredMsgGet(fwd.Client, acc, stream, fwd.Subject, fwd.Reply, fwd.Seq, []byte(fwd.Request))
+}
+
+// sendClusteredMsgGet will load the message from a current replica and send it back.
+func (s *Server) sendClusteredMsgGet(ci *ClientInfo, acc *Account, stream, subject, reply string, seq uint64, rmsg []byte) {
+	var resp = JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	subj, hdr, msg, ts, err := mset.store.LoadMsg(seq)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Message = &StoredMsg{
+		Subject:  subj,
+		Sequence: seq,
+		Header:   hdr,
+		Data:     msg,
+		Time:     time.Unix(0, ts),
+	}
+	s.sendAPIResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(resp))
+}
+
+// jsClusteredStreamLastSeqRequest will serve a last sequence request for a clustered stream.
+// Only a current stream leader answers.
+func (s *Server) jsClusteredStreamLastSeqRequest(ci *ClientInfo, acc *Account, stream, subject, reply, filter string, rmsg []byte) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	var resp = JSApiStreamLastSeqResponse{ApiResponse: ApiResponse{Type: JSApiStreamLastSeqResponseType}}
+
+	js.mu.RLock()
+	isMetaLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+	isLeader, isCurrent := cc.isStreamLeader(acc.Name, stream), cc.isStreamCurrent(acc.Name, stream)
+	js.mu.RUnlock()
+
+	if sa == nil {
+		if isMetaLeader {
+			resp.Error = jsNotFoundError(ErrJetStreamStreamNotFound)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if js.isGroupLeaderless(sa.Group) {
+		resp.Error = jsClusterNotAvailErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if !isLeader {
+		return
+	}
+	if !isCurrent {
+		resp.Error = jsStreamNotCurrentErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Subject, resp.Seq = filter, mset.LastSeqForSubject(filter)
+	s.sendAPIResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(resp))
+}
+
+func encodeAddStreamAssignment(sa *streamAssignment) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(assignStreamOp))
+	json.NewEncoder(&bb).Encode(sa)
+	return bb.Bytes()
+}
+
+func encodeUpdateStreamAssignment(sa *streamAssignment) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(updateStreamOp))
+	json.NewEncoder(&bb).Encode(sa)
+	return bb.Bytes()
+}
+
+func encodeDeleteStreamAssignment(sa *streamAssignment) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(removeStreamOp))
+	json.NewEncoder(&bb).Encode(sa)
+	return bb.Bytes()
+}
+
+func decodeStreamAssignment(buf []byte) (*streamAssignment, error) {
+	var sa streamAssignment
+	err := json.Unmarshal(buf, &sa)
+	return &sa, err
+}
+
+// createGroupForConsumer will create a new group with same peer set as the stream.
+func (cc *jetStreamCluster) createGroupForConsumer(sa *streamAssignment, consumer string) *raftGroup {
+	peers := sa.Group.Peers
+	if len(peers) == 0 {
+		return nil
+	}
+	salt := cc.groupSalt(sa.Client.Account, sa.Config.Name, consumer)
+	return &raftGroup{Name: groupNameForConsumer(peers, sa.Config.Storage, salt), Storage: sa.Config.Storage, Peers: peers}
+}
+
+func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, subject, reply string, rmsg []byte, stream string, cfg *ConsumerConfig) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var resp = JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType}}
+	acc, err := s.LookupAccount(ci.Account)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Check the config here before proposing, so a bad config does not leave an assignment behind.
+	if err := checkConsumerCfg(cfg); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Lookup the stream assignment.
+	sa := js.streamAssignment(ci.Account, stream)
+	if sa == nil {
+		resp.Error = jsError(ErrJetStreamStreamNotFound)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// We need to set the ephemeral here before replicating.
+	var oname string
+	if !isDurableConsumer(cfg) {
+		for {
+			oname = createConsumerName()
+			if sa.consumers != nil {
+				if sa.consumers[oname] != nil {
+					continue
+				}
+			}
+			break
+		}
+	} else {
+		oname = cfg.Durable
+		if sa.consumers[oname] != nil {
+			resp.Error = jsError(ErrJetStreamConsumerAlreadyUsed)
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	// Check the stream's consumer limit here before proposing.
+	if maxc := sa.Config.MaxConsumers; maxc > 0 && len(sa.consumers) >= maxc {
+		resp.Error = jsError(ErrJetStreamMaximumConsumers)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	rg := cc.createGroupForConsumer(sa, oname)
+	if rg == nil {
+		resp.Error = jsInsufficientErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Pick a preferred leader.
+	rg.setPreferred()
+
+	ca := &consumerAssignment{Group: rg, Stream: stream, Name: oname, Config: cfg, Reply: reply, Client: ci, Created: time.Now()}
+	cc.meta.Propose(encodeAddConsumerAssignment(ca))
+}
+
+func encodeAddConsumerAssignment(ca *consumerAssignment) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(assignConsumerOp))
+	json.NewEncoder(&bb).Encode(ca)
+	return bb.Bytes()
+}
+
+func encodeDeleteConsumerAssignment(ca *consumerAssignment) []byte {
+	var bb bytes.Buffer
+	bb.WriteByte(byte(removeConsumerOp))
+	json.NewEncoder(&bb).Encode(ca)
+	return bb.Bytes()
+}
+
+func decodeConsumerAssignment(buf []byte) (*consumerAssignment, error) {
+	var ca consumerAssignment
+	err := json.Unmarshal(buf, &ca)
+	return &ca, err
+}
+
+func encodeAddConsumerAssignmentCompressed(ca *consumerAssignment) []byte {
+	b, err := json.Marshal(ca)
+	if err != nil {
+		return nil
+	}
+	// TODO(dlc) - Streaming better approach here probably.
+	var bb bytes.Buffer
+	bb.WriteByte(byte(assignCompressedConsumerOp))
+	bb.Write(s2.Encode(nil, b))
+	return bb.Bytes()
+}
+
+func decodeConsumerAssignmentCompressed(buf []byte) (*consumerAssignment, error) {
+	var ca consumerAssignment
+	js, err := s2.Decode(nil, buf)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(js, &ca)
+	return &ca, err
+}
+
+var errBadStreamMsg = errors.New("jetstream cluster bad replicated stream msg")
+
+func decodeStreamMsg(buf []byte) (subject, reply string, hdr, msg []byte, lseq uint64, ts int64, err error) {
+	var le = binary.LittleEndian
+	if len(buf) < 26 {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	lseq = le.Uint64(buf)
+	buf = buf[8:]
+	ts = int64(le.Uint64(buf))
+	buf = buf[8:]
+	sl := int(le.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < sl {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	subject = string(buf[:sl])
+	buf = buf[sl:]
+	if len(buf) < 2 {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	rl := int(le.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < rl {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	reply = string(buf[:rl])
+	buf = buf[rl:]
+	if len(buf) < 2 {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	hl := int(le.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < hl {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	hdr = buf[:hl]
+	buf = buf[hl:]
+	if len(buf) < 4 {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	ml := int(le.Uint32(buf))
+	buf = buf[4:]
+	if len(buf) < ml {
+		return _EMPTY_, _EMPTY_, nil, nil, 0, 0, errBadStreamMsg
+	}
+	msg = buf[:ml]
+	return subject, reply, hdr, msg, lseq, ts, nil
+}
+
+func encodeStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64) []byte {
+	elen := 1 + 8 + 8 + len(subject) + len(reply) + len(hdr) + len(msg)
+	elen += (2 + 2 + 2 + 4) // Encoded lengths, 4bytes
+	// TODO(dlc) - check sizes of subject, reply and hdr, make sure uint16 ok.
+	buf := make([]byte, elen)
+	buf[0] = byte(streamMsgOp)
+	var le = binary.LittleEndian
+	wi := 1
+	le.PutUint64(buf[wi:], lseq)
+	wi += 8
+	le.PutUint64(buf[wi:], uint64(ts))
+	wi += 8
+	le.PutUint16(buf[wi:], uint16(len(subject)))
+	wi += 2
+	copy(buf[wi:], subject)
+	wi += len(subject)
+	le.PutUint16(buf[wi:], uint16(len(reply)))
+	wi += 2
+	copy(buf[wi:], reply)
+	wi += len(reply)
+	le.PutUint16(buf[wi:], uint16(len(hdr)))
+	wi += 2
+	if len(hdr) > 0 {
+		copy(buf[wi:], hdr)
+		wi += len(hdr)
+	}
+	le.PutUint32(buf[wi:], uint32(len(msg)))
+	wi += 4
+	if len(msg) > 0 {
+		copy(buf[wi:], msg)
+		wi += len(msg)
+	}
+	return buf[:wi]
+}
+
+// StreamSnapshot is used for snapshotting and out of band catch up in clustered mode.
+type streamSnapshot struct {
+	Msgs        uint64       `json:"messages"`
+	Bytes       uint64       `json:"bytes"`
+	FirstSeq    uint64       `json:"first_seq"`
+	LastSeq     uint64       `json:"last_seq"`
+	Deleted     []uint64     `json:"deleted,omitempty"`
+	RePublished uint64       `json:"republished,omitempty"`
+	MirrorSeq   uint64       `json:"mirror_seq,omitempty"`
+	MinRetained uint64       `json:"min_retained_seq,omitempty"`
+	MsgIds      []*snapMsgId `json:"msg_ids,omitempty"`
+}
+
+// snapMsgId is a duplicate window entry carried in stream snapshots so replicas that
+// catch up from a snapshot still reject duplicates the leader saw.
+type snapMsgId struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+	TS  int64  `json:"ts"`
+}
+
+// Returns the message ids still inside our duplicate window.
+// Lock should be held.
+func (mset *Stream) snapshotMsgIds() []*snapMsgId {
+	if len(mset.ddmap) == 0 {
+		return nil
+	}
+	now, window := time.Now().UnixNano(), int64(mset.config.Duplicates)
+	var ids []*snapMsgId
+	for _, dde := range mset.ddarr[mset.ddindex:] {
+		if now-dde.ts < window {
+			ids = append(ids, &snapMsgId{dde.id, dde.seq, dde.ts})
+		}
+	}
+	return ids
+}
+
+// restoreMsgIds will merge message ids from a leader's snapshot into our duplicate window.
+func (mset *Stream) restoreMsgIds(ids []*snapMsgId) {
+	if len(ids) == 0 {
+		return
+	}
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	now, window := time.Now().UnixNano(), int64(mset.config.Duplicates)
+	if mset.ddmap == nil {
+		mset.ddmap = make(map[string]*ddentry)
+	}
+	var added bool
+	for _, id := range ids {
+		if now-id.TS >= window || mset.ddmap[id.ID] != nil {
+			continue
+		}
+		dde := &ddentry{id.ID, id.Seq, id.TS}
+		mset.ddmap[dde.id] = dde
+		mset.ddarr = append(mset.ddarr, dde)
+		added = true
+	}
+	if !added {
+		return
+	}
+	// Purging walks the window oldest first, so keep it ordered by time.
+	dds := append([]*ddentry(nil), mset.ddarr[mset.ddindex:]...)
+	sort.Slice(dds, func(i, j int) bool { return dds[i].ts < dds[j].ts })
+	mset.ddarr, mset.ddindex = dds, 0
+	if mset.ddtmr == nil {
+		mset.ddtmr = time.AfterFunc(mset.config.Duplicates, mset.purgeMsgIds)
+	}
+}
+
+// Grab a snapshot of a stream for clustered mode.
+func (mset *Stream) snapshot() []byte {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+
+	state := mset.store.State()
+	snap := &streamSnapshot{
+		Msgs:        state.Msgs,
+		Bytes:       state.Bytes,
+		FirstSeq:    state.FirstSeq,
+		LastSeq:     state.LastSeq,
+		Deleted:     state.Deleted,
+		RePublished: mset.rpseq,
+		MirrorSeq:   mset.mlseq,
+		MinRetained: mset.minRetainedSeq,
+		MsgIds:      mset.snapshotMsgIds(),
+	}
+	b, _ := json.Marshal(snap)
+	return encodeSnapshot(b)
+}
+
+// checkDiscardNew will check if a new message of size sz, as accounted by our store, would exceed our limits
+// with discard new.
+// Lock should be held.
+func (mset *Stream) checkDiscardNew(sz uint64) error {
+	discard := mset.config.Discard
+	if mset.config.RetentionHold {
+		// See storeConfig(), limits are either lifted or turn into discard new.
+		if !mset.config.HoldRejectWrites {
+			return nil
+		}
+		discard = DiscardNew
+	}
+	if discard != DiscardNew || mset.store == nil {
+		return nil
+	}
+	if mset.config.MaxMsgs <= 0 && mset.config.MaxBytes <= 0 {
+		return nil
+	}
+	var pending uint64
+	applied := mset.lseq + mset.clfs
+	if mset.clseq > applied {
+		pending = mset.clseq - applied
+	}
+	mset.pruneProposed(applied)
+	state := mset.store.State()
+	if mset.config.MaxMsgs > 0 && state.Msgs+pending >= uint64(mset.config.MaxMsgs) {
+		return ErrMaxMsgs
+	}
+	if mset.config.MaxBytes > 0 && state.Bytes+mset.clpb+sz > uint64(mset.config.MaxBytes) {
+		return ErrMaxBytes
+	}
+	return nil
+}
+
+// proposedMsg is the size of a message the leader proposed at seq.
+type proposedMsg struct {
+	seq uint64
+	sz  uint64
+}
+
+// storedMsgSize returns the size of a message as accounted by our store.
+// Lock should be held.
+func (mset *Stream) storedMsgSize(subj string, hdr, msg []byte) uint64 {
+	if mset.config.Storage == MemoryStorage {
+		return memStoreMsgSize(subj, hdr, msg)
+	}
+	return fileStoreMsgSize(subj, hdr, msg)
+}
+
+// trackProposed will remember the size of a message we proposed at seq until it is applied.
+// Lock should be held.
+func (mset *Stream) trackProposed(seq, sz uint64) {
+	if mset.config.MaxBytes <= 0 {
+		return
+	}
+	mset.pruneProposed(mset.lseq + mset.clfs)
+	mset.clps = append(mset.clps, proposedMsg{seq, sz})
+	mset.clpb += sz
+}
+
+// pruneProposed will drop proposed messages that have been applied, stored or not.
+// Lock should be held.
+func (mset *Stream) pruneProposed(applied uint64) {
+	var i int
+	for ; i < len(mset.clps) && mset.clps[i].seq < applied; i++ {
+		mset.clpb -= mset.clps[i].sz
+	}
+	if i == len(mset.clps) {
+		mset.clps = nil
+	} else if i > 0 {
+		mset.clps = append(mset.clps[:0], mset.clps[i:]...)
+	}
+}
+
+// processClusteredMsg will propose the inbound message to the underlying raft group.
+func (mset *Stream) processClusteredInboundMsg(subject, reply string, hdr, msg []byte) error {
+	// For possible error response.
+	var response []byte
+
+	mset.mu.RLock()
+	canRespond := !mset.config.NoAck && len(reply) > 0
+	s, jsa, st, rf, sendq := mset.srv, mset.jsa, mset.config.Storage, mset.config.Replicas, mset.sendq
+	maxMsgSize, sealed, paused := int(mset.config.MaxMsgSize), mset.config.Sealed, mset.wpause > 0
+	allowed := mset.subjectAllowed(subject)
+	hdrErr := mset.checkRequiredHeaders(hdr)
+	mset.mu.RUnlock()
+
+	// Sealed streams do not accept new messages.
+	if sealed {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: errStreamSealed.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return errStreamSealed
+	}
+
+	// Paused streams reject new messages until resumed.
+	if paused {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 503, Description: errStreamWritesPaused.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return errStreamWritesPaused
+	}
+
+	// Check publish acls here so disallowed subjects never reach the log.
+	if !allowed {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: errSubjectNotAllowed.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return errSubjectNotAllowed
+	}
+
+	// Required headers are checked here so rejected messages never reach the log.
+	if hdrErr != nil {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: hdrErr.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return hdrErr
+	}
+
+	// Publish rate limits are only enforced here so replicas do not need to agree on timing.
+	// Checked last so rejected messages above do not take from the rate.
+	mset.mu.RLock()
+	rlErr := mset.checkRateLimit(subject, hdr, msg)
+	mset.mu.RUnlock()
+	if rlErr != nil {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 429, Description: rlErr.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return rlErr
+	}
+
+	// Check here pre-emptively if we have exceeded our account limits.
+	var exceeded bool
+	jsa.mu.RLock()
+	if st == MemoryStorage {
+		total := jsa.storeTotal + int64(memStoreMsgSize(subject, hdr, msg)*uint64(rf))
+		if jsa.limits.MaxMemory > 0 && total > jsa.limits.MaxMemory {
+			exceeded = true
+		}
+	} else {
+		total := jsa.storeTotal + int64(fileStoreMsgSize(subject, hdr, msg)*uint64(rf))
+		if jsa.limits.MaxStore > 0 && total > jsa.limits.MaxStore {
+			exceeded = true
+		}
+	}
+	jsa.mu.RUnlock()
+
+	// If we have exceeded our account limits go ahead and return.
+	if exceeded {
+		err := fmt.Errorf("JetStream resource limits exceeded for account: %q", jsa.acc().Name)
+		s.Warnf(err.Error())
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: "resource limits exceeded for account"}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return err
+	}
+
+	// Check msgSize if we have a limit set there. Again this works if it goes through but better to be pre-emptive.
+	if maxMsgSize >= 0 && (len(hdr)+len(msg)) > maxMsgSize {
+		err := fmt.Errorf("JetStream message size exceeds limits for '%s > %s'", jsa.acc().Name, mset.config.Name)
+		s.Warnf(err.Error())
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: "message size exceeds maximum allowed"}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return err
+	}
+
+	// Check for duplicates before proposing so retries do not land in the replicated log.
+	// The dedupe window is rebuilt from applied entries on every replica, so it survives a leader change.
+	// In-flight duplicates not yet applied will still be caught consistently when applied.
+	if len(hdr) > 0 {
+		if msgId := getMsgId(hdr); msgId != _EMPTY_ {
+			mset.mu.RLock()
+			dde, pubAck := mset.checkMsgId(msgId), mset.pubAck
+			mset.mu.RUnlock()
+			if dde != nil {
+				if canRespond {
+					response = append(pubAck, strconv.FormatUint(dde.seq, 10)...)
+					response = append(response, ",\"duplicate\": true}"...)
+					sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+				}
+				return errors.New("msgid is duplicate")
+			}
+		}
+	}
+
+	// Proceed with proposing this message.
+	mset.mu.Lock()
+
+	// We only use mset.clseq for clustering and in case we run ahead of actual commits.
+	// Check if we need to set initial value here
+	if mset.clseq < mset.lseq {
+		mset.clseq = mset.lseq
+	}
+
+	// For discard new check limits here so a full stream rejects before proposing. We include proposals not yet
+	// applied so concurrent publishes can not push us past the limit. Replicas still check when storing, and that
+	// outcome is the same on every replica. Discard old is enforced by each store in log order, so replicas match.
+	sz := mset.storedMsgSize(subject, hdr, msg)
+	if err := mset.checkDiscardNew(sz); err != nil {
+		mset.mu.Unlock()
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: err.Error()}
+			response, _ = json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return err
+	}
+
+	// Do proposal.
+	err := mset.node.Propose(encodeStreamMsg(subject, reply, hdr, msg, mset.clseq, time.Now().UnixNano()))
+	if err != nil {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.config.Name}}
+			resp.Error = &ApiError{Code: 503, Description: err.Error()}
+			response, _ = json.Marshal(resp)
+		}
+	} else {
+		mset.trackProposed(mset.clseq, sz)
+		mset.clseq++
+	}
+	mset.mu.Unlock()
+
+	// If we errored out respond here.
+	if err != nil && canRespond {
+		sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	}
+
+	return err
+}
+
+// How long we will hold a pub ack waiting on replicas for our ack level.
+const ackLevelTimeout = 4 * time.Second
+
+// sendPubAckWhenStored will hold the pub ack for the message at index until all
+// replicas have stored it. The leader releases these in index order as followers respond.
+func (mset *Stream) sendPubAckWhenStored(node RaftNode, index uint64, reply string, response []byte) {
+	mset.mu.RLock()
+	name, replicas, sendq, qch := mset.config.Name, mset.config.Replicas, mset.sendq, mset.qch
+	mset.mu.RUnlock()
+
+	if qch == nil {
+		return
+	}
+
+	node.NotifyStored(index, replicas, ackLevelTimeout, func(err error) {
+		if err != nil {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: name}}
+			resp.Error = &ApiError{Code: 503, Description: err.Error()}
+			response, _ = json.Marshal(resp)
+		}
+		// Drop the ack if we are stopping.
+		select {
+		case sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}:
+		case <-qch:
+		}
+	})
+}
+
+// For requesting messages post raft snapshot to catch up streams post server restart.
+// Any deleted msgs etc will be handled inline on catchup.
+type streamSyncRequest struct {
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+// Given a stream state that represents a snapshot, calculate the sync request based on our current state.
+func (mset *Stream) calculateSyncRequest(state *StreamState, snap *streamSnapshot) *streamSyncRequest {
+	// Quick check if we are already caught up.
+	if state.LastSeq >= snap.LastSeq {
+		return nil
+	}
+	return &streamSyncRequest{FirstSeq: state.LastSeq + 1, LastSeq: snap.LastSeq}
+}
+
+// processSnapshotDeletes will update our current store based on the snapshot
+// but only processing deletes and new FirstSeq / purges.
+func (mset *Stream) processSnapshotDeletes(snap *streamSnapshot) {
+	mset.setMinRetainedSeq(snap.FirstSeq)
+	state := mset.store.State()
+
+	// Adjust if FirstSeq has moved.
+	if snap.FirstSeq > state.FirstSeq {
+		mset.store.Compact(snap.FirstSeq)
+		state = mset.store.State()
+	}
+	// Range the deleted and delete if applicable.
+	for _, dseq := range snap.Deleted {
+		if dseq <= state.LastSeq {
+			mset.store.RemoveMsg(dseq)
+		}
+	}
+}
+
+// setMinRetainedSeq will raise our floor, sequences below it are never stored again.
+func (mset *Stream) setMinRetainedSeq(seq uint64) {
+	mset.mu.Lock()
+	if seq > mset.minRetainedSeq {
+		mset.minRetainedSeq = seq
+	}
+	mset.mu.Unlock()
+}
+
+func (mset *Stream) getMinRetainedSeq() uint64 {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.minRetainedSeq
+}
+
+// setCatchingUp will mark us as catching up to the target sequence.
+// Can be called again to update the target.
+func (mset *Stream) setCatchingUp(target uint64) {
+	mset.mu.Lock()
+	if !mset.catchup {
+		mset.catchup = true
+		mset.cstart = time.Now()
+		mset.cdone = make(chan struct{})
+	}
+	mset.ctarget = target
+	mset.mu.Unlock()
+}
+
+func (mset *Stream) clearCatchingUp() {
+	mset.mu.Lock()
+	mset.catchup = false
+	mset.cstart, mset.ctarget = time.Time{}, 0
+	if mset.cdone != nil {
+		close(mset.cdone)
+		mset.cdone = nil
+	}
+	// Catchup stores directly, so rebuild our last value index on next use.
+	mset.lvs = nil
+	mset.mu.Unlock()
+}
+
+// CatchupInfo describes a stream that is catching up from its leader.
+type CatchupInfo struct {
+	Account string    `json:"account"`
+	Stream  string    `json:"stream"`
+	Group   string    `json:"group,omitempty"`
+	Current uint64    `json:"current_seq"`
+	Target  uint64    `json:"target_seq"`
+	Started time.Time `json:"started"`
+}
+
+// catchupInfo returns our catchup progress, or nil if we are not catching up.
+func (mset *Stream) catchupInfo() *CatchupInfo {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	if !mset.catchup {
+		return nil
+	}
+	ci := &CatchupInfo{
+		Account: mset.jsa.account.Name,
+		Stream:  mset.config.Name,
+		Current: mset.store.State().LastSeq,
+		Target:  mset.ctarget,
+		Started: mset.cstart,
+	}
+	if mset.node != nil {
+		ci.Group = mset.node.Group()
+	}
+	return ci
+}
+
+// ActiveCatchups returns the streams on this server that are currently catching up.
+func (s *Server) ActiveCatchups() []CatchupInfo {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	js.mu.RLock()
+	accounts := make([]*Account, 0, len(js.accounts))
+	for acc := range js.accounts {
+		accounts = append(accounts, acc)
+	}
+	js.mu.RUnlock()
+
+	var cis []CatchupInfo
+	for _, acc := range accounts {
+		for _, mset := range acc.Streams() {
+			if ci := mset.catchupInfo(); ci != nil {
+				cis = append(cis, *ci)
+			}
+		}
+	}
+	return cis
+}
+
+func (mset *Stream) isCatchingUp() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.catchup
+}
+
+// Process a stream snapshot.
+func (mset *Stream) processSnapshot(buf []byte) error {
+	buf, err := decodeSnapshot(buf)
+	if err != nil {
+		return err
+	}
+	var snap streamSnapshot
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		return err
+	}
+
+	// Update any deletes, etc.
+	mset.processSnapshotDeletes(&snap)
+	mset.setRePublished(snap.RePublished)
+	mset.setMirrorSeq(snap.MirrorSeq)
+	mset.setMinRetainedSeq(snap.MinRetained)
+	mset.restoreMsgIds(snap.MsgIds)
+
+	mset.mu.Lock()
+	state := mset.store.State()
+	sreq := mset.calculateSyncRequest(&state, &snap)
+	s, subject, n, mqch := mset.srv, mset.sa.Sync, mset.node, mset.qch
+	mset.mu.Unlock()
+
+	// Just return if up to date or we have been stopped.
+	if sreq == nil || mqch == nil {
+		return nil
+	}
+
+	// Pause the apply channel for our raft group while we catch up.
+	n.PauseApply()
+	defer n.ResumeApply()
+
+	// Set our catchup state.
+	mset.setCatchingUp(sreq.LastSeq)
+	defer mset.clearCatchingUp()
+
+	js := s.getJetStream()
+
+RETRY:
+
+	// If our stream was stopped or deleted do not touch the store again.
+	select {
+	case <-mqch:
+		return nil
+	default:
+	}
+
+	// Grab sync request again on failures.
+	if sreq == nil {
+		mset.mu.Lock()
+		state := mset.store.State()
+		sreq = mset.calculateSyncRequest(&state, &snap)
+		mset.mu.Unlock()
+		if sreq == nil {
+			return nil
+		}
+	}
+
+	msgsC := make(chan []byte, 1024)
+
+	// Send our catchup request here.
+	reply := syncReplySubject()
+	sub, err := s.sysSubscribe(reply, func(_ *subscription, _ *client, _, reply string, msg []byte) {
+		// Make copies - https://github.com/go101/go101/wiki
+		// TODO(dlc) - Since we are using a buffer from the inbound client/route.
+		if len(msg) > 0 {
+			msg = append(msg[:0:0], msg...)
+		}
+		// Do not block the route if we have stopped reading.
+		select {
+		case msgsC <- msg:
+		case <-mqch:
+			return
+		}
+		if reply != _EMPTY_ {
+			s.sendInternalMsgLocked(reply, _EMPTY_, nil, nil)
+		}
+	})
+	if err != nil {
+		return nil
+	}
+	defer s.sysUnsubscribe(sub)
+
+	b, _ := json.Marshal(sreq)
+	s.sendInternalMsgLocked(subject, reply, nil, b)
+
+	// Clear our sync request and capture last.
+	last := sreq.LastSeq
+	mset.setCatchingUp(last)
+	sreq = nil
+
+	const activityInterval = 5 * time.Second
+	notActive := time.NewTimer(activityInterval)
+	defer notActive.Stop()
+
+	// Run our own select loop here.
+	for qch, lch := n.QuitC(), n.LeadChangeC(); ; {
+		select {
+		case msg := <-msgsC:
+			notActive.Reset(activityInterval)
+			// Check eof signaling.
+			if len(msg) == 0 {
+				goto RETRY
+			}
+
+			if lseq, err := mset.processCatchupMsg(msg); err == nil {
+				if lseq >= last {
+					return nil
+				}
+			} else {
+				goto RETRY
+			}
+		case <-notActive.C:
+			s.Warnf("Catchup for stream '%s > %s' stalled", mset.account(), mset.Name())
+			goto RETRY
+		case <-s.quitCh:
+			return nil
+		case <-qch:
+			return nil
+		case <-mqch:
+			return nil
+		case isLeader := <-lch:
+			sa := js.streamAssignment(mset.account().Name, mset.Name())
+			js.processStreamLeaderChange(mset, sa, isLeader)
+		}
+	}
+}
+
+// processCatchupMsg will be called to process out of band catchup msgs from a sync request.
+func (mset *Stream) processCatchupMsg(msg []byte) (uint64, error) {
+	if len(msg) == 0 || entryOp(msg[0]) != streamMsgOp {
+		// TODO(dlc) - This is error condition, log.
+		return 0, errors.New("bad catchup msg")
+	}
+
+	subj, _, hdr, msg, seq, ts, err := decodeStreamMsg(msg[1:])
+	if err != nil {
+		return 0, errors.New("bad catchup msg")
+	}
+	// Put into our store
+	// Messages to be skipped have no subject or timestamp.
+	// Anything below our replicated floor was purged, so skip it as well.
+	// TODO(dlc) - formalize witrh skipMsgOp
+	if subj == _EMPTY_ && ts == 0 || seq < mset.getMinRetainedSeq() {
+		lseq := mset.store.SkipMsg()
+		if lseq != seq {
+			return 0, errors.New("wrong sequence for skipped msg")
+		}
+	} else if err := mset.store.StoreRawMsg(subj, hdr, msg, seq, ts); err != nil {
+		return 0, err
+	} else {
+		// Keep our duplicate window and last sequence index in step with the messages we caught up on.
+		if msgId := getMsgId(hdr); msgId != _EMPTY_ {
+			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		}
+		mset.trackLastSeq(subj, seq)
+		if mseq := getMirrorSeq(hdr); mseq > 0 {
+			mset.setMirrorSeq(mseq)
+		}
+	}
+	// Update our lseq.
+	mset.setLastSeq(seq)
+
+	return seq, nil
+}
+
+func (mset *Stream) handleClusterSyncRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var sreq streamSyncRequest
+	if err := json.Unmarshal(msg, &sreq); err != nil {
+		// Log error.
+		return
+	}
+	mset.srv.startGoRoutine(func() { mset.runCatchup(reply, &sreq) })
+}
+
+// clusterInfo will report on the status of the raft group.
+func (s *Server) clusterInfo(n RaftNode) *ClusterInfo {
+	if n == nil {
+		return &ClusterInfo{
+			Name:   s.ClusterName(),
+			Leader: s.Name(),
+		}
+	}
+
+	ci := &ClusterInfo{
+		Name:   s.ClusterName(),
+		Leader: s.serverNameForNode(n.GroupLeader()),
+	}
+
+	now := time.Now()
+
+	id, peers := n.ID(), n.Peers()
+	for _, rp := range peers {
+		if rp.ID != id {
+			lastSeen := now.Sub(rp.Last)
+			current := rp.Current
+			if current && lastSeen > lostQuorumInterval {
+				current = false
+			}
+			pi := &PeerInfo{Name: s.serverNameForNode(rp.ID), Current: current, Active: lastSeen}
+			ci.Replicas = append(ci.Replicas, pi)
+		}
+	}
+	return ci
+}
+
+func (mset *Stream) handleClusterStreamInfoRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	mset.mu.RLock()
+	if mset.client == nil {
+		mset.mu.RUnlock()
+		return
+	}
+	s, config, node := mset.srv, mset.config, mset.node
+	mset.mu.RUnlock()
+
+	si := &StreamInfo{Created: mset.Created(), State: mset.State(), Config: config, Cluster: s.clusterInfo(node)}
+	b, _ := json.Marshal(si)
+	s.sendInternalMsgLocked(reply, _EMPTY_, nil, b)
+}
+
+func (mset *Stream) runCatchup(sendSubject string, sreq *streamSyncRequest) {
+	s := mset.srv
+	defer s.grWG.Done()
+
+	// Wait our turn if we are limiting concurrent catchups.
+	if !s.acquireCatchup(nil) {
+		return
+	}
+	defer s.releaseCatchup()
+
+	const maxOut = int64(48 * 1024 * 1024) // 48MB for now.
+	out := int64(0)
+
+	// Flow control processing.
+	ackReplySize := func(subj string) int64 {
+		if li := strings.LastIndexByte(subj, btsep); li > 0 && li < len(subj) {
+			return parseAckReplyNum(subj[li+1:])
+		}
+		return 0
+	}
+
+	nextBatchC := make(chan struct{}, 1)
+	nextBatchC <- struct{}{}
+
+	// Setup ackReply for flow control.
+	ackReply := syncAckSubject()
+	ackSub, _ := s.sysSubscribe(ackReply, func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		sz := ackReplySize(subject)
+		atomic.AddInt64(&out, -sz)
+		select {
+		case nextBatchC <- struct{}{}:
+		default:
+		}
+	})
+	defer s.sysUnsubscribe(ackSub)
+	ackReplyT := strings.ReplaceAll(ackReply, ".*", ".%d")
+
+	// EOF
+	defer s.sendInternalMsgLocked(sendSubject, _EMPTY_, nil, nil)
+
+	const activityInterval = 5 * time.Second
+	notActive := time.NewTimer(activityInterval)
+	defer notActive.Stop()
+
+	// Setup sequences to walk through.
+	seq, last := sreq.FirstSeq, sreq.LastSeq
+
+	// Optional rate limit in bytes per second, the stream's setting overrides the server's.
+	mset.mu.RLock()
+	rate := mset.config.CatchupRate
+	mset.mu.RUnlock()
+	if rate == 0 {
+		rate = s.getOpts().MaxCatchupRate
+	}
+	rl := newCatchupLimiter(rate)
+	var rlt *time.Timer
+	defer func() {
+		if rlt != nil {
+			rlt.Stop()
+		}
+	}()
+
+	// Grab stream quit channel.
+	mset.mu.RLock()
+	qch := mset.qch
+	mset.mu.RUnlock()
+	if qch == nil {
+		return
+	}
+
+	sendNextBatch := func() {
+		for ; seq <= last && atomic.LoadInt64(&out) <= maxOut; seq++ {
+			// If we are over our rate, kick the next batch when we have tokens again.
+			if wait := rl.wait(); wait > 0 {
+				if rlt == nil {
+					rlt = time.AfterFunc(wait, func() {
+						select {
+						case nextBatchC <- struct{}{}:
+						default:
+						}
+					})
+				} else {
+					rlt.Reset(wait)
+				}
+				return
+			}
+			// Stop if the stream is being stopped or deleted.
+			select {
+			case <-qch:
+				seq = last + 1
+				return
+			default:
+			}
+			subj, hdr, msg, ts, err := mset.store.LoadMsg(seq)
+			// if this is not a deleted msg, bail out.
+			if err != nil && err != ErrStoreMsgNotFound && err != errDeletedMsg {
+				// break, something changed.
+				seq = last + 1
+				return
+			}
+			// S2?
+			em := encodeStreamMsg(subj, _EMPTY_, hdr, msg, seq, ts)
+			// Place size in reply subject for flow control.
+			reply := fmt.Sprintf(ackReplyT, len(em))
+			atomic.AddInt64(&out, int64(len(em)))
+			rl.take(int64(len(em)))
+			s.sendInternalMsgLocked(sendSubject, reply, nil, em)
+		}
+	}
+
+	// Run as long as we are still active and need catchup.
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case <-notActive.C:
+			s.Warnf("Catchup for stream '%s > %s' stalled", mset.account(), mset.Name())
+			return
+		case <-nextBatchC:
+			// Update our activity timer.
+			notActive.Reset(activityInterval)
+			sendNextBatch()
+			// Check if we are finished.
+			if seq >= last {
+				s.Debugf("Done resync for stream '%s > %s'", mset.account(), mset.Name())
+				return
+			}
+		}
+	}
+}
+
+// catchupLimiter is a simple token bucket used to rate limit catchup traffic.
+// Burst is one second worth of bytes. A nil limiter does not limit.
+type catchupLimiter struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newCatchupLimiter(rate int64) *catchupLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &catchupLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait will refill our tokens and return how long until we can send again.
+func (rl *catchupLimiter) wait() time.Duration {
+	if rl == nil {
+		return 0
+	}
+	now := time.Now()
+	if elapsed := now.Sub(rl.last); elapsed > 0 {
+		rl.tokens += int64(float64(rl.rate) * elapsed.Seconds())
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+		rl.last = now
+	}
+	if rl.tokens > 0 {
+		return 0
+	}
+	return time.Duration(float64(-rl.tokens+1) / float64(rl.rate) * float64(time.Second))
+}
+
+// take will consume tokens for bytes sent. We allow going negative
+// so a single message larger than our burst can still be sent.
+func (rl *catchupLimiter) take(sz int64) {
+	if rl != nil {
+		rl.tokens -= sz
+	}
+}
+
+func syncSubjForStream() string {
+	return syncSubject("$JSC.SYNC")
+}
+
+func syncReplySubject() string {
+	return syncSubject("$JSC.R")
+}
+
+func infoReplySubject() string {
+	return syncSubject("$JSC.R")
+}
+
+func syncAckSubject() string {
+	return syncSubject("$JSC.ACK") + ".*"
+}
+
+func syncSubject(pre string) string {
+	var sb strings.Builder
+	sb.WriteString(pre)
+	sb.WriteByte(btsep)
+
+	var b [replySuffixLen]byte
+	rn := rand.Int63()
+	for i, l := 0, rn; i < len(b); i++ {
+		b[i] = digits[l%base]
+		l /= base
+	}
+
+	sb.Write(b[:])
+	return sb.String()
+}
+
+const (
+	clusterStreamInfoT   = "$JSC.SI.%s.%s"
+	clusterConsumerInfoT = "$JSC.CI.%s.%s.%s"
+	clusterMsgGetT       = "$JSC.MG.%s.%s.%s"
+	jsaUpdatesSubT       = "$JSC.ARU.%s.*"
+	jsaUpdatesPubT       = "$JSC.ARU.%s.%s"
+)
@@ -0,0 +1,40 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestJetStreamClusterMsgGetResponder(t *testing.T) {
+	peers := []*Peer{
+		{ID: "L", Current: true},
+		{ID: "B", Current: false},
+		{ID: "C", Current: true},
+	}
+
+	// A current leader serves the read itself.
+	if peer, ok := msgGetResponder(true, "L", peers); !ok || peer != _EMPTY_ {
+		t.Fatalf("Expected the leader to serve, got %q %v", peer, ok)
+	}
+	// A leader that is not current hands it to a current follower, never a lagging one.
+	if peer, ok := msgGetResponder(false, "L", peers); !ok || peer != "C" {
+		t.Fatalf("Expected the current follower to serve, got %q %v", peer, ok)
+	}
+	// With only lagging followers the leader returns not current.
+	peers[2].Current = false
+	if peer, ok := msgGetResponder(false, "L", peers); ok || peer != _EMPTY_ {
+		t.Fatalf("Expected no replica to serve, got %q %v", peer, ok)
+	}
+}
@@ -0,0 +1,3569 @@
+// Copyright 2020-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RaftNode interface {
+	Propose(entry []byte) error
+	PausePropose()
+	ResumePropose()
+	ForwardProposal(entry []byte) error
+	Snapshot(snap []byte) error
+	SnapshotAndWait(snap []byte, timeout time.Duration) error
+	Applied(index uint64)
+	Compact(index uint64) error
+	State() RaftState
+	Size() (entries, bytes uint64)
+	Stats() *RaftStats
+	StorageStats() *RaftStorageStats
+	Leader() bool
+	Quorum() bool
+	Current() bool
+	GroupLeader() string
+	WaitForLeader(timeout time.Duration) (string, error)
+	NotifyStored(index uint64, replicas int, timeout time.Duration, cb func(error))
+	StepDown() error
+	TransferLeader(peer string) error
+	Campaign() error
+	ID() string
+	Group() string
+	Peers() []*Peer
+	MutePeers() []string
+	CanRemoveSelf() bool
+	ProposeAddPeer(peer string) error
+	ProposeRemovePeer(peer string) error
+	ApplyC() <-chan *CommittedEntry
+	ApplyFailed(index uint64, err error)
+	SetApplyErrorFunc(fn ApplyErrorFunc)
+	PauseApply()
+	ResumeApply()
+	Pause() error
+	Resume()
+	LeadChangeC() <-chan bool
+	QuitC() <-chan struct{}
+	Stop()
+	Delete()
+}
+
+type WAL interface {
+	StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error)
+	LoadMsg(index uint64) (subj string, hdr, msg []byte, ts int64, err error)
+	RemoveMsg(index uint64) (bool, error)
+	Compact(index uint64) (uint64, error)
+	State() StreamState
+	Stop() error
+	Delete() error
+}
+
+type LeadChange struct {
+	Leader   bool
+	Previous string
+}
+
+type Peer struct {
+	ID      string
+	Current bool
+	Last    time.Time
+	Index   uint64
+}
+
+// RaftStats holds proposal and commit latencies for a raft node.
+// Latencies are smoothed averages and are only tracked while leader,
+// Proposals and Commits are the number of samples taken for each.
+type RaftStats struct {
+	Proposals     uint64        `json:"proposals"`
+	Commits       uint64        `json:"commits"`
+	StoreLatency  time.Duration `json:"store_latency"`
+	CommitLatency time.Duration `json:"commit_latency"`
+}
+
+// RaftStorageStats describes the physical storage used by a raft WAL.
+type RaftStorageStats struct {
+	Bytes       uint64 `json:"bytes"`
+	Reclaimable uint64 `json:"reclaimable"`
+	Blocks      int    `json:"blocks"`
+}
+
+// ApplyErrorFunc is called when the upper layer failed to apply a committed entry.
+type ApplyErrorFunc func(index uint64, err error)
+
+type RaftState uint8
+
+// Allowable states for a NATS Consensus Group.
+const (
+	Follower RaftState = iota
+	Leader
+	Candidate
+	Observer
+	Closed
+)
+
+func (state RaftState) String() string {
+	switch state {
+	case Follower:
+		return "FOLLOWER"
+	case Candidate:
+		return "CANDIDATE"
+	case Leader:
+		return "LEADER"
+	case Observer:
+		return "OBSERVER"
+	case Closed:
+		return "CLOSED"
+	}
+	return "UNKNOWN"
+}
+
+type raft struct {
+	sync.RWMutex
+	group   string
+	sd      string
+	id      string
+	wal     WAL
+	state   RaftState
+	csz     int
+	qn      int
+	wqn     int
+	peers   map[string]*lps
+	acks    map[uint64]map[string]struct{}
+	elect   *time.Timer
+	active  time.Time
+	term    uint64
+	pterm   uint64
+	pindex  uint64
+	sindex  uint64
+	commit  uint64
+	scommit uint64
+	applied uint64
+	leader  string
+	vote    string
+	hash    string
+	failed  int
+	s       *Server
+	c       *client
+	dflag   bool
+	sflag   bool
+	escale  bool
+
+	// Adaptive heartbeats, counted in hbInterval ticks. See heartbeatDue().
+	hbmax  int
+	hbtks  int
+	hbwait int
+
+	// Most entries we will track acks for before we push back on proposals.
+	maxacks int
+
+	// Structured log fields, updated with term and state changes.
+	lfields atomic.Value
+
+	// Subjects for votes, updates, replays.
+	psubj  string
+	vsubj  string
+	vreply string
+	asubj  string
+	areply string
+
+	// For when we need to catch up as a follower.
+	catchup *catchupState
+
+	// For leader or server catching up a follower.
+	progress map[string]chan uint64
+
+	// For when we have paused our applyC.
+	paused  bool
+	hcommit uint64
+
+	// Called when an entry failed to apply, see ApplyFailed().
+	aerrf ApplyErrorFunc
+
+	// For when we have paused participation for maintenance.
+	// A degraded node is halted until restarted.
+	halted   bool
+	degraded bool
+
+	// Bootstrapped and have not heard from a leader yet, see processAppendEntry().
+	fresh bool
+
+	// When we last became leader, see MutePeers().
+	lstart time.Time
+
+	// For those waiting on a leader.
+	lwait chan struct{}
+
+	// Recent leadership changes, see RaftLeadershipHistory().
+	lhist [leaderHistorySize]leaderChange
+	nlch  uint64
+
+	// Leader side, those waiting on entries to be stored by our followers, in index order.
+	swaits []*storedWait
+
+	// Latency tracking, see Stats().
+	pts    int64
+	stimes [latencyWindow]storeTime
+	nprops uint64
+	ncmts  uint64
+	slat   int64
+	clat   int64
+
+	// Channels
+	propc    chan *Entry
+	pausec   chan struct{}
+	applyc   chan *CommittedEntry
+	sendq    chan *pubMsg
+	quit     chan struct{}
+	reqs     chan *voteRequest
+	votes    chan *voteResponse
+	resp     chan *appendEntryResponse
+	leadc    chan bool
+	stepdown chan string
+}
+
+// cacthupState structure that holds our subscription, and catchup term and index
+// as well as starting term and index and how many updates we have seen.
+type catchupState struct {
+	sub    *subscription
+	cterm  uint64
+	cindex uint64
+	pterm  uint64
+	pindex uint64
+	hbs    int
+	// Where we requested the catchup from the leader.
+	reply string
+}
+
+// lps holds peer state of last time and last index replicated.
+type lps struct {
+	ts int64
+	li uint64
+}
+
+const (
+	minElectionTimeout = 300 * time.Millisecond
+	maxElectionTimeout = 3 * minElectionTimeout
+	minCampaignTimeout = 50 * time.Millisecond
+	maxCampaignTimeout = 4 * minCampaignTimeout
+	hbInterval         = 200 * time.Millisecond
+	lostQuorumInterval = hbInterval * 3
+	maxCampaignBackoff = 4 * maxElectionTimeout
+	latencyWindow      = 64
+	leaderHistorySize  = 32
+	maxPendingApplies  = 256
+	walStoreRetries    = 3
+	walRetryDelay      = 10 * time.Millisecond
+)
+
+type RaftConfig struct {
+	Name  string
+	Store string
+	Log   WAL
+	// Observer will have us start as a non-voting observer until the group commits adding us as a peer.
+	Observer bool
+	// WriteQuorum is how many peers need to store an entry before it is committed.
+	// This can only raise the quorum, elections always need a majority.
+	WriteQuorum int
+	// FSM will have the node apply committed entries to it, see FSM.
+	// When set ApplyC() should not be used.
+	FSM FSM
+}
+
+// FSM is a replicated state machine that a raft node can drive directly
+// instead of the caller consuming ApplyC().
+type FSM interface {
+	// Apply is called with each committed entry in log order.
+	Apply(index uint64, data []byte) error
+	// Snapshot returns the current state, used by the leader to compact the log.
+	// This is only called once every committed entry has been applied.
+	Snapshot() ([]byte, error)
+	// Restore replaces the current state with a snapshot. This is only called
+	// for snapshots newer than the entries we have applied.
+	Restore(snap []byte) error
+}
+
+const (
+	// How many entries the leader applies to an FSM between snapshots.
+	fsmSnapshotInterval = 8192
+	// How long the leader will hold proposals waiting to take an FSM snapshot.
+	fsmSnapshotWait = 2 * time.Second
+)
+
+var (
+	errProposalFailed  = errors.New("raft: proposal failed")
+	errProposalsPaused = errors.New("raft: proposals paused")
+	errNotLeader       = errors.New("raft: not leader")
+	errAlreadyLeader   = errors.New("raft: already leader")
+	errNotCurrent      = errors.New("raft: not current")
+	errNilCfg          = errors.New("raft: no config given")
+	errUnknownPeer     = errors.New("raft: unknown peer")
+	errCorruptPeers    = errors.New("raft: corrupt peer state")
+	errStepdownFailed  = errors.New("raft: stepdown failed")
+	errPeersNotCurrent = errors.New("raft: all peers are not current")
+	errFailedToApply   = errors.New("raft: could not place apply entry")
+	errEntryLoadFailed = errors.New("raft: could not load entry from WAL")
+	errNodeRunning     = errors.New("raft: node is running")
+	errBadTermVote     = errors.New("raft: term and vote inconsistent with peers")
+	errUnknownGroup    = errors.New("raft: unknown group")
+	errNodeClosed      = errors.New("raft: node closed")
+	errNoLeaderTimeout = errors.New("raft: timeout waiting for leader")
+	errReplicaTimeout  = errors.New("raft: timeout waiting for replicas")
+	errNodePaused      = errors.New("raft: node is paused")
+	errIndexMismatch   = errors.New("raft: entry stored at wrong WAL index")
+	errObserver        = errors.New("raft: node is an observer")
+	errPeerNotCurrent  = errors.New("raft: peer is not current")
+	errSnapshotTimeout = errors.New("raft: timeout waiting for snapshot")
+	errTooManyPending  = errors.New("raft: too many proposals waiting on commit")
+	errBadFSMSnapshot  = errors.New("raft: bad FSM snapshot")
+	errWALChanged      = errors.New("raft: log changed while retrying WAL store")
+)
+
+// Default for how many uncommitted entries a leader will track acks for, see MaxRaftPendingAcks.
+const defaultMaxPendingAcks = 128 * 1024
+
+// This will bootstrap a raftNode by writing its config into the store directory.
+func (s *Server) bootstrapRaftNode(cfg *RaftConfig, knownPeers []string, allPeersKnown bool) error {
+	if cfg == nil {
+		return errNilCfg
+	}
+	// Check validity of peers if presented.
+	for _, p := range knownPeers {
+		if len(p) != idLen {
+			return fmt.Errorf("raft: illegal peer: %q", p)
+		}
+	}
+	expected := len(knownPeers)
+	// We need to adjust this is all peers are not known.
+	if !allPeersKnown {
+		if expected < 2 {
+			expected = 2
+		}
+		if ncr := s.configuredRoutes(); expected < ncr {
+			expected = ncr
+		}
+	}
+
+	return writePeerState(cfg.Store, &peerState{knownPeers, expected})
+}
+
+// recoverPeerState will rewrite the peer state for a stopped raft node from an
+// operator supplied peer set. This is for when the peer state has been lost or is corrupt.
+func (s *Server) recoverPeerState(sd, group string, peers []string) error {
+	if s.lookupRaftNode(group) != nil {
+		return errNodeRunning
+	}
+	s.mu.Lock()
+	if s.sys == nil {
+		s.mu.Unlock()
+		return ErrNoSysAccount
+	}
+	ourID := s.sys.shash[:idLen]
+	s.mu.Unlock()
+
+	// Check validity of peers and make sure we are included.
+	known, hasUs := make(map[string]struct{}), false
+	for _, p := range peers {
+		if len(p) != idLen {
+			return fmt.Errorf("raft: illegal peer: %q", p)
+		}
+		known[p] = struct{}{}
+		if p == ourID {
+			hasUs = true
+		}
+	}
+	if !hasUs {
+		peers = append(peers, ourID)
+		known[ourID] = struct{}{}
+	}
+	if len(known) < 2 {
+		return errors.New("raft: cluster too small")
+	}
+
+	// If we have a recorded vote it needs to be for a member of the new peer set.
+	tn := &raft{sd: sd}
+	term, vote, err := tn.readTermVote()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if vote != noVote {
+		if _, ok := known[vote]; !ok || term == 0 {
+			return errBadTermVote
+		}
+	}
+
+	return writePeerState(sd, &peerState{peers, len(known)})
+}
+
+// startRaftNode will start the raft node.
+func (s *Server) startRaftNode(cfg *RaftConfig) (RaftNode, error) {
+	if cfg == nil {
+		return nil, errNilCfg
+	}
+	s.mu.Lock()
+	if s.sys == nil || s.sys.sendq == nil {
+		s.mu.Unlock()
+		return nil, ErrNoSysAccount
+	}
+	sendq := s.sys.sendq
+	sacc := s.sys.account
+	hash := s.sys.shash
+	s.mu.Unlock()
+
+	ps, err := readPeerState(cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+	if ps == nil || ps.clusterSize < 2 {
+		return nil, errors.New("raft: cluster too small")
+	}
+	n := &raft{
+		id:       hash[:idLen],
+		group:    cfg.Name,
+		sd:       cfg.Store,
+		wal:      cfg.Log,
+		state:    Follower,
+		csz:      ps.clusterSize,
+		qn:       ps.clusterSize/2 + 1,
+		wqn:      cfg.WriteQuorum,
+		hash:     hash,
+		peers:    make(map[string]*lps),
+		acks:     make(map[uint64]map[string]struct{}),
+		s:        s,
+		c:        s.createInternalSystemClient(),
+		sendq:    sendq,
+		quit:     make(chan struct{}),
+		reqs:     make(chan *voteRequest, 4),
+		votes:    make(chan *voteResponse, 8),
+		resp:     make(chan *appendEntryResponse, 256),
+		propc:    make(chan *Entry, 256),
+		applyc:   make(chan *CommittedEntry, 512),
+		leadc:    make(chan bool, 4),
+		stepdown: make(chan string, 4),
+	}
+	n.c.registerWithAccount(sacc)
+
+	if atomic.LoadInt32(&s.logging.debug) > 0 {
+		n.dflag = true
+	}
+	if s.getOpts().LogStructured {
+		n.sflag = true
+	}
+	if s.getOpts().ScaleElectionTimeout {
+		n.escale = true
+	}
+	if maxhb := s.getOpts().MaxHeartbeatInterval; maxhb > hbInterval {
+		n.hbmax = int(maxhb / hbInterval)
+	}
+	if n.maxacks = s.getOpts().MaxRaftPendingAcks; n.maxacks <= 0 {
+		n.maxacks = defaultMaxPendingAcks
+	}
+
+	if term, vote, err := n.readTermVote(); err != nil && term > 0 {
+		n.term = term
+		n.vote = vote
+	}
+	n.updateLogFields()
+
+	if state := n.wal.State(); state.Msgs > 0 {
+		// TODO(dlc) - Recover our state here.
+		if first, err := n.loadFirstEntry(); err == nil {
+			n.pterm, n.pindex = first.pterm, first.pindex
+			if first.commit > 0 {
+				n.commit = first.commit
+			}
+		}
+		// Replay the log.
+		// Since doing this in place we need to make sure we have enough room on the applyc.
+		needed := state.Msgs + 1 // 1 is for nil to mark end of replay.
+		if uint64(cap(n.applyc)) < needed {
+			n.applyc = make(chan *CommittedEntry, needed)
+		}
+
+		for index := state.FirstSeq; index <= state.LastSeq; index++ {
+			ae, err := n.loadEntry(index)
+			if err != nil {
+				panic("err loading entry from WAL")
+			}
+			n.processAppendEntry(ae, nil)
+		}
+	}
+
+	// Send nil entry to signal the upper layers we are done doing replay/restore.
+	n.applyc <- nil
+
+	// Setup our internal subscriptions.
+	if err := n.createInternalSubs(); err != nil {
+		n.shutdown(true)
+		return nil, err
+	}
+
+	// Make sure to track ourselves.
+	n.trackPeer(n.id)
+	// Track known peers
+	for _, peer := range ps.knownPeers {
+		// Set these to 0 to start.
+		if peer != n.id {
+			n.peers[peer] = &lps{0, 0}
+		}
+	}
+
+	n.notice("Started")
+
+	n.Lock()
+	n.fresh = n.pindex == 0 && n.commit == 0
+	if cfg.Observer {
+		n.notice("Starting as an observer")
+		n.state = Observer
+	}
+	n.resetElectionTimeout()
+	n.Unlock()
+
+	s.registerRaftNode(n.group, n)
+	s.startGoRoutine(n.run)
+	if cfg.FSM != nil {
+		fsm := cfg.FSM
+		s.startGoRoutine(func() { n.runFSM(fsm) })
+	}
+
+	return n, nil
+}
+
+// StartRaftNode will start a raft node for a group outside of JetStream.
+// The system account needs to be configured.
+func (s *Server) StartRaftNode(cfg *RaftConfig) (RaftNode, error) {
+	return s.startRaftNode(cfg)
+}
+
+// runFSM will apply committed entries to fsm until we are stopped.
+// If the FSM fails to apply an entry we stop the node, the FSM would have diverged.
+func (n *raft) runFSM(fsm FSM) {
+	s := n.s
+	defer s.grWG.Done()
+
+	n.RLock()
+	applyc, qch := n.applyc, n.quit
+	n.RUnlock()
+
+	// The last index applied to the FSM and the one we last snapshotted at.
+	var applied, lsnap uint64
+
+	// The leader pauses proposals to snapshot, so the snapshot entry directly follows the state it holds.
+	var swait *time.Timer
+	var swaitC <-chan time.Time
+	endSnapshot := func() {
+		if swait != nil {
+			swait.Stop()
+			swait, swaitC = nil, nil
+			n.ResumePropose()
+		}
+		lsnap = applied
+	}
+	defer endSnapshot()
+
+	trySnapshot := func() {
+		if !n.Leader() {
+			endSnapshot()
+			return
+		}
+		if !n.quiesced() {
+			return
+		}
+		snap, err := fsm.Snapshot()
+		if err != nil {
+			n.warn("FSM snapshot failed: %v", err)
+		} else if err = n.Snapshot(encodeFSMSnapshot(applied, snap)); err != nil {
+			n.debug("FSM snapshot not taken: %v", err)
+		}
+		endSnapshot()
+	}
+
+	for {
+		select {
+		case <-qch:
+			return
+		case <-swaitC:
+			n.debug("FSM snapshot not taken, proposals did not settle")
+			endSnapshot()
+		case ce := <-applyc:
+			// A nil entry marks the end of replay.
+			if ce == nil {
+				continue
+			}
+			for _, e := range ce.Entries {
+				var err error
+				switch e.Type {
+				case EntryNormal:
+					err = fsm.Apply(ce.Index, e.Data)
+				case EntrySnapshot:
+					// Skip snapshots of state we have already applied, as is the
+					// case for the leader and any follower that has kept up.
+					var sindex uint64
+					var snap []byte
+					if sindex, snap, err = decodeFSMSnapshot(e.Data); err == nil && sindex > applied {
+						err = fsm.Restore(snap)
+					}
+				}
+				if err != nil {
+					n.error("FSM failed to apply entry %d: %v", ce.Index, err)
+					n.Stop()
+					return
+				}
+			}
+			applied = ce.Index
+			n.Applied(ce.Index)
+			if lsnap == 0 {
+				lsnap = ce.Index
+			}
+			if swait != nil {
+				trySnapshot()
+			} else if ce.Index-lsnap >= fsmSnapshotInterval && n.Leader() {
+				n.PausePropose()
+				swait = time.NewTimer(fsmSnapshotWait)
+				swaitC = swait.C
+				trySnapshot()
+			}
+		}
+	}
+}
+
+// quiesced returns if everything proposed has been stored, committed and applied.
+func (n *raft) quiesced() bool {
+	n.RLock()
+	defer n.RUnlock()
+	return len(n.propc) == 0 && n.pindex == n.commit && n.commit == n.applied
+}
+
+// FSM snapshots carry the index they were taken at.
+func encodeFSMSnapshot(index uint64, snap []byte) []byte {
+	buf := make([]byte, 8+len(snap))
+	binary.LittleEndian.PutUint64(buf, index)
+	copy(buf[8:], snap)
+	return buf
+}
+
+func decodeFSMSnapshot(buf []byte) (uint64, []byte, error) {
+	if len(buf) < 8 {
+		return 0, nil, errBadFSMSnapshot
+	}
+	return binary.LittleEndian.Uint64(buf), buf[8:], nil
+}
+
+// Maps node names back to server names.
+func (s *Server) serverNameForNode(node string) string {
+	s.mu.Lock()
+	sn := s.nodeToName[node]
+	s.mu.Unlock()
+	return sn
+}
+
+// Server will track all raft nodes.
+func (s *Server) registerRaftNode(group string, n RaftNode) {
+	s.rnMu.Lock()
+	defer s.rnMu.Unlock()
+	if s.raftNodes == nil {
+		s.raftNodes = make(map[string]RaftNode)
+	}
+	s.raftNodes[group] = n
+}
+
+func (s *Server) unregisterRaftNode(group string) {
+	s.rnMu.Lock()
+	defer s.rnMu.Unlock()
+	if s.raftNodes != nil {
+		delete(s.raftNodes, group)
+	}
+}
+
+func (s *Server) lookupRaftNode(group string) RaftNode {
+	s.rnMu.RLock()
+	defer s.rnMu.RUnlock()
+	var n RaftNode
+	if s.raftNodes != nil {
+		n = s.raftNodes[group]
+	}
+	return n
+}
+
+// RaftEntryInfo describes an entry in a raft log without its payload.
+type RaftEntryInfo struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+	Size  int    `json:"size"`
+}
+
+// RaftTail returns information on the last num entries of the log for the named raft group.
+// This is read-only and intended for debugging replication.
+func (s *Server) RaftTail(group string, num int) ([]RaftEntryInfo, error) {
+	node := s.lookupRaftNode(group)
+	if node == nil {
+		return nil, errUnknownGroup
+	}
+	n, ok := node.(*raft)
+	if !ok {
+		return nil, errUnknownGroup
+	}
+	return n.tail(num)
+}
+
+// tail will load the last num entries from our WAL.
+func (n *raft) tail(num int) ([]RaftEntryInfo, error) {
+	n.RLock()
+	defer n.RUnlock()
+
+	if n.state == Closed {
+		return nil, ErrStoreClosed
+	}
+	state := n.wal.State()
+	if num <= 0 || state.Msgs == 0 {
+		return nil, nil
+	}
+	first := state.FirstSeq
+	if state.LastSeq >= uint64(num) && state.LastSeq-uint64(num)+1 > first {
+		first = state.LastSeq - uint64(num) + 1
+	}
+
+	var entries []RaftEntryInfo
+	for index := first; index <= state.LastSeq; index++ {
+		ae, err := n.loadEntry(index)
+		if err != nil {
+			// Could have been removed, e.g. compacted.
+			continue
+		}
+		for _, e := range ae.entries {
+			entries = append(entries, RaftEntryInfo{Index: index, Term: ae.term, Type: e.Type.String(), Size: len(e.Data)})
+		}
+	}
+	return entries, nil
+}
+
+// RaftPendingApplies returns the entries for the named raft group that are committed but not yet applied.
+// This is read-only and intended for debugging a stalled apply loop.
+func (s *Server) RaftPendingApplies(group string) ([]RaftEntryInfo, error) {
+	node := s.lookupRaftNode(group)
+	if node == nil {
+		return nil, errUnknownGroup
+	}
+	n, ok := node.(*raft)
+	if !ok {
+		return nil, errUnknownGroup
+	}
+	return n.PendingApplies()
+}
+
+// PendingApplies will load the entries between applied and commit from our WAL.
+// At most maxPendingApplies entries are returned, starting with the oldest.
+func (n *raft) PendingApplies() ([]RaftEntryInfo, error) {
+	n.RLock()
+	defer n.RUnlock()
+
+	if n.state == Closed {
+		return nil, ErrStoreClosed
+	}
+	var entries []RaftEntryInfo
+	for index := n.applied + 1; index <= n.commit && len(entries) < maxPendingApplies; index++ {
+		ae, err := n.loadEntry(index)
+		if err != nil {
+			// Could have been removed, e.g. compacted.
+			continue
+		}
+		for _, e := range ae.entries {
+			entries = append(entries, RaftEntryInfo{Index: index, Term: ae.term, Type: e.Type.String(), Size: len(e.Data)})
+		}
+	}
+	return entries, nil
+}
+
+// RaftForceCatchup will have this server's follower for the named raft group request its catchup again.
+// See ForceCatchup.
+func (s *Server) RaftForceCatchup(group string) error {
+	node := s.lookupRaftNode(group)
+	if node == nil {
+		return errUnknownGroup
+	}
+	n, ok := node.(*raft)
+	if !ok {
+		return errUnknownGroup
+	}
+	n.ForceCatchup()
+	return nil
+}
+
+// ForceCatchup will have a follower that is catching up cancel its catchup and request it again from
+// the leader right away, instead of waiting for stall detection. This is a manual nudge for a stalled
+// catchup and is a no-op if we are the leader, current or not catching up.
+func (n *raft) ForceCatchup() {
+	n.Lock()
+	if n.state == Leader || n.state == Closed || n.isCurrent() {
+		n.Unlock()
+		return
+	}
+	cs := n.catchup
+	if cs == nil || cs.reply == _EMPTY_ {
+		n.Unlock()
+		return
+	}
+	n.debug("Forcing catchup, will request again")
+	inbox := n.createCatchup(&appendEntry{pterm: cs.cterm, pindex: cs.cindex, reply: cs.reply})
+	ar := &appendEntryResponse{n.pterm, n.pindex, n.id, false, n.state == Observer, _EMPTY_}
+	n.Unlock()
+
+	n.sendRPC(cs.reply, inbox, ar.encode())
+}
+
+// RaftLeaderChange describes a single leadership transition for a raft group.
+type RaftLeaderChange struct {
+	Time      time.Time `json:"time"`
+	Term      uint64    `json:"term"`
+	OldLeader string    `json:"old_leader,omitempty"`
+	NewLeader string    `json:"new_leader,omitempty"`
+}
+
+// leaderChange is how we record a leadership transition internally.
+type leaderChange struct {
+	ts     int64
+	term   uint64
+	prev   string
+	leader string
+}
+
+// RaftLeadershipHistory returns the most recent leadership transitions seen by this server
+// for the named raft group, oldest first. Only the last leaderHistorySize changes are kept.
+// Leaders are reported by server name when known and are empty when there was no leader.
+func (s *Server) RaftLeadershipHistory(group string) ([]RaftLeaderChange, error) {
+	node := s.lookupRaftNode(group)
+	if node == nil {
+		return nil, errUnknownGroup
+	}
+	n, ok := node.(*raft)
+	if !ok {
+		return nil, errUnknownGroup
+	}
+	hist := n.leaderHistory()
+	nameFor := func(node string) string {
+		if node == noLeader {
+			return _EMPTY_
+		}
+		if sn := s.serverNameForNode(node); sn != _EMPTY_ {
+			return sn
+		}
+		return node
+	}
+	changes := make([]RaftLeaderChange, 0, len(hist))
+	for _, lc := range hist {
+		changes = append(changes, RaftLeaderChange{
+			Time:      time.Unix(0, lc.ts).UTC(),
+			Term:      lc.term,
+			OldLeader: nameFor(lc.prev),
+			NewLeader: nameFor(lc.leader),
+		})
+	}
+	return changes, nil
+}
+
+// leaderHistory returns our recorded leadership changes, oldest first.
+func (n *raft) leaderHistory() []leaderChange {
+	n.RLock()
+	defer n.RUnlock()
+
+	start := uint64(0)
+	if n.nlch > leaderHistorySize {
+		start = n.nlch - leaderHistorySize
+	}
+	hist := make([]leaderChange, 0, n.nlch-start)
+	for i := start; i < n.nlch; i++ {
+		hist = append(hist, n.lhist[i%leaderHistorySize])
+	}
+	return hist
+}
+
+// numRaftNodes returns how many raft groups we are currently running.
+func (s *Server) numRaftNodes() int {
+	s.rnMu.RLock()
+	defer s.rnMu.RUnlock()
+	return len(s.raftNodes)
+}
+
+func (s *Server) transferRaftLeaders() bool {
+	if s == nil {
+		return false
+	}
+
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	if len(s.raftNodes) > 0 {
+		s.Noticef("Transferring any raft leaders")
+	}
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n)
+	}
+	s.rnMu.RUnlock()
+
+	var led []RaftNode
+	for _, node := range nodes {
+		if node.Leader() {
+			node.StepDown()
+			led = append(led, node)
+		}
+	}
+	s.waitForNewRaftLeaders(led, leaderTransferWait)
+	return len(led) > 0
+}
+
+// How long we will wait on shutdown for groups we led to elect a new leader.
+const leaderTransferWait = 2 * time.Second
+
+// Minimum time between leadership rebalances, gives transfers time to settle and avoids flapping.
+const leaderRebalanceInterval = 30 * time.Second
+
+// RebalanceRaftLeaders will hand leadership of groups we lead to caught up peers that lead
+// fewer of the groups we share with them. A transfer only happens when we lead at least two
+// more groups than the target, so leadership converges instead of bouncing back and forth.
+// Returns the number of transfers started.
+func (s *Server) RebalanceRaftLeaders() int {
+	if s == nil {
+		return 0
+	}
+
+	var nodes []RaftNode
+	s.rnMu.Lock()
+	if time.Since(s.rebal) < leaderRebalanceInterval {
+		s.rnMu.Unlock()
+		return 0
+	}
+	s.rebal = time.Now()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n)
+	}
+	s.rnMu.Unlock()
+
+	// Count how many of our groups each peer is leading.
+	counts := make(map[string]int)
+	var led []RaftNode
+	for _, node := range nodes {
+		if leader := node.GroupLeader(); leader != noLeader {
+			counts[leader]++
+		}
+		if node.Leader() {
+			led = append(led, node)
+		}
+	}
+
+	var moved int
+	for _, node := range led {
+		id, target := node.ID(), noLeader
+		low := counts[id] - 1
+		for _, p := range node.Peers() {
+			if p.ID == id || !p.Current {
+				continue
+			}
+			if c := counts[p.ID]; c < low {
+				target, low = p.ID, c
+			}
+		}
+		if target == noLeader {
+			continue
+		}
+		if err := node.TransferLeader(target); err != nil {
+			s.Debugf("Could not transfer raft group %q leadership to %q: %v", node.Group(), s.serverNameForNode(target), err)
+			continue
+		}
+		counts[id]--
+		counts[target]++
+		moved++
+	}
+	if moved > 0 {
+		s.Noticef("Rebalanced leadership for %d raft groups", moved)
+	}
+	return moved
+}
+
+// waitForNewRaftLeaders will wait, up to timeout in total, for each of the nodes
+// to see a leader other than us.
+func (s *Server) waitForNewRaftLeaders(nodes []RaftNode, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, node := range nodes {
+		for {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				s.Warnf("Timeout waiting for raft groups to elect new leaders")
+				return
+			}
+			leader, err := node.WaitForLeader(remaining)
+			if err != nil && err != errNoLeaderTimeout {
+				break
+			}
+			if leader != noLeader && leader != node.ID() {
+				break
+			}
+			// Our stepdown may not have been processed yet.
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (s *Server) shutdownRaftNodes() {
+	if s == nil {
+		return
+	}
+
+	var nodes []RaftNode
+	s.rnMu.RLock()
+	for _, n := range s.raftNodes {
+		nodes = append(nodes, n)
+	}
+	s.rnMu.RUnlock()
+
+	// Stop consumer groups before their parent stream groups, and the meta group last.
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return raftShutdownOrder(nodes[i].Group()) < raftShutdownOrder(nodes[j].Group())
+	})
+
+	// A stepdown will send the leader transfer to our followers which
+	// resets their election timers, so they will not all campaign at once.
+	// Wait for new leaders before we stop so clients do not see a leaderless window.
+	var led []RaftNode
+	for _, node := range nodes {
+		if node.Leader() {
+			node.StepDown()
+			led = append(led, node)
+		}
+	}
+	s.waitForNewRaftLeaders(led, leaderTransferWait)
+
+	for _, node := range nodes {
+		node.Stop()
+	}
+}
+
+// raftShutdownOrder returns the relative order a group should be shutdown.
+func raftShutdownOrder(group string) int {
+	switch {
+	case strings.HasPrefix(group, "C-"):
+		return 0
+	case strings.HasPrefix(group, "S-"):
+		return 1
+	}
+	return 2
+}
+
+// Formal API
+
+// Propose will propose a new entry to the group.
+// This should only be called on the leader.
+func (n *raft) Propose(data []byte) error {
+	n.RLock()
+	if n.state != Leader {
+		n.RUnlock()
+		n.debug("Proposal ignored, not leader")
+		return errNotLeader
+	}
+	// Push back if commits have stalled, e.g. on a slow follower, instead of tracking acks without bound.
+	// This is retryable once commits catch up.
+	if len(n.acks) >= n.maxacks {
+		n.RUnlock()
+		n.debug("Proposal throttled, too many entries waiting on commit")
+		return errTooManyPending
+	}
+	propc, paused, quit := n.propc, n.pausec, n.quit
+	n.RUnlock()
+
+	if paused != nil {
+		n.debug("Proposals paused, will wait")
+		select {
+		case <-paused:
+		case <-quit:
+			return errProposalFailed
+		case <-time.After(422 * time.Millisecond):
+			return errProposalsPaused
+		}
+	}
+
+	select {
+	case propc <- &Entry{EntryNormal, data}:
+		// Track the oldest proposal waiting to be stored.
+		atomic.CompareAndSwapInt64(&n.pts, 0, time.Now().UnixNano())
+	default:
+		n.debug("Propose failed!")
+		return errProposalFailed
+	}
+	return nil
+}
+
+// ForwardProposal will forward the proposal to the leader if known.
+// If we are the leader this is the same as calling propose.
+// FIXME(dlc) - We could have a reply subject and wait for a response
+// for retries, but would need to not block and be in separate Go routine.
+func (n *raft) ForwardProposal(entry []byte) error {
+	if n.Leader() {
+		return n.Propose(entry)
+	}
+	n.RLock()
+	subj := n.psubj
+	n.RUnlock()
+
+	n.sendRPC(subj, _EMPTY_, entry)
+	return nil
+}
+
+// PausePropose will pause new proposals.
+func (n *raft) PausePropose() {
+	n.Lock()
+	if n.pausec == nil {
+		n.pausec = make(chan struct{})
+	}
+	n.Unlock()
+}
+
+// ResumePropose will resum new proposals.
+func (n *raft) ResumePropose() {
+	n.Lock()
+	paused := n.pausec
+	n.pausec = nil
+	n.Unlock()
+
+	if paused != nil {
+		close(paused)
+	}
+}
+
+// ProposeAddPeer is called to add a peer to the group.
+func (n *raft) ProposeAddPeer(peer string) error {
+	n.RLock()
+	if n.state != Leader {
+		n.RUnlock()
+		return errNotLeader
+	}
+	propc := n.propc
+	n.RUnlock()
+
+	select {
+	case propc <- &Entry{EntryAddPeer, []byte(peer)}:
+	default:
+		return errProposalFailed
+	}
+	return nil
+}
+
+// ProposeRemovePeer is called to remove a peer from the group.
+func (n *raft) ProposeRemovePeer(peer string) error {
+	return errors.New("no impl")
+}
+
+// ApplyFailed is called by the upper layer when a committed entry could not be applied.
+// This will invoke any registered ApplyErrorFunc.
+func (n *raft) ApplyFailed(index uint64, err error) {
+	n.RLock()
+	aerrf := n.aerrf
+	n.RUnlock()
+
+	n.warn("Failed to apply entry %d: %v", index, err)
+	if aerrf != nil {
+		aerrf(index, err)
+	}
+}
+
+// SetApplyErrorFunc will register a function to be called when an entry fails to apply.
+func (n *raft) SetApplyErrorFunc(fn ApplyErrorFunc) {
+	n.Lock()
+	n.aerrf = fn
+	n.Unlock()
+}
+
+// PauseApply will allow us to pause processing of append entries onto our
+// external apply chan.
+func (n *raft) PauseApply() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.paused = true
+	n.hcommit = n.commit
+}
+
+func (n *raft) ResumeApply() {
+	n.Lock()
+	defer n.Unlock()
+
+	// Run catchup..
+	if n.hcommit > n.commit {
+		for index := n.commit + 1; index <= n.hcommit; index++ {
+			if err := n.applyCommit(index); err != nil {
+				break
+			}
+		}
+	}
+	n.paused = false
+	n.hcommit = 0
+}
+
+// Pause will stop this node from participating in the group, e.g. for maintenance.
+// We will not vote, campaign or store new entries, but remain a member. A leader will stepdown first.
+func (n *raft) Pause() error {
+	n.Lock()
+	if n.state == Closed {
+		n.Unlock()
+		return errNodeClosed
+	}
+	isLeader := n.state == Leader
+	n.halted = true
+	n.Unlock()
+
+	n.notice("Pausing participation in group")
+	if isLeader {
+		return n.StepDown()
+	}
+	return nil
+}
+
+// Resume will have a paused node participate in the group again.
+// We will catch up from the leader as normal.
+func (n *raft) Resume() {
+	n.Lock()
+	defer n.Unlock()
+	if !n.halted {
+		return
+	}
+	if n.degraded {
+		n.warn("Can not resume participation in group, node is degraded")
+		return
+	}
+	n.notice("Resuming participation in group")
+	n.halted = false
+	n.resetElectionTimeout()
+}
+
+// Compact will compact our WAL. If this node is a leader we will want
+// all our peers to be at least to the same index. Non-leaders just compact
+// directly. This is for when we know we have our state on stable storage.
+// E.g JS Consumers.
+func (n *raft) Compact(index uint64) error {
+	n.Lock()
+	defer n.Unlock()
+	// If we are not the leader compact at will.
+	if n.state != Leader {
+		_, err := n.wal.Compact(index)
+		return err
+	}
+	// We are the leader so we need to make sure all peers are at least up to this index.
+	for peer, ps := range n.peers {
+		if peer != n.id && ps.li < index {
+			return errPeersNotCurrent
+		}
+	}
+	return nil
+}
+
+// snapshotIndex returns the index of our last applied snapshot entry, 0 if none.
+// Entries below this one are covered by the snapshot, so the WAL can be compacted to it.
+func (n *raft) snapshotIndex() uint64 {
+	n.RLock()
+	defer n.RUnlock()
+	if n.sindex == 0 || n.applied < n.sindex {
+		return 0
+	}
+	return n.sindex
+}
+
+// Applied is to be called when the FSM has applied the committed entries.
+func (n *raft) Applied(index uint64) {
+	n.Lock()
+	defer n.Unlock()
+
+	// Ignore if already applied.
+	if index <= n.applied {
+		return
+	}
+
+	// FIXME(dlc) - Check spec on error conditions, storage
+	n.applied = index
+	if index == n.sindex {
+		n.debug("Found snapshot entry: compacting log to index %d", index)
+		n.wal.Compact(index)
+	}
+}
+
+// Snapshot is used to snapshot the fsm. This can only be called from a leader.
+// For now these are assumed to be small and will be placed into the log itself.
+// TODO(dlc) - For meta and consumers this is straightforward, and for streams sans the messages this is as well.
+func (n *raft) Snapshot(snap []byte) error {
+	n.Lock()
+	defer n.Unlock()
+
+	n.debug("Snapshot called with %d bytes, applied is %d", len(snap), n.applied)
+
+	if n.state != Leader {
+		return errNotLeader
+	}
+	if !n.isCurrent() {
+		return errNotCurrent
+	}
+
+	select {
+	case n.propc <- &Entry{EntrySnapshot, snap}:
+	default:
+		return errProposalFailed
+	}
+
+	return nil
+}
+
+// SnapshotAndWait is like Snapshot but will wait up to timeout for the snapshot
+// entry to be applied and our log compacted to it.
+func (n *raft) SnapshotAndWait(snap []byte, timeout time.Duration) error {
+	n.RLock()
+	last := n.pindex
+	n.RUnlock()
+
+	if err := n.Snapshot(snap); err != nil {
+		return err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		n.RLock()
+		done, quit := n.sindex > last && n.applied >= n.sindex, n.quit
+		n.RUnlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return errNodeClosed
+		case <-t.C:
+			return errSnapshotTimeout
+		}
+	}
+}
+
+// Leader returns if we are the leader for our group.
+func (n *raft) Leader() bool {
+	if n == nil {
+		return false
+	}
+	n.RLock()
+	isLeader := n.state == Leader
+	n.RUnlock()
+	return isLeader
+}
+
+// Lock should be held.
+func (n *raft) isCurrent() bool {
+	// First check if we match commit and applied.
+	if n.commit != n.applied {
+		return false
+	}
+	// Make sure we are the leader or we know we have heard from the leader recently.
+	if n.state == Leader {
+		return true
+	}
+
+	// Check here on catchup status.
+	if cs := n.catchup; cs != nil && n.pterm >= cs.cterm && n.pindex >= cs.cindex {
+		n.cancelCatchup()
+	}
+
+	// Check to see that we have heard from the current leader lately.
+	if n.leader != noLeader && n.leader != n.id && n.catchup == nil {
+		okInterval := int64(n.hbWindow()) * 2
+		ts := time.Now().UnixNano()
+		if ps := n.peers[n.leader]; ps != nil && ps.ts > 0 && (ts-ps.ts) <= okInterval {
+			return true
+		}
+	}
+	return false
+}
+
+// Current returns if we are the leader for our group or an up to date follower.
+func (n *raft) Current() bool {
+	if n == nil {
+		return false
+	}
+	n.RLock()
+	defer n.RUnlock()
+
+	return n.isCurrent()
+}
+
+// GroupLeader returns the current leader of the group.
+func (n *raft) GroupLeader() string {
+	if n == nil {
+		return noLeader
+	}
+	n.RLock()
+	defer n.RUnlock()
+	return n.leader
+}
+
+// WaitForLeader will wait until a leader is known for our group, returning the leader or an error on timeout.
+func (n *raft) WaitForLeader(timeout time.Duration) (string, error) {
+	n.Lock()
+	if n.leader != noLeader {
+		leader := n.leader
+		n.Unlock()
+		return leader, nil
+	}
+	if n.lwait == nil {
+		n.lwait = make(chan struct{})
+	}
+	lwait, quit := n.lwait, n.quit
+	n.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-lwait:
+		return n.GroupLeader(), nil
+	case <-quit:
+		return noLeader, errNodeClosed
+	case <-t.C:
+		return noLeader, errNoLeaderTimeout
+	}
+}
+
+// Lock should be held.
+func (n *raft) updateLeader(leader string) {
+	if leader != n.leader {
+		n.lhist[n.nlch%leaderHistorySize] = leaderChange{time.Now().UnixNano(), n.term, n.leader, leader}
+		n.nlch++
+	}
+	n.leader = leader
+	// Signal anyone waiting on a leader.
+	if leader != noLeader && n.lwait != nil {
+		close(n.lwait)
+		n.lwait = nil
+	}
+}
+
+// Someone waiting on an entry to be stored by a number of peers, see NotifyStored().
+type storedWait struct {
+	index    uint64
+	replicas int
+	expires  int64
+	cb       func(error)
+}
+
+// NotifyStored will call cb once the entry at index has been committed and stored by
+// at least replicas peers, including ourselves. This should only be called on the leader
+// in index order, e.g. when applying committed entries. If that does not happen within
+// timeout, or we lose leadership or are stopped, cb is called with an error instead.
+// The callback is never called with the lock held but should not block.
+func (n *raft) NotifyStored(index uint64, replicas int, timeout time.Duration, cb func(error)) {
+	n.Lock()
+	if n.state != Leader {
+		n.Unlock()
+		cb(errNotLeader)
+		return
+	}
+	if len(n.swaits) == 0 && n.commit >= index && n.storedBy(index) >= replicas {
+		n.Unlock()
+		cb(nil)
+		return
+	}
+	n.swaits = append(n.swaits, &storedWait{index, replicas, time.Now().Add(timeout).UnixNano(), cb})
+	n.Unlock()
+}
+
+// releaseStored will remove and return any waiters that have been satisfied, or have
+// expired when now is non-zero. Since waiters are in index order we stop at the first
+// one still pending.
+// Lock should be held.
+func (n *raft) releaseStored(now int64) (done, expired []*storedWait) {
+	var i int
+	for _, sw := range n.swaits {
+		if n.commit >= sw.index && n.storedBy(sw.index) >= sw.replicas {
+			done = append(done, sw)
+		} else if now > 0 && now >= sw.expires {
+			expired = append(expired, sw)
+		} else {
+			break
+		}
+		i++
+	}
+	if i > 0 {
+		n.swaits = append(n.swaits[:0], n.swaits[i:]...)
+	}
+	return done, expired
+}
+
+// Let waiters know their outcome. Lock should not be held.
+func notifyStoredWaits(sws []*storedWait, err error) {
+	for _, sw := range sws {
+		sw.cb(err)
+	}
+}
+
+// Returns the number of peers, including ourselves, known to have stored index.
+// Lock should be held.
+func (n *raft) storedBy(index uint64) int {
+	nr := 0
+	if n.pindex >= index {
+		nr++
+	}
+	for peer, ps := range n.peers {
+		if peer != n.id && ps.li >= index {
+			nr++
+		}
+	}
+	return nr
+}
+
+// StepDown will have a leader stepdown and optionally do a leader transfer.
+func (n *raft) StepDown() error {
+	n.Lock()
+
+	if n.state != Leader {
+		n.Unlock()
+		return errNotLeader
+	}
+
+	n.debug("Being asked to stepdown")
+
+	// See if we have up to date followers.
+	maybeLeader := n.selectTransferTarget()
+	stepdown := n.stepdown
+	n.Unlock()
+
+	if maybeLeader != noLeader {
+		n.debug("Stepping down, selected %q for new leader", maybeLeader)
+		n.sendAppendEntry([]*Entry{&Entry{EntryLeaderTransfer, []byte(maybeLeader)}})
+	}
+	// Force us to stepdown here.
+	select {
+	case stepdown <- noLeader:
+	default:
+		return errStepdownFailed
+	}
+	return nil
+}
+
+// TransferLeader will have a leader hand leadership to the named peer.
+// The peer needs to be alive and have stored everything we have.
+func (n *raft) TransferLeader(peer string) error {
+	n.Lock()
+	if n.state != Leader {
+		n.Unlock()
+		return errNotLeader
+	}
+	if peer == n.id {
+		n.Unlock()
+		return errAlreadyLeader
+	}
+	ps := n.peers[peer]
+	if ps == nil {
+		n.Unlock()
+		return errUnknownPeer
+	}
+	if time.Now().UnixNano()-ps.ts >= int64(n.hbWindow()*2) || ps.li < n.pindex {
+		n.Unlock()
+		return errPeerNotCurrent
+	}
+	stepdown := n.stepdown
+	n.Unlock()
+
+	n.debug("Transferring leadership to %q", peer)
+	n.sendAppendEntry([]*Entry{&Entry{EntryLeaderTransfer, []byte(peer)}})
+
+	select {
+	case stepdown <- noLeader:
+	default:
+		return errStepdownFailed
+	}
+	return nil
+}
+
+// selectTransferTarget will pick the follower best suited to take over as leader.
+// This is the alive follower with the highest replicated index, ties go to the most recently heard from.
+// Lock should be held.
+func (n *raft) selectTransferTarget() string {
+	nowts := time.Now().UnixNano()
+	maybeLeader, best := noLeader, (*lps)(nil)
+	for peer, ps := range n.peers {
+		// If not us and alive.
+		if peer == n.id || (nowts-ps.ts) >= int64(n.hbWindow()*2) {
+			continue
+		}
+		if n.s.getRouteByHash([]byte(peer)) == nil {
+			continue
+		}
+		n.debug("Looking at %q which is at index %d and %v behind", peer, ps.li, time.Duration(nowts-ps.ts))
+		if best == nil || ps.li > best.li || (ps.li == best.li && ps.ts > best.ts) {
+			maybeLeader, best = peer, ps
+		}
+	}
+	return maybeLeader
+}
+
+// Campaign will have our node start a leadership vote.
+func (n *raft) Campaign() error {
+	n.Lock()
+	defer n.Unlock()
+	if n.halted {
+		return errNodePaused
+	}
+	if n.state == Observer {
+		return errObserver
+	}
+	return n.campaign()
+}
+
+func randCampaignTimeout() time.Duration {
+	delta := rand.Int63n(int64(maxCampaignTimeout - minCampaignTimeout))
+	return (minCampaignTimeout + time.Duration(delta))
+}
+
+// Campaign will have our node start a leadership vote.
+// Lock should be held.
+func (n *raft) campaign() error {
+	n.debug("Starting campaign")
+	if n.state == Leader {
+		return errAlreadyLeader
+	}
+	n.resetElect(randCampaignTimeout())
+	return nil
+}
+
+// State return the current state for this node.
+func (n *raft) State() RaftState {
+	n.RLock()
+	state := n.state
+	n.RUnlock()
+	return state
+}
+
+// Size returns number of entries and total bytes for our WAL.
+func (n *raft) Size() (uint64, uint64) {
+	n.RLock()
+	state := n.wal.State()
+	n.RUnlock()
+	return state.Msgs, state.Bytes
+}
+
+// Stats returns our proposal and commit latencies.
+func (n *raft) Stats() *RaftStats {
+	n.RLock()
+	defer n.RUnlock()
+	return &RaftStats{
+		Proposals:     n.nprops,
+		Commits:       n.ncmts,
+		StoreLatency:  time.Duration(n.slat),
+		CommitLatency: time.Duration(n.clat),
+	}
+}
+
+// StorageStats returns the on-disk footprint of our WAL and how much of it compaction could reclaim.
+// This includes entries at or below our applied index and space still held by removed entries.
+func (n *raft) StorageStats() *RaftStorageStats {
+	n.RLock()
+	wal, applied := n.wal, n.applied
+	n.RUnlock()
+
+	if fs, ok := wal.(*fileStore); ok {
+		total, reclaimable, blocks := fs.diskUsage(applied + 1)
+		return &RaftStorageStats{Bytes: total, Reclaimable: reclaimable, Blocks: blocks}
+	}
+	// Not file based, so nothing on disk.
+	return &RaftStorageStats{}
+}
+
+// storeTime is when we stored an index into our WAL as leader.
+type storeTime struct {
+	index uint64
+	ts    int64
+}
+
+// Smooths latency samples, same weighting as TCP's srtt.
+func smoothLatency(avg, sample int64) int64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + (sample-avg)/8
+}
+
+func (n *raft) ID() string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.id
+}
+
+func (n *raft) Group() string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.group
+}
+
+func (n *raft) Peers() []*Peer {
+	n.RLock()
+	defer n.RUnlock()
+
+	var peers []*Peer
+	for id, ps := range n.peers {
+		p := &Peer{ID: id, Current: id == n.leader || ps.li >= n.applied, Last: time.Unix(0, ps.ts)}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// MutePeers returns the peers a leader has been sending entries to that we still
+// have a route to but have not heard an append entry response from within
+// our quorum window. This is the signature of an asymmetric partition, where the
+// follower receives our appends but its responses never make it back.
+func (n *raft) MutePeers() []string {
+	n.RLock()
+	defer n.RUnlock()
+
+	qw := n.quorumWindow()
+	if n.state != Leader || time.Since(n.lstart) < qw {
+		return nil
+	}
+
+	var mute []string
+	now := time.Now().UnixNano()
+	for id, ps := range n.peers {
+		if id == n.id || now-ps.ts < int64(qw) {
+			continue
+		}
+		// If we have no route to them this is a regular partition or they are down.
+		if n.s.getRouteByHash([]byte(id)) != nil {
+			mute = append(mute, id)
+		}
+	}
+	return mute
+}
+
+// CanRemoveSelf returns true if the remaining peers would still have a quorum, and at least
+// one of them is current, if we were removed from the group. Peers we have not heard from
+// within our quorum window count as down. Only a leader hears from all peers, a follower
+// only knows about the leader so this will be conservative when not the leader.
+func (n *raft) CanRemoveSelf() bool {
+	n.RLock()
+	defer n.RUnlock()
+
+	// The quorum of the group without us.
+	csz := n.csz - 1
+	if csz < 1 {
+		return false
+	}
+	qn := csz/2 + 1
+	if n.wqn > qn {
+		qn = n.wqn
+	}
+	if qn > csz {
+		return false
+	}
+
+	var alive int
+	var current bool
+	now, qw := time.Now().UnixNano(), int64(n.quorumWindow())
+	for id, ps := range n.peers {
+		if id == n.id || now-ps.ts >= qw {
+			continue
+		}
+		alive++
+		if ps.li >= n.commit {
+			current = true
+		}
+	}
+	return alive >= qn && current
+}
+
+func (n *raft) Stop() {
+	n.shutdown(false)
+}
+
+func (n *raft) Delete() {
+	n.shutdown(true)
+}
+
+func (n *raft) ApplyC() <-chan *CommittedEntry { return n.applyc }
+func (n *raft) LeadChangeC() <-chan bool       { return n.leadc }
+func (n *raft) QuitC() <-chan struct{}         { return n.quit }
+
+func (n *raft) shutdown(shouldDelete bool) {
+	n.Lock()
+	if n.state == Closed {
+		n.Unlock()
+		return
+	}
+	close(n.quit)
+	n.c.closeConnection(InternalClient)
+	n.state = Closed
+	s, g, wal := n.s, n.group, n.wal
+
+	// Delete our peer state and vote state.
+	if shouldDelete {
+		os.Remove(path.Join(n.sd, peerStateFile))
+		os.Remove(path.Join(n.sd, termVoteFile))
+	}
+
+	n.Unlock()
+
+	s.unregisterRaftNode(g)
+	if shouldDelete {
+		n.notice("Deleted")
+	} else {
+		n.notice("Shutdown")
+	}
+	if wal != nil {
+		if shouldDelete {
+			wal.Delete()
+		} else {
+			wal.Stop()
+		}
+	}
+}
+
+func (n *raft) newInbox(cn string) string {
+	var b [replySuffixLen]byte
+	rn := rand.Int63()
+	for i, l := 0, rn; i < len(b); i++ {
+		b[i] = digits[l%base]
+		l /= base
+	}
+	return fmt.Sprintf(raftReplySubj, b[:])
+}
+
+const (
+	raftVoteSubj   = "$NRG.V.%s.%s"
+	raftAppendSubj = "$NRG.E.%s.%s"
+	raftPropSubj   = "$NRG.P.%s"
+	raftReplySubj  = "$NRG.R.%s"
+)
+
+// Our internal subscribe.
+// Lock should be held.
+func (n *raft) subscribe(subject string, cb msgHandler) (*subscription, error) {
+	return n.s.systemSubscribe(subject, _EMPTY_, false, n.c, cb)
+}
+
+func (n *raft) createInternalSubs() error {
+	cn := n.s.ClusterName()
+	n.vsubj, n.vreply = fmt.Sprintf(raftVoteSubj, cn, n.group), n.newInbox(cn)
+	n.asubj, n.areply = fmt.Sprintf(raftAppendSubj, cn, n.group), n.newInbox(cn)
+	n.psubj = fmt.Sprintf(raftPropSubj, n.group)
+
+	// Votes
+	if _, err := n.subscribe(n.vreply, n.handleVoteResponse); err != nil {
+		return err
+	}
+	if _, err := n.subscribe(n.vsubj, n.handleVoteRequest); err != nil {
+		return err
+	}
+	// AppendEntry
+	if _, err := n.subscribe(n.areply, n.handleAppendEntryResponse); err != nil {
+		return err
+	}
+	if _, err := n.subscribe(n.asubj, n.handleAppendEntry); err != nil {
+		return err
+	}
+
+	// TODO(dlc) change events.
+	return nil
+}
+
+// campaignBackoff returns how much longer to wait before our next campaign
+// based on how many consecutive elections we have failed to win.
+// Lock should be held.
+func (n *raft) campaignBackoff() time.Duration {
+	if n.failed == 0 {
+		return 0
+	}
+	const maxShift = 8
+	shift := n.failed - 1
+	if shift > maxShift {
+		shift = maxShift
+	}
+	bo := minElectionTimeout << uint(shift)
+	if bo > maxCampaignBackoff {
+		bo = maxCampaignBackoff
+	}
+	return bo
+}
+
+// When scaling election timeouts, each peer past a 3 node group adds this much,
+// up to maxElectionScalePeers. The range widens as well as moves up.
+const (
+	electionScalePerPeer  = 50 * time.Millisecond
+	maxElectionScalePeers = 8
+)
+
+// randElectionTimeout returns a random election timeout, extra will raise and widen the range.
+func randElectionTimeout(extra time.Duration) time.Duration {
+	min, max := minElectionTimeout+extra, maxElectionTimeout+2*extra
+	delta := rand.Int63n(int64(max - min))
+	return (min + time.Duration(delta))
+}
+
+// electionScale returns how much to scale our election timeout for our cluster size.
+// Lock should be held.
+func (n *raft) electionScale() time.Duration {
+	if !n.escale || n.csz <= 3 {
+		return 0
+	}
+	peers := n.csz - 3
+	if peers > maxElectionScalePeers {
+		peers = maxElectionScalePeers
+	}
+	return time.Duration(peers) * electionScalePerPeer
+}
+
+// electionExtra returns how much to raise our election timeout. Besides scaling for cluster size,
+// followers must outwait the slowest heartbeat an idle leader may send.
+// Lock should be held.
+func (n *raft) electionExtra() time.Duration {
+	return n.electionScale() + n.hbWindow() - hbInterval
+}
+
+// hbWindow is the longest we may go without a heartbeat from an idle leader.
+// Lock should be held.
+func (n *raft) hbWindow() time.Duration {
+	if n.hbmax > 1 {
+		return time.Duration(n.hbmax) * hbInterval
+	}
+	return hbInterval
+}
+
+// quorumWindow is how long we wait to hear from peers before we consider them gone.
+// This scales with our heartbeat window so quorum loss is still detected with idle groups.
+// Lock should be held.
+func (n *raft) quorumWindow() time.Duration {
+	return lostQuorumInterval * n.hbWindow() / hbInterval
+}
+
+// Lock should be held.
+func (n *raft) resetElectionTimeout() {
+	n.resetElect(randElectionTimeout(n.electionExtra()))
+}
+
+// Lock should be held.
+func (n *raft) resetElect(et time.Duration) {
+	if n.elect == nil {
+		n.elect = time.NewTimer(et)
+	} else {
+		if !n.elect.Stop() && len(n.elect.C) > 0 {
+			<-n.elect.C
+		}
+		n.elect.Reset(et)
+	}
+}
+
+func (n *raft) run() {
+	s := n.s
+	defer s.grWG.Done()
+
+	for s.isRunning() {
+		switch n.State() {
+		case Follower:
+			n.runAsFollower()
+		case Candidate:
+			n.runAsCandidate()
+		case Leader:
+			n.runAsLeader()
+		case Observer:
+			// TODO(dlc) - fix.
+			n.runAsFollower()
+		case Closed:
+			return
+		}
+	}
+}
+
+// Lock should be held.
+func (n *raft) updateLogFields() {
+	if !n.sflag {
+		return
+	}
+	lf := fmt.Sprintf("group=%q id=%q term=%d state=%s", n.group, n.id, n.term, n.state)
+	n.lfields.Store(strings.ReplaceAll(lf, "%", "%%"))
+}
+
+// logFormat will prefix our id and group, and if configured for structured logging
+// append the structured fields. This does not require the lock.
+func (n *raft) logFormat(format string) string {
+	nf := fmt.Sprintf("RAFT [%s - %s] %s", n.id, n.group, format)
+	if n.sflag {
+		if lf, ok := n.lfields.Load().(string); ok {
+			nf += " " + lf
+		}
+	}
+	return nf
+}
+
+func (n *raft) debug(format string, args ...interface{}) {
+	if n.dflag {
+		n.s.Debugf(n.logFormat(format), args...)
+	}
+}
+
+func (n *raft) warn(format string, args ...interface{}) {
+	n.s.Warnf(n.logFormat(format), args...)
+}
+
+func (n *raft) error(format string, args ...interface{}) {
+	n.s.Errorf(n.logFormat(format), args...)
+}
+
+func (n *raft) notice(format string, args ...interface{}) {
+	n.s.Noticef(n.logFormat(format), args...)
+}
+
+func (n *raft) electTimer() *time.Timer {
+	n.RLock()
+	elect := n.elect
+	n.RUnlock()
+	return elect
+}
+
+func (n *raft) runAsFollower() {
+	for {
+		elect := n.electTimer()
+		select {
+		case <-n.s.quitCh:
+			return
+		case <-n.quit:
+			return
+		case <-elect.C:
+			// If we are paused or an observer we do not campaign.
+			// An observer that is a member of the group has to vote once its leader is gone.
+			n.Lock()
+			if n.state == Observer && n.peers[n.id] != nil {
+				n.promoteObserver("lost our leader")
+			}
+			halted := n.halted || n.state == Observer
+			if halted {
+				n.resetElectionTimeout()
+			}
+			n.Unlock()
+			if halted {
+				continue
+			}
+			n.switchToCandidate()
+			return
+		case vreq := <-n.reqs:
+			n.processVoteRequest(vreq)
+		case newLeader := <-n.stepdown:
+			n.switchToFollower(newLeader)
+			return
+		}
+	}
+}
+
+// CommitEntry is handed back to the user to apply a commit to their FSM.
+type CommittedEntry struct {
+	Index   uint64
+	Entries []*Entry
+}
+
+type appendEntry struct {
+	leader  string
+	term    uint64
+	commit  uint64
+	pterm   uint64
+	pindex  uint64
+	entries []*Entry
+	// internal use only.
+	reply string
+	buf   []byte
+}
+
+type EntryType uint8
+
+const (
+	EntryNormal EntryType = iota
+	EntrySnapshot
+	EntryPeerState
+	EntryAddPeer
+	EntryRemovePeer
+	EntryLeaderTransfer
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryNormal:
+		return "Normal"
+	case EntrySnapshot:
+		return "Snapshot"
+	case EntryPeerState:
+		return "PeerState"
+	case EntryAddPeer:
+		return "AddPeer"
+	case EntryRemovePeer:
+		return "RemovePeer"
+	case EntryLeaderTransfer:
+		return "LeaderTransfer"
+	}
+	return fmt.Sprintf("Unknown [%d]", uint8(t))
+}
+
+type Entry struct {
+	Type EntryType
+	Data []byte
+}
+
+func (ae *appendEntry) String() string {
+	return fmt.Sprintf("&{leader:%s term:%d commit:%d pterm:%d pindex:%d entries: %d}",
+		ae.leader, ae.term, ae.commit, ae.pterm, ae.pindex, len(ae.entries))
+}
+
+const appendEntryBaseLen = idLen + 4*8 + 2
+
+func (ae *appendEntry) encode() []byte {
+	var elen int
+	for _, e := range ae.entries {
+		elen += len(e.Data) + 1 + 4 // 1 is type, 4 is for size.
+	}
+	var le = binary.LittleEndian
+	buf := make([]byte, appendEntryBaseLen+elen)
+	copy(buf[:idLen], ae.leader)
+	le.PutUint64(buf[8:], ae.term)
+	le.PutUint64(buf[16:], ae.commit)
+	le.PutUint64(buf[24:], ae.pterm)
+	le.PutUint64(buf[32:], ae.pindex)
+	le.PutUint16(buf[40:], uint16(len(ae.entries)))
+	wi := 42
+	for _, e := range ae.entries {
+		le.PutUint32(buf[wi:], uint32(len(e.Data)+1))
+		wi += 4
+		buf[wi] = byte(e.Type)
+		wi++
+		copy(buf[wi:], e.Data)
+		wi += len(e.Data)
+	}
+	return buf[:wi]
+}
+
+// This can not be used post the wire level callback since we do not copy.
+func (n *raft) decodeAppendEntry(msg []byte, reply string) *appendEntry {
+	if len(msg) < appendEntryBaseLen {
+		return nil
+	}
+
+	var le = binary.LittleEndian
+	ae := &appendEntry{
+		leader: string(msg[:idLen]),
+		term:   le.Uint64(msg[8:]),
+		commit: le.Uint64(msg[16:]),
+		pterm:  le.Uint64(msg[24:]),
+		pindex: le.Uint64(msg[32:]),
+	}
+	// Decode Entries.
+	ne, ri := int(le.Uint16(msg[40:])), 42
+	for i := 0; i < ne; i++ {
+		le := int(le.Uint32(msg[ri:]))
+		ri += 4
+		etype := EntryType(msg[ri])
+		ae.entries = append(ae.entries, &Entry{etype, msg[ri+1 : ri+le]})
+		ri += int(le)
+	}
+	ae.reply = reply
+	ae.buf = msg
+	return ae
+}
+
+// appendEntryResponse is our response to a received appendEntry.
+type appendEntryResponse struct {
+	term    uint64
+	index   uint64
+	peer    string
+	success bool
+	// Observers joining the group do not count towards quorum.
+	observer bool
+	// internal
+	reply string
+}
+
+// We want to make sure this does not change from system changing length of syshash.
+const idLen = 8
+const appendEntryResponseLen = 24 + 1
+
+func (ar *appendEntryResponse) encode() []byte {
+	var buf [appendEntryResponseLen]byte
+	var le = binary.LittleEndian
+	le.PutUint64(buf[0:], ar.term)
+	le.PutUint64(buf[8:], ar.index)
+	copy(buf[16:], ar.peer)
+
+	if ar.success {
+		buf[24] = 1
+	}
+	if ar.observer {
+		buf[24] |= 2
+	}
+	return buf[:appendEntryResponseLen]
+}
+
+func (n *raft) decodeAppendEntryResponse(msg []byte) *appendEntryResponse {
+	if len(msg) != appendEntryResponseLen {
+		return nil
+	}
+	var le = binary.LittleEndian
+	ar := &appendEntryResponse{
+		term:  le.Uint64(msg[0:]),
+		index: le.Uint64(msg[8:]),
+		peer:  string(msg[16 : 16+idLen]),
+	}
+	ar.success = msg[24]&1 == 1
+	ar.observer = msg[24]&2 == 2
+	return ar
+}
+
+// Called when a peer has forwarded a proposal.
+func (n *raft) handleForwardedProposal(sub *subscription, c *client, _, reply string, msg []byte) {
+	if !n.Leader() {
+		n.debug("Ignoring forwarded proposal, not leader")
+		return
+	}
+	// Need to copy since this is underlying client/route buffer.
+	msg = append(msg[:0:0], msg...)
+	if err := n.Propose(msg); err != nil {
+		n.warn("Got error processing forwarded proposal: %v", err)
+	}
+}
+
+func (n *raft) runAsLeader() {
+	n.Lock()
+	// For forwarded proposals.
+	fsub, err := n.subscribe(n.psubj, n.handleForwardedProposal)
+	n.Unlock()
+
+	if err != nil {
+		panic(fmt.Sprintf("Error subscribing to forwarded proposals: %v", err))
+	}
+
+	// Cleanup our subscription when we leave.
+	// Waiters on stored entries only make sense on a leader, let them know.
+	defer func() {
+		n.Lock()
+		if fsub != nil {
+			n.s.sysUnsubscribe(fsub)
+		}
+		sws, err := n.swaits, errNotLeader
+		if n.state == Closed {
+			err = errNodeClosed
+		}
+		n.swaits = nil
+		n.Unlock()
+		notifyStoredWaits(sws, err)
+	}()
+
+	n.sendPeerState()
+
+	hb := time.NewTicker(hbInterval)
+	defer hb.Stop()
+
+	for {
+		select {
+		case <-n.s.quitCh:
+			return
+		case <-n.quit:
+			return
+		case b := <-n.propc:
+			entries := []*Entry{b}
+			if b.Type == EntryNormal {
+				const maxBatch = 256 * 1024
+			gather:
+				for sz := 0; sz < maxBatch; {
+					select {
+					case e := <-n.propc:
+						entries = append(entries, e)
+						sz += len(e.Data) + 1
+					default:
+						break gather
+					}
+				}
+			}
+			n.sendAppendEntry(entries)
+		case <-hb.C:
+			if n.heartbeatDue() {
+				n.sendHeartbeat()
+			}
+			n.Lock()
+			done, expired := n.releaseStored(time.Now().UnixNano())
+			n.Unlock()
+			notifyStoredWaits(done, nil)
+			notifyStoredWaits(expired, errReplicaTimeout)
+			if n.lostQuorum() {
+				n.switchToFollower(noLeader)
+				return
+			}
+
+		case vresp := <-n.votes:
+			if vresp.term > n.currentTerm() {
+				n.switchToFollower(noLeader)
+				return
+			}
+			n.trackPeer(vresp.peer)
+		case vreq := <-n.reqs:
+			n.processVoteRequest(vreq)
+		case newLeader := <-n.stepdown:
+			n.switchToFollower(newLeader)
+			return
+		case ar := <-n.resp:
+			n.trackPeer(ar.peer)
+			if ar.success {
+				n.trackResponse(ar)
+			} else if ar.reply != _EMPTY_ {
+				n.catchupFollower(ar)
+			}
+		}
+	}
+}
+
+// Quorum reports the quorum status. Will be called on former leaders.
+func (n *raft) Quorum() bool {
+	n.RLock()
+	defer n.RUnlock()
+
+	now, nc, qw := time.Now().UnixNano(), 1, int64(n.quorumWindow())
+	for _, peer := range n.peers {
+		if now-peer.ts < qw {
+			nc++
+			if nc >= n.qn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *raft) lostQuorum() bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.lostQuorumLocked()
+}
+
+func (n *raft) lostQuorumLocked() bool {
+	now, nc, qw := time.Now().UnixNano(), 1, int64(n.quorumWindow())
+	for _, peer := range n.peers {
+		if now-peer.ts < qw {
+			nc++
+			if nc >= n.qn {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// heartbeatDue is called on every heartbeat tick and determines if we need to send one.
+// When we have a max heartbeat interval and are idle with no followers behind,
+// we double the ticks between heartbeats up to the max. Any activity or a
+// lagging follower snaps us back to sending every tick.
+func (n *raft) heartbeatDue() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	if time.Since(n.active) <= hbInterval {
+		n.hbtks, n.hbwait = 1, 0
+		return false
+	}
+	if n.hbwait++; n.hbwait < n.hbtks {
+		return false
+	}
+	n.hbwait = 0
+	if n.hbmax <= 1 || n.followerBehind() {
+		n.hbtks = 1
+	} else if n.hbtks *= 2; n.hbtks > n.hbmax {
+		n.hbtks = n.hbmax
+	}
+	return true
+}
+
+// followerBehind returns true if any of our followers have not stored all of our entries.
+// Lock should be held.
+func (n *raft) followerBehind() bool {
+	for id, ps := range n.peers {
+		if id != n.id && ps.li < n.pindex {
+			return true
+		}
+	}
+	return false
+}
+
+// Return our current term.
+func (n *raft) currentTerm() uint64 {
+	n.RLock()
+	defer n.RUnlock()
+	return n.term
+}
+
+// Lock should be held.
+func (n *raft) loadFirstEntry() (ae *appendEntry, err error) {
+	return n.loadEntry(n.wal.State().FirstSeq)
+}
+
+func (n *raft) runCatchup(peer, subj string, observer bool, indexUpdatesC <-chan uint64) {
+	n.RLock()
+	s, reply := n.s, n.areply
+	n.RUnlock()
+
+	defer s.grWG.Done()
+
+	defer func() {
+		n.Lock()
+		delete(n.progress, peer)
+		if len(n.progress) == 0 {
+			n.progress = nil
+		}
+		// Check if this is a new peer and if so go ahead and propose adding them.
+		_, ok := n.peers[peer]
+		n.Unlock()
+		if !ok {
+			n.debug("Catchup done for %q, will add into peers", peer)
+			n.ProposeAddPeer(peer)
+		} else if observer {
+			// A member that joined as an observer votes again once adding it is committed.
+			n.debug("Catchup done for observer %q, will promote", peer)
+			n.ProposeAddPeer(peer)
+		}
+	}()
+
+	// Wait our turn if we are limiting concurrent catchups.
+	if !s.acquireCatchup(n.quit) {
+		return
+	}
+	defer s.releaseCatchup()
+
+	n.debug("Running catchup for %q", peer)
+
+	const maxOutstanding = 48 * 1024 * 1024 // 48MB for now.
+	next, total, om := uint64(0), 0, make(map[uint64]int)
+
+	sendNext := func() {
+		for total <= maxOutstanding {
+			next++
+			ae, err := n.loadEntry(next)
+			if err != nil {
+				if err != ErrStoreEOF {
+					n.debug("Got an error loading %d index: %v", next, err)
+				}
+				return
+			}
+			// Update our tracking total.
+			om[next] = len(ae.buf)
+			total += len(ae.buf)
+			n.sendRPC(subj, reply, ae.buf)
+		}
+	}
+
+	const activityInterval = 2 * time.Second
+	timeout := time.NewTimer(activityInterval)
+	defer timeout.Stop()
+
+	stepCheck := time.NewTicker(100 * time.Millisecond)
+	defer stepCheck.Stop()
+
+	// Run as long as we are leader and still not caught up.
+	for n.Leader() {
+		select {
+		case <-n.s.quitCh:
+			return
+		case <-n.quit:
+			return
+		case <-stepCheck.C:
+			if !n.Leader() {
+				n.debug("Catching up canceled, no longer leader")
+				return
+			}
+		case <-timeout.C:
+			n.debug("Catching up for %q stalled", peer)
+			return
+		case index := <-indexUpdatesC:
+			// Update our activity timer.
+			timeout.Reset(activityInterval)
+			// Update outstanding total.
+			total -= om[index]
+			delete(om, index)
+			n.RLock()
+			finished := index >= n.pindex
+			n.RUnlock()
+			// Check if we are done.
+			if finished {
+				n.debug("Finished catching up")
+				return
+			}
+			// Still have more catching up to do.
+			if next < index {
+				n.debug("Adjusting next to %d from %d", index, next)
+				next = index
+			}
+			sendNext()
+		}
+	}
+}
+
+func (n *raft) catchupFollower(ar *appendEntryResponse) {
+	n.debug("Being asked to catch up follower: %q", ar.peer)
+	n.Lock()
+	if n.progress == nil {
+		n.progress = make(map[string]chan uint64)
+	}
+	if _, ok := n.progress[ar.peer]; ok {
+		n.debug("Existing entry for catching up %q", ar.peer)
+		n.Unlock()
+		return
+	}
+	ae, err := n.loadEntry(ar.index + 1)
+	if err != nil {
+		ae, err = n.loadFirstEntry()
+	}
+	if err != nil || ae == nil {
+		n.debug("Could not find a starting entry for us: %v", err)
+		n.Unlock()
+		return
+	}
+	if ae.pindex != ar.index || ae.pterm != ar.term {
+		n.debug("Our first entry does not match")
+	}
+	// Create a chan for delivering updates from responses.
+	indexUpdates := make(chan uint64, 1024)
+	indexUpdates <- ae.pindex
+	n.progress[ar.peer] = indexUpdates
+	n.Unlock()
+
+	n.s.startGoRoutine(func() { n.runCatchup(ar.peer, ar.reply, ar.observer, indexUpdates) })
+}
+
+func (n *raft) loadEntry(index uint64) (*appendEntry, error) {
+	_, _, msg, _, err := n.wal.LoadMsg(index)
+	if err != nil {
+		return nil, err
+	}
+	return n.decodeAppendEntry(msg, _EMPTY_), nil
+}
+
+// applyCommit will update our commit index and apply the entry to the apply chan.
+// lock should be held.
+func (n *raft) applyCommit(index uint64) error {
+	if index <= n.commit {
+		n.debug("Ignoring apply commit for %d, already processed", index)
+		return nil
+	}
+	if index > n.pindex {
+		n.debug("Ignoring apply commit for %d, past our stored index %d", index, n.pindex)
+		return errEntryLoadFailed
+	}
+	original := n.commit
+	n.commit = index
+
+	if n.state == Leader {
+		delete(n.acks, index)
+		if st := &n.stimes[index%latencyWindow]; st.index == index {
+			n.clat = smoothLatency(n.clat, time.Now().UnixNano()-st.ts)
+			n.ncmts++
+		}
+	}
+
+	// FIXME(dlc) - Can keep this in memory if this too slow.
+	ae, err := n.loadEntry(index)
+	if err != nil {
+		n.debug("Got an error loading %d index: %v", index, err)
+		n.commit = original
+		return errEntryLoadFailed
+	}
+	ae.buf = nil
+
+	var committed []*Entry
+	for _, e := range ae.entries {
+		switch e.Type {
+		case EntryNormal:
+			committed = append(committed, e)
+		case EntrySnapshot:
+			committed = append(committed, e)
+		case EntryPeerState:
+			if ps, err := decodePeerState(e.Data); err == nil {
+				n.processPeerState(ps)
+				for _, peer := range ps.knownPeers {
+					if peer == n.id {
+						n.promoteObserver("in peer state")
+					}
+				}
+			}
+		case EntryAddPeer:
+			newPeer := string(e.Data)
+			n.debug("Added peer %q", newPeer)
+			if newPeer == n.id {
+				n.promoteObserver("added as peer")
+			}
+			if _, ok := n.peers[newPeer]; !ok {
+				// We are not tracking this one automatically so we need to bump cluster size.
+				n.debug("Expanding our clustersize: %d -> %d", n.csz, n.csz+1)
+				n.csz++
+				n.qn = n.csz/2 + 1
+				n.peers[newPeer] = &lps{time.Now().UnixNano(), 0}
+			}
+			writePeerState(n.sd, &peerState{n.peerNames(), n.csz})
+		}
+	}
+	// Pass to the upper layers if we have normal entries.
+	if len(committed) > 0 {
+		select {
+		case n.applyc <- &CommittedEntry{index, committed}:
+		default:
+			n.debug("Failed to place committed entry onto our apply channel")
+			n.commit = original
+			return errFailedToApply
+		}
+	} else {
+		// If we processed inline update our applied index.
+		n.applied = index
+	}
+	return nil
+}
+
+// Used to track a success response and apply entries.
+func (n *raft) trackResponse(ar *appendEntryResponse) {
+	n.Lock()
+
+	// Update peer's last index and release anyone waiting on it, once we have unlocked.
+	if ps := n.peers[ar.peer]; ps != nil && ar.index > ps.li {
+		ps.li = ar.index
+		if done, _ := n.releaseStored(0); len(done) > 0 {
+			defer notifyStoredWaits(done, nil)
+		}
+	}
+
+	// If we are tracking this peer as a catchup follower, update that here.
+	if indexUpdateC := n.progress[ar.peer]; indexUpdateC != nil {
+		select {
+		case indexUpdateC <- ar.index:
+		default:
+			n.debug("Failed to place tracking response for catchup, will try again")
+			n.Unlock()
+			indexUpdateC <- ar.index
+			n.Lock()
+		}
+	}
+
+	// Ignore items already committed.
+	if ar.index <= n.commit {
+		n.Unlock()
+		return
+	}
+
+	// See if we have items to apply.
+	var sendHB bool
+
+	// Only members count towards quorum, not observers joining the group.
+	if results := n.acks[ar.index]; results != nil && (!ar.observer || n.peers[ar.peer] != nil) {
+		results[ar.peer] = struct{}{}
+		if nr := len(results); nr >= n.writeQuorum() {
+			// We have a quorum.
+			for index := n.commit + 1; index <= ar.index; index++ {
+				if err := n.applyCommit(index); err != nil {
+					break
+				}
+			}
+			// Push the new commit to followers right away unless an append already carried it,
+			// so they do not wait on the next proposal or heartbeat tick to apply.
+			sendHB = n.commit > n.scommit
+		}
+	}
+	n.Unlock()
+
+	if sendHB {
+		n.sendHeartbeat()
+	}
+}
+
+// Track interactions with this peer.
+func (n *raft) trackPeer(peer string) error {
+	n.Lock()
+	var needPeerUpdate bool
+	if n.state == Leader {
+		if _, ok := n.peers[peer]; !ok {
+			// This is someone new, if we have registered all of the peers already
+			// this is an error.
+			if len(n.peers) >= n.csz {
+				n.Unlock()
+				n.debug("Leader detected a new peer! %q", peer)
+				return errUnknownPeer
+			}
+			needPeerUpdate = true
+		}
+	}
+	if ps := n.peers[peer]; ps != nil {
+		ps.ts = time.Now().UnixNano()
+	} else {
+		n.peers[peer] = &lps{time.Now().UnixNano(), 0}
+	}
+	n.Unlock()
+
+	if needPeerUpdate {
+		n.sendPeerState()
+	}
+	return nil
+}
+
+func (n *raft) runAsCandidate() {
+	n.Lock()
+	// Drain old responses.
+	for len(n.votes) > 0 {
+		<-n.votes
+	}
+	n.Unlock()
+
+	// Send out our request for votes.
+	n.requestVote()
+
+	// We vote for ourselves.
+	votes := 1
+
+	for {
+		elect := n.electTimer()
+		select {
+		case <-n.s.quitCh:
+			return
+		case <-n.quit:
+			return
+		case <-elect.C:
+			n.switchToCandidate()
+			return
+		case vresp := <-n.votes:
+			n.trackPeer(vresp.peer)
+			if vresp.granted && n.term >= vresp.term {
+				votes++
+				if n.wonElection(votes) {
+					// Become LEADER if we have won.
+					n.switchToLeader()
+					return
+				}
+			}
+		case vreq := <-n.reqs:
+			n.processVoteRequest(vreq)
+		case newLeader := <-n.stepdown:
+			n.switchToFollower(newLeader)
+			return
+		}
+	}
+}
+
+// handleAppendEntry handles an append entry from the wire. We can't rely on msg being available
+// past this callback so will do a bunch of processing here to avoid copies, channels etc.
+func (n *raft) handleAppendEntry(sub *subscription, c *client, subject, reply string, msg []byte) {
+	ae := n.decodeAppendEntry(msg, reply)
+	if ae == nil {
+		return
+	}
+	n.processAppendEntry(ae, sub)
+}
+
+// Lock should be held.
+func (n *raft) cancelCatchup() {
+	n.debug("Canceling catchup subscription since we are now up to date")
+	n.s.sysUnsubscribe(n.catchup.sub)
+	n.catchup = nil
+}
+
+// catchupStalled will try to determine if we are stalled. This is called
+// on a new entry from our leader.
+// Lock should be held.
+func (n *raft) catchupStalled() bool {
+	if n.catchup == nil {
+		return false
+	}
+	const maxHBs = 3
+	if n.catchup.pindex == n.pindex {
+		n.catchup.hbs++
+	} else {
+		n.catchup.pindex = n.pindex
+		n.catchup.hbs = 0
+	}
+	return n.catchup.hbs >= maxHBs
+}
+
+// Lock should be held.
+func (n *raft) createCatchup(ae *appendEntry) string {
+	// Cleanup any old ones.
+	if n.catchup != nil && n.catchup.sub != nil {
+		n.s.sysUnsubscribe(n.catchup.sub)
+	}
+	// Snapshot term and index.
+	n.catchup = &catchupState{
+		cterm:  ae.pterm,
+		cindex: ae.pindex,
+		pterm:  n.pterm,
+		pindex: n.pindex,
+		reply:  ae.reply,
+	}
+	inbox := n.newInbox(n.s.ClusterName())
+	sub, _ := n.subscribe(inbox, n.handleAppendEntry)
+	n.catchup.sub = sub
+	return inbox
+}
+
+// Attempt to stepdown, lock should be held.
+func (n *raft) attemptStepDown(newLeader string) {
+	select {
+	case n.stepdown <- newLeader:
+	default:
+		n.debug("Failed to place stepdown for new leader %q for %q", newLeader, n.group)
+	}
+}
+
+// processAppendEntry will process an appendEntry.
+func (n *raft) processAppendEntry(ae *appendEntry, sub *subscription) {
+	n.Lock()
+	// Just return if closed.
+	if n.state == Closed {
+		n.Unlock()
+		return
+	}
+
+	// If we are paused drop new entries, we will catch up when resumed.
+	if n.halted && sub != nil {
+		n.Unlock()
+		return
+	}
+
+	// If we received an append entry as a candidate we should convert to a follower.
+	if n.state == Candidate {
+		n.debug("Received append entry in candidate state from %q, converting to follower", ae.leader)
+		n.term = ae.term
+		n.vote = noVote
+		n.writeTermVote()
+		n.attemptStepDown(ae.leader)
+	}
+
+	// Catching up state.
+	catchingUp := n.catchup != nil
+	// Is this a new entry or a replay on startup?
+	isNew := sub != nil && (!catchingUp || sub != n.catchup.sub)
+
+	if isNew {
+		n.resetElectionTimeout()
+		// Track leader directly
+		if ae.leader != noLeader {
+			if ps := n.peers[ae.leader]; ps != nil {
+				ps.ts = time.Now().UnixNano()
+			} else {
+				n.peers[ae.leader] = &lps{time.Now().UnixNano(), 0}
+			}
+		}
+	}
+
+	// Ignore old terms.
+	if isNew && ae.term < n.term {
+		n.Unlock()
+		n.debug("AppendEntry ignoring old term")
+		return
+	}
+
+	// Check state if we are catching up.
+	if catchingUp && isNew {
+		if cs := n.catchup; cs != nil && n.pterm >= cs.cterm && n.pindex >= cs.cindex {
+			// If we are here we are good, so if we have a catchup pending we can cancel.
+			n.cancelCatchup()
+			catchingUp = false
+		} else {
+			var ar *appendEntryResponse
+			var inbox string
+			// Check to see if we are stalled. If so recreate our catchup state and resend response.
+			if n.catchupStalled() {
+				n.debug("Catchup may be stalled, will request again")
+				inbox = n.createCatchup(ae)
+				ar = &appendEntryResponse{n.pterm, n.pindex, n.id, false, n.state == Observer, _EMPTY_}
+			}
+			// Ignore new while catching up or replaying.
+			n.Unlock()
+			if ar != nil {
+				n.sendRPC(ae.reply, inbox, ar.encode())
+			}
+			return
+		}
+	}
+
+	// If this term is greater than ours.
+	if ae.term > n.term {
+		n.term = ae.term
+		n.vote = noVote
+		n.writeTermVote()
+		if n.state != Follower && n.state != Observer {
+			n.debug("Term higher than ours and we are not a follower: %v, stepping down to %q", n.state, ae.leader)
+			n.attemptStepDown(ae.leader)
+		}
+	}
+
+	if n.leader != ae.leader && (n.state == Follower || n.state == Observer) {
+		n.debug("AppendEntry updating leader to %q", ae.leader)
+		// If the first leader we hear from already has committed entries we are joining an existing
+		// group, so do not vote until the group commits adding us.
+		if n.fresh && n.state == Follower && ae.commit > 0 {
+			n.notice("Joining an existing group as an observer")
+			n.state = Observer
+			n.updateLogFields()
+		}
+		n.fresh = false
+		n.updateLeader(ae.leader)
+		n.failed = 0
+		n.vote = noVote
+		n.writeTermVote()
+		if isNew {
+			n.resetElectionTimeout()
+			n.updateLeadChange(false)
+		}
+	}
+
+	// TODO(dlc) - Do both catchup and delete new behaviors from spec.
+	if ae.pterm != n.pterm || ae.pindex != n.pindex {
+		// Check if we are catching up and this is a snapshot, if so reset our wal's index.
+		// Snapshots will always be by themselves.
+		if catchingUp && len(ae.entries) > 0 && ae.entries[0].Type == EntrySnapshot {
+			n.debug("Should reset index for wal to %d", ae.pindex+1)
+			n.wal.Compact(ae.pindex + 1)
+			n.pindex = ae.pindex
+			n.commit = ae.pindex
+		} else {
+			n.debug("AppendEntry did not match %d %d with %d %d", ae.pterm, ae.pindex, n.pterm, n.pindex)
+			// Reset our term.
+			n.term = n.pterm
+			// Setup our state for catching up.
+			inbox := n.createCatchup(ae)
+			ar := appendEntryResponse{n.pterm, n.pindex, n.id, false, n.state == Observer, _EMPTY_}
+			n.Unlock()
+			n.sendRPC(ae.reply, inbox, ar.encode())
+			return
+		}
+	}
+
+	// Save to our WAL if we have entries.
+	if len(ae.entries) > 0 {
+		// Only store if an original which will have sub != nil
+		if sub != nil {
+			// Do not ack what we could not store, the leader will resend.
+			if err := n.storeToWAL(ae); err != nil {
+				if err != ErrStoreClosed && err != errWALChanged {
+					n.error("Error storing to WAL: %v", err)
+				}
+				n.Unlock()
+				return
+			}
+		} else {
+			// This is a replay on startup so just take the appendEntry version.
+			n.pterm = ae.term
+			n.pindex = ae.pindex + 1
+		}
+
+		// Check to see if we have any related entries to process here.
+		for _, e := range ae.entries {
+			switch e.Type {
+			case EntryLeaderTransfer:
+				if isNew {
+					maybeLeader := string(e.Data)
+					if maybeLeader == n.id {
+						n.campaign()
+					}
+				}
+			case EntryAddPeer:
+				if newPeer := string(e.Data); len(newPeer) == idLen {
+					// Track directly
+					if ps := n.peers[newPeer]; ps != nil {
+						ps.ts = time.Now().UnixNano()
+					} else {
+						n.peers[newPeer] = &lps{time.Now().UnixNano(), 0}
+					}
+				}
+			case EntrySnapshot:
+				if ae.pindex+1 > n.sindex {
+					n.sindex = ae.pindex + 1
+				}
+			}
+		}
+	}
+
+	// Never commit past what we have stored. This is expected while catching up.
+	commit := ae.commit
+	if commit > n.pindex {
+		n.debug("Leader commit %d is past our stored index %d, clamping", commit, n.pindex)
+		commit = n.pindex
+	}
+
+	// Apply anything we need here.
+	if commit > n.commit {
+		if n.paused {
+			n.hcommit = commit
+			n.debug("Paused, not applying %d", commit)
+		} else {
+			for index := n.commit + 1; index <= commit; index++ {
+				if err := n.applyCommit(index); err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	ar := appendEntryResponse{n.pterm, n.pindex, n.id, true, n.state == Observer, _EMPTY_}
+	n.Unlock()
+
+	// Success. Send our response.
+	n.sendRPC(ae.reply, _EMPTY_, ar.encode())
+}
+
+// Lock should be held.
+func (n *raft) processPeerState(ps *peerState) {
+	// Update our version of peers to that of the leader.
+	n.csz = ps.clusterSize
+	n.peers = make(map[string]*lps)
+	for _, peer := range ps.knownPeers {
+		n.peers[peer] = &lps{0, 0}
+	}
+	n.debug("Update peers from leader to %+v", n.peers)
+	writePeerState(n.sd, ps)
+}
+
+// handleAppendEntryResponse just places the decoded response on the appropriate channel.
+func (n *raft) handleAppendEntryResponse(sub *subscription, c *client, subject, reply string, msg []byte) {
+	aer := n.decodeAppendEntryResponse(msg)
+	if reply != _EMPTY_ {
+		aer.reply = reply
+	}
+	select {
+	case n.resp <- aer:
+	default:
+		n.error("Failed to place add entry response on chan for %q", n.group)
+	}
+}
+
+func (n *raft) buildAppendEntry(entries []*Entry) *appendEntry {
+	return &appendEntry{n.id, n.term, n.commit, n.pterm, n.pindex, entries, _EMPTY_, nil}
+}
+
+// storeToWAL will store the appendEntry in our WAL, retrying transient
+// failures a bounded number of times. The lock is released while we back off,
+// if our log or term changed in the meantime the entry is stale and we give up.
+// lock should be held.
+func (n *raft) storeToWAL(ae *appendEntry) error {
+	if ae.buf == nil {
+		panic("nil buffer for appendEntry!")
+	}
+	var seq uint64
+	var err error
+	pindex, term := n.pindex, n.term
+	for i := 0; i < walStoreRetries; i++ {
+		if i > 0 {
+			n.warn("Retrying store to WAL after error: %v", err)
+			n.Unlock()
+			time.Sleep(walRetryDelay)
+			n.Lock()
+			if n.pindex != pindex || n.term != term {
+				return errWALChanged
+			}
+		}
+		if seq, _, err = n.wal.StoreMsg(_EMPTY_, nil, ae.buf); err == nil || err == ErrStoreClosed {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Sanity checking, if this fails our log can not be trusted.
+	if ae.pindex != seq-1 {
+		n.error("Placed an entry at the wrong index, ae is %+v, index is %d, marking node degraded", ae, seq)
+		n.degraded, n.halted = true, true
+		return errIndexMismatch
+	}
+
+	n.pterm = ae.term
+	n.pindex = seq
+	return nil
+}
+
+func (n *raft) sendAppendEntry(entries []*Entry) {
+	n.Lock()
+	defer n.Unlock()
+	ae := n.buildAppendEntry(entries)
+	ae.buf = ae.encode()
+	// If we have entries store this in our wal.
+	if len(entries) > 0 {
+		if err := n.storeToWAL(ae); err != nil {
+			// We could not store, so do not send. Stepdown so another node can take over.
+			// If our log or term moved on while we retried we are no longer sending this entry.
+			if err != ErrStoreClosed && err != errWALChanged {
+				n.error("Error storing to WAL, stepping down: %v", err)
+				select {
+				case n.stepdown <- noLeader:
+				default:
+				}
+			}
+			return
+		}
+		// We count ourselves.
+		n.acks[n.pindex] = map[string]struct{}{n.id: struct{}{}}
+		// Track latencies.
+		now := time.Now().UnixNano()
+		if pts := atomic.SwapInt64(&n.pts, 0); pts > 0 {
+			n.slat = smoothLatency(n.slat, now-pts)
+			n.nprops++
+		}
+		n.stimes[n.pindex%latencyWindow] = storeTime{n.pindex, now}
+		// Check for snapshot
+		for _, e := range entries {
+			if e.Type == EntrySnapshot {
+				n.sindex = n.pindex
+			}
+		}
+		n.active = time.Now()
+	}
+	n.scommit = ae.commit
+	n.sendRPC(n.asubj, n.areply, ae.buf)
+}
+
+type peerState struct {
+	knownPeers  []string
+	clusterSize int
+}
+
+func encodePeerState(ps *peerState) []byte {
+	var le = binary.LittleEndian
+	buf := make([]byte, 4+4+(8*len(ps.knownPeers)))
+	le.PutUint32(buf[0:], uint32(ps.clusterSize))
+	le.PutUint32(buf[4:], uint32(len(ps.knownPeers)))
+	wi := 8
+	for _, peer := range ps.knownPeers {
+		copy(buf[wi:], peer)
+		wi += idLen
+	}
+	return buf
+}
+
+func decodePeerState(buf []byte) (*peerState, error) {
+	if len(buf) < 8 {
+		return nil, errCorruptPeers
+	}
+	var le = binary.LittleEndian
+	ps := &peerState{clusterSize: int(le.Uint32(buf[0:]))}
+	expectedPeers := int(le.Uint32(buf[4:]))
+	buf = buf[8:]
+	for i, ri, n := 0, 0, expectedPeers; i < n && ri < len(buf); i++ {
+		ps.knownPeers = append(ps.knownPeers, string(buf[ri:ri+idLen]))
+		ri += idLen
+	}
+	if len(ps.knownPeers) != expectedPeers {
+		return nil, errCorruptPeers
+	}
+	return ps, nil
+}
+
+// Lock should be held.
+func (n *raft) peerNames() []string {
+	var peers []string
+	for peer := range n.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (n *raft) currentPeerState() *peerState {
+	n.RLock()
+	ps := &peerState{n.peerNames(), n.csz}
+	n.RUnlock()
+	return ps
+}
+
+// sendPeerState will send our current peer state to the cluster.
+func (n *raft) sendPeerState() {
+	n.sendAppendEntry([]*Entry{&Entry{EntryPeerState, encodePeerState(n.currentPeerState())}})
+}
+
+func (n *raft) sendHeartbeat() {
+	n.sendAppendEntry(nil)
+}
+
+type voteRequest struct {
+	term      uint64
+	lastTerm  uint64
+	lastIndex uint64
+	candidate string
+	// internal only.
+	reply string
+}
+
+const voteRequestLen = 24 + idLen
+
+func (vr *voteRequest) encode() []byte {
+	var buf [voteRequestLen]byte
+	var le = binary.LittleEndian
+	le.PutUint64(buf[0:], vr.term)
+	le.PutUint64(buf[8:], vr.lastTerm)
+	le.PutUint64(buf[16:], vr.lastIndex)
+	copy(buf[24:24+idLen], vr.candidate)
+
+	return buf[:voteRequestLen]
+}
+
+func (n *raft) decodeVoteRequest(msg []byte, reply string) *voteRequest {
+	if len(msg) != voteRequestLen {
+		return nil
+	}
+	// Need to copy for now b/c of candidate.
+	msg = append(msg[:0:0], msg...)
+
+	var le = binary.LittleEndian
+	return &voteRequest{
+		term:      le.Uint64(msg[0:]),
+		lastTerm:  le.Uint64(msg[8:]),
+		lastIndex: le.Uint64(msg[16:]),
+		candidate: string(msg[24 : 24+idLen]),
+		reply:     reply,
+	}
+}
+
+const peerStateFile = "peers.idx"
+
+// Writes out our peer state.
+func writePeerState(sd string, ps *peerState) error {
+	psf := path.Join(sd, peerStateFile)
+	if _, err := os.Stat(psf); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(psf, encodePeerState(ps), 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readPeerState(sd string) (ps *peerState, err error) {
+	buf, err := ioutil.ReadFile(path.Join(sd, peerStateFile))
+	if err != nil {
+		return nil, err
+	}
+	return decodePeerState(buf)
+}
+
+const termVoteFile = "tav.idx"
+const termVoteLen = idLen + 8
+
+// readTermVote will read the largest term and who we voted from to stable storage.
+// Lock should be held.
+func (n *raft) readTermVote() (term uint64, voted string, err error) {
+	buf, err := ioutil.ReadFile(path.Join(n.sd, termVoteFile))
+	if err != nil {
+		return 0, noVote, err
+	}
+	if len(buf) < termVoteLen {
+		return 0, noVote, nil
+	}
+	var le = binary.LittleEndian
+	term = le.Uint64(buf[0:])
+	voted = string(buf[8:])
+	return term, voted, nil
+}
+
+// writeTermVote will record the largest term and who we voted for to stable storage.
+// Lock should be held.
+func (n *raft) writeTermVote() error {
+	tvf := path.Join(n.sd, termVoteFile)
+	if _, err := os.Stat(tvf); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var buf [termVoteLen]byte
+	var le = binary.LittleEndian
+	le.PutUint64(buf[0:], n.term)
+	// FIXME(dlc) - NoVote
+	copy(buf[8:], n.vote)
+	// Term or state may have changed.
+	n.updateLogFields()
+	if err := ioutil.WriteFile(tvf, buf[:8+len(n.vote)], 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+// voteResponse is a response to a vote request.
+type voteResponse struct {
+	term    uint64
+	peer    string
+	granted bool
+}
+
+const voteResponseLen = 8 + 8 + 1
+
+func (vr *voteResponse) encode() []byte {
+	var buf [voteResponseLen]byte
+	var le = binary.LittleEndian
+	le.PutUint64(buf[0:], vr.term)
+	copy(buf[8:], vr.peer)
+	if vr.granted {
+		buf[16] = 1
+	} else {
+		buf[16] = 0
+	}
+	return buf[:voteResponseLen]
+}
+
+func (n *raft) decodeVoteResponse(msg []byte) *voteResponse {
+	if len(msg) != voteResponseLen {
+		return nil
+	}
+	var le = binary.LittleEndian
+	vr := &voteResponse{term: le.Uint64(msg[0:]), peer: string(msg[8:16])}
+	vr.granted = msg[16] == 1
+	return vr
+}
+
+func (n *raft) handleVoteResponse(sub *subscription, c *client, _, reply string, msg []byte) {
+	vr := n.decodeVoteResponse(msg)
+	n.debug("Received a voteResponse %+v", vr)
+	if vr == nil {
+		n.error("Received malformed vote response for %q", n.group)
+		return
+	}
+	select {
+	case n.votes <- vr:
+	default:
+		// FIXME(dlc)
+		n.error("Failed to place vote response on chan for %q", n.group)
+	}
+}
+
+func (n *raft) processVoteRequest(vr *voteRequest) error {
+	n.RLock()
+	vresp := voteResponse{n.term, n.id, false}
+	n.RUnlock()
+
+	n.debug("Received a voteRequest %+v", vr)
+	defer n.debug("Sending a voteResponse %+v -> %q", &vresp, vr.reply)
+
+	if err := n.trackPeer(vr.candidate); err != nil {
+		n.sendReply(vr.reply, vresp.encode())
+		return err
+	}
+
+	n.Lock()
+
+	// Ignore if we are paused, an observer or newer.
+	if n.halted || n.state == Observer || vr.term < n.term {
+		n.Unlock()
+		n.sendReply(vr.reply, vresp.encode())
+		return nil
+	}
+
+	// If this is a higher term go ahead and stepdown.
+	if vr.term > n.term {
+		n.term = vr.term
+		n.vote = noVote
+		n.writeTermVote()
+		if n.state == Candidate {
+			n.debug("Stepping down from candidate, detected higher term: %d vs %d", vr.term, n.term)
+			n.attemptStepDown(noLeader)
+		}
+	}
+
+	// Deterministic tie-break for split votes. If we are a candidate for the same term and the
+	// other candidate is equally up to date, defer to the higher id. We already voted for
+	// ourselves so we can not grant here, but we back off so the other candidate wins the next round.
+	if n.state == Candidate && vr.term == n.term && vr.lastTerm == n.pterm && vr.lastIndex == n.pindex && vr.candidate > n.id {
+		n.debug("Tie with candidate %q, backing off", vr.candidate)
+		n.resetElect(maxElectionTimeout)
+	}
+
+	// Only way we get to yes is through here.
+	if vr.lastIndex >= n.pindex && n.vote == noVote || n.vote == vr.candidate {
+		vresp.granted = true
+		n.vote = vr.candidate
+		n.writeTermVote()
+		n.resetElectionTimeout()
+	}
+	n.Unlock()
+
+	n.sendReply(vr.reply, vresp.encode())
+
+	return nil
+}
+
+func (n *raft) handleVoteRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	vr := n.decodeVoteRequest(msg, reply)
+	if vr == nil {
+		n.error("Received malformed vote request for %q", n.group)
+		return
+	}
+	select {
+	case n.reqs <- vr:
+	default:
+		n.error("Failed to place vote request on chan for %q", n.group)
+	}
+}
+
+func (n *raft) requestVote() {
+	n.Lock()
+	if n.state != Candidate {
+		n.Unlock()
+		panic("raft requestVote not from candidate")
+	}
+	n.vote = n.id
+	n.writeTermVote()
+	vr := voteRequest{n.term, n.pterm, n.pindex, n.id, _EMPTY_}
+	subj, reply := n.vsubj, n.vreply
+	n.Unlock()
+
+	n.debug("Sending out voteRequest %+v", vr)
+
+	// Now send it out.
+	n.sendRPC(subj, reply, vr.encode())
+}
+
+func (n *raft) sendRPC(subject, reply string, msg []byte) {
+	n.sendq <- &pubMsg{n.c, subject, reply, nil, msg, false}
+}
+
+func (n *raft) sendReply(subject string, msg []byte) {
+	n.sendq <- &pubMsg{n.c, subject, _EMPTY_, nil, msg, false}
+}
+
+func (n *raft) wonElection(votes int) bool {
+	return votes >= n.quorumNeeded()
+}
+
+// writeQuorum returns how many peers need to store an entry to commit it.
+// This is never less than a majority, so any elected leader will have all committed entries.
+// Lock should be held.
+func (n *raft) writeQuorum() int {
+	switch {
+	case n.wqn <= n.qn:
+		return n.qn
+	case n.wqn > n.csz:
+		return n.csz
+	}
+	return n.wqn
+}
+
+// Return the quorum size for a given cluster config.
+func (n *raft) quorumNeeded() int {
+	n.RLock()
+	qn := n.qn
+	n.RUnlock()
+	return qn
+}
+
+// Lock should be held.
+func (n *raft) updateLeadChange(isLeader bool) {
+	select {
+	case n.leadc <- isLeader:
+	case <-n.leadc:
+		// We had an old value not consumed.
+		select {
+		case n.leadc <- isLeader:
+		default:
+			n.error("Failed to post lead change to %v for %q", isLeader, n.group)
+		}
+	}
+}
+
+// Lock should be held.
+func (n *raft) switchState(state RaftState) {
+	if n.state == Closed {
+		return
+	}
+
+	// Reset the election timer.
+	n.resetElectionTimeout()
+
+	if n.state == Leader && state != Leader {
+		n.updateLeadChange(false)
+	} else if state == Leader && n.state != Leader {
+		n.updateLeadChange(true)
+	}
+
+	// Observers stay observers until promoted.
+	if n.state == Observer && state == Follower {
+		state = Observer
+	}
+
+	n.state = state
+	n.vote = noVote
+	n.writeTermVote()
+}
+
+// promoteObserver will have an observer become a voting follower.
+// Lock should be held.
+func (n *raft) promoteObserver(reason string) {
+	if n.state != Observer {
+		return
+	}
+	n.notice("Promoting observer to follower, %s", reason)
+	n.state = Follower
+	n.updateLogFields()
+	n.resetElectionTimeout()
+}
+
+const (
+	noLeader = _EMPTY_
+	noVote   = _EMPTY_
+)
+
+func (n *raft) switchToFollower(leader string) {
+	n.notice("Switching to follower")
+	n.Lock()
+	defer n.Unlock()
+	n.updateLeader(leader)
+	// We have a leader so reset our backoff.
+	if leader != noLeader {
+		n.failed = 0
+	}
+	n.switchState(Follower)
+}
+
+func (n *raft) switchToCandidate() {
+	n.Lock()
+	defer n.Unlock()
+	n.fresh = false
+	if n.state != Candidate {
+		n.notice("Switching to candidate")
+	} else {
+		// Our last campaign did not succeed.
+		n.failed++
+		if n.lostQuorumLocked() {
+			// We signal to the upper layers such that can alert on quorum lost.
+			n.updateLeadChange(false)
+		}
+	}
+	// Increment the term.
+	n.term++
+	// Clear current Leader.
+	n.updateLeader(noLeader)
+	n.switchState(Candidate)
+	// Backoff if we keep failing to win elections.
+	if bo := n.campaignBackoff(); bo > 0 {
+		n.debug("Failed %d elections, backing off %v", n.failed, bo)
+		n.resetElect(randElectionTimeout(n.electionExtra()) + bo)
+	}
+}
+
+func (n *raft) switchToLeader() {
+	n.notice("Switching to leader")
+	n.Lock()
+	defer n.Unlock()
+	n.updateLeader(n.id)
+	n.failed = 0
+	n.lstart = time.Now()
+	n.hbtks, n.hbwait = 1, 0
+	n.switchState(Leader)
+}
@@ -0,0 +1,3093 @@
+// Copyright 2019-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nuid"
+	"golang.org/x/time/rate"
+)
+
+// StreamConfig will determine the name, subjects and retention policy
+// for a given stream. If subjects is empty the name will be used.
+type StreamConfig struct {
+	Name              string            `json:"name"`
+	Subjects          []string          `json:"subjects,omitempty"`
+	Retention         RetentionPolicy   `json:"retention"`
+	MaxConsumers      int               `json:"max_consumers"`
+	MaxMsgs           int64             `json:"max_msgs"`
+	MaxBytes          int64             `json:"max_bytes"`
+	Discard           DiscardPolicy     `json:"discard"`
+	MaxAge            time.Duration     `json:"max_age"`
+	MaxMsgSize        int32             `json:"max_msg_size,omitempty"`
+	Storage           StorageType       `json:"storage"`
+	Replicas          int               `json:"num_replicas"`
+	NoAck             bool              `json:"no_ack,omitempty"`
+	Template          string            `json:"template_owner,omitempty"`
+	Duplicates        time.Duration     `json:"duplicate_window,omitempty"`
+	Sealed            bool              `json:"sealed,omitempty"`
+	AckLevel          AckLevel          `json:"ack_level,omitempty"`
+	MaxStreamIdle     time.Duration     `json:"max_stream_idle,omitempty"`
+	CatchupRate       int64             `json:"catchup_rate,omitempty"`
+	Compaction        CompactPolicy     `json:"compaction,omitempty"`
+	MaxMsgsPerSubject int64             `json:"max_msgs_per_subject,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	AllowSubjects     []string          `json:"allow_subjects,omitempty"`
+	DenySubjects      []string          `json:"deny_subjects,omitempty"`
+	Mirror            *StreamSource     `json:"mirror,omitempty"`
+	RePublish         *RePublish        `json:"republish,omitempty"`
+	Compression       StoreCompression  `json:"compression,omitempty"`
+	WriteQuorum       int               `json:"write_quorum,omitempty"`
+	SubjectTransform  *SubjectTransform `json:"subject_transform,omitempty"`
+	RequiredHeaders   []string          `json:"required_headers,omitempty"`
+	DenyDelete        bool              `json:"deny_delete,omitempty"`
+	DenyPurge         bool              `json:"deny_purge,omitempty"`
+	AckFloorRetention bool              `json:"ack_floor_retention,omitempty"`
+	PublishRateLimit  *StreamRateLimit  `json:"publish_rate_limit,omitempty"`
+	RetentionHold     bool              `json:"retention_hold,omitempty"`
+	HoldRejectWrites  bool              `json:"hold_reject_writes,omitempty"`
+
+	// These are non public configuration options.
+	// If you add new options, check fileStreamInfoJSON in order for them to
+	// be properly persisted/recovered, if needed.
+	internal       bool
+	allowNoSubject bool
+}
+
+// StreamSource dictates another stream to copy messages from, along with an optional filter.
+type StreamSource struct {
+	Name          string `json:"name"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+}
+
+// RePublish is for republishing messages once committed to a stream.
+// Source is an optional filter for which stored messages are republished.
+type RePublish struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+}
+
+// SubjectTransform will store inbound messages under the destination subject when they match the source,
+// using the same token place holders as account subject mappings, e.g. "orders.*" to "orders.new.$1".
+type SubjectTransform struct {
+	Source      string `json:"src"`
+	Destination string `json:"dest"`
+}
+
+const JSApiPubAckResponseType = "io.nats.jetstream.api.v1.pub_ack_response"
+
+// JSPubAckResponse is a formal response to a publish operation.
+type JSPubAckResponse struct {
+	Error *ApiError `json:"error,omitempty"`
+	*PubAck
+}
+
+// PubAck is the detail you get back from a publish to a stream that was successful.
+// e.g. +OK {"stream": "Orders", "seq": 22}
+type PubAck struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// StreamInfo shows config and current state for this stream.
+type StreamInfo struct {
+	Config  StreamConfig `json:"config"`
+	Created time.Time    `json:"created"`
+	State   StreamState  `json:"state"`
+	Cluster *ClusterInfo `json:"cluster,omitempty"`
+}
+
+// ClusterInfo shows information about the underlying set of servers
+// that make up the stream or consumer.
+type ClusterInfo struct {
+	Name     string      `json:"name,omitempty"`
+	Leader   string      `json:"leader,omitempty"`
+	Replicas []*PeerInfo `json:"replicas,omitempty"`
+}
+
+// PeerInfo shows information about all the peers in the cluster that
+// are supporting the stream or consumer.
+type PeerInfo struct {
+	Name    string        `json:"name"`
+	Current bool          `json:"current"`
+	Active  time.Duration `json:"active"`
+}
+
+// Stream is a jetstream stream of messages. When we receive a message internally destined
+// for a Stream we will direct link from the client to this Stream structure.
+type Stream struct {
+	mu        sync.RWMutex
+	jsa       *jsAccount
+	srv       *Server
+	client    *client
+	sysc      *client
+	sid       int
+	pubAck    []byte
+	sendq     chan *jsPubMsg
+	store     StreamStore
+	lseq      uint64
+	lmsgId    string
+	consumers map[string]*Consumer
+	numFilter int
+	config    StreamConfig
+	created   time.Time
+	ddmap     map[string]*ddentry
+	ddarr     []*ddentry
+	ddindex   int
+	ddtmr     *time.Timer
+	qch       chan struct{}
+	active    bool
+
+	// Clustered mode.
+	sa      *streamAssignment
+	node    RaftNode
+	catchup bool
+	cstart  time.Time
+	ctarget uint64
+	syncSub *subscription
+	infoSub *subscription
+	getSub  *subscription
+	clseq   uint64
+	clfs    uint64
+	cdone   chan struct{}
+	lqsent  time.Time
+	apsent  time.Time
+
+	// Sizes of messages the leader proposed that are not applied yet, oldest first, and their total.
+	// Only tracked with MaxBytes for discard new, see checkDiscardNew().
+	clps []proposedMsg
+	clpb uint64
+
+	// Sequences per subject, oldest first, for streams with MaxMsgsPerSubject.
+	// When clustered the leader tracks those it proposed deletes for until they are applied.
+	lvs map[string][]uint64
+	lvp map[uint64]struct{}
+
+	// Last sequence per subject for last sequence requests, built on first use.
+	// We stop indexing and scan the store instead past maxLastSeqSubjects.
+	lss    map[string]uint64
+	lssOff bool
+
+	// Replicated floor below which we never store, from purges and snapshots.
+	minRetainedSeq uint64
+
+	// For mirrors, quit channel for the leader's fill loop, the last applied source sequence and the last one persisted.
+	mqch  chan struct{}
+	mlseq uint64
+	mpseq uint64
+
+	// Last sequence republished, see RePublish. Replicated by the leader.
+	rpseq uint64
+
+	// For replicated streams the leader proposes age expiry instead of each store
+	// expiring on its own. The last expiry sequence we proposed, see checkAgeExpiry().
+	ldage  bool
+	expseq uint64
+
+	// Compiled transform for inbound subjects, see SubjectTransform.
+	itr *transform
+
+	// The last ack floor sequence we proposed, see ackFloorCompactSeq().
+	afseq uint64
+	// Standalone streams coalesce acks and check the ack floor on a timer, see checkAckFloor().
+	aftmr *time.Timer
+
+	// Publish rate limiters, see StreamRateLimit. Only used by the leader.
+	mrl *rate.Limiter
+	brl *rate.Limiter
+
+	// Deadline in unix nanoseconds of a write pause, 0 if writes are allowed.
+	// Replicated, the leader proposes the resume once it has passed.
+	wpause int64
+}
+
+// Headers for published messages.
+const (
+	JSMsgId             = "Nats-Msg-Id"
+	JSExpectedStream    = "Nats-Expected-Stream"
+	JSExpectedLastSeq   = "Nats-Expected-Last-Sequence"
+	JSExpectedLastMsgId = "Nats-Expected-Last-Msg-Id"
+	JSMirrorSeq         = "Nats-Mirror-Seq"
+	JSStream            = "Nats-Stream"
+	JSSubject           = "Nats-Subject"
+	JSSequence          = "Nats-Sequence"
+)
+
+// Dedupe entry
+type ddentry struct {
+	id  string
+	seq uint64
+	ts  int64
+}
+
+// Replicas Range
+const (
+	StreamDefaultReplicas = 1
+	StreamMaxReplicas     = 5
+)
+
+// AddStream adds a stream for the given account.
+func (a *Account) AddStream(config *StreamConfig) (*Stream, error) {
+	return a.addStream(config, nil, nil)
+}
+
+// AddStreamWithStore adds a stream for the given account with custome store config options.
+func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreConfig) (*Stream, error) {
+	return a.addStream(config, fsConfig, nil)
+}
+
+func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment) (*Stream, error) {
+	s, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	// If we do not have the stream currently assigned to us in cluster mode we will proceed but warn.
+	// This can happen on startup with restored state where on meta replay we still do not have
+	// the assignment. Running in single server mode this always returns true.
+	if !jsa.streamAssigned(config.Name) {
+		s.Debugf("Stream %q does not seem to be assigned to this server", config.Name)
+	}
+
+	// Sensible defaults.
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return nil, err
+	}
+
+	jsa.mu.Lock()
+	if mset, ok := jsa.streams[cfg.Name]; ok {
+		jsa.mu.Unlock()
+		// Check to see if configs are same.
+		ocfg := mset.Config()
+		if reflect.DeepEqual(ocfg, cfg) {
+			if sa != nil {
+				mset.setStreamAssignment(sa)
+			}
+			return mset, nil
+		} else {
+			return nil, ErrJetStreamStreamAlreadyUsed
+		}
+	}
+	// Check for limits.
+	if err := jsa.checkLimits(&cfg); err != nil {
+		jsa.mu.Unlock()
+		return nil, err
+	}
+	// Check for template ownership if present.
+	if cfg.Template != _EMPTY_ && jsa.account != nil {
+		if !jsa.checkTemplateOwnership(cfg.Template, cfg.Name) {
+			jsa.mu.Unlock()
+			return nil, fmt.Errorf("stream not owned by template")
+		}
+	}
+
+	// Check for overlapping subjects. These are not allowed for now.
+	if jsa.subjectsOverlap(cfg.Subjects) {
+		jsa.mu.Unlock()
+		return nil, fmt.Errorf("subjects overlap with an existing stream")
+	}
+
+	// Setup the internal clients.
+	c := s.createInternalJetStreamClient()
+	ic := s.createInternalJetStreamClient()
+
+	mset := &Stream{jsa: jsa, config: cfg, srv: s, client: c, sysc: ic, consumers: make(map[string]*Consumer), qch: make(chan struct{})}
+	mset.ldage = sa != nil && sa.Group != nil && len(sa.Group.Peers) > 1
+	mset.itr, _ = newStreamTransform(cfg.SubjectTransform)
+	mset.mrl, mset.brl = newStreamRateLimiters(cfg.PublishRateLimit)
+
+	jsa.streams[cfg.Name] = mset
+	storeDir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
+	jsa.mu.Unlock()
+
+	// Bind to the user account.
+	c.registerWithAccount(a)
+	// Bind to the system account.
+	ic.registerWithAccount(s.SystemAccount())
+
+	// Create the appropriate storage
+	fsCfg := fsConfig
+	if fsCfg == nil {
+		fsCfg = &FileStoreConfig{}
+		// If we are file based and not explicitly configured
+		// we may be able to auto-tune based on max msgs or bytes.
+		if cfg.Storage == FileStorage {
+			mset.autoTuneFileStorageBlockSize(fsCfg)
+		}
+	}
+	fsCfg.StoreDir = storeDir
+	if err := mset.setupStore(fsCfg); err != nil {
+		mset.Delete()
+		return nil, err
+	}
+
+	// Create our pubAck template here. Better than json marshal each time on success.
+	b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: cfg.Name, Sequence: math.MaxUint64}})
+	end := bytes.Index(b, []byte(strconv.FormatUint(math.MaxUint64, 10)))
+	// We need to force cap here to make sure this is a copy when sending a response.
+	mset.pubAck = b[:end:end]
+
+	// Rebuild dedupe as needed.
+	mset.rebuildDedupe()
+	// Do not republish messages recovered from our store. When clustered
+	// this comes from our replicated state instead.
+	if sa == nil {
+		mset.rpseq = mset.lseq
+	}
+	// Recover where our mirror was in its source.
+	mset.loadMirrorSeq()
+
+	// Setup our internal send go routine.
+	mset.setupSendCapabilities()
+
+	// Set our stream assignment if in clustered mode.
+	if sa != nil {
+		mset.setStreamAssignment(sa)
+	}
+
+	// Call directly to set leader if not in clustered mode.
+	// This can be called though before we actually setup clustering, so check both.
+	if !s.JetStreamIsClustered() && s.standAloneMode() {
+		if err := mset.setLeader(true); err != nil {
+			mset.Delete()
+			return nil, err
+		}
+	}
+
+	// This is always true in single server mode.
+	mset.mu.RLock()
+	isLeader := mset.isLeader()
+	mset.mu.RUnlock()
+
+	if isLeader {
+		// Send advisory.
+		var suppress bool
+		if !s.standAloneMode() && sa == nil {
+			suppress = true
+		} else if sa != nil {
+			suppress = sa.responded
+		}
+		if !suppress {
+			mset.sendCreateAdvisory()
+		}
+	}
+
+	return mset, nil
+}
+
+func (mset *Stream) setStreamAssignment(sa *streamAssignment) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	mset.sa = sa
+	// Set our node.
+	if sa != nil {
+		mset.node = sa.Group.node
+	}
+	// Any member may be handed a message get by the leader, see jsClusteredMsgGetRequest().
+	if mset.node != nil && mset.getSub == nil && mset.jsa != nil {
+		gsubj := fmt.Sprintf(clusterMsgGetT, mset.jsa.acc(), mset.config.Name, mset.node.ID())
+		mset.getSub, _ = mset.srv.systemSubscribe(gsubj, _EMPTY_, false, mset.sysc, mset.handleClusterMsgGetRequest)
+	}
+}
+
+// Lock should be held.
+func (mset *Stream) isLeader() bool {
+	if mset.node != nil {
+		return mset.node.Leader()
+	}
+	return true
+}
+
+// TODO(dlc) - Check to see if we can accept being the leader or we should should step down.
+func (mset *Stream) setLeader(isLeader bool) error {
+	mset.mu.Lock()
+	// If we are here we have a change in leader status.
+	if isLeader {
+		// Make sure we are listening for sync requests.
+		// TODO(dlc) - Original design was that all in sync members of the group would do DQ.
+		mset.startClusterSubs()
+		// Setup subscriptions
+		if err := mset.subscribeToStream(); err != nil {
+			mset.mu.Unlock()
+			// FIXME(dlc)
+			mset.Delete()
+			return err
+		}
+		// Mirrors are filled by the leader.
+		if mset.config.Mirror != nil && mset.mqch == nil {
+			mset.mqch = make(chan struct{})
+			mset.srv.startGoRoutine(func() { mset.processMirror(mset.mqch) })
+		}
+	} else {
+		// Stop responding to sync requests.
+		mset.stopClusterSubs()
+		// Unsubscribe from direct stream.
+		mset.unsubscribeToStream()
+		mset.stopMirror()
+	}
+	mset.mu.Unlock()
+	return nil
+}
+
+// Lock should be held.
+func (mset *Stream) startClusterSubs() {
+	if mset.infoSub == nil {
+		if jsa := mset.jsa; jsa != nil {
+			isubj := fmt.Sprintf(clusterStreamInfoT, jsa.acc(), mset.config.Name)
+			// Note below the way we subscribe here is so that we can send requests to ourselves.
+			mset.infoSub, _ = mset.srv.systemSubscribe(isubj, _EMPTY_, false, mset.sysc, mset.handleClusterStreamInfoRequest)
+		}
+	}
+	if mset.isClustered() && mset.syncSub == nil {
+		mset.syncSub, _ = mset.srv.systemSubscribe(mset.sa.Sync, _EMPTY_, false, mset.sysc, mset.handleClusterSyncRequest)
+	}
+}
+
+// Lock should be held.
+func (mset *Stream) stopClusterSubs() {
+	if mset.infoSub != nil {
+		mset.srv.sysUnsubscribe(mset.infoSub)
+		mset.infoSub = nil
+	}
+	if mset.syncSub != nil {
+		mset.srv.sysUnsubscribe(mset.syncSub)
+		mset.syncSub = nil
+	}
+}
+
+// account gets the account for this stream.
+func (mset *Stream) account() *Account {
+	mset.mu.RLock()
+	jsa := mset.jsa
+	mset.mu.RUnlock()
+	if jsa == nil {
+		return nil
+	}
+	return jsa.acc()
+}
+
+// Helper to determine the max msg size for this stream if file based.
+func (mset *Stream) maxMsgSize() uint64 {
+	maxMsgSize := mset.config.MaxMsgSize
+	if maxMsgSize <= 0 {
+		// Pull from the account.
+		if mset.jsa != nil {
+			if acc := mset.jsa.acc(); acc != nil {
+				acc.mu.RLock()
+				maxMsgSize = acc.mpay
+				acc.mu.RUnlock()
+			}
+		}
+		// If all else fails use default.
+		if maxMsgSize <= 0 {
+			maxMsgSize = MAX_PAYLOAD_SIZE
+		}
+	}
+	// Now determine an estimation for the subjects etc.
+	maxSubject := -1
+	for _, subj := range mset.config.Subjects {
+		if subjectIsLiteral(subj) {
+			if len(subj) > maxSubject {
+				maxSubject = len(subj)
+			}
+		}
+	}
+	if maxSubject < 0 {
+		const defaultMaxSubject = 256
+		maxSubject = defaultMaxSubject
+	}
+	// filestore will add in estimates for record headers, etc.
+	return fileStoreMsgSizeEstimate(maxSubject, int(maxMsgSize))
+}
+
+// If we are file based and the file storage config was not explicitly set
+// we can autotune block sizes to better match. Our target will be to store 125%
+// of the theoretical limit. We will round up to nearest 100 bytes as well.
+func (mset *Stream) autoTuneFileStorageBlockSize(fsCfg *FileStoreConfig) {
+	var totalEstSize uint64
+
+	// MaxBytes will take precedence for now.
+	if mset.config.MaxBytes > 0 {
+		totalEstSize = uint64(mset.config.MaxBytes)
+	} else if mset.config.MaxMsgs > 0 {
+		// Determine max message size to estimate.
+		totalEstSize = mset.maxMsgSize() * uint64(mset.config.MaxMsgs)
+	} else {
+		// If nothing set will let underlying filestore determine blkSize.
+		return
+	}
+
+	blkSize := (totalEstSize / 4) + 1 // (25% overhead)
+	// Round up to nearest 100
+	if m := blkSize % 100; m != 0 {
+		blkSize += 100 - m
+	}
+	if blkSize < FileStoreMinBlkSize {
+		blkSize = FileStoreMinBlkSize
+	}
+	if blkSize > FileStoreMaxBlkSize {
+		blkSize = FileStoreMaxBlkSize
+	}
+	fsCfg.BlockSize = uint64(blkSize)
+}
+
+// rebuildDedupe will rebuild any dedupe structures needed after recovery of a stream.
+// TODO(dlc) - Might be good to know if this should be checked at all for streams with no
+// headers and msgId in them. Would need signaling from the storage layer.
+func (mset *Stream) rebuildDedupe() {
+	state := mset.store.State()
+	mset.lseq = state.LastSeq
+
+	// We have some messages. Lookup starting sequence by duplicate time window.
+	sseq := mset.store.GetSeqFromTime(time.Now().Add(-mset.config.Duplicates))
+	if sseq == 0 {
+		return
+	}
+
+	for seq := sseq; seq <= state.LastSeq; seq++ {
+		_, hdr, _, ts, err := mset.store.LoadMsg(seq)
+		var msgId string
+		if err == nil && len(hdr) > 0 {
+			if msgId = getMsgId(hdr); msgId != _EMPTY_ {
+				mset.storeMsgId(&ddentry{msgId, seq, ts})
+			}
+		}
+		if seq == state.LastSeq {
+			mset.lmsgId = msgId
+		}
+	}
+}
+
+func (mset *Stream) lastSeq() uint64 {
+	mset.mu.RLock()
+	lseq := mset.lseq
+	mset.mu.RUnlock()
+	return lseq
+}
+
+func (mset *Stream) setLastSeq(lseq uint64) {
+	mset.mu.Lock()
+	mset.lseq = lseq
+	mset.mu.Unlock()
+}
+
+func (mset *Stream) sendCreateAdvisory() {
+	mset.mu.Lock()
+	name := mset.config.Name
+	template := mset.config.Template
+	sendq := mset.sendq
+	mset.mu.Unlock()
+
+	if sendq == nil {
+		return
+	}
+
+	// finally send an event that this stream was created
+	m := JSStreamActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   name,
+		Action:   CreateEvent,
+		Template: template,
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryStreamCreatedPre + "." + name
+	sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+}
+
+func (mset *Stream) sendDeleteAdvisoryLocked() {
+	if mset.sendq == nil {
+		return
+	}
+
+	m := JSStreamActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   mset.config.Name,
+		Action:   DeleteEvent,
+		Template: mset.config.Template,
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		subj := JSAdvisoryStreamDeletedPre + "." + mset.config.Name
+		mset.sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+	}
+}
+
+func (mset *Stream) sendUpdateAdvisoryLocked() {
+	if mset.sendq == nil {
+		return
+	}
+
+	m := JSStreamActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream: mset.config.Name,
+		Action: ModifyEvent,
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		subj := JSAdvisoryStreamUpdatedPre + "." + mset.config.Name
+		mset.sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+	}
+}
+
+// Created returns created time.
+func (mset *Stream) Created() time.Time {
+	mset.mu.RLock()
+	created := mset.created
+	mset.mu.RUnlock()
+	return created
+}
+
+// Internal to allow creation time to be restored.
+func (mset *Stream) setCreated(created time.Time) {
+	mset.mu.Lock()
+	mset.created = created
+	mset.mu.Unlock()
+}
+
+// Check to see if these subjects overlap with existing subjects.
+// Lock should be held.
+func (jsa *jsAccount) subjectsOverlap(subjects []string) bool {
+	for _, mset := range jsa.streams {
+		for _, subj := range mset.config.Subjects {
+			for _, tsubj := range subjects {
+				if SubjectsCollide(tsubj, subj) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Default duplicates window.
+const StreamDefaultDuplicatesWindow = 2 * time.Minute
+
+func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
+	if config == nil {
+		return StreamConfig{}, fmt.Errorf("stream configuration invalid")
+	}
+	if !isValidName(config.Name) {
+		return StreamConfig{}, fmt.Errorf("stream name is required and can not contain '.', '*', '>'")
+	}
+	if len(config.Name) > JSMaxNameLen {
+		return StreamConfig{}, fmt.Errorf("stream name is too long, maximum allowed is %d", JSMaxNameLen)
+	}
+	cfg := *config
+
+	// Make file the default.
+	if cfg.Storage == 0 {
+		cfg.Storage = FileStorage
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+	if cfg.Replicas > StreamMaxReplicas {
+		return cfg, fmt.Errorf("maximum replicas is %d", StreamMaxReplicas)
+	}
+	// A write quorum can only be between a majority and all replicas.
+	if cfg.WriteQuorum != 0 && (cfg.WriteQuorum < cfg.Replicas/2+1 || cfg.WriteQuorum > cfg.Replicas) {
+		return cfg, fmt.Errorf("write quorum must be between %d and %d", cfg.Replicas/2+1, cfg.Replicas)
+	}
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.MaxMsgSize == 0 {
+		cfg.MaxMsgSize = -1
+	}
+	if cfg.MaxConsumers == 0 {
+		cfg.MaxConsumers = -1
+	}
+	if cfg.Duplicates == 0 {
+		if cfg.MaxAge != 0 && cfg.MaxAge < StreamDefaultDuplicatesWindow {
+			cfg.Duplicates = cfg.MaxAge
+		} else {
+			cfg.Duplicates = StreamDefaultDuplicatesWindow
+		}
+	} else if cfg.Duplicates < 0 {
+		return StreamConfig{}, fmt.Errorf("duplicates window can not be negative")
+	}
+	// Check that duplicates is not larger then age if set.
+	if cfg.MaxAge != 0 && cfg.Duplicates > cfg.MaxAge {
+		return StreamConfig{}, fmt.Errorf("duplicates window can not be larger then max age")
+	}
+	if cfg.MaxStreamIdle < 0 {
+		return StreamConfig{}, fmt.Errorf("max stream idle can not be negative")
+	}
+	if cfg.CatchupRate < 0 {
+		return StreamConfig{}, fmt.Errorf("catchup rate can not be negative")
+	}
+	if mlen := metadataSize(cfg.Metadata); mlen > JSMaxMetadataLen {
+		return StreamConfig{}, fmt.Errorf("stream metadata size of %d exceeds maximum of %d", mlen, JSMaxMetadataLen)
+	}
+	for _, subjects := range [][]string{cfg.AllowSubjects, cfg.DenySubjects} {
+		for _, subj := range subjects {
+			if !IsValidSubject(subj) {
+				return StreamConfig{}, fmt.Errorf("invalid publish acl subject %q", subj)
+			}
+		}
+	}
+	if cfg.Mirror != nil {
+		if !isValidName(cfg.Mirror.Name) {
+			return StreamConfig{}, fmt.Errorf("mirror stream name is invalid")
+		}
+		if cfg.Mirror.Name == cfg.Name {
+			return StreamConfig{}, fmt.Errorf("stream can not mirror itself")
+		}
+		if len(cfg.Subjects) > 0 {
+			return StreamConfig{}, fmt.Errorf("stream mirrors can not also contain subjects")
+		}
+		if cfg.Mirror.FilterSubject != _EMPTY_ && !IsValidSubject(cfg.Mirror.FilterSubject) {
+			return StreamConfig{}, fmt.Errorf("mirror filter subject is invalid")
+		}
+	}
+	if rp := cfg.RePublish; rp != nil {
+		if rp.Source != _EMPTY_ && !IsValidSubject(rp.Source) {
+			return StreamConfig{}, fmt.Errorf("republish source is invalid")
+		}
+		if !IsValidLiteralSubject(rp.Destination) {
+			return StreamConfig{}, fmt.Errorf("republish destination needs to be a literal subject")
+		}
+		for _, subj := range cfg.Subjects {
+			if subjectIsSubsetMatch(rp.Destination, subj) {
+				return StreamConfig{}, fmt.Errorf("republish destination forms a cycle with stream subjects")
+			}
+		}
+	}
+	if cfg.SubjectTransform != nil {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, fmt.Errorf("stream mirrors can not have a subject transform")
+		}
+		if _, err := newStreamTransform(cfg.SubjectTransform); err != nil {
+			return StreamConfig{}, fmt.Errorf("subject transform is invalid")
+		}
+	}
+	if len(cfg.RequiredHeaders) > 0 {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, fmt.Errorf("stream mirrors can not have required headers")
+		}
+		for _, h := range cfg.RequiredHeaders {
+			if h == _EMPTY_ || strings.ContainsAny(h, " \t\r\n:") {
+				return StreamConfig{}, fmt.Errorf("required header %q is invalid", h)
+			}
+		}
+	}
+	if rl := cfg.PublishRateLimit; rl != nil {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, fmt.Errorf("stream mirrors can not have a publish rate limit")
+		}
+		if rl.Msgs < 0 || rl.Bytes < 0 || rl.Burst < 0 {
+			return StreamConfig{}, fmt.Errorf("publish rate limit values can not be negative")
+		}
+		if rl.Msgs == 0 && rl.Bytes == 0 {
+			return StreamConfig{}, fmt.Errorf("publish rate limit needs a message or byte rate")
+		}
+	}
+	if cfg.AckFloorRetention && cfg.Retention != InterestPolicy {
+		return StreamConfig{}, fmt.Errorf("ack floor retention requires interest retention")
+	}
+	if cfg.DenyDelete && cfg.MaxStreamIdle > 0 {
+		return StreamConfig{}, fmt.Errorf("stream with deny delete can not have max stream idle")
+	}
+	if cfg.MaxMsgsPerSubject < 0 {
+		return StreamConfig{}, fmt.Errorf("max messages per subject can not be negative")
+	}
+
+	if len(cfg.Subjects) == 0 {
+		// Mirrors only receive messages from their source.
+		if !cfg.allowNoSubject && cfg.Mirror == nil {
+			cfg.Subjects = append(cfg.Subjects, cfg.Name)
+		}
+	} else {
+		// We can allow overlaps, but don't allow direct duplicates.
+		dset := make(map[string]struct{}, len(cfg.Subjects))
+		for _, subj := range cfg.Subjects {
+			if _, ok := dset[subj]; ok {
+				return StreamConfig{}, fmt.Errorf("duplicate subjects detected")
+			}
+			// Also check to make sure we do not overlap with our $JS API subjects.
+			if subjectIsSubsetMatch(subj, "$JS.API.>") {
+				return StreamConfig{}, fmt.Errorf("subjects overlap with jetstream api")
+			}
+
+			dset[subj] = struct{}{}
+		}
+	}
+	return cfg, nil
+}
+
+// Config returns the stream's configuration.
+func (mset *Stream) Config() StreamConfig {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return mset.config
+}
+
+func (mset *Stream) FileStoreConfig() (FileStoreConfig, error) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	store := mset.store
+	if cs, ok := store.(*compressedStore); ok {
+		store = cs.StreamStore
+	}
+	fs, ok := store.(*fileStore)
+	if !ok {
+		return FileStoreConfig{}, ErrStoreWrongType
+	}
+	return fs.fileStoreConfig(), nil
+}
+
+// Delete deletes a stream from the owning account.
+func (mset *Stream) Delete() error {
+	return mset.delete()
+}
+
+// Update will allow certain configuration properties of an existing stream to be updated.
+func (mset *Stream) Update(config *StreamConfig) error {
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return err
+	}
+	o_cfg := mset.Config()
+
+	// Name must match.
+	if cfg.Name != o_cfg.Name {
+		return fmt.Errorf("stream configuration name must match original")
+	}
+	// Can't change MaxConsumers for now.
+	if cfg.MaxConsumers != o_cfg.MaxConsumers {
+		return fmt.Errorf("stream configuration update can not change MaxConsumers")
+	}
+	// Can't change storage types.
+	if cfg.Storage != o_cfg.Storage {
+		return fmt.Errorf("stream configuration update can not change storage type")
+	}
+	// Can't change retention.
+	if cfg.Retention != o_cfg.Retention {
+		return fmt.Errorf("stream configuration update can not change retention policy")
+	}
+	// Can not have a template owner for now.
+	if o_cfg.Template != "" {
+		return fmt.Errorf("stream configuration update not allowed on template owned stream")
+	}
+	if cfg.Template != "" {
+		return fmt.Errorf("stream configuration update can not be owned by a template")
+	}
+	// Sealing is permanent.
+	if o_cfg.Sealed && !cfg.Sealed {
+		return fmt.Errorf("stream configuration update can not unseal a sealed stream")
+	}
+	// Only republish new messages when republish is added.
+	// When clustered the leader's cursor is replicated to the others.
+	if o_cfg.RePublish == nil && cfg.RePublish != nil {
+		mset.mu.Lock()
+		if mset.isLeader() {
+			mset.rpseq = mset.lseq
+		}
+		mset.mu.Unlock()
+	}
+	// Can't change mirror configuration.
+	if (cfg.Mirror == nil) != (o_cfg.Mirror == nil) || (cfg.Mirror != nil && *cfg.Mirror != *o_cfg.Mirror) {
+		return fmt.Errorf("stream configuration update can not change mirror")
+	}
+	// Stored messages are all in one form or the other.
+	if cfg.Compression != o_cfg.Compression {
+		return fmt.Errorf("stream configuration update can not change compression")
+	}
+	// The write quorum is fixed when the raft group is created.
+	if cfg.WriteQuorum != o_cfg.WriteQuorum {
+		return fmt.Errorf("stream configuration update can not change write quorum")
+	}
+
+	// Check limits.
+	mset.mu.Lock()
+	jsa := mset.jsa
+	mset.mu.Unlock()
+
+	jsa.mu.Lock()
+	if cfg.MaxConsumers > 0 && cfg.MaxConsumers > jsa.limits.MaxConsumers {
+		jsa.mu.Unlock()
+		return fmt.Errorf("stream configuration maximum consumers exceeds account limit")
+	}
+	if cfg.MaxBytes > 0 && cfg.MaxBytes > o_cfg.MaxBytes {
+		if err := jsa.checkBytesLimits(cfg.MaxBytes*int64(cfg.Replicas), cfg.Storage); err != nil {
+			jsa.mu.Unlock()
+			return err
+		}
+	}
+	jsa.mu.Unlock()
+
+	// Now check for subject interest differences.
+	current := make(map[string]struct{}, len(o_cfg.Subjects))
+	for _, s := range o_cfg.Subjects {
+		current[s] = struct{}{}
+	}
+	// Update config with new values. The store update will enforce any stricter limits.
+	mset.mu.Lock()
+
+	// Now walk new subjects. All of these need to be added, but we will check
+	// the originals first, since if it is in there we can skip, already added.
+	for _, s := range cfg.Subjects {
+		if _, ok := current[s]; !ok {
+			if _, err := mset.subscribeInternal(s, mset.processInboundJetStreamMsg); err != nil {
+				mset.mu.Unlock()
+				return err
+			}
+		}
+		delete(current, s)
+	}
+	// What is left in current needs to be deleted.
+	for s := range current {
+		if err := mset.unsubscribeInternal(s); err != nil {
+			mset.mu.Unlock()
+			return err
+		}
+	}
+
+	// Check for the Duplicates
+	if cfg.Duplicates != o_cfg.Duplicates && mset.ddtmr != nil {
+		// Let it fire right away, it will adjust properly on purge.
+		mset.ddtmr.Reset(time.Microsecond)
+	}
+	// Now update config and store's version of our config.
+	mset.config = cfg
+	mset.itr, _ = newStreamTransform(cfg.SubjectTransform)
+	if !reflect.DeepEqual(cfg.PublishRateLimit, o_cfg.PublishRateLimit) {
+		mset.mrl, mset.brl = newStreamRateLimiters(cfg.PublishRateLimit)
+	}
+	// Rebuild our per subject index if the limit changed, we do not track it while unset.
+	if cfg.MaxMsgsPerSubject != o_cfg.MaxMsgsPerSubject {
+		mset.lvs = nil
+	}
+
+	var suppress bool
+	if mset.isClustered() && mset.sa != nil {
+		suppress = mset.sa.responded
+	}
+	if !suppress {
+		mset.sendUpdateAdvisoryLocked()
+	}
+	scfg := mset.storeConfig()
+	mset.mu.Unlock()
+
+	mset.store.UpdateConfig(&scfg)
+
+	// Remove what our retention policy would have while it was held.
+	if o_cfg.RetentionHold && !cfg.RetentionHold {
+		mset.releaseHeldRetention()
+	}
+
+	return nil
+}
+
+// Purge will remove all messages from the stream and underlying store.
+func (mset *Stream) Purge() (uint64, error) {
+	mset.mu.Lock()
+	if mset.client == nil {
+		mset.mu.Unlock()
+		return 0, errors.New("stream closed")
+	}
+	// Purge dedupe.
+	mset.ddmap = nil
+	mset.lvs = nil
+	mset.lss, mset.lssOff = nil, false
+	var _obs [4]*Consumer
+	obs := _obs[:0]
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	mset.mu.Unlock()
+
+	purged, err := mset.store.Purge()
+	if err != nil {
+		return purged, err
+	}
+	stats := mset.store.State()
+	for _, o := range obs {
+		o.purge(stats.FirstSeq)
+	}
+	return purged, nil
+}
+
+// expireTo will remove all messages below seq, as proposed by the leader for age expiry or ack floor retention.
+// Returns the number of messages removed and the first sequence removed.
+func (mset *Stream) expireTo(seq uint64) (uint64, uint64, error) {
+	mset.mu.Lock()
+	if mset.client == nil {
+		mset.mu.Unlock()
+		return 0, 0, errors.New("stream closed")
+	}
+	store := mset.store
+	mset.lvs = nil
+	var _obs [4]*Consumer
+	obs := _obs[:0]
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	mset.mu.Unlock()
+
+	first := store.State().FirstSeq
+	if seq <= first {
+		return 0, 0, nil
+	}
+	expired, err := store.Compact(seq)
+	if err != nil {
+		return expired, first, err
+	}
+	stats := store.State()
+	for _, o := range obs {
+		o.purge(stats.FirstSeq)
+	}
+	return expired, first, nil
+}
+
+// trackPerSubject will record seq as the newest message for subject and return the oldest ones that now
+// put the subject over MaxMsgsPerSubject. Only applies when MaxMsgsPerSubject is set. We build our index
+// from the store on first use. This only depends on what has been applied, so replicas agree.
+// When clustered the oldest ones stay tracked until their deletes are applied, and only the leader
+// gets them back, once each, to propose.
+func (mset *Stream) trackPerSubject(subject string, seq uint64, clustered, isLeader bool) []uint64 {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	max, hold := int(mset.config.MaxMsgsPerSubject), mset.config.RetentionHold
+	if max <= 0 {
+		return nil
+	}
+	// A new leader will propose anything still pending again.
+	if !isLeader {
+		mset.lvp = nil
+	}
+	if mset.lvs == nil {
+		mset.lvs = make(map[string][]uint64)
+		mset.lvp = nil
+		state := mset.store.State()
+		for lseq := state.FirstSeq; lseq > 0 && lseq <= state.LastSeq && lseq < seq; lseq++ {
+			if subj, _, _, _, err := mset.store.LoadMsg(lseq); err == nil {
+				mset.lvs[subj] = append(mset.lvs[subj], lseq)
+			}
+		}
+	}
+	seqs := append(mset.lvs[subject], seq)
+	var evict []uint64
+	// Keep tracking while held, the excess is removed with the next message once lifted.
+	for i := 0; !hold && len(seqs)-i > max; {
+		old := seqs[i]
+		// Drop any already removed, e.g. by limits, deletes or our proposals once applied, they do not count.
+		if _, _, _, _, err := mset.store.LoadMsg(old); err != nil {
+			seqs = append(seqs[:i], seqs[i+1:]...)
+			delete(mset.lvp, old)
+			continue
+		}
+		if !clustered {
+			evict = append(evict, old)
+			seqs = seqs[1:]
+			continue
+		}
+		if _, ok := mset.lvp[old]; isLeader && !ok {
+			if mset.lvp == nil {
+				mset.lvp = make(map[uint64]struct{})
+			}
+			mset.lvp[old] = struct{}{}
+			evict = append(evict, old)
+		}
+		i++
+	}
+	mset.lvs[subject] = seqs
+	return evict
+}
+
+// perSubjectDeleteSkipped is called when a proposed per subject delete was not applied,
+// so the leader will propose it again if still needed.
+func (mset *Stream) perSubjectDeleteSkipped(seq uint64) {
+	mset.mu.Lock()
+	delete(mset.lvp, seq)
+	mset.mu.Unlock()
+}
+
+// Upper bound on subjects we will index for last sequence requests.
+const maxLastSeqSubjects = 256 * 1024
+
+// LastSeqForSubject returns the sequence of the last message stored for subject, or 0 if there is none.
+// This only depends on our store so every replica gives the same answer for the entries it has applied.
+func (mset *Stream) LastSeqForSubject(subject string) uint64 {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	if mset.lss == nil && !mset.lssOff {
+		mset.buildLastSeqIndex()
+	}
+	if mset.lss == nil {
+		return mset.scanLastSeq(subject, mset.store.State().LastSeq+1)
+	}
+	seq := mset.lss[subject]
+	if seq == 0 {
+		return 0
+	}
+	if subj, _, _, _, err := mset.store.LoadMsg(seq); err == nil && subj == subject {
+		return seq
+	}
+	// Our last one was removed, look for the one before it.
+	if seq = mset.scanLastSeq(subject, seq); seq == 0 {
+		delete(mset.lss, subject)
+	} else {
+		mset.lss[subject] = seq
+	}
+	return seq
+}
+
+// Lock should be held.
+func (mset *Stream) buildLastSeqIndex() {
+	lss := make(map[string]uint64)
+	state := mset.store.State()
+	for seq := state.FirstSeq; seq > 0 && seq <= state.LastSeq; seq++ {
+		if subj, _, _, _, err := mset.store.LoadMsg(seq); err == nil {
+			lss[subj] = seq
+			if len(lss) > maxLastSeqSubjects {
+				mset.lssOff = true
+				return
+			}
+		}
+	}
+	mset.lss = lss
+}
+
+// scanLastSeq will walk back from just below seq looking for the last message on subject.
+// Lock should be held.
+func (mset *Stream) scanLastSeq(subject string, seq uint64) uint64 {
+	for first := mset.store.State().FirstSeq; seq > first; {
+		seq--
+		if subj, _, _, _, err := mset.store.LoadMsg(seq); err == nil && subj == subject {
+			return seq
+		}
+	}
+	return 0
+}
+
+// trackLastSeq will record seq as the last message for subject if we are indexing.
+func (mset *Stream) trackLastSeq(subject string, seq uint64) {
+	mset.mu.Lock()
+	if mset.lss != nil {
+		mset.lss[subject] = seq
+		if len(mset.lss) > maxLastSeqSubjects {
+			mset.lss, mset.lssOff = nil, true
+		}
+	}
+	mset.mu.Unlock()
+}
+
+// subjectAllowed checks subject against the stream's allow and deny lists.
+// Deny takes precedence. An empty allow list allows all subjects.
+// Lock should be held.
+func (mset *Stream) subjectAllowed(subject string) bool {
+	for _, deny := range mset.config.DenySubjects {
+		if subjectIsSubsetMatch(subject, deny) {
+			return false
+		}
+	}
+	if len(mset.config.AllowSubjects) == 0 {
+		return true
+	}
+	for _, allow := range mset.config.AllowSubjects {
+		if subjectIsSubsetMatch(subject, allow) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// How long we wait for a response from the mirror's source.
+	mirrorRequestTimeout = 2 * time.Second
+	// How long we wait before polling again once caught up or on errors.
+	mirrorPollInterval = time.Second
+	// How often the mirror leader persists the last mirrored sequence.
+	mirrorPersistInterval = 5 * time.Second
+	// File in the stream's directory holding the last mirrored sequence.
+	mirrorSeqFile = "mirror.inf"
+)
+
+// mirrorResponse is a response from the mirror's source along with the reply subject it was sent to.
+type mirrorResponse struct {
+	subject string
+	msg     []byte
+}
+
+// isMsgNotFoundErr returns true if the source told us the message is not there,
+// either a gap from a delete or purge or past its last sequence.
+func isMsgNotFoundErr(e *ApiError) bool {
+	if e == nil {
+		return false
+	}
+	switch e.Description {
+	case ErrStoreMsgNotFound.Error(), ErrStoreEOF.Error(), errDeletedMsg.Error():
+		return true
+	}
+	return false
+}
+
+// mirrorLastSeq returns the last source sequence we have applied.
+// Lock should be held.
+func (mset *Stream) mirrorLastSeq() uint64 {
+	return mset.mlseq
+}
+
+// setMirrorSeq will move our last mirrored sequence forward, e.g. from a snapshot or catchup.
+func (mset *Stream) setMirrorSeq(seq uint64) {
+	mset.mu.Lock()
+	if seq > mset.mlseq {
+		mset.mlseq = seq
+	}
+	mset.mu.Unlock()
+}
+
+// mirrorSeqPath returns where we persist our last mirrored sequence, empty if not a file based mirror.
+// Lock should be held.
+func (mset *Stream) mirrorSeqPath() string {
+	if mset.config.Mirror == nil || mset.config.Storage != FileStorage || mset.jsa == nil {
+		return _EMPTY_
+	}
+	return path.Join(mset.jsa.storeDir, streamsDir, mset.config.Name, mirrorSeqFile)
+}
+
+// loadMirrorSeq will recover the last mirrored sequence we persisted.
+// Lock should be held.
+func (mset *Stream) loadMirrorSeq() {
+	fn := mset.mirrorSeqPath()
+	if fn == _EMPTY_ {
+		return
+	}
+	if b, err := ioutil.ReadFile(fn); err == nil {
+		if n := parseInt64(bytes.TrimSpace(b)); n > 0 {
+			mset.mlseq, mset.mpseq = uint64(n), uint64(n)
+		}
+	}
+}
+
+// storeMirrorSeq will persist our last mirrored sequence if it has moved.
+func (mset *Stream) storeMirrorSeq() {
+	mset.mu.Lock()
+	fn, seq := mset.mirrorSeqPath(), mset.mlseq
+	if fn == _EMPTY_ || seq == mset.mpseq {
+		mset.mu.Unlock()
+		return
+	}
+	mset.mpseq = seq
+	mset.mu.Unlock()
+
+	if err := ioutil.WriteFile(fn, []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		mset.srv.Warnf("JetStream unable to persist mirror sequence for stream '%s > %s': %v", mset.jsa.acc().Name, mset.Name(), err)
+	}
+}
+
+// Lock should be held.
+func (mset *Stream) stopMirror() {
+	if mset.mqch != nil {
+		close(mset.mqch)
+		mset.mqch = nil
+	}
+}
+
+// setMirrorHeader will place the source sequence first in the headers so it
+// takes precedence over one from a source that is itself a mirror.
+func setMirrorHeader(hdr []byte, seq uint64) []byte {
+	return prependHeader(hdr, JSMirrorSeq, strconv.FormatUint(seq, 10))
+}
+
+// prependHeader will place key and value first in hdr, creating hdr if needed.
+// Since lookups find the first match this overrides any existing value for key.
+func prependHeader(hdr []byte, key, value string) []byte {
+	const hdrLine = "NATS/1.0\r\n"
+	var bb bytes.Buffer
+	bb.WriteString(hdrLine)
+	bb.WriteString(key + ": " + value + CR_LF)
+	if len(hdr) > len(hdrLine) && bytes.HasPrefix(hdr, []byte(hdrLine)) {
+		bb.Write(hdr[len(hdrLine):])
+	} else {
+		bb.WriteString(CR_LF)
+	}
+	return bb.Bytes()
+}
+
+// processMirror runs on the stream leader and copies messages from our source stream.
+// We use the message get API so the source can be served by its own leader when clustered.
+// We resume from the last mirrored sequence in our replicated store on a leader change.
+func (mset *Stream) processMirror(qch chan struct{}) {
+	s := mset.srv
+	defer s.grWG.Done()
+
+	mset.mu.Lock()
+	source := *mset.config.Mirror
+	name, sendq, isClustered := mset.config.Name, mset.sendq, mset.node != nil
+	respC := make(chan *mirrorResponse, 1)
+	reply := fmt.Sprintf(jsMirrorReplyT, name, nuid.Next())
+	_, err := mset.subscribeInternal(reply+".*", func(_ *subscription, c *client, subject, _ string, rmsg []byte) {
+		_, msg := c.msgParts(rmsg)
+		select {
+		case respC <- &mirrorResponse{subject, append(msg[:0:0], msg...)}:
+		default:
+		}
+	})
+	next := mset.mirrorLastSeq() + 1
+	mset.mu.Unlock()
+
+	if err != nil {
+		s.Warnf("JetStream unable to start mirror for stream '%s > %s': %v", mset.jsa.acc().Name, name, err)
+		return
+	}
+	defer func() {
+		mset.mu.Lock()
+		mset.unsubscribeInternal(reply + ".*")
+		mset.mu.Unlock()
+		mset.storeMirrorSeq()
+	}()
+
+	// request will send body to subject and return the response or nil on timeout or quit.
+	// Each request has its own reply subject so a late response to an earlier one is dropped.
+	// Our internal client does not carry client info, so we tell the API which account is asking.
+	var rid uint64
+	ci, _ := json.Marshal(&ClientInfo{Account: mset.jsa.acc().Name})
+	hdr := prependHeader(nil, ClientInfoHdr, string(ci))
+	request := func(subject string, body []byte) []byte {
+		rid++
+		rsubj := reply + "." + strconv.FormatUint(rid, 10)
+		select {
+		case sendq <- &jsPubMsg{subject, _EMPTY_, rsubj, hdr, body, nil, 0}:
+		case <-qch:
+			return nil
+		}
+		timeout := time.NewTimer(mirrorRequestTimeout)
+		defer timeout.Stop()
+		for {
+			select {
+			case resp := <-respC:
+				if resp.subject == rsubj {
+					return resp.msg
+				}
+			case <-timeout.C:
+				return nil
+			case <-qch:
+				return nil
+			}
+		}
+	}
+
+	// Wait is used on errors or when we are caught up.
+	wait := func() bool {
+		select {
+		case <-qch:
+			return false
+		case <-s.quitCh:
+			return false
+		case <-time.After(mirrorPollInterval):
+			return true
+		}
+	}
+
+	getSubj := fmt.Sprintf(JSApiMsgGetT, source.Name)
+	infoSubj := fmt.Sprintf(JSApiStreamInfoT, source.Name)
+	lpt := time.Now()
+
+	for {
+		select {
+		case <-qch:
+			return
+		case <-s.quitCh:
+			return
+		default:
+		}
+		if time.Since(lpt) > mirrorPersistInterval {
+			mset.storeMirrorSeq()
+			lpt = time.Now()
+		}
+
+		var resp JSApiMsgGetResponse
+		req, _ := json.Marshal(&JSApiMsgGetRequest{Seq: next})
+		b := request(getSubj, req)
+		if b == nil || json.Unmarshal(b, &resp) != nil {
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if resp.Error != nil || resp.Message == nil {
+			// Anything but not found, e.g. the source is not current or not available, we retry the same sequence.
+			if !isMsgNotFoundErr(resp.Error) {
+				if !wait() {
+					return
+				}
+				continue
+			}
+			// Could be a gap from a delete or purge, or we could be caught up.
+			var si JSApiStreamInfoResponse
+			if b := request(infoSubj, nil); b == nil || json.Unmarshal(b, &si) != nil || si.StreamInfo == nil {
+				if !wait() {
+					return
+				}
+				continue
+			}
+			state := si.State
+			if next < state.FirstSeq {
+				next = state.FirstSeq
+			} else if next <= state.LastSeq {
+				next++
+			} else if !wait() {
+				return
+			}
+			continue
+		}
+
+		sm := resp.Message
+		if source.FilterSubject == _EMPTY_ || subjectIsSubsetMatch(sm.Subject, source.FilterSubject) {
+			hdr := setMirrorHeader(sm.Header, sm.Sequence)
+			if isClustered {
+				err = mset.processClusteredInboundMsg(sm.Subject, _EMPTY_, hdr, sm.Data)
+			} else {
+				err = mset.processJetStreamMsg(sm.Subject, _EMPTY_, hdr, sm.Data, 0, 0, 0)
+			}
+			if err != nil && err != errMirrorDuplicate {
+				// Resync from what has been applied.
+				mset.mu.Lock()
+				next = mset.mirrorLastSeq() + 1
+				mset.mu.Unlock()
+				if !wait() {
+					return
+				}
+				continue
+			}
+		}
+		next = sm.Sequence + 1
+	}
+}
+
+// republishPending will republish any stored messages past our last republished sequence.
+func (mset *Stream) republishPending() {
+	mset.mu.Lock()
+	rp, sendq, name := mset.config.RePublish, mset.sendq, mset.config.Name
+	if rp == nil || mset.store == nil || sendq == nil {
+		mset.mu.Unlock()
+		return
+	}
+	state := mset.store.State()
+	start := mset.rpseq + 1
+	if start < state.FirstSeq {
+		start = state.FirstSeq
+	}
+	if start > state.LastSeq {
+		mset.mu.Unlock()
+		return
+	}
+	var pms []*jsPubMsg
+	for seq := start; seq <= state.LastSeq; seq++ {
+		subj, hdr, msg, _, err := mset.store.LoadMsg(seq)
+		if err != nil || (rp.Source != _EMPTY_ && !subjectIsSubsetMatch(subj, rp.Source)) {
+			continue
+		}
+		hdr = prependHeader(hdr, JSSequence, strconv.FormatUint(seq, 10))
+		hdr = prependHeader(hdr, JSSubject, subj)
+		hdr = prependHeader(hdr, JSStream, name)
+		pms = append(pms, &jsPubMsg{rp.Destination, _EMPTY_, _EMPTY_, hdr, msg, nil, 0})
+	}
+	mset.rpseq = state.LastSeq
+	mset.mu.Unlock()
+
+	for _, pm := range pms {
+		sendq <- pm
+	}
+}
+
+// rePublished returns our last republished sequence.
+func (mset *Stream) rePublished() uint64 {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.rpseq
+}
+
+// setRePublished will move our last republished sequence forward.
+func (mset *Stream) setRePublished(seq uint64) {
+	mset.mu.Lock()
+	if seq > mset.rpseq {
+		mset.rpseq = seq
+	}
+	mset.mu.Unlock()
+}
+
+func metadataSize(md map[string]string) int {
+	var sz int
+	for k, v := range md {
+		sz += len(k) + len(v)
+	}
+	return sz
+}
+
+// RemoveMsg will remove a message from a stream.
+// FIXME(dlc) - Should pick one and be consistent.
+func (mset *Stream) RemoveMsg(seq uint64) (bool, error) {
+	return mset.removeMsg(seq, false)
+}
+
+// DeleteMsg will remove a message from a stream.
+func (mset *Stream) DeleteMsg(seq uint64) (bool, error) {
+	return mset.removeMsg(seq, false)
+}
+
+// EraseMsg will securely remove a message and rewrite the data with random data.
+func (mset *Stream) EraseMsg(seq uint64) (bool, error) {
+	return mset.removeMsg(seq, true)
+}
+
+func (mset *Stream) removeMsg(seq uint64, secure bool) (bool, error) {
+	mset.mu.RLock()
+	if mset.client == nil {
+		mset.mu.RUnlock()
+		return false, fmt.Errorf("invalid stream")
+	}
+	mset.mu.RUnlock()
+	if secure {
+		return mset.store.EraseMsg(seq)
+	} else {
+		return mset.store.RemoveMsg(seq)
+	}
+}
+
+// Will create internal subscriptions for the stream.
+// Lock should be held.
+func (mset *Stream) subscribeToStream() error {
+	if mset.active {
+		return nil
+	}
+	for _, subject := range mset.config.Subjects {
+		if _, err := mset.subscribeInternal(subject, mset.processInboundJetStreamMsg); err != nil {
+			return err
+		}
+	}
+	mset.active = true
+	return nil
+}
+
+// Will unsubscribe from the stream.
+// Lock should be held.
+func (mset *Stream) unsubscribeToStream() error {
+	for _, subject := range mset.config.Subjects {
+		mset.unsubscribeInternal(subject)
+	}
+	mset.active = false
+	return nil
+}
+
+// Lock should be held.
+func (mset *Stream) subscribeInternal(subject string, cb msgHandler) (*subscription, error) {
+	c := mset.client
+	if c == nil {
+		return nil, fmt.Errorf("invalid stream")
+	}
+	if !c.srv.eventsEnabled() {
+		return nil, ErrNoSysAccount
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("undefined message handler")
+	}
+
+	mset.sid++
+
+	// Now create the subscription
+	return c.processSub([]byte(subject), nil, []byte(strconv.Itoa(mset.sid)), cb, false)
+}
+
+// Helper for unlocked stream.
+func (mset *Stream) subscribeInternalUnlocked(subject string, cb msgHandler) (*subscription, error) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return mset.subscribeInternal(subject, cb)
+}
+
+// This will unsubscribe us from the exact subject given.
+// We do not currently track the subs so do not have the sid.
+// This should be called only on an update.
+// Lock should be held.
+func (mset *Stream) unsubscribeInternal(subject string) error {
+	c := mset.client
+	if c == nil {
+		return fmt.Errorf("invalid stream")
+	}
+
+	var sid []byte
+	c.mu.Lock()
+	for _, sub := range c.subs {
+		if subject == string(sub.subject) {
+			sid = sub.sid
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if sid != nil {
+		return c.processUnsub(sid)
+	}
+	return nil
+}
+
+// Lock should be held.
+func (mset *Stream) unsubscribe(sub *subscription) {
+	if sub == nil || mset.client == nil {
+		return
+	}
+	mset.client.unsubscribe(mset.client.acc, sub, true, true)
+}
+
+func (mset *Stream) unsubscribeUnlocked(sub *subscription) {
+	mset.mu.Lock()
+	mset.unsubscribe(sub)
+	mset.mu.Unlock()
+}
+
+func (mset *Stream) setupStore(fsCfg *FileStoreConfig) error {
+	mset.mu.Lock()
+	mset.created = time.Now().UTC()
+
+	cfg := mset.storeConfig()
+	switch mset.config.Storage {
+	case MemoryStorage:
+		ms, err := newMemStore(&cfg)
+		if err != nil {
+			mset.mu.Unlock()
+			return err
+		}
+		mset.store = ms
+	case FileStorage:
+		fs, _, err := newFileStoreWithCreated(*fsCfg, cfg, mset.created)
+		if err != nil {
+			mset.mu.Unlock()
+			return err
+		}
+		mset.store = fs
+	}
+	if mset.config.Compression == S2Compression {
+		mset.store = &compressedStore{mset.store}
+	}
+	mset.mu.Unlock()
+
+	mset.store.RegisterStorageUpdates(mset.storeUpdates)
+
+	return nil
+}
+
+// storeConfig returns the config for our store. When the leader drives age expiry
+// the store does not expire messages itself.
+// Lock should be held.
+func (mset *Stream) storeConfig() StreamConfig {
+	cfg := mset.config
+	if mset.ldage {
+		cfg.MaxAge = 0
+	}
+	// While retention is held the store keeps everything. Going over our limits either
+	// grows the stream or, with HoldRejectWrites, rejects new messages like DiscardNew.
+	if cfg.RetentionHold {
+		cfg.MaxAge = 0
+		if cfg.HoldRejectWrites {
+			cfg.Discard = DiscardNew
+		} else {
+			cfg.MaxMsgs, cfg.MaxBytes = -1, -1
+		}
+	}
+	return cfg
+}
+
+// retentionHeld returns if all retention is suspended, see RetentionHold.
+func (mset *Stream) retentionHeld() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.config.RetentionHold
+}
+
+// Called for any updates to the underlying stream. We pass through the bytes to the
+// jetstream account. We do local processing for stream pending for consumers, but only
+// for removals.
+// Lock should not be held.
+func (mset *Stream) storeUpdates(md, bd int64, seq uint64, subj string) {
+	// If we have a single negative update then we will process our consumers for stream pending.
+	// Purge and Store handled separately inside individual calls.
+	if md == -1 && seq > 0 {
+		mset.mu.RLock()
+		for _, o := range mset.consumers {
+			o.decStreamPending(seq, subj)
+		}
+		mset.mu.RUnlock()
+	}
+
+	if mset.jsa != nil {
+		mset.jsa.updateUsage(mset.config.Storage, bd)
+	}
+}
+
+// NumMsgIds returns the number of message ids being tracked for duplicate suppression.
+func (mset *Stream) NumMsgIds() int {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return len(mset.ddmap)
+}
+
+// checkMsgId will process and check for duplicates.
+// Lock should be held.
+func (mset *Stream) checkMsgId(id string) *ddentry {
+	if id == "" || mset.ddmap == nil {
+		return nil
+	}
+	return mset.ddmap[id]
+}
+
+// Will purge the entries that are past the window.
+// Should be called from a timer.
+func (mset *Stream) purgeMsgIds() {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	tmrNext := mset.config.Duplicates
+	window := int64(tmrNext)
+
+	for i, dde := range mset.ddarr[mset.ddindex:] {
+		if now-dde.ts >= window {
+			delete(mset.ddmap, dde.id)
+		} else {
+			mset.ddindex += i
+			// Check if we should garbage collect here if we are 1/3 total size.
+			if cap(mset.ddarr) > 3*(len(mset.ddarr)-mset.ddindex) {
+				mset.ddarr = append([]*ddentry(nil), mset.ddarr[mset.ddindex:]...)
+				mset.ddindex = 0
+			}
+			tmrNext = time.Duration(window - (now - dde.ts))
+			break
+		}
+	}
+	if len(mset.ddmap) > 0 {
+		// Make sure to not fire too quick
+		const minFire = 50 * time.Millisecond
+		if tmrNext < minFire {
+			tmrNext = minFire
+		}
+		mset.ddtmr.Reset(tmrNext)
+	} else {
+		mset.ddtmr.Stop()
+		mset.ddtmr = nil
+	}
+}
+
+// storeMsgId will store the message id for duplicate detection.
+func (mset *Stream) storeMsgId(dde *ddentry) {
+	mset.mu.Lock()
+	if mset.ddmap == nil {
+		mset.ddmap = make(map[string]*ddentry)
+	}
+	if mset.ddtmr == nil {
+		mset.ddtmr = time.AfterFunc(mset.config.Duplicates, mset.purgeMsgIds)
+	}
+	mset.ddmap[dde.id] = dde
+	mset.ddarr = append(mset.ddarr, dde)
+	mset.mu.Unlock()
+}
+
+// Will return the value for the header denoted by key or nil if it does not exists.
+// This function ignores errors and tries to achieve speed and no additional allocations.
+func getHdrVal(key string, hdr []byte) []byte {
+	index := bytes.Index(hdr, []byte(key))
+	if index < 0 {
+		return nil
+	}
+
+	var value []byte
+	hdrLen := len(hdr)
+	index += len(key) + 1
+	for hdr[index] == ' ' && index < hdrLen {
+		index++
+	}
+	for index < hdrLen {
+		if hdr[index] == '\r' && index < hdrLen-1 && hdr[index+1] == '\n' {
+			break
+		}
+		value = append(value, hdr[index])
+		index++
+	}
+	return value
+}
+
+// Fast lookup of msgId.
+func getMsgId(hdr []byte) string {
+	return string(getHdrVal(JSMsgId, hdr))
+}
+
+// Fast lookup of expected last msgId.
+func getExpectedLastMsgId(hdr []byte) string {
+	return string(getHdrVal(JSExpectedLastMsgId, hdr))
+}
+
+// Fast lookup of expected stream.
+func getExpectedStream(hdr []byte) string {
+	return string(getHdrVal(JSExpectedStream, hdr))
+}
+
+// Fast lookup of the source sequence for mirrored msgs.
+func getMirrorSeq(hdr []byte) uint64 {
+	bseq := getHdrVal(JSMirrorSeq, hdr)
+	if len(bseq) == 0 {
+		return 0
+	}
+	if n := parseInt64(bseq); n > 0 {
+		return uint64(n)
+	}
+	return 0
+}
+
+// Fast lookup of expected stream.
+func getExpectedLastSeq(hdr []byte) uint64 {
+	bseq := getHdrVal(JSExpectedLastSeq, hdr)
+	if len(bseq) == 0 {
+		return 0
+	}
+	return uint64(parseInt64(bseq))
+}
+
+// setWritePause will set the deadline of our write pause, 0 resumes writes.
+func (mset *Stream) setWritePause(until int64) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if until > 0 {
+		mset.srv.Noticef("JetStream pausing writes to stream '%s > %s'", mset.jsa.account.Name, mset.config.Name)
+	} else if mset.wpause > 0 {
+		mset.srv.Noticef("JetStream resuming writes to stream '%s > %s'", mset.jsa.account.Name, mset.config.Name)
+	}
+	mset.wpause = until
+}
+
+// writePauseExpired returns true if writes are paused and the pause has passed.
+func (mset *Stream) writePauseExpired() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.wpause > 0 && time.Now().UnixNano() >= mset.wpause
+}
+
+// StreamRateLimit limits the rate of publishes to a stream, enforced on the leader before
+// messages are proposed. Burst is how much of the rate can be used at once, default is one second.
+type StreamRateLimit struct {
+	Msgs  int64         `json:"msgs_per_sec,omitempty"`
+	Bytes int64         `json:"bytes_per_sec,omitempty"`
+	Burst time.Duration `json:"burst,omitempty"`
+}
+
+var errStreamRateLimited = errors.New("stream publish rate limit exceeded")
+
+// newStreamRateLimiters will create the token buckets for the message and byte rates, if set.
+func newStreamRateLimiters(rl *StreamRateLimit) (mrl, brl *rate.Limiter) {
+	if rl == nil {
+		return nil, nil
+	}
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = time.Second
+	}
+	if rl.Msgs > 0 {
+		n := int(float64(rl.Msgs) * burst.Seconds())
+		if n < 1 {
+			n = 1
+		}
+		mrl = rate.NewLimiter(rate.Limit(rl.Msgs), n)
+	}
+	if rl.Bytes > 0 {
+		// A single message always needs to fit in the bucket.
+		n := int(float64(rl.Bytes) * burst.Seconds())
+		if n < MAX_PAYLOAD_SIZE {
+			n = MAX_PAYLOAD_SIZE
+		}
+		brl = rate.NewLimiter(rate.Limit(rl.Bytes), n)
+	}
+	return mrl, brl
+}
+
+// checkRateLimit will take from our publish rate limits and return an error if exceeded.
+// Lock should be held.
+func (mset *Stream) checkRateLimit(subject string, hdr, msg []byte) error {
+	if mset.mrl == nil && mset.brl == nil {
+		return nil
+	}
+	now := time.Now()
+	if mset.mrl != nil && !mset.mrl.AllowN(now, 1) {
+		return errStreamRateLimited
+	}
+	if mset.brl != nil && !mset.brl.AllowN(now, len(subject)+len(hdr)+len(msg)) {
+		return errStreamRateLimited
+	}
+	return nil
+}
+
+// checkRequiredHeaders will make sure the message has a value for each of the stream's required headers.
+// Lock should be held.
+func (mset *Stream) checkRequiredHeaders(hdr []byte) error {
+	for _, h := range mset.config.RequiredHeaders {
+		if len(getHdrVal(h, hdr)) == 0 {
+			return fmt.Errorf("message is missing required header %q", h)
+		}
+	}
+	return nil
+}
+
+// Lock should be held.
+func (mset *Stream) isClustered() bool {
+	return mset.node != nil
+}
+
+// processInboundJetStreamMsg handles processing messages bound for a stream.
+func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subject, reply string, rmsg []byte) {
+	hdr, msg := pc.msgParts(rmsg)
+
+	mset.mu.RLock()
+	isLeader, isClustered := mset.isLeader(), mset.node != nil
+	canRespond, sendq := !mset.config.NoAck && len(reply) > 0, mset.sendq
+	subject, err := mset.transformSubject(subject)
+	mset.mu.RUnlock()
+
+	// If we are not the leader just ignore.
+	if !isLeader {
+		return
+	}
+
+	// The transform is applied here on the leader so every replica stores the same subject.
+	if err != nil {
+		if canRespond {
+			var resp = &JSPubAckResponse{PubAck: &PubAck{Stream: mset.Name()}}
+			resp.Error = &ApiError{Code: 400, Description: err.Error()}
+			response, _ := json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return
+	}
+
+	// If we are clustered we need to propose this message to the underlying raft group.
+	// Single replica streams do not have a raft group and will store directly.
+	if isClustered {
+		mset.processClusteredInboundMsg(subject, reply, hdr, msg)
+	} else {
+		mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0, 0)
+	}
+}
+
+// newStreamTransform will compile the subject transform, if any.
+func newStreamTransform(st *SubjectTransform) (*transform, error) {
+	if st == nil {
+		return nil, nil
+	}
+	return newTransform(st.Source, st.Destination)
+}
+
+// transformSubject returns the subject an inbound message will be stored under.
+// Subjects that do not match the transform source are stored as is.
+// Lock should be held.
+func (mset *Stream) transformSubject(subject string) (string, error) {
+	if mset.itr == nil {
+		return subject, nil
+	}
+	nsubj, err := mset.itr.match(subject)
+	if err == ErrNoTransforms {
+		return subject, nil
+	}
+	if err != nil || !IsValidLiteralSubject(nsubj) {
+		return _EMPTY_, errSubjectTransformInvalid
+	}
+	return nsubj, nil
+}
+
+var errLastSeqMismatch = errors.New("last sequence mismatch")
+var errSubjectTransformInvalid = errors.New("subject transform produced an invalid subject")
+var errStreamSealed = errors.New("stream is sealed")
+var errStreamWritesPaused = errors.New("stream writes are paused")
+var errSubjectNotAllowed = errors.New("subject not allowed by stream")
+var errMirrorDuplicate = errors.New("mirror msg is duplicate")
+
+// processJetStreamMsg is where we try to actually process the stream msg.
+// For clustering index is the raft index of the entry, used to hold pub acks for our ack level.
+func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64, index uint64) error {
+	mset.mu.Lock()
+	store := mset.store
+	c := mset.client
+	if c == nil {
+		mset.mu.Unlock()
+		return nil
+	}
+
+	var accName string
+	if c != nil && c.acc != nil {
+		accName = c.acc.Name
+	}
+
+	doAck := !mset.config.NoAck
+	pubAck := mset.pubAck
+	jsa := mset.jsa
+	stype := mset.config.Storage
+	name := mset.config.Name
+	maxMsgSize := int(mset.config.MaxMsgSize)
+	numConsumers := len(mset.consumers)
+	interestRetention := mset.config.Retention == InterestPolicy
+	ackLevel, node := mset.config.AckLevel, mset.node
+	var ci *ClientInfo
+	if mset.sa != nil {
+		ci = mset.sa.Client
+	}
+	// Snapshot if we are the leader and if we can respond.
+	isLeader := mset.isLeader()
+	canRespond := doAck && len(reply) > 0 && isLeader
+
+	var resp = &JSPubAckResponse{}
+
+	// For clustering the lower layers will pass our expected lseq. If it is present check for that here.
+	// This is from the clustering layers so will not respond here.
+	if lseq > 0 && lseq != (mset.lseq+mset.clfs) {
+		sendq := mset.sendq
+		mset.mu.Unlock()
+		if canRespond && sendq != nil {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 503, Description: "expected stream sequence does not match"}
+			b, _ := json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return errLastSeqMismatch
+	}
+
+	// Sealed streams do not accept new messages.
+	if mset.config.Sealed {
+		sendq := mset.sendq
+		mset.clfs++
+		mset.mu.Unlock()
+		if canRespond && sendq != nil {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: errStreamSealed.Error()}
+			b, _ := json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return errStreamSealed
+	}
+
+	// Single replica streams resume on their own once the pause has passed.
+	if node == nil && mset.wpause > 0 && time.Now().UnixNano() >= mset.wpause {
+		mset.wpause = 0
+	}
+	// Paused streams do not accept new messages. The leader checks before proposing,
+	// this catches messages proposed before the pause was applied.
+	if mset.wpause > 0 {
+		sendq := mset.sendq
+		mset.clfs++
+		mset.mu.Unlock()
+		if canRespond && sendq != nil {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 503, Description: errStreamWritesPaused.Error()}
+			b, _ := json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return errStreamWritesPaused
+	}
+
+	// Check publish acls. When clustered this is done by the leader before proposing.
+	if node == nil && !mset.subjectAllowed(subject) {
+		sendq := mset.sendq
+		mset.mu.Unlock()
+		if canRespond && sendq != nil {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: errSubjectNotAllowed.Error()}
+			b, _ := json.Marshal(resp)
+			sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return errSubjectNotAllowed
+	}
+
+	// Check our publish rate limit. When clustered this is done by the leader before proposing.
+	if node == nil {
+		if err := mset.checkRateLimit(subject, hdr, msg); err != nil {
+			sendq := mset.sendq
+			mset.mu.Unlock()
+			if canRespond && sendq != nil {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 429, Description: err.Error()}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return err
+		}
+	}
+
+	// Check required headers. When clustered this is done by the leader before proposing.
+	if node == nil {
+		if err := mset.checkRequiredHeaders(hdr); err != nil {
+			sendq := mset.sendq
+			mset.mu.Unlock()
+			if canRespond && sendq != nil {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: err.Error()}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return err
+		}
+	}
+
+	// Process msg headers if present.
+	var msgId string
+	var mseq uint64
+	if len(hdr) > 0 {
+		msgId = getMsgId(hdr)
+		sendq := mset.sendq
+		if dde := mset.checkMsgId(msgId); dde != nil {
+			mset.clfs++
+			mset.mu.Unlock()
+			if canRespond {
+				response := append(pubAck, strconv.FormatUint(dde.seq, 10)...)
+				response = append(response, ",\"duplicate\": true}"...)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+			}
+			return errors.New("msgid is duplicate")
+		}
+
+		// Mirrors may see a source message more than once across leader changes.
+		if mseq = getMirrorSeq(hdr); mseq > 0 && mseq <= mset.mirrorLastSeq() {
+			mset.clfs++
+			mset.mu.Unlock()
+			return errMirrorDuplicate
+		}
+
+		// Expected headers on mirrored msgs were for the source stream, so skip those checks.
+		// Expected stream.
+		if sname := getExpectedStream(hdr); mseq == 0 && sname != _EMPTY_ && sname != name {
+			mset.clfs++
+			mset.mu.Unlock()
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: "expected stream does not match"}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return errors.New("expected stream does not match")
+		}
+		// Expected last sequence.
+		if seq := getExpectedLastSeq(hdr); mseq == 0 && seq > 0 && seq != mset.lseq {
+			mlseq := mset.lseq
+			mset.clfs++
+			mset.mu.Unlock()
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("wrong last sequence: %d", mlseq)}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return fmt.Errorf("last sequence mismatch: %d vs %d", seq, mlseq)
+		}
+		// Expected last msgId.
+		if lmsgId := getExpectedLastMsgId(hdr); mseq == 0 && lmsgId != _EMPTY_ && lmsgId != mset.lmsgId {
+			last := mset.lmsgId
+			mset.clfs++
+			mset.mu.Unlock()
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("wrong last msg ID: %s", last)}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return fmt.Errorf("last msgid mismatch: %q vs %q", lmsgId, last)
+		}
+	}
+
+	// Response Ack.
+	var (
+		response []byte
+		seq      uint64
+		err      error
+	)
+
+	// Check to see if we are over the max msg size.
+	if maxMsgSize >= 0 && (len(hdr)+len(msg)) > maxMsgSize {
+		mset.mu.Unlock()
+		mset.clfs++
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: "message size exceeds maximum allowed"}
+			b, _ := json.Marshal(resp)
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return ErrMaxPayload
+	}
+
+	var noInterest bool
+
+	// If we are interest based retention and have no consumers then we can skip.
+	if interestRetention {
+		if numConsumers == 0 {
+			noInterest = true
+		} else if mset.numFilter > 0 {
+			// Assume none.
+			noInterest = true
+			for _, o := range mset.consumers {
+				if o.config.FilterSubject != _EMPTY_ && subjectIsSubsetMatch(subject, o.config.FilterSubject) {
+					noInterest = false
+					break
+				}
+			}
+		}
+	}
+
+	// Grab timestamp if not already set.
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+
+	// Skip msg here.
+	if noInterest {
+		mset.lseq = store.SkipMsg()
+		mset.lmsgId = msgId
+		mset.mu.Unlock()
+
+		if canRespond {
+			response = append(pubAck, strconv.FormatUint(mset.lseq, 10)...)
+			response = append(response, '}')
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		// If we have a msgId make sure to save.
+		if msgId != _EMPTY_ {
+			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		}
+		return nil
+	}
+
+	// If here we will attempt to store the message.
+	// Assume this will succeed.
+	olseq, olmsgId := mset.lseq, mset.lmsgId
+	mset.lmsgId = msgId
+	mset.lseq++
+
+	// Set sequence if not set.
+	if seq == 0 {
+		seq = mset.lseq
+	}
+
+	// We hold the lock to this point to make sure nothing gets between us since we check for pre-conditions.
+	// Currently can not hold while calling store b/c we have inline storage update calls that may need the lock.
+	mset.mu.Unlock()
+
+	// Store actual msg.
+	err = store.StoreRawMsg(subject, hdr, msg, seq, ts)
+
+	// If we did not succeed put those values back.
+	if err != nil {
+		// FIXME(dlc) - This most likely is asymmetric under clustered scenarios.
+		mset.mu.Lock()
+		mset.lseq = olseq
+		mset.lmsgId = olmsgId
+		// Discard new limits are decided the same on every replica, so account for it like other failures.
+		if err == ErrMaxMsgs || err == ErrMaxBytes {
+			mset.clfs++
+		}
+		mset.mu.Unlock()
+	}
+
+	if err != nil {
+		if err != ErrStoreClosed {
+			c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
+		}
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: err.Error()}
+			response, _ = json.Marshal(resp)
+		}
+	} else if jsa.limitsExceeded(stype) {
+		c.Warnf("JetStream resource limits exceeded for account: %q", accName)
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: "resource limits exceeded for account"}
+			response, _ = json.Marshal(resp)
+		}
+		store.RemoveMsg(seq)
+		seq = 0
+	} else {
+		// If we have a msgId make sure to save.
+		if msgId != "" {
+			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		}
+		if mseq > 0 {
+			mset.mu.Lock()
+			mset.mlseq = mseq
+			mset.mu.Unlock()
+		}
+		mset.trackLastSeq(subject, seq)
+		// Remove the oldest messages for this subject past MaxMsgsPerSubject. When clustered the
+		// leader proposes the deletes so all replicas remove the same messages in the same log order.
+		for _, old := range mset.trackPerSubject(subject, seq, node != nil, isLeader) {
+			if node == nil {
+				store.RemoveMsg(old)
+			} else {
+				node.Propose(encodeMsgDelete(&streamMsgDelete{Client: ci, Stream: name, Seq: old, Newer: seq}))
+			}
+		}
+		// When clustered the leader republishes once entries have been applied.
+		if node == nil {
+			mset.republishPending()
+		}
+		if canRespond {
+			response = append(pubAck, strconv.FormatUint(seq, 10)...)
+			response = append(response, '}')
+			// Hold the ack until all replicas have this message. Entries are only applied once
+			// a quorum has stored them, so there is nothing to wait on for the other levels.
+			if index > 0 && node != nil && ackLevel == AckLevelAll {
+				mset.sendPubAckWhenStored(node, index, reply, response)
+				canRespond = false
+			}
+		}
+	}
+
+	// Send response here.
+	if canRespond {
+		mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	}
+
+	if err == nil && seq > 0 && numConsumers > 0 {
+		var _obs [4]*Consumer
+		obs := _obs[:0]
+
+		mset.mu.Lock()
+		for _, o := range mset.consumers {
+			if o.isLeader() {
+				obs = append(obs, o)
+			}
+		}
+		mset.mu.Unlock()
+
+		for _, o := range obs {
+			o.incStreamPending(seq, subject)
+			if !o.deliverCurrentMsg(subject, hdr, msg, seq, ts) {
+				o.signalNewMessages()
+			}
+		}
+	}
+
+	return nil
+}
+
+// Internal message for use by jetstream subsystem.
+type jsPubMsg struct {
+	subj  string
+	dsubj string
+	reply string
+	hdr   []byte
+	msg   []byte
+	o     *Consumer
+	seq   uint64
+}
+
+// StoredMsg is for raw access to messages in a stream.
+type StoredMsg struct {
+	Subject  string    `json:"subject"`
+	Sequence uint64    `json:"seq"`
+	Header   []byte    `json:"hdrs,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// TODO(dlc) - Maybe look at onering instead of chan - https://github.com/pltr/onering
+const msetSendQSize = 1024
+
+// This is similar to system semantics but did not want to overload the single system sendq,
+// or require system account when doing simple setup with jetstream.
+func (mset *Stream) setupSendCapabilities() {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if mset.sendq != nil {
+		return
+	}
+	mset.sendq = make(chan *jsPubMsg, msetSendQSize)
+	go mset.internalSendLoop()
+}
+
+// Name returns the stream name.
+func (mset *Stream) Name() string {
+	if mset == nil {
+		return _EMPTY_
+	}
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return mset.config.Name
+}
+
+func (mset *Stream) internalSendLoop() {
+	mset.mu.RLock()
+	c := mset.client
+	if c == nil {
+		mset.mu.RUnlock()
+		return
+	}
+	s := c.srv
+	sendq := mset.sendq
+	name := mset.config.Name
+	mset.mu.RUnlock()
+
+	// Warn when internal send queue is backed up past 75%
+	warnThresh := 3 * msetSendQSize / 4
+	warnFreq := time.Second
+	last := time.Now().Add(-warnFreq)
+
+	for {
+		if len(sendq) > warnThresh && time.Since(last) >= warnFreq {
+			s.Warnf("Jetstream internal send queue > 75%% for account: %q stream: %q", c.acc.Name, name)
+			last = time.Now()
+		}
+		select {
+		case pm := <-sendq:
+			if pm == nil {
+				return
+			}
+			c.pa.subject = []byte(pm.subj)
+			c.pa.deliver = []byte(pm.dsubj)
+			c.pa.size = len(pm.msg) + len(pm.hdr)
+			c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+			c.pa.reply = []byte(pm.reply)
+
+			var msg []byte
+			if len(pm.hdr) > 0 {
+				c.pa.hdr = len(pm.hdr)
+				c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+				msg = append(pm.hdr, pm.msg...)
+				msg = append(msg, _CRLF_...)
+			} else {
+				c.pa.hdr = -1
+				c.pa.hdb = nil
+				msg = append(pm.msg, _CRLF_...)
+			}
+
+			didDeliver := c.processInboundClientMsg(msg)
+			c.pa.szb = nil
+			c.flushClients(0)
+
+			// Check to see if this is a delivery for an observable and
+			// we failed to deliver the message. If so alert the observable.
+			if pm.o != nil && pm.seq > 0 && !didDeliver {
+				pm.o.didNotDeliver(pm.seq)
+			}
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// How long we wait for an active catchup to stop when stopping a stream.
+const catchupStopWait = 2 * time.Second
+
+// Internal function to delete a stream.
+func (mset *Stream) delete() error {
+	return mset.stop(true, true)
+}
+
+// Internal function to stop or delete the stream.
+func (mset *Stream) stop(deleteFlag, advisory bool) error {
+	mset.mu.RLock()
+	jsa := mset.jsa
+	mset.mu.RUnlock()
+
+	if jsa == nil {
+		return ErrJetStreamNotEnabledForAccount
+	}
+
+	// Remove from our account map.
+	jsa.mu.Lock()
+	delete(jsa.streams, mset.config.Name)
+	jsa.mu.Unlock()
+
+	// Clean up consumers.
+	mset.mu.Lock()
+	var obs []*Consumer
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	mset.consumers = nil
+	mset.mu.Unlock()
+
+	for _, o := range obs {
+		// Second flag says do not broadcast to signal.
+		// TODO(dlc) - If we have an err here we don't want to stop
+		// but should we log?
+		o.stop(deleteFlag, false, advisory)
+	}
+
+	if !deleteFlag {
+		mset.storeMirrorSeq()
+	}
+
+	mset.mu.Lock()
+
+	// Quit channel.
+	if mset.qch != nil {
+		close(mset.qch)
+		mset.qch = nil
+	}
+	mset.stopMirror()
+
+	// Cluster cleanup
+	if n := mset.node; n != nil {
+		if deleteFlag {
+			n.Delete()
+		} else {
+			n.Stop()
+		}
+		mset.stopClusterSubs()
+	}
+	if mset.getSub != nil {
+		mset.srv.sysUnsubscribe(mset.getSub)
+		mset.getSub = nil
+	}
+
+	// Send stream delete advisory after the consumers.
+	if deleteFlag && advisory {
+		mset.sendDeleteAdvisoryLocked()
+	}
+
+	if mset.sendq != nil {
+		mset.sendq <- nil
+	}
+
+	c := mset.client
+	mset.client = nil
+	if c == nil {
+		mset.mu.Unlock()
+		return nil
+	}
+	// Closing our quit channel signals an active catchup to stop, we wait for it below.
+	cdone := mset.cdone
+
+	// Cleanup duplicate timer if running.
+	if mset.ddtmr != nil {
+		mset.ddtmr.Stop()
+		mset.ddtmr = nil
+		mset.ddarr = nil
+		mset.ddmap = nil
+	}
+	if mset.aftmr != nil {
+		mset.aftmr.Stop()
+		mset.aftmr = nil
+	}
+
+	sysc := mset.sysc
+	mset.sysc = nil
+
+	// Clustered cleanup.
+	mset.mu.Unlock()
+
+	c.closeConnection(ClientClosed)
+
+	if sysc != nil {
+		sysc.closeConnection(ClientClosed)
+	}
+
+	if mset.store == nil {
+		return nil
+	}
+
+	// Make sure an active catchup is not writing to the store while we tear it down.
+	if cdone != nil {
+		select {
+		case <-cdone:
+		case <-time.After(catchupStopWait):
+			mset.srv.Warnf("JetStream catchup for stream '%s > %s' did not stop in time", jsa.account.Name, mset.config.Name)
+		}
+	}
+
+	if deleteFlag {
+		if err := mset.store.Delete(); err != nil {
+			return err
+		}
+	} else if err := mset.store.Stop(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mset *Stream) GetMsg(seq uint64) (*StoredMsg, error) {
+	subj, hdr, msg, ts, err := mset.store.LoadMsg(seq)
+	if err != nil {
+		return nil, err
+	}
+	sm := &StoredMsg{
+		Subject:  subj,
+		Sequence: seq,
+		Header:   hdr,
+		Data:     msg,
+		Time:     time.Unix(0, ts).UTC(),
+	}
+	return sm, nil
+}
+
+// Consunmers will return all the current consumers for this stream.
+func (mset *Stream) Consumers() []*Consumer {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	var obs []*Consumer
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	return obs
+}
+
+// NumConsumers reports on number of active observables for this stream.
+func (mset *Stream) NumConsumers() int {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return len(mset.consumers)
+}
+
+func (mset *Stream) setConsumer(o *Consumer) {
+	mset.consumers[o.name] = o
+	if o.config.FilterSubject != _EMPTY_ {
+		mset.numFilter++
+	}
+}
+
+func (mset *Stream) deleteConsumer(o *Consumer) {
+	if o.config.FilterSubject != _EMPTY_ {
+		mset.numFilter--
+	}
+	delete(mset.consumers, o.name)
+}
+
+// LookupConsumer will retrieve a consumer by name.
+func (mset *Stream) LookupConsumer(name string) *Consumer {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return mset.consumers[name]
+}
+
+// State will return the current state for this stream.
+func (mset *Stream) State() StreamState {
+	mset.mu.RLock()
+	c, store := mset.client, mset.store
+	mset.mu.RUnlock()
+	if c == nil || store == nil {
+		return StreamState{}
+	}
+	// Currently rely on store.
+	return store.State()
+}
+
+// Determines if the new proposed partition is unique amongst all observables.
+// Lock should be held.
+func (mset *Stream) partitionUnique(partition string) bool {
+	for _, o := range mset.consumers {
+		if o.config.FilterSubject == _EMPTY_ {
+			return false
+		}
+		if subjectIsSubsetMatch(partition, o.config.FilterSubject) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lock should be held.
+func (mset *Stream) checkInterest(seq uint64, obs *Consumer) bool {
+	for _, o := range mset.consumers {
+		if o != obs && o.needAck(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// ackMsg is called into from a consumer when we have a WorkQueue or Interest retention policy.
+func (mset *Stream) ackMsg(obs *Consumer, seq uint64) {
+	// Nothing is removed while retention is held.
+	if mset.retentionHeld() {
+		return
+	}
+	switch mset.config.Retention {
+	case LimitsPolicy:
+		return
+	case WorkQueuePolicy:
+		mset.store.RemoveMsg(seq)
+	case InterestPolicy:
+		mset.mu.Lock()
+		if mset.config.AckFloorRetention {
+			// Clustered streams have their leader propose removals, see ackFloorCompactSeq().
+			if !mset.isClustered() && mset.aftmr == nil {
+				mset.aftmr = time.AfterFunc(ackFloorCheckDelay, mset.checkAckFloor)
+			}
+			mset.mu.Unlock()
+			return
+		}
+		hasInterest := mset.checkInterest(seq, obs)
+		mset.mu.Unlock()
+		if !hasInterest {
+			mset.store.RemoveMsg(seq)
+		}
+	}
+}
+
+// How long we wait to propose again when throttled removing released messages.
+const releaseRetryDelay = 100 * time.Millisecond
+
+// releaseHeldRetention will remove the messages an interest or work queue stream kept while retention
+// was held, i.e. those with no interest left or already acked. When clustered the leader proposes
+// the removals so every replica removes the same messages. Ack floor retention catches up on its own.
+// This walks the whole stream so is done in its own go routine.
+func (mset *Stream) releaseHeldRetention() {
+	mset.mu.RLock()
+	retention, afr := mset.config.Retention, mset.config.AckFloorRetention
+	store, node, qch := mset.store, mset.node, mset.qch
+	mset.mu.RUnlock()
+
+	if store == nil || qch == nil || retention == LimitsPolicy || (retention == InterestPolicy && afr) {
+		return
+	}
+	if node != nil && !node.Leader() {
+		return
+	}
+	mset.srv.startGoRoutine(func() { mset.removeReleased(store, node, qch) })
+}
+
+// removeReleased will remove what releaseHeldRetention found. The leading run of messages we can
+// remove goes with a single compact to the floor, anything past it one message at a time.
+func (mset *Stream) removeReleased(store StreamStore, node RaftNode, qch chan struct{}) {
+	s, name := mset.srv, mset.Name()
+	defer s.grWG.Done()
+
+	// Returns false if we should stop, e.g. we are no longer the leader or are stopping.
+	propose := func(entry []byte) bool {
+		for {
+			err := node.Propose(entry)
+			if err == nil {
+				return true
+			}
+			if err != errTooManyPending && err != errProposalsPaused {
+				s.Warnf("JetStream cluster failed to propose removal of released msgs for stream %q: %v", name, err)
+				return false
+			}
+			select {
+			case <-qch:
+				return false
+			case <-node.QuitC():
+				return false
+			case <-time.After(releaseRetryDelay):
+			}
+		}
+	}
+	// We go by the replicated consumer states, we are not always the consumer leader.
+	type ackState struct {
+		explicit bool
+		state    *ConsumerState
+	}
+	var states []ackState
+	for _, o := range mset.Consumers() {
+		state := o.readStoreState()
+		if state == nil {
+			return
+		}
+		states = append(states, ackState{o.Config().AckPolicy == AckExplicit, state})
+	}
+	if len(states) == 0 {
+		return
+	}
+	removable := func(seq uint64) bool {
+		for _, as := range states {
+			if seq <= as.state.AckFloor.Stream {
+				continue
+			}
+			if _, pending := as.state.Pending[seq]; !as.explicit || pending || seq > as.state.Delivered.Stream {
+				return false
+			}
+		}
+		return true
+	}
+
+	state := store.State()
+	seq := state.FirstSeq
+	for ; seq > 0 && seq <= state.LastSeq; seq++ {
+		if _, _, _, _, err := store.LoadMsg(seq); err == nil && !removable(seq) {
+			break
+		}
+	}
+	if seq > state.FirstSeq {
+		if node == nil {
+			mset.expireTo(seq)
+		} else if !propose(encodeStreamAckFloor(seq)) {
+			return
+		}
+	}
+	for ; seq > 0 && seq <= state.LastSeq; seq++ {
+		if _, _, _, _, err := store.LoadMsg(seq); err != nil || !removable(seq) {
+			continue
+		}
+		if node == nil {
+			store.RemoveMsg(seq)
+		} else if !propose(encodeMsgDelete(&streamMsgDelete{Stream: name, Seq: seq, NoErase: true})) {
+			return
+		}
+	}
+}
+
+// How long a standalone stream with ack floor retention collects acks before checking the floor.
+const ackFloorCheckDelay = 50 * time.Millisecond
+
+// checkAckFloor will remove everything below the ack floor for standalone streams.
+func (mset *Stream) checkAckFloor() {
+	mset.mu.Lock()
+	if mset.aftmr == nil {
+		// We have been stopped.
+		mset.mu.Unlock()
+		return
+	}
+	mset.aftmr = nil
+	mset.mu.Unlock()
+
+	if mset.retentionHeld() {
+		return
+	}
+	if seq, ok := mset.ackFloor(); ok {
+		mset.expireTo(seq + 1)
+	}
+}
+
+// ackFloor returns the lowest stream ack floor across all of our consumers, from their stored state.
+// Returns false if we have no consumers.
+func (mset *Stream) ackFloor() (uint64, bool) {
+	obs := mset.Consumers()
+	if len(obs) == 0 {
+		return 0, false
+	}
+	var floor uint64
+	for i, o := range obs {
+		state := o.readStoreState()
+		if state == nil {
+			return 0, false
+		}
+		if i == 0 || state.AckFloor.Stream < floor {
+			floor = state.AckFloor.Stream
+		}
+	}
+	return floor, true
+}
+
+// ackFloorCompactSeq will return the sequence below which every consumer has acked, or 0 if there is
+// nothing new to remove. Consumer states are replicated, so this is the same floor on every replica.
+// We need all expected consumers locally, otherwise we do not know their floors and keep everything.
+// This should only be called on the leader, which will propose it so every replica removes the same messages.
+func (mset *Stream) ackFloorCompactSeq(expected int) uint64 {
+	mset.mu.RLock()
+	enabled, store, afseq := mset.config.AckFloorRetention && !mset.config.RetentionHold, mset.store, mset.afseq
+	mset.mu.RUnlock()
+
+	if !enabled || store == nil || expected == 0 || len(mset.Consumers()) < expected {
+		return 0
+	}
+	floor, ok := mset.ackFloor()
+	if !ok || floor == 0 {
+		return 0
+	}
+	seq := floor + 1
+	if seq <= store.State().FirstSeq || seq <= afseq {
+		return 0
+	}
+	mset.mu.Lock()
+	mset.afseq = seq
+	mset.mu.Unlock()
+	return seq
+}
+
+// Snapshot creates a snapshot for the stream and possibly consumers.
+func (mset *Stream) Snapshot(deadline time.Duration, checkMsgs, includeConsumers bool) (*SnapshotResult, error) {
+	mset.mu.RLock()
+	if mset.client == nil || mset.store == nil {
+		mset.mu.RUnlock()
+		return nil, fmt.Errorf("invalid stream")
+	}
+	store := mset.store
+	mset.mu.RUnlock()
+
+	return store.Snapshot(deadline, checkMsgs, includeConsumers)
+}
+
+const snapsDir = "__snapshots__"
+
+// RestoreStream will restore a stream from a snapshot.
+func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	sd := path.Join(jsa.storeDir, snapsDir)
+	defer os.RemoveAll(sd)
+
+	if _, err := os.Stat(sd); os.IsNotExist(err) {
+		if err := os.MkdirAll(sd, 0755); err != nil {
+			return nil, fmt.Errorf("could not create snapshots directory - %v", err)
+		}
+	}
+	sdir, err := ioutil.TempDir(sd, "snap-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(sdir); os.IsNotExist(err) {
+		if err := os.MkdirAll(sdir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create snapshots directory - %v", err)
+		}
+	}
+
+	tr := tar.NewReader(s2.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // End of snapshot
+		}
+		if err != nil {
+			return nil, err
+		}
+		fpath := path.Join(sdir, filepath.Clean(hdr.Name))
+		pdir := filepath.Dir(fpath)
+		os.MkdirAll(pdir, 0750)
+		fd, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(fd, tr)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check metadata
+	var cfg FileStreamInfo
+	b, err := ioutil.ReadFile(path.Join(sdir, JetStreamMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	// See if names match
+	if cfg.Name != stream {
+		return nil, fmt.Errorf("stream name [%q] does not match snapshot stream [%q]", stream, cfg.Name)
+	}
+
+	// See if this stream already exists.
+	if _, err := a.LookupStream(cfg.Name); err == nil {
+		return nil, ErrJetStreamStreamAlreadyUsed
+	}
+	// Move into the correct place here.
+	ndir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
+	if err := os.Rename(sdir, ndir); err != nil {
+		return nil, err
+	}
+	if cfg.Template != _EMPTY_ {
+		if err := jsa.addStreamNameToTemplate(cfg.Template, cfg.Name); err != nil {
+			return nil, err
+		}
+	}
+	mset, err := a.AddStream(&cfg.StreamConfig)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Created.IsZero() {
+		mset.setCreated(cfg.Created)
+	}
+
+	// Now do consumers.
+	odir := path.Join(ndir, consumerDir)
+	ofis, _ := ioutil.ReadDir(odir)
+	for _, ofi := range ofis {
+		metafile := path.Join(odir, ofi.Name(), JetStreamMetaFile)
+		metasum := path.Join(odir, ofi.Name(), JetStreamMetaFileSum)
+		if _, err := os.Stat(metafile); os.IsNotExist(err) {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+		buf, err := ioutil.ReadFile(metafile)
+		if err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+		if _, err := os.Stat(metasum); os.IsNotExist(err) {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+		var cfg FileConsumerInfo
+		if err := json.Unmarshal(buf, &cfg); err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+		isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
+		if isEphemeral {
+			// This is an ephermal consumer and this could fail on restart until
+			// the consumer can reconnect. We will create it as a durable and switch it.
+			cfg.ConsumerConfig.Durable = ofi.Name()
+		}
+		obs, err := mset.AddConsumer(&cfg.ConsumerConfig)
+		if err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+		if isEphemeral {
+			obs.switchToEphemeral()
+		}
+		if !cfg.Created.IsZero() {
+			obs.setCreated(cfg.Created)
+		}
+		if err := obs.readStoredState(); err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
+	}
+	return mset, nil
+}
@@ -0,0 +1,4007 @@
+// Copyright 2020-2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestJetStreamClusterConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 16GB, max_file_store: 10TB, store_dir: "%s"}
+		cluster { listen: 127.0.0.1:-1 }
+	`))
+	defer os.Remove(conf)
+
+	check := func(errStr string) {
+		t.Helper()
+		opts, err := server.ProcessConfigFile(conf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := server.NewServer(opts); err == nil || !strings.Contains(err.Error(), errStr) {
+			t.Fatalf("Expected an error of `%s`, got `%v`", errStr, err)
+		}
+	}
+
+	check("requires `server_name`")
+
+	conf = createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		server_name: "TEST"
+		jetstream: {max_mem_store: 16GB, max_file_store: 10TB, store_dir: "%s"}
+		cluster { listen: 127.0.0.1:-1 }
+	`))
+	defer os.Remove(conf)
+
+	check("requires `cluster.name`")
+}
+
+func TestJetStreamClusterLeader(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	// Kill our current leader and force an election.
+	c.leader().Shutdown()
+	c.waitOnClusterReady()
+
+	// Now killing our current leader should leave us leaderless.
+	c.leader().Shutdown()
+	c.expectNoLeader()
+}
+
+func TestJetStreamExpandCluster(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 2)
+	defer c.shutdown()
+
+	c.addInNewServer()
+	c.waitOnPeerCount(3)
+}
+
+func TestJetStreamClusterJoinWithoutQuorumLoss(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 4)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync(server.JSAdvisoryStreamQuorumLostPre + ".>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish("TEST", []byte("JSC-OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+	sendBatch(100)
+
+	// The fifth server joins an existing cluster, it should observe until added and not disturb anyone.
+	c.addInNewServer()
+	sendBatch(100)
+	c.waitOnPeerCount(5)
+	c.waitOnStreamLeader("$G", "TEST")
+	sendBatch(100)
+
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.State.Msgs != 300 {
+		t.Fatalf("Expected 300 msgs, got %d", si.State.Msgs)
+	}
+	if nmsgs, _, _ := sub.Pending(); nmsgs > 0 {
+		t.Fatalf("Expected no quorum lost advisories, got %d", nmsgs)
+	}
+}
+
+func TestJetStreamClusterAccountInfo(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	reply := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(reply)
+
+	if err := nc.PublishRequest(server.JSApiAccountInfo, reply, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkSubsPending(t, sub, 1)
+	resp, _ := sub.NextMsg(0)
+
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.JetStreamAccountStats == nil || info.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", info.Error)
+	}
+	// Make sure we only got 1 response.
+	// Technicall this will always work since its a singelton service export.
+	if nmsgs, _, _ := sub.Pending(); nmsgs > 0 {
+		t.Fatalf("Expected only a single response, got %d more", nmsgs)
+	}
+}
+
+func TestJetStreamClusterSingleReplicaStreams(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R1S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomNonLeader()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	si, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Cluster == nil {
+		t.Fatalf("Expected si to have cluster info")
+	}
+	// Send in 10 messages.
+	msg, toSend := []byte("Hello JS Clustering"), 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	// Now grab info for this stream.
+	si, err = js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "TEST" {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+	// Check active state as well, shows that the owner answered.
+	if si.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d msgs, got bad state: %+v", toSend, si.State)
+	}
+	// Now create a consumer. This should be pinned to same server that our stream was allocated to.
+	// First do a normal sub.
+	sub, err := js.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, sub, toSend)
+
+	// Now create a consumer as well.
+	ci, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ci == nil || ci.Name != "dlc" || ci.Stream != "TEST" {
+		t.Fatalf("ConsumerInfo is not correct %+v", ci)
+	}
+
+	// Now make sure that if we kill and restart the server that this stream and consumer return.
+	sl := c.streamLeader("$G", "TEST")
+	sl.Shutdown()
+	c.restartServer(sl)
+	c.waitOnStreamLeader("$G", "TEST")
+	time.Sleep(500 * time.Millisecond)
+
+	si, err = js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "TEST" {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+	// Now durable consumer.
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err = js.ConsumerInfo("TEST", "dlc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamClusterMultiReplicaStreams(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "RNS", 5)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Send in 10 messages.
+	msg, toSend := []byte("Hello JS Clustering"), 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Now grab info for this stream.
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "TEST" {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+	// Check active state as well, shows that the owner answered.
+	if si.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d msgs, got bad state: %+v", toSend, si.State)
+	}
+	// Now create a consumer. This should be affinitize to the same set of servers as the stream.
+	// First do a normal sub.
+	sub, err := js.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, sub, toSend)
+
+	// Now create a consumer as well.
+	ci, err := js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ci == nil || ci.Name != "dlc" || ci.Stream != "TEST" || ci.NumPending != uint64(toSend) {
+		t.Fatalf("ConsumerInfo is not correct %+v", ci)
+	}
+}
+
+func TestJetStreamClusterMemoryStore(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3M", 3)
+	defer c.shutdown()
+
+	// Client based API
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	// FIXME(dlc) - This should be default.
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+		Storage:  nats.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Send in 100 messages.
+	msg, toSend := []byte("Hello MemoryStore"), 100
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	// Now grab info for this stream.
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "TEST" {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+	if si.Cluster == nil || len(si.Cluster.Replicas) != 2 {
+		t.Fatalf("Cluster info is incorrect: %+v", si.Cluster)
+	}
+	// Check active state as well, shows that the owner answered.
+	if si.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d msgs, got bad state: %+v", toSend, si.State)
+	}
+	// Do a normal sub.
+	sub, err := js.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, sub, toSend)
+}
+
+func TestJetStreamClusterCompaction(t *testing.T) {
+	// This test takes a long time to observe compactions.
+	// Once moved to server we can adjust and re-enable.
+	skip(t)
+
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend := 1000
+	payload := []byte("Hello JSC")
+	for i := 0; i < toSend; i++ {
+		if _, err := js.Publish("TEST", payload); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	nc.Flush()
+
+	if _, err := js.StreamInfo("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sub, err := js.SubscribeSync("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	checkSubsPending(t, sub, toSend)
+
+	for i := 0; i < toSend; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg %d: %v", i+1, err)
+		}
+		m.Ack()
+	}
+}
+
+func TestJetStreamClusterDelete(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "RNS", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	cfg := server.StreamConfig{
+		Name:     "C22",
+		Subjects: []string{"foo", "bar", "baz"},
+		Replicas: 2,
+		Storage:  server.FileStorage,
+		MaxMsgs:  100,
+	}
+	req, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+	// Now create a consumer.
+	obsReq := server.CreateConsumerRequest{
+		Stream: cfg.Name,
+		Config: server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit},
+	}
+	req, err = json.Marshal(obsReq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, cfg.Name, "dlc"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", ccResp.Error)
+	}
+
+	// Now delete the consumer.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiConsumerDeleteT, cfg.Name, "dlc"), nil, time.Second)
+	var cdResp server.JSApiConsumerDeleteResponse
+	if err = json.Unmarshal(resp.Data, &cdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cdResp.Success || cdResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", cdResp)
+	}
+
+	// Now delete the stream.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, cfg.Name), nil, time.Second)
+	var dResp server.JSApiStreamDeleteResponse
+	if err = json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", dResp.Error)
+	}
+
+	// This will get the current information about usage and limits for this account.
+	resp, err = nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Streams != 0 {
+		t.Fatalf("Expected no remaining streams, got %d", info.Streams)
+	}
+}
+
+func TestJetStreamClusterStreamPurge(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R5S", 5)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg, toSend := []byte("Hello JS Clustering"), 100
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Now grab info for this stream.
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Check active state as well, shows that the owner answered.
+	if si.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d msgs, got bad state: %+v", toSend, si.State)
+	}
+
+	// Now purge the stream.
+	if err := js.PurgeStream("TEST"); err != nil {
+		t.Fatalf("Unexpected purge error: %v", err)
+	}
+	si, err = js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if si.State.Msgs != 0 || si.State.FirstSeq != uint64(toSend+1) {
+		t.Fatalf("Expected no msgs, got: %+v", si.State)
+	}
+}
+
+func TestJetStreamClusterConsumerState(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg, toSend := []byte("Hello JS Clustering"), 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.Pull(1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, sub, 1)
+
+	// Pull 5 messages and ack.
+	for i := 0; i < 5; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg %d: %v", i+1, err)
+		}
+		m.Ack()
+	}
+
+	// Let state propagate for exact comparison below.
+	time.Sleep(200 * time.Millisecond)
+
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+	if ci.AckFloor.Consumer != 5 {
+		t.Fatalf("Expected ack floor of %d, got %d", 5, ci.AckFloor.Consumer)
+	}
+
+	c.consumerLeader("$G", "TEST", "dlc").Shutdown()
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	nci, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+
+	if nci.Delivered != ci.Delivered {
+		t.Fatalf("Consumer delivered did not match after leader switch, wanted %+v, got %+v", ci.Delivered, nci.Delivered)
+	}
+	if nci.AckFloor != ci.AckFloor {
+		t.Fatalf("Consumer ackfloor did not match after leader switch, wanted %+v, got %+v", ci.AckFloor, nci.AckFloor)
+	}
+
+	// Now make sure we can receive new messages.
+	// Pull last 5.
+	for i := 0; i < 5; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg %d: %v", i+1, err)
+		}
+		m.Ack()
+	}
+	nci, _ = sub.ConsumerInfo()
+	if nci.Delivered.Consumer != 10 || nci.Delivered.Stream != 10 {
+		t.Fatalf("Received bad delivered: %+v", nci.Delivered)
+	}
+	if nci.AckFloor.Consumer != 10 || nci.AckFloor.Stream != 10 {
+		t.Fatalf("Received bad ackfloor: %+v", nci.AckFloor)
+	}
+	if nci.NumAckPending != 0 {
+		t.Fatalf("Received bad ackpending: %+v", nci.NumAckPending)
+	}
+}
+
+func TestJetStreamClusterFullConsumerState(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg, toSend := []byte("Hello JS Clustering"), 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.Pull(1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, sub, 1)
+
+	// Now purge the stream.
+	if err := js.PurgeStream("TEST"); err != nil {
+		t.Fatalf("Unexpected purge error: %v", err)
+	}
+}
+
+func TestJetStreamClusterDeadLetterAcrossFailover(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.Publish("TEST", []byte("JSC-OK")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	obsReq := server.CreateConsumerRequest{
+		Stream: "TEST",
+		Config: server.ConsumerConfig{
+			Durable:           "dlc",
+			DeliverSubject:    sub.Subject,
+			AckPolicy:         server.AckExplicit,
+			AckWait:           250 * time.Millisecond,
+			MaxDeliver:        2,
+			DeadLetterSubject: "dlq.TEST",
+		},
+	}
+	req, err := json.Marshal(obsReq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, "TEST", "dlc"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", ccResp.Error)
+	}
+
+	// Let it exceed its deliveries before the dead letter stream exists, it should stay pending.
+	checkSubsPending(t, sub, 2)
+	time.Sleep(time.Second)
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "DLQ", Subjects: []string{"dlq.TEST"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkDLQ := func() {
+		t.Helper()
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			si, err := js.StreamInfo("DLQ")
+			if err != nil {
+				return err
+			}
+			if si.State.Msgs != 1 {
+				return fmt.Errorf("Expected 1 msg in the dead letter stream, got %d", si.State.Msgs)
+			}
+			return nil
+		})
+	}
+	checkDLQ()
+
+	// Now fail over the consumer leader, the move is replicated so it should not be moved or delivered again.
+	c.consumerLeader("$G", "TEST", "dlc").Shutdown()
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	time.Sleep(time.Second)
+	checkDLQ()
+	if nmsgs, _, _ := sub.Pending(); nmsgs != 2 {
+		t.Fatalf("Expected only 2 deliveries, got %d", nmsgs)
+	}
+
+	dsub, err := js.SubscribeSync("dlq.TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer dsub.Unsubscribe()
+	m, err := dsub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(m.Data) != "JSC-OK" || m.Header.Get(server.JSStream) != "TEST" || m.Header.Get(server.JSSequence) != "1" {
+		t.Fatalf("Unexpected dead letter message: %+v", m)
+	}
+}
+
+func TestJetStreamClusterMetaSnapshotsAndCatchup(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Shut one down.
+	rs := c.randomServer()
+	rs.Shutdown()
+	c.waitOnLeader()
+
+	s := c.leader()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	numStreams := 4
+	// Create 4 streams
+	// FIXME(dlc) - R2 make sure we place properly.
+	for i := 0; i < numStreams; i++ {
+		sn := fmt.Sprintf("T-%d", i+1)
+		_, err := js.AddStream(&nats.StreamConfig{Name: sn})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	c.leader().JetStreamSnapshotMeta()
+	time.Sleep(250 * time.Millisecond)
+
+	rs = c.restartServer(rs)
+	c.checkClusterFormed()
+	c.waitOnServerCurrent(rs)
+
+	rs.Shutdown()
+	c.waitOnLeader()
+
+	for i := 0; i < numStreams; i++ {
+		sn := fmt.Sprintf("T-%d", i+1)
+		resp, _ := nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, sn), nil, time.Second)
+		var dResp server.JSApiStreamDeleteResponse
+		if err := json.Unmarshal(resp.Data, &dResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !dResp.Success || dResp.Error != nil {
+			t.Fatalf("Got a bad response %+v", dResp.Error)
+		}
+	}
+
+	rs = c.restartServer(rs)
+	c.checkClusterFormed()
+	c.waitOnServerCurrent(rs)
+}
+
+func TestJetStreamClusterMetaSnapshotsMultiChange(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 2)
+	defer c.shutdown()
+
+	s := c.leader()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Add in 2 streams with 1 consumer each.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "S1"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err := js.AddConsumer("S1", &nats.ConsumerConfig{Durable: "S1C1", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "S2"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = js.AddConsumer("S2", &nats.ConsumerConfig{Durable: "S2C1", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Add in a new server to the group. This way we know we can delete the original streams and consumers.
+	rs := c.addInNewServer()
+	c.waitOnServerCurrent(rs)
+
+	// Shut it down.
+	rs.Shutdown()
+	time.Sleep(250 * time.Millisecond)
+
+	// We want to make changes here that test each delta scenario for the meta snapshots.
+	// Add new stream and consumer.
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "S3"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = js.AddConsumer("S3", &nats.ConsumerConfig{Durable: "S3C1", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Delete stream S2
+	resp, _ := nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, "S2"), nil, time.Second)
+	var dResp server.JSApiStreamDeleteResponse
+	if err := json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", dResp.Error)
+	}
+	// Delete the consumer on S1 but add another.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiConsumerDeleteT, "S1", "S1C1"), nil, time.Second)
+	var cdResp server.JSApiConsumerDeleteResponse
+	if err = json.Unmarshal(resp.Data, &cdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cdResp.Success || cdResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", cdResp)
+	}
+	// Add new consumer on S1
+	_, err = js.AddConsumer("S1", &nats.ConsumerConfig{Durable: "S1C2", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c.leader().JetStreamSnapshotMeta()
+	time.Sleep(250 * time.Millisecond)
+
+	rs = c.restartServer(rs)
+	c.checkClusterFormed()
+	c.waitOnServerCurrent(rs)
+}
+
+func TestJetStreamClusterStreamSynchedTimeStamps(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 5)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "foo", Replicas: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = js.Publish("foo", []byte("TSS")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+
+	// Grab the message and timestamp from our current leader
+	sub, err := js.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	meta, _ := m.MetaData()
+
+	sub.Unsubscribe()
+
+	sl := c.streamLeader("$G", "foo")
+
+	sl.Shutdown()
+	c.waitOnStreamLeader("$G", "foo")
+
+	s = c.randomServer()
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err = js.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err = sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	meta2, _ := m.MetaData()
+	if meta.Timestamp != meta2.Timestamp {
+		t.Fatalf("Expected same timestamps, got %v vs %v", meta.Timestamp, meta2.Timestamp)
+	}
+}
+
+// Test to mimic what R.I. was seeing.
+func TestJetStreamClusterRestoreSingleConsumer(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "foo"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = js.Publish("foo", []byte("TSS")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else {
+		m.Ack()
+	}
+
+	c.stopAll()
+	c.restartAll()
+
+	s = c.randomServer()
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	resp, err := nc.Request(server.JSApiStreams, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var streams server.JSApiStreamNamesResponse
+	if err = json.Unmarshal(resp.Data, &streams); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(streams.Streams) != 1 {
+		t.Fatalf("Expected only 1 stream but got %d", len(streams.Streams))
+	}
+
+	// Now do detailed version.
+	resp, err = nc.Request(server.JSApiStreamList, nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var listResponse server.JSApiStreamListResponse
+	if err = json.Unmarshal(resp.Data, &listResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(listResponse.Streams) != 1 {
+		t.Fatalf("Expected 1 stream but got %d", len(listResponse.Streams))
+	}
+	si, err := js.StreamInfo("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "foo" {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+
+	// Now check for consumer.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumersT, "foo"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var clResponse server.JSApiConsumerNamesResponse
+	if err = json.Unmarshal(resp.Data, &clResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(clResponse.Consumers) != 1 {
+		t.Fatalf("Expected 1 consumer but got %d", len(clResponse.Consumers))
+	}
+
+}
+
+func TestJetStreamClusterStreamPublishWithActiveConsumers(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "foo", Replicas: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = js.Publish("foo", []byte("TSS")); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else {
+		m.Ack()
+	}
+
+	// Send 10 messages.
+	for i := 1; i <= 10; i++ {
+		payload := []byte(fmt.Sprintf("MSG-%d", i))
+		if _, err = js.Publish("foo", payload); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	checkSubsPending(t, sub, 10)
+	// Sanity check for duplicate deliveries..
+	if nmsgs, _, _ := sub.Pending(); nmsgs > 10 {
+		t.Fatalf("Expected only %d responses, got %d more", 10, nmsgs)
+	}
+	for i := 1; i <= 10; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		payload := []byte(fmt.Sprintf("MSG-%d", i))
+		if !bytes.Equal(m.Data, payload) {
+			t.Fatalf("Did not get expected msg, expected %q, got %q", payload, m.Data)
+		}
+	}
+
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+
+	c.consumerLeader("$G", "foo", "dlc").Shutdown()
+	c.waitOnConsumerLeader("$G", "foo", "dlc")
+
+	ci2, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+
+	ci.Cluster = nil
+	ci2.Cluster = nil
+
+	if !reflect.DeepEqual(ci, ci2) {
+		t.Fatalf("Consumer info did not match: %+v vs %+v", ci, ci2)
+	}
+
+	// In case the server above was also stream leader.
+	c.waitOnStreamLeader("$G", "foo")
+
+	// Now send more..
+	// Send 10 more messages.
+	for i := 11; i <= 20; i++ {
+		payload := []byte(fmt.Sprintf("MSG-%d", i))
+		if _, err = js.Publish("foo", payload); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	checkSubsPending(t, sub, 10)
+	// Sanity check for duplicate deliveries..
+	if nmsgs, _, _ := sub.Pending(); nmsgs > 10 {
+		t.Fatalf("Expected only %d responses, got %d more", 10, nmsgs)
+	}
+
+	for i := 11; i <= 20; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		payload := []byte(fmt.Sprintf("MSG-%d", i))
+		if !bytes.Equal(m.Data, payload) {
+			t.Fatalf("Did not get expected msg, expected %q, got %q", payload, m.Data)
+		}
+	}
+}
+
+func TestJetStreamClusterStreamOverlapSubjects(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R32", 2)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST2", Subjects: []string{"foo"}, Replicas: 2}); err == nil || err == nats.ErrTimeout {
+		t.Fatalf("Expected error but got none or timeout")
+	}
+
+	// Now grab list of streams and make sure the second is not there.
+	resp, err := nc.Request(server.JSApiStreams, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var streams server.JSApiStreamNamesResponse
+	if err = json.Unmarshal(resp.Data, &streams); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(streams.Streams) != 1 {
+		t.Fatalf("Expected only 1 stream but got %d", len(streams.Streams))
+	}
+
+	// Now do detailed version.
+	resp, err = nc.Request(server.JSApiStreamList, nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var listResponse server.JSApiStreamListResponse
+	if err = json.Unmarshal(resp.Data, &listResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamClusterStreamInfoList(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	createStream := func(name string) {
+		t.Helper()
+		if _, err := js.AddStream(&nats.StreamConfig{Name: name}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	createStream("foo")
+	createStream("bar")
+	createStream("baz")
+
+	sendBatch := func(subject string, n int) {
+		t.Helper()
+		// Send a batch to a given subject.
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish(subject, []byte("OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+
+	sendBatch("foo", 10)
+	sendBatch("bar", 22)
+	sendBatch("baz", 33)
+
+	// Now get the stream list info.
+	sl := js.NewStreamLister()
+	if !sl.Next() {
+		t.Fatalf("Unexpected error: %v", sl.Err())
+	}
+	p := sl.Page()
+	if len(p) != 3 {
+		t.Fatalf("StreamInfo expected 3 results, got %d", len(p))
+	}
+	for _, si := range p {
+		switch si.Config.Name {
+		case "foo":
+			if si.State.Msgs != 10 {
+				t.Fatalf("Expected %d msgs but got %d", 10, si.State.Msgs)
+			}
+		case "bar":
+			if si.State.Msgs != 22 {
+				t.Fatalf("Expected %d msgs but got %d", 22, si.State.Msgs)
+			}
+		case "baz":
+			if si.State.Msgs != 33 {
+				t.Fatalf("Expected %d msgs but got %d", 33, si.State.Msgs)
+			}
+		}
+	}
+}
+
+func TestJetStreamClusterConsumerInfoList(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Place messages so we can generate consumer state.
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("TEST", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	createConsumer := func(name string) *nats.Subscription {
+		t.Helper()
+		sub, err := js.SubscribeSync("TEST", nats.Durable(name), nats.Pull(2))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		checkSubsPending(t, sub, 2)
+		return sub
+	}
+
+	subFoo := createConsumer("foo")
+	subBar := createConsumer("bar")
+	subBaz := createConsumer("baz")
+
+	// Place consumers in various states.
+	for _, ss := range []struct {
+		sub   *nats.Subscription
+		fetch int
+		ack   int
+	}{
+		{subFoo, 4, 2},
+		{subBar, 2, 0},
+		{subBaz, 8, 6},
+	} {
+		for i := 0; i < ss.fetch; i++ {
+			if m, err := ss.sub.NextMsg(time.Second); err != nil {
+				t.Fatalf("Unexpected error getting message %d: %v", i, err)
+			} else if i < ss.ack {
+				m.Ack()
+			}
+		}
+	}
+
+	// Now get the consumer list info.
+	cl := js.NewConsumerLister("TEST")
+	if !cl.Next() {
+		t.Fatalf("Unexpected error: %v", cl.Err())
+	}
+	p := cl.Page()
+	if len(p) != 3 {
+		t.Fatalf("ConsumerInfo expected 3 results, got %d", len(p))
+	}
+	for _, ci := range p {
+		switch ci.Name {
+		case "foo":
+			if ci.Delivered.Consumer != 4 {
+				t.Fatalf("Expected %d delivered but got %d", 4, ci.Delivered.Consumer)
+			}
+			if ci.AckFloor.Consumer != 2 {
+				t.Fatalf("Expected %d for ack floor but got %d", 2, ci.AckFloor.Consumer)
+			}
+		case "bar":
+			if ci.Delivered.Consumer != 2 {
+				t.Fatalf("Expected %d delivered but got %d", 2, ci.Delivered.Consumer)
+			}
+			if ci.AckFloor.Consumer != 0 {
+				t.Fatalf("Expected %d for ack floor but got %d", 0, ci.AckFloor.Consumer)
+			}
+		case "baz":
+			if ci.Delivered.Consumer != 8 {
+				t.Fatalf("Expected %d delivered but got %d", 8, ci.Delivered.Consumer)
+			}
+			if ci.AckFloor.Consumer != 6 {
+				t.Fatalf("Expected %d for ack floor but got %d", 6, ci.AckFloor.Consumer)
+			}
+		}
+	}
+}
+
+func TestJetStreamClusterStreamUpdate(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sc := &nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 3,
+		MaxMsgs:  10,
+		Discard:  server.DiscardNew,
+	}
+
+	if _, err := js.AddStream(sc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 1; i <= int(sc.MaxMsgs); i++ {
+		msg := []byte(fmt.Sprintf("HELLO JSC-%d", i))
+		if _, err := js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Expect error here.
+	if _, err := js.Publish("foo", []byte("fail")); err == nil {
+		t.Fatalf("Expected publish to fail")
+	}
+
+	// Now update MaxMsgs, select non-leader server.
+	s = c.randomNonStreamLeader("$G", "TEST")
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	sc.MaxMsgs = 20
+	si, err := js.UpdateStream(sc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Config.MaxMsgs != 20 {
+		t.Fatalf("Expected to have config updated with max msgs of %d, got %d", 20, si.Config.MaxMsgs)
+	}
+
+	// Do one that will fail. Wait and make sure we only are getting one response.
+	sc.Name = "TEST22"
+
+	rsub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer rsub.Unsubscribe()
+	nc.Flush()
+
+	req, _ := json.Marshal(sc)
+	if err := nc.PublishRequest(fmt.Sprintf(server.JSApiStreamUpdateT, "TEST"), rsub.Subject, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Wait incase more than one reply sent.
+	time.Sleep(250 * time.Millisecond)
+
+	if nmsgs, _, _ := rsub.Pending(); err != nil || nmsgs != 1 {
+		t.Fatalf("Expected only one response, got %d", nmsgs)
+	}
+
+	m, err := rsub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(m.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo != nil || scResp.Error == nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp)
+	}
+}
+
+func TestJetStreamClusterDiscardPolicies(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	const maxBytes = 4 * 1024
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:     "NEW",
+		Subjects: []string{"new"},
+		Replicas: 3,
+		Discard:  server.DiscardNew,
+		MaxBytes: maxBytes,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Send a burst without waiting so proposals race to the limit, the stream should never go past it.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	const toSend = 200
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < toSend; i++ {
+		if err := nc.PublishRequest("new", sub.Subject, msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkSubsPending(t, sub, toSend)
+	var stored uint64
+	for i := 0; i < toSend; i++ {
+		m, _ := sub.NextMsg(0)
+		var resp server.JSPubAckResponse
+		if err := json.Unmarshal(m.Data, &resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Error == nil {
+			stored++
+		}
+	}
+	si, err := js.StreamInfo("NEW")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.State.Bytes > maxBytes {
+		t.Fatalf("Expected at most %d bytes, got %d", maxBytes, si.State.Bytes)
+	}
+	// Nothing we acked should have been evicted to make room.
+	if stored == 0 || si.State.Msgs != stored || si.State.FirstSeq != 1 {
+		t.Fatalf("Expected %d msgs for the acks we got, got %+v", stored, si.State)
+	}
+	// We should be full now.
+	if _, err := js.Publish("new", msg); err == nil {
+		t.Fatalf("Expected publish to fail")
+	}
+
+	// Discard old should evict the same messages on every replica.
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:     "OLD",
+		Subjects: []string{"old"},
+		Replicas: 3,
+		Discard:  server.DiscardOld,
+		MaxMsgs:  10,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 25; i++ {
+		if _, err := js.Publish("old", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		for _, cs := range c.servers {
+			mset, err := cs.GlobalAccount().LookupStream("OLD")
+			if err != nil {
+				return err
+			}
+			if state := mset.State(); state.Msgs != 10 || state.FirstSeq != 16 || state.LastSeq != 25 {
+				return fmt.Errorf("Unexpected state on %q: %+v", cs.Name(), state)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterMaxMsgsPerSubject(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	const max = 3
+	cfg := &server.StreamConfig{
+		Name:              "KV",
+		Subjects:          []string{"kv.*"},
+		Replicas:          3,
+		MaxMsgsPerSubject: max,
+		Storage:           server.FileStorage,
+	}
+	req, _ := json.Marshal(cfg)
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+	c.waitOnStreamLeader("$G", "KV")
+
+	// Send bursts without waiting so many messages for the same subject cross the limit together.
+	const subjects, perSubject = 5, 20
+	sendBurst := func() {
+		t.Helper()
+		sub, _ := nc.SubscribeSync(nats.NewInbox())
+		defer sub.Unsubscribe()
+		for i := 0; i < perSubject; i++ {
+			for j := 0; j < subjects; j++ {
+				if err := nc.PublishRequest(fmt.Sprintf("kv.%d", j), sub.Subject, []byte("OK")); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+		}
+		checkSubsPending(t, sub, subjects*perSubject)
+		for i := 0; i < subjects*perSubject; i++ {
+			m, _ := sub.NextMsg(0)
+			var pa server.JSPubAckResponse
+			if err := json.Unmarshal(m.Data, &pa); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if pa.Error != nil {
+				t.Fatalf("Unexpected error: %+v", pa.Error)
+			}
+		}
+	}
+	// Returns the sequences per subject a server has.
+	stored := func(cs *server.Server) map[string][]uint64 {
+		t.Helper()
+		mset, err := cs.GlobalAccount().LookupStream("KV")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		seqs := make(map[string][]uint64)
+		state := mset.State()
+		for seq := state.FirstSeq; seq > 0 && seq <= state.LastSeq; seq++ {
+			if sm, err := mset.GetMsg(seq); err == nil {
+				seqs[sm.Subject] = append(seqs[sm.Subject], seq)
+			}
+		}
+		return seqs
+	}
+	// Every replica should keep only the last max messages per subject.
+	checkReplicas := func(expected map[string][]uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			for _, cs := range c.servers {
+				if !cs.Running() {
+					continue
+				}
+				if seqs := stored(cs); !reflect.DeepEqual(seqs, expected) {
+					return fmt.Errorf("Expected %v on %q, got %v", expected, cs.Name(), seqs)
+				}
+			}
+			return nil
+		})
+	}
+	expected := func(start uint64) map[string][]uint64 {
+		seqs := make(map[string][]uint64)
+		for seq := start; seq < start+subjects*perSubject; seq++ {
+			subj := fmt.Sprintf("kv.%d", (seq-start)%subjects)
+			if ss := append(seqs[subj], seq); len(ss) > max {
+				seqs[subj] = ss[1:]
+			} else {
+				seqs[subj] = ss
+			}
+		}
+		return seqs
+	}
+
+	sendBurst()
+	checkReplicas(expected(1))
+
+	// A new leader has to pick up enforcement.
+	sl := c.streamLeader("$G", "KV")
+	if sl == s {
+		nc.Close()
+		nc, _ = jsClientConnect(t, c.randomNonStreamLeader("$G", "KV"))
+		defer nc.Close()
+	}
+	sl.Shutdown()
+	c.waitOnStreamLeader("$G", "KV")
+	sendBurst()
+	checkReplicas(expected(subjects*perSubject + 1))
+
+	// The old leader should evict the same sequences once back.
+	sl = c.restartServer(sl)
+	c.waitOnStreamCurrent(sl, "$G", "KV")
+	checkReplicas(expected(subjects*perSubject + 1))
+}
+
+func TestJetStreamClusterRetentionHold(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	request := func(subj string, cfg *server.StreamConfig) {
+		t.Helper()
+		req, _ := json.Marshal(cfg)
+		resp, err := nc.Request(fmt.Sprintf(subj, cfg.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var scResp server.JSApiStreamCreateResponse
+		if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if scResp.StreamInfo == nil || scResp.Error != nil {
+			t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+		}
+	}
+	limits := &server.StreamConfig{
+		Name:          "LIMITS",
+		Subjects:      []string{"limits"},
+		Replicas:      3,
+		MaxMsgs:       10,
+		RetentionHold: true,
+		Storage:       server.FileStorage,
+	}
+	request(server.JSApiStreamCreateT, limits)
+	interest := &server.StreamConfig{
+		Name:          "INTEREST",
+		Subjects:      []string{"interest"},
+		Replicas:      3,
+		Retention:     server.InterestPolicy,
+		RetentionHold: true,
+		Storage:       server.FileStorage,
+	}
+	request(server.JSApiStreamCreateT, interest)
+	if _, err := js.AddConsumer("INTEREST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.waitOnConsumerLeader("$G", "INTEREST", "dlc")
+
+	const toSend = 50
+	for i := 0; i < toSend; i++ {
+		for _, subj := range []string{"limits", "interest"} {
+			if _, err := js.Publish(subj, []byte("HOLD")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+	// Ack the first 30 and the 40th, leaving a contiguous run and a single message to remove.
+	for i := 1; i <= 40; i++ {
+		m, err := nc.Request(fmt.Sprintf(server.JSApiRequestNextT, "INTEREST", "dlc"), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if i <= 30 || i == 40 {
+			m.Respond(nil)
+		}
+	}
+	nc.Flush()
+
+	checkReplicas := func(stream string, check func(mset *server.Stream) error) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+			for _, cs := range c.servers {
+				mset, err := cs.GlobalAccount().LookupStream(stream)
+				if err != nil {
+					return err
+				}
+				if err := check(mset); err != nil {
+					return fmt.Errorf("%s: %v", cs.Name(), err)
+				}
+			}
+			return nil
+		})
+	}
+	all := func(mset *server.Stream) error {
+		if state := mset.State(); state.Msgs != toSend || state.FirstSeq != 1 {
+			return fmt.Errorf("Expected all %d msgs held, got %+v", toSend, state)
+		}
+		return nil
+	}
+
+	// Nothing is removed while held, past limits or once acked.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		ci, err := js.ConsumerInfo("INTEREST", "dlc")
+		if err != nil {
+			return err
+		}
+		if ci.AckFloor.Stream != 30 {
+			return fmt.Errorf("Expected an ack floor of 30, got %d", ci.AckFloor.Stream)
+		}
+		return nil
+	})
+	time.Sleep(250 * time.Millisecond)
+	checkReplicas("LIMITS", all)
+	checkReplicas("INTEREST", all)
+
+	// Lifting the hold removes what was acked on every replica.
+	interest.RetentionHold = false
+	request(server.JSApiStreamUpdateT, interest)
+	checkReplicas("INTEREST", func(mset *server.Stream) error {
+		if state := mset.State(); state.Msgs != toSend-31 || state.FirstSeq != 31 {
+			return fmt.Errorf("Expected %d msgs from 31, got %+v", toSend-31, state)
+		}
+		if _, err := mset.GetMsg(40); err == nil {
+			return fmt.Errorf("Expected msg 40 to be removed")
+		}
+		return nil
+	})
+	checkReplicas("LIMITS", all)
+}
+
+func TestJetStreamClusterAckLevels(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for name, level := range map[string]server.AckLevel{"QUORUM": server.AckLevelQuorum, "ALL": server.AckLevelAll} {
+		cfg := &server.StreamConfig{
+			Name:     name,
+			Subjects: []string{strings.ToLower(name)},
+			Replicas: 3,
+			AckLevel: level,
+			Storage:  server.FileStorage,
+		}
+		req, _ := json.Marshal(cfg)
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var scResp server.JSApiStreamCreateResponse
+		if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if scResp.StreamInfo == nil || scResp.Error != nil {
+			t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+		}
+	}
+	c.waitOnStreamLeader("$G", "QUORUM")
+	c.waitOnStreamLeader("$G", "ALL")
+
+	publish := func(subj string, timeout time.Duration) *server.JSPubAckResponse {
+		t.Helper()
+		m, err := nc.Request(subj, []byte("HELLO"), timeout)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var resp server.JSPubAckResponse
+		if err := json.Unmarshal(m.Data, &resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &resp
+	}
+	stored := func(stream string) (n int) {
+		t.Helper()
+		for _, cs := range c.servers {
+			if !cs.Running() {
+				continue
+			}
+			mset, err := cs.GlobalAccount().LookupStream(stream)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mset.State().Msgs == 1 {
+				n++
+			}
+		}
+		return n
+	}
+
+	// With all replicas up an ack for all means every replica has stored the message,
+	// followers apply it once they learn of the commit.
+	if resp := publish("all", 5*time.Second); resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if n := stored("ALL"); n != 3 {
+			return fmt.Errorf("Expected all 3 replicas to have the message, got %d", n)
+		}
+		return nil
+	})
+
+	// Take down a follower of both streams.
+	ql, al := c.streamLeader("$G", "QUORUM"), c.streamLeader("$G", "ALL")
+	var sf *server.Server
+	for _, cs := range c.servers {
+		if cs != ql && cs != al {
+			sf = cs
+			break
+		}
+	}
+	if sf == s {
+		nc.Close()
+		nc, _ = jsClientConnect(t, ql)
+		defer nc.Close()
+	}
+	sf.Shutdown()
+
+	// A quorum ack is not held on the missing replica and the remaining majority gets the message.
+	start := time.Now()
+	if resp := publish("quorum", 2*time.Second); resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Quorum ack took too long: %v", elapsed)
+	}
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if n := stored("QUORUM"); n != 2 {
+			return fmt.Errorf("Expected 2 replicas to have the message, got %d", n)
+		}
+		return nil
+	})
+
+	// An ack for all can not be satisfied with a replica down.
+	if resp := publish("all", 10*time.Second); resp.Error == nil || resp.Error.Code != 503 {
+		t.Fatalf("Expected a 503 error, got %+v", resp.Error)
+	}
+
+	// Once it is back and caught up acks for all are sent again.
+	sf = c.restartServer(sf)
+	c.waitOnServerCurrent(sf)
+	c.waitOnStreamCurrent(sf, "$G", "ALL")
+	checkFor(t, 10*time.Second, 250*time.Millisecond, func() error {
+		if resp := publish("all", 5*time.Second); resp.Error != nil {
+			return fmt.Errorf("Unexpected error: %+v", resp.Error)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterDoubleAdd(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R32", 2)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Check double add fails.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 2}); err == nil || err == nats.ErrTimeout {
+		t.Fatalf("Expected error but got none or timeout")
+	}
+
+	// Do Consumers too.
+	cfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy}
+	if _, err := js.AddConsumer("TEST", cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Check double add fails.
+	if _, err := js.AddConsumer("TEST", cfg); err == nil || err == nats.ErrTimeout {
+		t.Fatalf("Expected error but got none or timeout")
+	}
+}
+
+func TestJetStreamClusterMsgGetSingleResponder(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("TEST", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Have a follower lag behind, it should stay silent while the leader serves the read.
+	sl := c.streamLeader("$G", "TEST")
+	var lagging *server.Server
+	for _, cs := range c.servers {
+		if cs != sl && cs != s {
+			lagging = cs
+			break
+		}
+	}
+	lagging.Shutdown()
+	for i := 0; i < 100; i++ {
+		if _, err := js.Publish("TEST", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	c.restartServer(lagging)
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	req, _ := json.Marshal(&server.JSApiMsgGetRequest{Seq: 100})
+	if err := nc.PublishRequest(fmt.Sprintf(server.JSApiMsgGetT, "TEST"), sub.Subject, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkSubsPending(t, sub, 1)
+	// Make sure nobody else answers.
+	time.Sleep(250 * time.Millisecond)
+	if nmsgs, _, _ := sub.Pending(); nmsgs != 1 {
+		t.Fatalf("Expected a single response, got %d", nmsgs)
+	}
+	m, _ := sub.NextMsg(0)
+	var resp server.JSApiMsgGetResponse
+	if err := json.Unmarshal(m.Data, &resp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.Error != nil || resp.Message == nil || resp.Message.Sequence != 100 || string(resp.Message.Data) != "JSC-OK" {
+		t.Fatalf("Did not receive correct response: %+v", resp.Error)
+	}
+}
+
+func TestJetStreamClusterMirrorAcrossFailover(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "S", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish("foo", []byte("JSC-OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+	sendBatch(50)
+
+	// Leave a gap in the source.
+	req, _ := json.Marshal(&server.JSApiMsgDeleteRequest{Seq: 10})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiMsgDeleteT, "S"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var dResp server.JSApiMsgDeleteResponse
+	if err := json.Unmarshal(resp.Data, &dResp); err != nil || !dResp.Success {
+		t.Fatalf("Got a bad response %+v", dResp.Error)
+	}
+
+	cfg := server.StreamConfig{
+		Name:     "M",
+		Mirror:   &server.StreamSource{Name: "S"},
+		Replicas: 3,
+		Storage:  server.FileStorage,
+	}
+	req, _ = json.Marshal(cfg)
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+
+	checkMirror := func(expected uint64) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+			si, err := js.StreamInfo("M")
+			if err != nil {
+				return err
+			}
+			if si.State.Msgs != expected {
+				return fmt.Errorf("Expected %d msgs in the mirror, got %d", expected, si.State.Msgs)
+			}
+			return nil
+		})
+	}
+	checkMirror(49)
+
+	// Fail over the mirror leader while the source keeps going.
+	ml := c.streamLeader("$G", "M")
+	if ml == s {
+		nc.Close()
+		nc, js = jsClientConnect(t, c.randomNonStreamLeader("$G", "M"))
+		defer nc.Close()
+	}
+	ml.Shutdown()
+	c.waitOnStreamLeader("$G", "S")
+	sendBatch(50)
+	c.waitOnStreamLeader("$G", "M")
+	checkMirror(99)
+
+	// Make sure we have every source message once and in order.
+	expected := uint64(1)
+	for seq := uint64(1); seq <= 99; seq++ {
+		req, _ := json.Marshal(&server.JSApiMsgGetRequest{Seq: seq})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiMsgGetT, "M"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var mResp server.JSApiMsgGetResponse
+		if err := json.Unmarshal(resp.Data, &mResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if mResp.Error != nil || mResp.Message == nil {
+			t.Fatalf("Did not receive correct response: %+v", mResp.Error)
+		}
+		if expected == 10 {
+			expected++
+		}
+		if hdr := string(mResp.Message.Header); !strings.Contains(hdr, fmt.Sprintf("%s: %d\r\n", server.JSMirrorSeq, expected)) {
+			t.Fatalf("Expected source sequence %d for mirror sequence %d, got %q", expected, seq, hdr)
+		}
+		expected++
+	}
+}
+
+func TestJetStreamClusterStreamNormalCatchup(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo", "bar"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend := 10
+	for i := 1; i <= toSend; i++ {
+		msg := []byte(fmt.Sprintf("HELLO JSC-%d", i))
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	sl := c.streamLeader("$G", "TEST")
+	sl.Shutdown()
+	c.waitOnStreamLeader("$G", "TEST")
+
+	// Send 10 more while one replica offline.
+	for i := toSend; i <= toSend*2; i++ {
+		msg := []byte(fmt.Sprintf("HELLO JSC-%d", i))
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Delete the first from the second batch.
+	dreq := server.JSApiMsgDeleteRequest{Seq: uint64(toSend)}
+	dreqj, err := json.Marshal(dreq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, _ := nc.Request(fmt.Sprintf(server.JSApiMsgDeleteT, "TEST"), dreqj, time.Second)
+	var delMsgResp server.JSApiMsgDeleteResponse
+	if err = json.Unmarshal(resp.Data, &delMsgResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !delMsgResp.Success || delMsgResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", delMsgResp.Error)
+	}
+
+	sl = c.restartServer(sl)
+	c.checkClusterFormed()
+
+	c.waitOnServerCurrent(sl)
+	c.waitOnStreamCurrent(sl, "$G", "TEST")
+}
+
+func TestJetStreamClusterStreamSnapshotCatchup(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pseq := uint64(1)
+	sendBatch := func(n int) {
+		t.Helper()
+		// Send a batch.
+		for i := 0; i < n; i++ {
+			msg := []byte(fmt.Sprintf("HELLO JSC-%d", pseq))
+			if _, err = js.Publish("foo", msg); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+			pseq++
+		}
+	}
+
+	sendBatch(2)
+
+	sl := c.streamLeader("$G", "TEST")
+
+	sl.Shutdown()
+	c.waitOnStreamLeader("$G", "TEST")
+
+	sendBatch(100)
+
+	deleteMsg := func(seq uint64) {
+		if err := js.DeleteMsg("TEST", seq); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Delete the first from the second batch.
+	deleteMsg(pseq / 2)
+	// Delete the next one too.
+	deleteMsg(pseq/2 + 1)
+
+	nsl := c.streamLeader("$G", "TEST")
+
+	nsl.JetStreamSnapshotStream("$G", "TEST")
+
+	// Do some activity post snapshot as well.
+	// Delete next to last.
+	deleteMsg(pseq - 2)
+	// Send another batch.
+	sendBatch(100)
+
+	sl = c.restartServer(sl)
+	c.checkClusterFormed()
+
+	c.waitOnServerCurrent(sl)
+	c.waitOnStreamCurrent(sl, "$G", "TEST")
+}
+
+func TestJetStreamClusterStreamSnapshotCatchupWithPurge(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R5S", 5)
+	defer c.shutdown()
+
+	s := c.randomServer()
+
+	// Client based API
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sl := c.streamLeader("$G", "TEST")
+
+	sl.Shutdown()
+	c.waitOnStreamLeader("$G", "TEST")
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	nsl := c.streamLeader("$G", "TEST")
+	if err := nsl.JetStreamSnapshotStream("$G", "TEST"); err != nil {
+		t.Fatalf("Error snapshotting stream: %v", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	sl = c.restartServer(sl)
+	c.checkClusterFormed()
+
+	// Now purge the stream while we are recovering.
+	if err := js.PurgeStream("TEST"); err != nil {
+		t.Fatalf("Unexpected purge error: %v", err)
+	}
+
+	c.waitOnServerCurrent(sl)
+	c.waitOnStreamCurrent(sl, "$G", "TEST")
+
+	nsl.Shutdown()
+	c.waitOnStreamLeader("$G", "TEST")
+
+	if _, err := js.StreamInfo("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamClusterExtendedStreamInfo(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend := 50
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	leader := c.streamLeader("$G", "TEST").Name()
+
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Cluster == nil {
+		t.Fatalf("Expected cluster info")
+	}
+	if si.Cluster.Name != c.name {
+		t.Fatalf("Expected cluster name of %q, got %q", c.name, si.Cluster.Name)
+	}
+
+	if si.Cluster.Leader != leader {
+		t.Fatalf("Expected leader of %q, got %q", leader, si.Cluster.Leader)
+	}
+	if len(si.Cluster.Replicas) != 2 {
+		t.Fatalf("Expected %d replicas, got %d", 2, len(si.Cluster.Replicas))
+	}
+
+	// We may need to wait a bit for peers to catch up.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, peer := range si.Cluster.Replicas {
+			if !peer.Current {
+				if si, err = js.StreamInfo("TEST"); err != nil {
+					t.Fatalf("Could not retrieve stream info")
+				}
+				return fmt.Errorf("Expected replica to be current: %+v", peer)
+			}
+		}
+		return nil
+	})
+
+	// Shutdown the leader.
+	oldLeader := c.streamLeader("$G", "TEST")
+	oldLeader.Shutdown()
+
+	c.waitOnStreamLeader("$G", "TEST")
+
+	// Re-request. The old leader hands off leadership as it shuts down, so the new leader
+	// has heard from it recently and will only report it as not current once it times out.
+	leader = c.streamLeader("$G", "TEST").Name()
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		si, err = js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.Cluster == nil {
+			t.Fatalf("Expected cluster info")
+		}
+		if si.Cluster.Leader != leader {
+			t.Fatalf("Expected leader of %q, got %q", leader, si.Cluster.Leader)
+		}
+		if len(si.Cluster.Replicas) != 2 {
+			t.Fatalf("Expected %d replicas, got %d", 2, len(si.Cluster.Replicas))
+		}
+		for _, peer := range si.Cluster.Replicas {
+			if peer.Name == oldLeader.Name() {
+				if peer.Current {
+					return fmt.Errorf("Expected old leader to be reported as not current: %+v", peer)
+				}
+			} else if !peer.Current {
+				t.Fatalf("Expected replica to be current: %+v", peer)
+			}
+		}
+		return nil
+	})
+
+	// Now send a few more messages then restart the oldLeader.
+	for i := 0; i < 10; i++ {
+		if _, err = js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	oldLeader = c.restartServer(oldLeader)
+	c.waitOnStreamCurrent(oldLeader, "$G", "TEST")
+
+	// Re-request.
+	leader = c.streamLeader("$G", "TEST").Name()
+	si, err = js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Cluster == nil {
+		t.Fatalf("Expected cluster info")
+	}
+	if si.Cluster.Leader != leader {
+		t.Fatalf("Expected leader of %q, got %q", leader, si.Cluster.Leader)
+	}
+	if len(si.Cluster.Replicas) != 2 {
+		t.Fatalf("Expected %d replicas, got %d", 2, len(si.Cluster.Replicas))
+	}
+	// We may need to wait a bit for peers to catch up.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, peer := range si.Cluster.Replicas {
+			if !peer.Current {
+				if si, err = js.StreamInfo("TEST"); err != nil {
+					t.Fatalf("Could not retrieve stream info")
+				}
+				return fmt.Errorf("Expected replica to be current: %+v", peer)
+			}
+		}
+		return nil
+	})
+
+	// Now do consumer.
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"), nats.Pull(10))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+	checkSubsPending(t, sub, 10)
+
+	leader = c.consumerLeader("$G", "TEST", "dlc").Name()
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+
+	if ci.Cluster.Leader != leader {
+		t.Fatalf("Expected leader of %q, got %q", leader, ci.Cluster.Leader)
+	}
+	if len(ci.Cluster.Replicas) != 2 {
+		t.Fatalf("Expected %d replicas, got %d", 2, len(ci.Cluster.Replicas))
+	}
+	for _, peer := range ci.Cluster.Replicas {
+		if !peer.Current {
+			t.Fatalf("Expected replica to be current: %+v", peer)
+		}
+	}
+}
+
+func TestJetStreamClusterExtendedStreamInfoSingleReplica(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend := 50
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	leader := c.streamLeader("$G", "TEST").Name()
+
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Cluster == nil {
+		t.Fatalf("Expected cluster info")
+	}
+	if si.Cluster.Name != c.name {
+		t.Fatalf("Expected cluster name of %q, got %q", c.name, si.Cluster.Name)
+	}
+	if si.Cluster.Leader != leader {
+		t.Fatalf("Expected leader of %q, got %q", leader, si.Cluster.Leader)
+	}
+	if len(si.Cluster.Replicas) != 0 {
+		t.Fatalf("Expected no replicas but got %d", len(si.Cluster.Replicas))
+	}
+
+	// Make sure we can grab consumer lists from any server.
+	cl := js.NewConsumerLister("TEST")
+	if !cl.Next() {
+		t.Fatalf("Unexpected error: %v", cl.Err())
+	}
+	p := cl.Page()
+	if len(p) != 0 {
+		t.Fatalf("ConsumerInfo expected no paged results, got %d", len(p))
+	}
+
+	// Now add in a consumer.
+	cfg := &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy}
+	if _, err := js.AddConsumer("TEST", cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cl = js.NewConsumerLister("TEST")
+	if !cl.Next() {
+		t.Fatalf("Unexpected error: %v", cl.Err())
+	}
+	p = cl.Page()
+	if len(p) != 1 {
+		t.Fatalf("ConsumerInfo expected 1 result, got %d", len(p))
+	}
+
+	// Now do direct names list as well.
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumersT, "TEST"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var clResponse server.JSApiConsumerNamesResponse
+	if err = json.Unmarshal(resp.Data, &clResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(clResponse.Consumers) != 1 {
+		t.Fatalf("Expected only 1 consumer but got %d", len(clResponse.Consumers))
+	}
+
+}
+
+func TestJetStreamClusterEphemeralConsumerCleanup(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "foo", Replicas: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sub, err := js.Subscribe("foo", func(m *nats.Msg) {})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ci, _ := sub.ConsumerInfo()
+	if ci == nil {
+		t.Fatalf("Unexpected error: no consumer info")
+	}
+
+	// We will look up by hand this consumer to set inactive threshold lower for this test.
+	cl := c.consumerLeader("$G", "foo", ci.Name)
+	if cl == nil {
+		t.Fatalf("Could not find consumer leader")
+	}
+	mset, err := cl.GlobalAccount().LookupStream("foo")
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", "foo")
+	}
+	o := mset.LookupConsumer(ci.Name)
+	if o == nil {
+		t.Fatalf("Error looking up consumer %q", ci.Name)
+	}
+	o.SetInActiveDeleteThreshold(10 * time.Millisecond)
+
+	msg, toSend := []byte("Hello JS Clustering"), 10
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	getConsumers := func() []string {
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumersT, "foo"), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var clResponse server.JSApiConsumerNamesResponse
+		if err = json.Unmarshal(resp.Data, &clResponse); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return clResponse.Consumers
+	}
+
+	checkConsumer := func(expected int) {
+		consumers := getConsumers()
+		if len(consumers) != expected {
+			t.Fatalf("Expected %d consumers but got %d", expected, len(consumers))
+		}
+	}
+
+	checkConsumer(1)
+
+	// Now Unsubscribe, since this is ephemeral this will make this go away.
+	sub.Unsubscribe()
+
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if consumers := getConsumers(); len(consumers) == 0 {
+			return nil
+		} else {
+			return fmt.Errorf("Still %d consumers remaining", len(consumers))
+		}
+	})
+}
+
+func TestJetStreamClusterUserSnapshotAndRestore(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 2,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend, batchSize := 200, 50
+
+	for i := 0; i < toSend; i++ {
+		if _, err = js.Publish("foo", []byte("OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// Create a consumer as well and give it a non-simplistic state.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, AckWait: time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	jsub, err := js.SubscribeSync("foo", nats.Attach("TEST", "dlc"), nats.Pull(batchSize))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkSubsPending(t, jsub, batchSize)
+	// Ack first 50.
+	for i := 1; i <= 50; i++ {
+		m, err := jsub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg %d: %v", i, err)
+		}
+		m.Ack()
+	}
+	// Now ack every third message for next 50.
+	for i := 51; i <= 100; i++ {
+		m, err := jsub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg %d: %v", i, err)
+		}
+		if i%3 == 0 {
+			m.Ack()
+		}
+	}
+
+	// Snapshot consumer info.
+	time.Sleep(100 * time.Millisecond)
+	ci, err := jsub.ConsumerInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error getting consumer info: %v", err)
+	}
+
+	sreq := &server.JSApiStreamSnapshotRequest{
+		DeliverSubject: nats.NewInbox(),
+		ChunkSize:      512,
+	}
+
+	req, _ := json.Marshal(sreq)
+	rmsg, err := nc.Request(fmt.Sprintf(server.JSApiStreamSnapshotT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error on snapshot request: %v", err)
+	}
+
+	var resp server.JSApiStreamSnapshotResponse
+	json.Unmarshal(rmsg.Data, &resp)
+	if resp.Error != nil {
+		t.Fatalf("Did not get correct error response: %+v", resp.Error)
+	}
+
+	// Grab state for comparison.
+	state := *resp.State
+	config := *resp.Config
+
+	var snapshot []byte
+	done := make(chan bool)
+
+	sub, _ := nc.Subscribe(sreq.DeliverSubject, func(m *nats.Msg) {
+		// EOF
+		if len(m.Data) == 0 {
+			done <- true
+			return
+		}
+		// Could be writing to a file here too.
+		snapshot = append(snapshot, m.Data...)
+		// Flow ack
+		m.Respond(nil)
+	})
+	defer sub.Unsubscribe()
+
+	// Wait to receive the snapshot.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive our snapshot in time")
+	}
+
+	var rresp server.JSApiStreamRestoreResponse
+	rreq := &server.JSApiStreamRestoreRequest{
+		Config: config,
+		State:  state,
+	}
+	req, _ = json.Marshal(rreq)
+
+	// Make sure a restore to an existing stream fails.
+	rmsg, err = nc.Request(fmt.Sprintf(server.JSApiStreamRestoreT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	json.Unmarshal(rmsg.Data, &rresp)
+	if rresp.Error == nil || rresp.Error.Code != 500 || !strings.Contains(rresp.Error.Description, "already in use") {
+		t.Fatalf("Did not get correct error response: %+v", rresp.Error)
+	}
+
+	if _, err := js.StreamInfo("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Now make sure a restore will work.
+	// Delete our stream first.
+	if err := js.DeleteStream("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// This should work properly.
+	rmsg, err = nc.Request(fmt.Sprintf(server.JSApiStreamRestoreT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	rresp.Error = nil
+	json.Unmarshal(rmsg.Data, &rresp)
+	if rresp.Error != nil {
+		t.Fatalf("Got an unexpected error response: %+v", rresp.Error)
+	}
+
+	// Send our snapshot back in to restore the stream.
+	// Can be any size message.
+	var chunk [1024]byte
+	for r := bytes.NewReader(snapshot); ; {
+		n, err := r.Read(chunk[:])
+		if err != nil {
+			break
+		}
+		nc.Request(rresp.DeliverSubject, chunk[:n], time.Second)
+	}
+	rmsg, err = nc.Request(rresp.DeliverSubject, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rresp.Error = nil
+	json.Unmarshal(rmsg.Data, &rresp)
+	if rresp.Error != nil {
+		t.Fatalf("Got an unexpected error response: %+v", rresp.Error)
+	}
+
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si == nil || si.Config.Name != "TEST" || si.State.Msgs != uint64(toSend) {
+		t.Fatalf("StreamInfo is not correct %+v", si)
+	}
+
+	// Make sure the replicas become current eventually. They will be doing catchup.
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		si, _ := js.StreamInfo("TEST")
+		if si == nil || si.Cluster == nil {
+			t.Fatalf("Did not get stream info")
+		}
+		for _, pi := range si.Cluster.Replicas {
+			if !pi.Current {
+				return fmt.Errorf("Peer not current: %+v", pi)
+			}
+		}
+		return nil
+	})
+
+	// Wait on the system to elect a leader for the restored consumer.
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	// Now check for the consumer being recreated.
+	nci, err := js.ConsumerInfo("TEST", "dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if nci.Delivered != ci.Delivered {
+		t.Fatalf("Delivered states do not match %+v vs %+v", nci.Delivered, ci.Delivered)
+	}
+	if nci.AckFloor != ci.AckFloor {
+		t.Fatalf("Ack floors did not match %+v vs %+v", nci.AckFloor, ci.AckFloor)
+	}
+
+	// Make sure consumer works.
+	// It should pick up with the next delivery spot, so check for that as first message.
+	// We should have all the messages for first delivery delivered.
+	start := 101
+	end := toSend
+	for i := start; i <= end; i++ {
+		m, err := jsub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting msg: %v", err)
+		}
+		meta, err := m.MetaData()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if meta.Stream != uint64(i) {
+			t.Fatalf("Expected stream sequence of %d, but got %d", i, meta.Stream)
+		}
+		m.Ack()
+	}
+
+	// Check that redelivered come in now..
+	redelivered := 50/3 + 1
+	checkSubsPending(t, jsub, redelivered)
+}
+
+func TestJetStreamClusterAccountInfoAndLimits(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R5S", 5)
+	defer c.shutdown()
+
+	// Adjust our limits.
+	c.updateLimits("$G", &server.JetStreamAccountLimits{
+		MaxMemory:    1024,
+		MaxStore:     8000,
+		MaxStreams:   3,
+		MaxConsumers: 1,
+	})
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "foo", Replicas: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "bar", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "baz", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sendBatch := func(subject string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish(subject, []byte("JSC-OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+
+	sendBatch("foo", 25)
+	sendBatch("bar", 75)
+	sendBatch("baz", 10)
+
+	accountStats := func() *server.JetStreamAccountStats {
+		t.Helper()
+		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var info server.JSApiAccountInfoResponse
+		if err := json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if info.Error != nil {
+			t.Fatalf("Unexpected error: %+v", info.Error)
+		}
+		if info.JetStreamAccountStats == nil {
+			t.Fatalf("AccountStats missing")
+		}
+		return info.JetStreamAccountStats
+	}
+
+	// If subject is not 3 letters or payload not 2 this needs to change.
+	const msgSize = uint64(22 + 3 + 6 + 8)
+
+	stats := accountStats()
+	if stats.Streams != 3 {
+		t.Fatalf("Should have been tracking 3 streams, found %d", stats.Streams)
+	}
+	expectedSize := 25*msgSize + 75*msgSize*2 + 10*msgSize*3
+	// This may lag.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if stats.Store != expectedSize {
+			stats = accountStats()
+			return fmt.Errorf("Expected store size to be %d, got %+v\n", expectedSize, stats)
+		}
+		return nil
+	})
+
+	// Check limit enforcement.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "fail", Replicas: 3}); err == nil {
+		t.Fatalf("Expected an error but got none")
+	}
+
+	// We should be at 7995 at the moment with a limit of 8000, so any message will go over.
+	if _, err := js.Publish("baz", []byte("JSC-NOT-OK")); err == nil {
+		t.Fatalf("Expected publish error but got none")
+	}
+
+	// Check consumers
+	_, err := js.AddConsumer("foo", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// This should fail.
+	_, err = js.AddConsumer("foo", &nats.ConsumerConfig{Durable: "dlc22", AckPolicy: nats.AckExplicitPolicy})
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+}
+
+func TestJetStreamClusterStreamLimits(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Check that large R will fail.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "foo", Replicas: 5}); err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+
+	maxMsgs := 5
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:       "foo",
+		Replicas:   3,
+		Retention:  nats.LimitsPolicy,
+		Discard:    server.DiscardNew,
+		MaxMsgSize: 11,
+		MaxMsgs:    int64(maxMsgs),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Large message should fail.
+	if _, err := js.Publish("foo", []byte("0123456789ZZZ")); err == nil {
+		t.Fatalf("Expected publish to fail")
+	}
+
+	for i := 0; i < maxMsgs; i++ {
+		if _, err := js.Publish("foo", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	// These should fail.
+	if _, err := js.Publish("foo", []byte("JSC-OK")); err == nil {
+		t.Fatalf("Expected publish to fail")
+	}
+
+}
+
+func TestJetStreamClusterStreamInterestOnlyPolicy(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:      "foo",
+		Replicas:  3,
+		Retention: nats.InterestPolicy,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toSend := 10
+
+	// With no interest these should be no-ops.
+	for i := 0; i < toSend; i++ {
+		if _, err := js.Publish("foo", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	si, err := js.StreamInfo("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.State.Msgs != 0 {
+		t.Fatalf("Expected no messages with no interest, got %d", si.State.Msgs)
+	}
+
+	// Now create a consumer.
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < toSend; i++ {
+		if _, err := js.Publish("foo", []byte("JSC-OK")); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	checkSubsPending(t, sub, toSend)
+
+	si, err = js.StreamInfo("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d messages with interest, got %d", toSend, si.State.Msgs)
+	}
+	if si.State.FirstSeq != uint64(toSend+1) {
+		t.Fatalf("Expected first sequence of %d, got %d", toSend+1, si.State.FirstSeq)
+	}
+
+	// Now delete the consumer.
+	sub.Unsubscribe()
+	if err := js.DeleteConsumer("foo", "dlc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Wait for the messages to be purged.
+	checkFor(t, 5*time.Second, 20*time.Millisecond, func() error {
+		si, err := js.StreamInfo("foo")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if si.State.Msgs == 0 {
+			return nil
+		}
+		return fmt.Errorf("Wanted 0 messages, got %d", si.State.Msgs)
+	})
+}
+
+// These are disabled for now.
+func TestJetStreamClusterStreamTemplates(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// List API
+	var tListResp server.JSApiStreamTemplateNamesResponse
+	resp, err := nc.Request(server.JSApiTemplates, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &tListResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tListResp.Error == nil {
+		t.Fatalf("Expected an unsupported error, got none")
+	}
+	if !strings.Contains(tListResp.Error.Description, "not currently supported in clustered mode") {
+		t.Fatalf("Did not get correct error response: %+v", tListResp.Error)
+	}
+
+	// Create
+	// Now do templates.
+	mcfg := &server.StreamConfig{
+		Subjects: []string{"kv.*"},
+		Storage:  server.MemoryStorage,
+	}
+	template := &server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     mcfg,
+		MaxStreams: 4,
+	}
+	req, err := json.Marshal(template)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var stResp server.JSApiStreamTemplateCreateResponse
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, template.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stResp.Error == nil {
+		t.Fatalf("Expected an unsupported error, got none")
+	}
+	if !strings.Contains(stResp.Error.Description, "not currently supported in clustered mode") {
+		t.Fatalf("Did not get correct error response: %+v", stResp.Error)
+	}
+}
+
+func TestJetStreamClusterExtendedAccountInfo(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sendBatch := func(subject string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish(subject, []byte("JSC-OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+
+	// Add in some streams with msgs and consumers.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-1", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-1", 25)
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-2", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-2", 50)
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-3", Replicas: 3, Storage: nats.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-3"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-3", 100)
+
+	// Go client will lag so use direct for now.
+	getAccountInfo := func() *server.JetStreamAccountStats {
+		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var info server.JSApiAccountInfoResponse
+		if err := json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return info.JetStreamAccountStats
+	}
+
+	ai := getAccountInfo()
+	if ai.Streams != 3 || ai.Consumers != 3 {
+		t.Fatalf("AccountInfo not correct: %+v", ai)
+	}
+	if ai.API.Total < 10 {
+		t.Fatalf("Expected at least 10 total API calls, got %d", ai.API.Total)
+	}
+
+	// Now do a failure to make sure we track API errors.
+	js.StreamInfo("NO-STREAM")
+	js.ConsumerInfo("TEST-1", "NO-CONSUMER")
+	js.ConsumerInfo("TEST-2", "NO-CONSUMER")
+	js.ConsumerInfo("TEST-3", "NO-CONSUMER")
+
+	ai = getAccountInfo()
+	if ai.API.Errors != 4 {
+		t.Fatalf("Expected 4 API calls to be errors, got %d", ai.API.Errors)
+	}
+}
+
+func TestJetStreamClusterNoQuorumStepdown(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Setup subscription for leader elected.
+	lesub, err := nc.SubscribeSync(server.JSAdvisoryStreamLeaderElectedPre + ".*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "NO-Q", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Make sure we received our leader elected advisory.
+	leadv, _ := lesub.NextMsg(0)
+	if leadv == nil {
+		t.Fatalf("Expected to receive a leader elected advisory")
+	}
+	var le server.JSStreamLeaderElectedAdvisory
+	if err := json.Unmarshal(leadv.Data, &le); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ln := c.streamLeader("$G", "NO-Q").Name(); le.Leader != ln {
+		t.Fatalf("Expected to have leader %q in elect advisory, got %q", ln, le.Leader)
+	}
+
+	payload := []byte("Hello JSC")
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish("NO-Q", payload); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Setup subscription for leader elected.
+	clesub, err := nc.SubscribeSync(server.JSAdvisoryConsumerLeaderElectedPre + ".*.*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sub, err := js.SubscribeSync("NO-Q")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ci, err := sub.ConsumerInfo()
+	if err != nil || ci == nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Make sure we received our consumer leader elected advisory.
+	leadv, _ = clesub.NextMsg(0)
+	if leadv == nil {
+		t.Fatalf("Expected to receive a consumer leader elected advisory")
+	}
+
+	// Setup subscriptions for lost quorum advisory.
+	ssub, err := nc.SubscribeSync(server.JSAdvisoryStreamQuorumLostPre + ".*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	csub, err := nc.SubscribeSync(server.JSAdvisoryConsumerQuorumLostPre + ".*.*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc.Flush()
+
+	// Shutdown the non-leader.
+	c.randomNonStreamLeader("$G", "NO-Q").Shutdown()
+
+	// This should eventually have us stepdown as leader since we would have lost quorum with R=2.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if sl := c.streamLeader("$G", "NO-Q"); sl == nil {
+			return nil
+		}
+		return fmt.Errorf("Still have leader for stream")
+	})
+
+	notAvailableErr := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "unavailable")
+	}
+
+	// Expect to get errors here.
+	if _, err := js.StreamInfo("NO-Q"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if cl := c.consumerLeader("$G", "NO-Q", ci.Name); cl == nil {
+			return nil
+		}
+		return fmt.Errorf("Still have leader for consumer")
+	})
+
+	if _, err = js.ConsumerInfo("NO-Q", ci.Name); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if _, err := sub.ConsumerInfo(); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+
+	// Make sure we received our lost quorum advisories.
+	adv, _ := ssub.NextMsg(0)
+	if adv == nil {
+		t.Fatalf("Expected to receive a stream quorum lost advisory")
+	}
+	var lqa server.JSStreamQuorumLostAdvisory
+	if err := json.Unmarshal(adv.Data, &lqa); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(lqa.Replicas) != 2 {
+		t.Fatalf("Expected reports for both replicas, only got %d", len(lqa.Replicas))
+	}
+	// Consumer too. Since we do not know if the consumer leader was not the one shutdown
+	// we should wait for a bit for the system to detect.
+	adv, _ = csub.NextMsg(time.Second)
+	if adv == nil {
+		t.Fatalf("Expected to receive a consumer quorum lost advisory")
+	}
+	var clqa server.JSConsumerQuorumLostAdvisory
+	if err := json.Unmarshal(adv.Data, &clqa); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(clqa.Replicas) != 2 {
+		t.Fatalf("Expected reports for both replicas, only got %d", len(clqa.Replicas))
+	}
+
+	// Check to make sure we do not rapid fire these.
+	time.Sleep(500 * time.Millisecond)
+	checkSubsPending(t, csub, 0)
+
+	// Now let's take out the other non meta-leader server.
+	// We should get same error for general API calls.
+	c.randomNonLeader().Shutdown()
+	c.expectNoLeader()
+
+	// Now make sure the general JS API responds with system unavailable.
+	if _, err = js.AccountInfo(); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "NO-Q33", Replicas: 2}); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if _, err := js.UpdateStream(&nats.StreamConfig{Name: "NO-Q33", Replicas: 2}); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if err := js.DeleteStream("NO-Q"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if _, err := js.StreamInfo("NO-Q"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if err := js.PurgeStream("NO-Q"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if err := js.DeleteMsg("NO-Q", 1); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	// Consumer
+	if _, err := js.AddConsumer("NO-Q", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy}); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if err := js.DeleteConsumer("NO-Q", "dlc"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	if _, err := js.ConsumerInfo("NO-Q", "dlc"); !notAvailableErr(err) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", err)
+	}
+	// Listers
+	if sl := js.NewStreamLister(); sl.Next() || !notAvailableErr(sl.Err()) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", sl.Err())
+	}
+	if cl := js.NewConsumerLister("NO-Q"); cl.Next() || !notAvailableErr(cl.Err()) {
+		t.Fatalf("Expected an 'unavailable' error, got %v", cl.Err())
+	}
+}
+
+func TestJetStreamClusterRestartAndRemoveAdvisories(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("$JS.EVENT.ADVISORY.API")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	csub, err := nc.SubscribeSync("$JS.EVENT.ADVISORY.*.CREATED.>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer csub.Unsubscribe()
+	nc.Flush()
+
+	sendBatch := func(subject string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := js.Publish(subject, []byte("JSC-OK")); err != nil {
+				t.Fatalf("Unexpected publish error: %v", err)
+			}
+		}
+	}
+
+	// Add in some streams with msgs and consumers.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-1", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-1", nats.Durable("DC")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-1", 25)
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-2", Replicas: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-2", nats.Durable("DC")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-2", 50)
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST-3", Replicas: 3, Storage: nats.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.SubscribeSync("TEST-3", nats.Durable("DC")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendBatch("TEST-3", 100)
+
+	drainSub := func(sub *nats.Subscription) {
+		for _, err := sub.NextMsg(0); err == nil; _, err = sub.NextMsg(0) {
+		}
+	}
+
+	// Wait for the advisories for all streams and consumers.
+	// 3 streams, 3 consumers, 3 stream names lookups for creating consumers and 6 audits for the proposals.
+	checkSubsPending(t, sub, 15)
+	drainSub(sub)
+
+	// Created audit events.
+	checkSubsPending(t, csub, 6)
+	drainSub(csub)
+
+	usub, err := nc.SubscribeSync("$JS.EVENT.ADVISORY.*.UPDATED.>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer usub.Unsubscribe()
+	nc.Flush()
+
+	checkSubsPending(t, sub, 0)
+	checkSubsPending(t, usub, 0)
+
+	// Now restart the other two servers we are not connected to.
+	for _, cs := range c.servers {
+		if cs != s {
+			cs.Shutdown()
+			c.restartServer(cs)
+		}
+	}
+	c.waitOnAllCurrent()
+
+	checkSubsPending(t, csub, 0)
+	checkSubsPending(t, sub, 0)
+	checkSubsPending(t, usub, 0)
+
+	dsub, err := nc.SubscribeSync("$JS.EVENT.ADVISORY.*.DELETED.>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer dsub.Unsubscribe()
+	nc.Flush()
+
+	c.waitOnConsumerLeader("$G", "TEST-1", "DC")
+
+	// Now check delete advisories as well.
+	if err := js.DeleteConsumer("TEST-1", "DC"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, csub, 0)
+	checkSubsPending(t, dsub, 1)
+	checkSubsPending(t, sub, 2)
+	checkSubsPending(t, usub, 0)
+	drainSub(dsub)
+
+	if err := js.DeleteStream("TEST-3"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkSubsPending(t, dsub, 2) // Stream and the consumer underneath.
+	checkSubsPending(t, sub, 6)
+}
+
+func TestJetStreamClusterProposalAuditAdvisories(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Connect to a server that is not the meta leader, the audit should come from there.
+	s := c.randomNonLeader()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync(server.JSAuditAdvisory)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := js.DeleteStream("TEST"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Responses are audited as well, we only want the proposals here.
+	var actions []string
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for m, err := sub.NextMsg(0); err == nil; m, err = sub.NextMsg(0) {
+			var audit server.JSAPIAudit
+			if err := json.Unmarshal(m.Data, &audit); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if audit.Action == "" {
+				continue
+			}
+			if audit.Server != s.Name() {
+				t.Fatalf("Expected audit from %q, got %q", s.Name(), audit.Server)
+			}
+			if audit.Client == nil || audit.Client.Account != "$G" || audit.Client.Server != s.Name() {
+				t.Fatalf("Unexpected client info: %+v", audit.Client)
+			}
+			actions = append(actions, audit.Action)
+		}
+		if len(actions) < 2 {
+			return fmt.Errorf("Expected 2 audits, got %d", len(actions))
+		}
+		return nil
+	})
+	if expected := []string{`create stream "TEST"`, `delete stream "TEST"`}; !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("Expected actions %q, got %q", expected, actions)
+	}
+}
+
+func TestJetStreamClusterMaxRaftGroupsPlacement(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R4S", 4)
+	defer c.shutdown()
+
+	// Restart a server that is not the meta leader with room for nothing but the meta group.
+	full := c.randomNonLeader()
+	var opts *server.Options
+	for i, cs := range c.servers {
+		if cs == full {
+			opts = c.opts[i]
+		}
+	}
+	conf, err := ioutil.ReadFile(opts.ConfigFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf = bytes.Replace(conf, []byte("jetstream: {"), []byte("jetstream: {max_raft_groups: 1, "), 1)
+	if err := ioutil.WriteFile(opts.ConfigFile, conf, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	full.Shutdown()
+	full = c.restartServer(full)
+	c.waitOnServerCurrent(full)
+
+	nc, js := jsClientConnect(t, c.leader())
+	defer nc.Close()
+
+	// R3 in a cluster of 4 will land on the full server for some of these, they should all be moved.
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("TEST-%d", i)
+		si, err := js.AddStream(&nats.StreamConfig{Name: name, Replicas: 3})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if si.Config.Name != name {
+			t.Fatalf("Did not receive correct create response: %+v", si)
+		}
+		c.waitOnStreamLeader("$G", name)
+		si, err = js.StreamInfo(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if si.Cluster.Leader == full.Name() {
+			t.Fatalf("Expected stream %q to not be placed on %q", name, full.Name())
+		}
+		for _, r := range si.Cluster.Replicas {
+			if r.Name == full.Name() {
+				t.Fatalf("Expected stream %q to not be placed on %q", name, full.Name())
+			}
+		}
+	}
+}
+
+func TestJetStreamClusterNoDuplicateOnNodeRestart(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "ND", 2)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sub, err := js.SubscribeSync("foo", nats.Durable("dlc"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	js.Publish("foo", []byte("msg1"))
+	if m, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else {
+		m.Ack()
+	}
+
+	sl := c.streamLeader("$G", "TEST")
+	sl.Shutdown()
+	c.restartServer(sl)
+	c.waitOnStreamLeader("$G", "TEST")
+
+	// Send second msg
+	js.Publish("foo", []byte("msg2"))
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if string(msg.Data) != "msg2" {
+		t.Fatalf("Unexpected message: %s", msg.Data)
+	}
+	msg.Ack()
+
+	// Make sure we don't get a duplicate.
+	msg, err = sub.NextMsg(250 * time.Millisecond)
+	if err == nil {
+		t.Fatalf("Should have gotten an error, got %s", msg.Data)
+	}
+}
+
+func TestJetStreamClusterNoDupePeerSelection(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "NDP", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Create 10 streams. Make sure none of them have a replica
+	// that is the same as the leader.
+	for i := 1; i <= 10; i++ {
+		si, err := js.AddStream(&nats.StreamConfig{
+			Name:     fmt.Sprintf("TEST-%d", i),
+			Replicas: 3,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if si.Cluster == nil || si.Cluster.Leader == "" || len(si.Cluster.Replicas) != 2 {
+			t.Fatalf("Unexpected cluster state for stream info: %+v\n", si.Cluster)
+		}
+		// Make sure that the replicas are not same as the leader.
+		for _, pi := range si.Cluster.Replicas {
+			if pi.Name == si.Cluster.Leader {
+				t.Fatalf("Found replica that is same as leader, meaning 2 nodes placed on same server")
+			}
+		}
+		// Now do a consumer and check same thing.
+		sub, err := js.SubscribeSync(si.Config.Name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ci, err := sub.ConsumerInfo()
+		if err != nil {
+			t.Fatalf("Unexpected error getting consumer info: %v", err)
+		}
+		for _, pi := range ci.Cluster.Replicas {
+			if pi.Name == ci.Cluster.Leader {
+				t.Fatalf("Found replica that is same as leader, meaning 2 nodes placed on same server")
+			}
+		}
+	}
+}
+
+func TestJetStreamClusterStreamPerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	skip(t)
+
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	// Client based API
+	s := c.randomServer()
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Replicas: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	numConnections := 2
+	var conns []nats.JetStream
+	for i := 0; i < numConnections; i++ {
+		s := c.randomServer()
+		_, js := jsClientConnect(t, s)
+		conns = append(conns, js)
+	}
+
+	toSend := 100000
+	numProducers := 10
+
+	payload := []byte("Hello JSC")
+
+	startCh := make(chan bool)
+	var wg sync.WaitGroup
+
+	for n := 0; n < numProducers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			js := conns[rand.Intn(numConnections)]
+			<-startCh
+			for i := 0; i < int(toSend)/numProducers; i++ {
+				if _, err = js.Publish("foo", payload); err != nil {
+					t.Errorf("Unexpected publish error: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Wait for Go routines.
+	time.Sleep(250 * time.Millisecond)
+
+	start := time.Now()
+	close(startCh)
+	wg.Wait()
+
+	tt := time.Since(start)
+	fmt.Printf("Took %v to send %d msgs with %d producers and R=3!\n", tt, toSend, numProducers)
+	fmt.Printf("%.0f msgs/sec\n\n", float64(toSend)/tt.Seconds())
+}
+
+// Support functions
+
+var jsClusterTempl = `
+	listen: 127.0.0.1:-1
+	server_name: %s
+	jetstream: {max_mem_store: 256MB, max_file_store: 2GB, store_dir: "%s"}
+	cluster {
+		name: %s
+		listen: 127.0.0.1:%d
+		routes = [%s]
+	}
+`
+
+// This will create a cluster that is explicitly configured for the routes, etc.
+// and also has a defined clustername. All configs for routes and cluster name will be the same.
+func createJetStreamClusterExplicit(t *testing.T, clusterName string, numServers int) *cluster {
+	t.Helper()
+	if clusterName == "" || numServers < 1 {
+		t.Fatalf("Bad params")
+	}
+	const startClusterPort = 22332
+
+	// Build out the routes that will be shared with all configs.
+	var routes []string
+	for cp := startClusterPort; cp < startClusterPort+numServers; cp++ {
+		routes = append(routes, fmt.Sprintf("nats-route://127.0.0.1:%d", cp))
+	}
+	routeConfig := strings.Join(routes, ",")
+
+	// Go ahead and build configurations and start servers.
+	c := &cluster{servers: make([]*server.Server, 0, numServers), opts: make([]*server.Options, 0, numServers), name: clusterName}
+
+	for cp := startClusterPort; cp < startClusterPort+numServers; cp++ {
+		storeDir, _ := ioutil.TempDir("", server.JetStreamStoreDir)
+		sn := fmt.Sprintf("S-%d", cp-startClusterPort+1)
+		conf := fmt.Sprintf(jsClusterTempl, sn, storeDir, clusterName, cp, routeConfig)
+		s, o := RunServerWithConfig(createConfFile(t, []byte(conf)))
+		c.servers = append(c.servers, s)
+		c.opts = append(c.opts, o)
+	}
+	c.t = t
+
+	// Wait til we are formed and have a leader.
+	c.checkClusterFormed()
+	c.waitOnClusterReady()
+
+	return c
+}
+
+func (c *cluster) addInNewServer() *server.Server {
+	c.t.Helper()
+	sn := fmt.Sprintf("S-%d", len(c.servers)+1)
+	storeDir, _ := ioutil.TempDir("", server.JetStreamStoreDir)
+	seedRoute := fmt.Sprintf("nats-route://127.0.0.1:%d", c.opts[0].Cluster.Port)
+	conf := fmt.Sprintf(jsClusterTempl, sn, storeDir, c.name, -1, seedRoute)
+	s, o := RunServerWithConfig(createConfFile(c.t, []byte(conf)))
+	c.servers = append(c.servers, s)
+	c.opts = append(c.opts, o)
+	c.checkClusterFormed()
+	return s
+}
+
+// Adjust limits for the given account.
+func (c *cluster) updateLimits(account string, newLimits *server.JetStreamAccountLimits) {
+	c.t.Helper()
+	for _, s := range c.servers {
+		acc, err := s.LookupAccount(account)
+		if err != nil {
+			c.t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := acc.UpdateJetStreamLimits(newLimits); err != nil {
+			c.t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+// Hack for staticcheck
+var skip = func(t *testing.T) {
+	t.SkipNow()
+}
+
+func jsClientConnect(t *testing.T, s *server.Server) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	js, err := nc.JetStream(nats.MaxWait(5 * time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error getting JetStream context: %v", err)
+	}
+	return nc, js
+}
+
+func checkSubsPending(t *testing.T, sub *nats.Subscription, numExpected int) {
+	t.Helper()
+	checkFor(t, 3*time.Second, 10*time.Millisecond, func() error {
+		if nmsgs, _, err := sub.Pending(); err != nil || nmsgs != numExpected {
+			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
+		}
+		return nil
+	})
+}
+
+func (c *cluster) restartServer(rs *server.Server) *server.Server {
+	c.t.Helper()
+	index := -1
+	var opts *server.Options
+	for i, s := range c.servers {
+		if s == rs {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		c.t.Fatalf("Could not find server %v to restart", rs)
+	}
+	opts = c.opts[index]
+	s, o := RunServerWithConfig(opts.ConfigFile)
+	c.servers[index] = s
+	c.opts[index] = o
+	return s
+}
+
+func (c *cluster) checkClusterFormed() {
+	c.t.Helper()
+	checkClusterFormed(c.t, c.servers...)
+}
+
+func (c *cluster) waitOnPeerCount(n int) {
+	c.t.Helper()
+	c.waitOnLeader()
+	leader := c.leader()
+	expires := time.Now().Add(10 * time.Second)
+	for time.Now().Before(expires) {
+		peers := leader.JetStreamClusterPeers()
+		if len(peers) == n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected a cluster peer count of %d, got %d", n, len(leader.JetStreamClusterPeers()))
+}
+
+func (c *cluster) waitOnConsumerLeader(account, stream, consumer string) {
+	c.t.Helper()
+	expires := time.Now().Add(10 * time.Second)
+	for time.Now().Before(expires) {
+		if leader := c.consumerLeader(account, stream, consumer); leader != nil {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected a consumer leader for %q %q %q, got none", account, stream, consumer)
+}
+
+func (c *cluster) consumerLeader(account, stream, consumer string) *server.Server {
+	c.t.Helper()
+	for _, s := range c.servers {
+		if s.JetStreamIsConsumerLeader(account, stream, consumer) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *cluster) waitOnStreamLeader(account, stream string) {
+	c.t.Helper()
+	expires := time.Now().Add(10 * time.Second)
+	for time.Now().Before(expires) {
+		if leader := c.streamLeader(account, stream); leader != nil {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected a stream leader for %q %q, got none", account, stream)
+}
+
+func (c *cluster) randomNonStreamLeader(account, stream string) *server.Server {
+	c.t.Helper()
+	for _, s := range c.servers {
+		if s.JetStreamIsStreamAssigned(account, stream) && !s.JetStreamIsStreamLeader(account, stream) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *cluster) streamLeader(account, stream string) *server.Server {
+	c.t.Helper()
+	for _, s := range c.servers {
+		if s.JetStreamIsStreamLeader(account, stream) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *cluster) waitOnStreamCurrent(s *server.Server, account, stream string) {
+	c.t.Helper()
+	expires := time.Now().Add(10 * time.Second)
+	for time.Now().Before(expires) {
+		if s.JetStreamIsStreamCurrent(account, stream) {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected server %q to eventually be current for stream %q", s, stream)
+}
+
+func (c *cluster) waitOnServerCurrent(s *server.Server) {
+	c.t.Helper()
+	expires := time.Now().Add(5 * time.Second)
+	for time.Now().Before(expires) {
+		if s.JetStreamIsCurrent() {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected server %q to eventually be current", s)
+}
+
+func (c *cluster) waitOnAllCurrent() {
+	for _, cs := range c.servers {
+		c.waitOnServerCurrent(cs)
+	}
+}
+
+func (c *cluster) randomNonLeader() *server.Server {
+	// range should randomize.. but..
+	for _, s := range c.servers {
+		if s.Running() && !s.JetStreamIsLeader() {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *cluster) leader() *server.Server {
+	for _, s := range c.servers {
+		if s.JetStreamIsLeader() {
+			return s
+		}
+	}
+	return nil
+}
+
+// This needs to match raft.go:minElectionTimeout*2
+const maxElectionTimeout = 900 * time.Millisecond
+
+func (c *cluster) expectNoLeader() {
+	c.t.Helper()
+	expires := time.Now().Add(maxElectionTimeout)
+	for time.Now().Before(expires) {
+		if c.leader() == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("Expected no leader but have one")
+}
+
+func (c *cluster) waitOnLeader() {
+	c.t.Helper()
+	expires := time.Now().Add(5 * time.Second)
+	for time.Now().Before(expires) {
+		if leader := c.leader(); leader != nil {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	c.t.Fatalf("Expected a cluster leader, got none")
+}
+
+// Helper function to check that a cluster is formed
+func (c *cluster) waitOnClusterReady() {
+	c.t.Helper()
+	var leader *server.Server
+	expires := time.Now().Add(10 * time.Second)
+	for time.Now().Before(expires) {
+		if leader = c.leader(); leader != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Now make sure we have all peers.
+	for leader != nil && time.Now().Before(expires) {
+		if len(leader.JetStreamClusterPeers()) == len(c.servers) {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.shutdown()
+	c.t.Fatalf("Expected a cluster leader and fully formed cluster")
+}
+
+// Helper function to check that a cluster is formed
+func (c *cluster) stopAll() {
+	c.t.Helper()
+	for _, s := range c.servers {
+		s.Shutdown()
+	}
+}
+
+func (c *cluster) restartAll() {
+	c.t.Helper()
+	for i, s := range c.servers {
+		if !s.Running() {
+			opts := c.opts[i]
+			s, o := RunServerWithConfig(opts.ConfigFile)
+			c.servers[i] = s
+			c.opts[i] = o
+		}
+	}
+	c.waitOnClusterReady()
+	c.waitOnClusterReady()
+}